@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+type claimsKey struct{}
+
+// WithClaims 将身份信息放入context
+func WithClaims(ctx context.Context, c *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, c)
+}
+
+// FromContext 取出经过Require校验后的身份信息
+func FromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsKey{}).(*Claims)
+	return c, ok
+}
+
+// Require 校验请求携带的token，未携带或无效时返回401，角色不符时返回403
+// roles为空表示任意角色均可访问
+func Require(next http.Handler, roles ...Role) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := FromRequest(r)
+		if err != nil {
+			log.Println("func Require:", r.Method, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if len(roles) > 0 && !c.HasRole(roles...) {
+			log.Printf("func Require: %s (%s) is not allowed to %s %s\n",
+				c.Subject, c.Role, r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), c)))
+	})
+}
@@ -0,0 +1,30 @@
+package auth
+
+import "fmt"
+
+// AddDevUsers 添加开发环境使用的本地账号，密码与用户名相同
+// 默认不添加，只有portal以-dev-users启动时调用，不能用于开发以外的环境
+func AddDevUsers() error {
+	mockUsers := []struct {
+		username  string
+		role      Role
+		studentID int
+		classes   []string
+	}{
+		{username: "admin", role: RoleAdmin},
+		{username: "teacherA", role: RoleTeacher, classes: []string{"A"}},
+		{username: "teacherB", role: RoleTeacher, classes: []string{"B"}},
+		{username: "nick", role: RoleStudent, studentID: 1},
+		{username: "roberto", role: RoleStudent, studentID: 2},
+		{username: "emma", role: RoleStudent, studentID: 3},
+		{username: "rachel", role: RoleStudent, studentID: 4},
+		{username: "kelly", role: RoleStudent, studentID: 5},
+	}
+	for _, u := range mockUsers {
+		err := AddUser(u.username, u.username, u.role, u.studentID, u.classes...)
+		if err != nil {
+			return fmt.Errorf("func AddDevUsers: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SessionCookie 保存会话ID的cookie名称
+const SessionCookie = "session"
+
+// SessionTTL 会话有效期
+const SessionTTL = 8 * time.Hour
+
+type session struct {
+	username  string
+	expiresAt time.Time
+}
+
+var (
+	sessions      = make(map[string]session)
+	sessionsMutex sync.Mutex
+)
+
+// NewSession 为登录成功的用户创建会话，并写入cookie
+func NewSession(w http.ResponseWriter, u *User) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(b)
+
+	sessionsMutex.Lock()
+	sessions[id] = session{username: u.Username, expiresAt: time.Now().Add(SessionTTL)}
+	sessionsMutex.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(SessionTTL / time.Second),
+	})
+	return nil
+}
+
+// SessionUser 根据请求中的cookie查询当前登录的用户
+func SessionUser(r *http.Request) (*User, bool) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	sessionsMutex.Lock()
+	s, ok := sessions[cookie.Value]
+	if ok && time.Now().After(s.expiresAt) {
+		delete(sessions, cookie.Value)
+		ok = false
+	}
+	sessionsMutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return GetUser(s.username)
+}
+
+// EndSession 注销会话并清除cookie
+func EndSession(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		sessionsMutex.Lock()
+		delete(sessions, cookie.Value)
+		sessionsMutex.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   SessionCookie,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
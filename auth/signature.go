@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 请求签名相关的请求头
+const (
+	TimestampHeader = "X-Signature-Timestamp"
+	NonceHeader     = "X-Signature-Nonce"
+	SignatureHeader = "X-Signature"
+)
+
+// SignatureWindow 签名的有效时间窗口，超出窗口的请求视为重放
+const SignatureWindow = 5 * time.Minute
+
+var (
+	ErrNoSignature      = errors.New("request is not signed")
+	ErrInvalidSignature = errors.New("invalid request signature")
+	ErrStaleSignature   = errors.New("request signature timestamp out of window")
+	ErrReplayedNonce    = errors.New("request nonce already used")
+)
+
+// SignRequest 对请求的方法、路径、时间戳、随机数及body签名，body需与请求实际发送的内容一致
+func SignRequest(req *http.Request, body []byte) error {
+	return SignRequestWithKey(req, body, sharedRequestKey())
+}
+
+// SignRequestWithKey 与SignRequest相同，但使用双方私有的key签名，而不是所有服务共享的密钥
+func SignRequestWithKey(req *http.Request, body, key []byte) error {
+	if len(key) == 0 {
+		return errors.New("func SignRequestWithKey: empty key")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("func SignRequestWithKey: %v", err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(b)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(
+		requestMAC(key, req.Method, req.URL.Path, ts, nonce, body)))
+	return nil
+}
+
+// VerifyRequest 校验请求签名，并拒绝时间窗口之外或随机数重复的请求
+// 已使用的随机数只记录在当前进程中，重放保护只在同一个进程内有效，见nonceCache
+// 校验通过后返回请求的body，r.Body会被重置以便再次读取
+func VerifyRequest(r *http.Request) ([]byte, error) {
+	return VerifyRequestWithKey(r, sharedRequestKey())
+}
+
+// VerifyRequestWithKey 校验由SignRequestWithKey以key签名的请求
+func VerifyRequestWithKey(r *http.Request, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrInvalidSignature
+	}
+	ts, nonce := r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader)
+	sig, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if ts == "" || nonce == "" || len(sig) == 0 || err != nil {
+		return nil, ErrNoSignature
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(sec, 0)); d > SignatureWindow || d < -SignatureWindow {
+		return nil, ErrStaleSignature
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if !hmac.Equal(sig, requestMAC(key, r.Method, r.URL.Path, ts, nonce, body)) {
+		return nil, ErrInvalidSignature
+	}
+	//签名有效后才记录随机数，避免伪造的请求占满缓存
+	if !nonces.use(nonce, time.Unix(sec, 0), now) {
+		return nil, ErrReplayedNonce
+	}
+	return body, nil
+}
+
+// 与token使用不同的派生密钥，避免两者的签名互相冒用
+func sharedRequestKey() []byte {
+	return sign([]byte("request-signature"))
+}
+
+func requestMAC(key []byte, method, path, ts, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%x", method, path, ts, nonce, bodyHash)
+	return mac.Sum(nil)
+}
+
+// 按签名时间戳所在的时间段记录已使用过的随机数，时间段整体过期，清理的开销与缓存的随机数数量无关
+// 只记录在当前进程的内存中：同一请求重放给另一个registry实例（或重启后的实例）时无法识别
+type nonceCache struct {
+	//时间段的起始时间(Unix秒) -> 该时间段内已使用的随机数
+	buckets map[int64]map[string]struct{}
+	mutex   sync.Mutex
+}
+
+// 每个时间段的长度，缓存中最多保留约2*SignatureWindow/nonceBucket+1个时间段
+const nonceBucket = 30 * time.Second
+
+var nonces = newNonceCache()
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{buckets: make(map[int64]map[string]struct{})}
+}
+
+// 随机数在ts所在的时间段中未出现过时记录它并返回true，ts需已经在now的时间窗口之内
+// 重放的请求携带相同的签名时间戳，因此只需要检查该时间段
+func (nc *nonceCache) use(nonce string, ts, now time.Time) bool {
+	width := int64(nonceBucket / time.Second)
+	nc.mutex.Lock()
+	defer nc.mutex.Unlock()
+	//整个时间段都已经超出时间窗口时，其中的随机数不会再通过时间戳校验，可以直接丢弃
+	oldest := now.Add(-SignatureWindow).Unix()
+	for start := range nc.buckets {
+		if start+width <= oldest {
+			delete(nc.buckets, start)
+		}
+	}
+	start := ts.Unix() - ts.Unix()%width
+	bucket, ok := nc.buckets[start]
+	if !ok {
+		bucket = make(map[string]struct{})
+		nc.buckets[start] = bucket
+	}
+	if _, ok := bucket[nonce]; ok {
+		return false
+	}
+	bucket[nonce] = struct{}{}
+	return true
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("signature-test-key")
+
+// 以testKey签名的请求，每次调用recv都由接收方校验一个新的请求，模拟重复发送同一请求
+type signedRequest struct {
+	header http.Header
+	body   string
+}
+
+func signBody(t *testing.T, body string) signedRequest {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/services", strings.NewReader(body))
+	if err := SignRequestWithKey(req, []byte(body), testKey); err != nil {
+		t.Fatal(err)
+	}
+	return signedRequest{header: req.Header, body: body}
+}
+
+func (sr signedRequest) recv(body string) ([]byte, error) {
+	req := httptest.NewRequest("POST", "/services", strings.NewReader(body))
+	req.Header = sr.header.Clone()
+	return VerifyRequestWithKey(req, testKey)
+}
+
+func TestVerifyRequestAcceptsSignedRequest(t *testing.T) {
+	sr := signBody(t, `{"serviceName":"GradeService"}`)
+	body, err := sr.recv(sr.body)
+	if err != nil {
+		t.Fatalf("VerifyRequestWithKey = %v", err)
+	}
+	if string(body) != sr.body {
+		t.Fatalf("body = %q, want %q", body, sr.body)
+	}
+}
+
+func TestVerifyRequestRejectsTamperedBody(t *testing.T) {
+	sr := signBody(t, `{"serviceName":"GradeService"}`)
+	if _, err := sr.recv(`{"serviceName":"PortalService"}`); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("tampered body: err = %v, want ErrInvalidSignature", err)
+	}
+	//签名被拒绝的请求不记录随机数，原请求仍然有效
+	if _, err := sr.recv(sr.body); err != nil {
+		t.Fatalf("original body after a rejected tampered copy: %v", err)
+	}
+}
+
+func TestVerifyRequestRejectsWrongKey(t *testing.T) {
+	req := httptest.NewRequest("POST", "/services", strings.NewReader("body"))
+	if err := SignRequestWithKey(req, []byte("body"), []byte("other-key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyRequestWithKey(req, testKey); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("err = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestVerifyRequestRejectsStaleTimestamp(t *testing.T) {
+	for _, offset := range []time.Duration{-SignatureWindow - time.Minute, SignatureWindow + time.Minute} {
+		sr := signBody(t, "body")
+		//重新计算签名，使请求只因时间戳超出窗口而被拒绝
+		ts := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+		sr.header.Set(TimestampHeader, ts)
+		sr.header.Set(SignatureHeader, hex.EncodeToString(
+			requestMAC(testKey, "POST", "/services", ts, sr.header.Get(NonceHeader), []byte(sr.body))))
+		if _, err := sr.recv(sr.body); !errors.Is(err, ErrStaleSignature) {
+			t.Fatalf("timestamp offset %v: err = %v, want ErrStaleSignature", offset, err)
+		}
+	}
+}
+
+func TestVerifyRequestRejectsReusedNonce(t *testing.T) {
+	sr := signBody(t, "body")
+	if _, err := sr.recv(sr.body); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	if _, err := sr.recv(sr.body); !errors.Is(err, ErrReplayedNonce) {
+		t.Fatalf("replayed request: err = %v, want ErrReplayedNonce", err)
+	}
+}
+
+func TestVerifyRequestRejectsUnsignedRequest(t *testing.T) {
+	req := httptest.NewRequest("POST", "/services", strings.NewReader("body"))
+	if _, err := VerifyRequestWithKey(req, testKey); !errors.Is(err, ErrNoSignature) {
+		t.Fatalf("err = %v, want ErrNoSignature", err)
+	}
+}
+
+func TestNonceCacheExpiresWholeBuckets(t *testing.T) {
+	nc := newNonceCache()
+	now := time.Unix(1700000000, 0)
+	if !nc.use("a", now, now) {
+		t.Fatal("first use of a nonce was rejected")
+	}
+	if nc.use("a", now, now.Add(SignatureWindow)) {
+		t.Fatal("nonce reused within the window was accepted")
+	}
+	//同一随机数出现在另一个时间段时，签名的时间戳不同，不是同一请求的重放
+	if !nc.use("a", now.Add(nonceBucket), now.Add(nonceBucket)) {
+		t.Fatal("nonce with a different timestamp bucket was rejected")
+	}
+
+	later := now.Add(SignatureWindow + 2*nonceBucket)
+	nc.use("b", later, later)
+	if _, ok := nc.buckets[now.Unix()-now.Unix()%int64(nonceBucket/time.Second)]; ok {
+		t.Fatal("bucket outside the window was not dropped")
+	}
+	if n := len(nc.buckets); n > int(2*SignatureWindow/nonceBucket)+1 {
+		t.Fatalf("%d buckets kept, want at most %d", n, int(2*SignatureWindow/nonceBucket)+1)
+	}
+}
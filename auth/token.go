@@ -0,0 +1,210 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role 用户或服务的角色
+type Role string
+
+const (
+	RoleAdmin   = Role("admin")
+	RoleTeacher = Role("teacher")
+	RoleStudent = Role("student")
+	//服务之间相互调用时使用的角色
+	RoleService = Role("service")
+)
+
+// Claims token中携带的身份信息
+type Claims struct {
+	Subject string
+	Role    Role
+	//签发该token的服务名称
+	Service string
+	//仅当Role为student时有效
+	StudentID int
+	//仅当Role为teacher时有效，表示所教的班级
+	Classes   []string
+	ExpiresAt int64
+	//为空时所有服务都接受该token，否则只有该服务接受，如portal签发给API客户端的token
+	Audience string `json:",omitempty"`
+}
+
+var (
+	ErrNoToken       = errors.New("no bearer token in request")
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrExpiredToken  = errors.New("token expired")
+	ErrWrongAudience = errors.New("token was issued for another service")
+)
+
+// ServiceTokenTTL 服务token的有效期
+const ServiceTokenTTL = 5 * time.Minute
+
+var (
+	secret      = loadSecret()
+	secretMutex sync.RWMutex
+)
+
+// SecretEnv 所有服务共享的签名密钥，持有它即可签发任意角色的token，包括管理员
+const SecretEnv = "DISTRIBUTED_SECRET"
+
+// 未设置SecretEnv时使用的密钥，随源码公开，只能用于本地开发
+const devSecret = "distributedDemo-dev-secret"
+
+// 所有服务共享同一个签名密钥，默认从环境变量读取
+func loadSecret() []byte {
+	if s := os.Getenv(SecretEnv); s != "" {
+		return []byte(s)
+	}
+	log.Printf("WARNING: %s is not set, falling back to the public development secret. "+
+		"Anyone with the source code can issue admin tokens; set %s to a random value outside local development.\n", SecretEnv, SecretEnv)
+	return []byte(devSecret)
+}
+
+// SetSecret 替换签名密钥
+func SetSecret(s []byte) {
+	secretMutex.Lock()
+	defer secretMutex.Unlock()
+	secret = s
+}
+
+func sign(payload []byte) []byte {
+	secretMutex.RLock()
+	defer secretMutex.RUnlock()
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// IssueToken 签发token，格式为 base64(claims).base64(signature)
+func IssueToken(c Claims, ttl time.Duration) (string, error) {
+	c.ExpiresAt = time.Now().Add(ttl).Unix()
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("func IssueToken: %v", err)
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(sign(payload)), nil
+}
+
+// ParseToken 校验签名及有效期，返回token中的身份信息
+func ParseToken(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal(sig, sign(payload)) {
+		return nil, ErrInvalidToken
+	}
+	var c Claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() > c.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &c, nil
+}
+
+// ServiceToken 为服务自身签发一个短期token
+func ServiceToken(serviceName string) string {
+	token, err := IssueToken(Claims{
+		Subject: serviceName,
+		Role:    RoleService,
+		Service: serviceName,
+	}, ServiceTokenTTL)
+	if err != nil {
+		//Claims总能被序列化，这里不会出错
+		panic(err)
+	}
+	return token
+}
+
+// SetToken 在请求头中携带token
+func SetToken(req *http.Request, token string) {
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+// FromRequest 解析请求头中的token，只接受没有指定Audience的token
+func FromRequest(r *http.Request) (*Claims, error) {
+	return FromRequestFor(r, "")
+}
+
+// FromRequestFor 解析请求头中的token，接受没有指定Audience或Audience为audience的token
+func FromRequestFor(r *http.Request, audience string) (*Claims, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, ErrNoToken
+	}
+	c, err := ParseToken(strings.TrimPrefix(h, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+	if c.Audience != "" && c.Audience != audience {
+		return nil, ErrWrongAudience
+	}
+	return c, nil
+}
+
+// HasRole 判断是否拥有其中任意一个角色
+func (c *Claims) HasRole(roles ...Role) bool {
+	for _, role := range roles {
+		if c.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// CanReadStudent 学生只能查看自己的成绩，老师只能查看所教班级的学生
+func (c *Claims) CanReadStudent(studentID int, class string) bool {
+	switch c.Role {
+	case RoleAdmin, RoleService:
+		return true
+	case RoleTeacher:
+		return c.teaches(class)
+	case RoleStudent:
+		return c.StudentID == studentID
+	}
+	return false
+}
+
+// CanWriteGrades 只有管理员与该班级的老师可以修改成绩
+func (c *Claims) CanWriteGrades(class string) bool {
+	switch c.Role {
+	case RoleAdmin, RoleService:
+		return true
+	case RoleTeacher:
+		return c.teaches(class)
+	}
+	return false
+}
+
+func (c *Claims) teaches(class string) bool {
+	for _, cl := range c.Classes {
+		if cl == class {
+			return true
+		}
+	}
+	return false
+}
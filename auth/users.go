@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// User 本地用户账号
+type User struct {
+	Username     string
+	PasswordHash []byte
+	Salt         []byte
+	Role         Role
+	StudentID    int
+	Classes      []string
+}
+
+type Users map[string]*User
+
+var (
+	users = make(Users)
+	//用户集合可能被并发访问
+	usersMutex sync.RWMutex
+)
+
+var ErrBadCredentials = errors.New("invalid username or password")
+
+const (
+	hashIterations = 10000
+	hashLength     = 32
+)
+
+// AddUser 新增或覆盖一个本地用户
+func AddUser(username, password string, role Role, studentID int, classes ...string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("func AddUser: %v", err)
+	}
+	u := &User{
+		Username:     username,
+		PasswordHash: hashPassword([]byte(password), salt),
+		Salt:         salt,
+		Role:         role,
+		StudentID:    studentID,
+		Classes:      classes,
+	}
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+	users[username] = u
+	return nil
+}
+
+// Authenticate 校验用户名与密码
+func Authenticate(username, password string) (*User, error) {
+	usersMutex.RLock()
+	u, ok := users[username]
+	usersMutex.RUnlock()
+	if !ok {
+		return nil, ErrBadCredentials
+	}
+	if !hmac.Equal(u.PasswordHash, hashPassword([]byte(password), u.Salt)) {
+		return nil, ErrBadCredentials
+	}
+	return u, nil
+}
+
+// GetUser 按用户名查询用户
+func GetUser(username string) (*User, bool) {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	u, ok := users[username]
+	return u, ok
+}
+
+// Claims 由用户生成token中的身份信息，service为代表用户发起调用的服务
+func (u *User) Claims(service string) Claims {
+	return Claims{
+		Subject:   u.Username,
+		Role:      u.Role,
+		Service:   service,
+		StudentID: u.StudentID,
+		Classes:   u.Classes,
+	}
+}
+
+// Token 为用户签发一个短期token，用于服务代表该用户调用其他服务
+func (u *User) Token(service string, ttl time.Duration) (string, error) {
+	return IssueToken(u.Claims(service), ttl)
+}
+
+// PBKDF2-HMAC-SHA256，输出长度固定为一个块
+func hashPassword(password, salt []byte) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	mac.Write(block[:])
+	u := mac.Sum(nil)
+	out := make([]byte, hashLength)
+	copy(out, u)
+	for i := 1; i < hashIterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"distributedDemo/registry"
+	"distributedDemo/tlsutil"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// 默认签发证书的服务，即所有内置服务与registry
+var defaultNames = []registry.ServiceName{
+	registry.RegistryService,
+	registry.LoggerService,
+	registry.GradeService,
+	registry.NotificationService,
+	registry.PortalService,
+	registry.GatewayService,
+}
+
+// 在启动服务之前运行一次，创建CA并为各服务签发证书，服务只读取自己的证书与CA证书
+//
+//	go run ./cmd/certs -dir ./certs
+//	go run ./cmd/certs -dir ./certs MyService
+func main() {
+	dir := flag.String("dir", os.Getenv(tlsutil.DirEnv), "directory of the CA and the service certificates (default $"+tlsutil.DirEnv+")")
+	flag.Parse()
+	if *dir == "" {
+		log.Fatalln("In ./cmd/certs: func main: set -dir or", tlsutil.DirEnv)
+	}
+
+	ca, err := tlsutil.CreateCA(*dir)
+	if errors.Is(err, os.ErrExist) {
+		ca, err = tlsutil.LoadCA(*dir)
+	}
+	if err != nil {
+		log.Fatalln("In ./cmd/certs: func main:", err)
+	}
+
+	names := flag.Args()
+	if len(names) == 0 {
+		for _, name := range defaultNames {
+			names = append(names, string(name))
+		}
+	}
+	for _, name := range names {
+		if _, err := ca.Issue(name); err != nil {
+			log.Fatalln("In ./cmd/certs: func main: issuing", name, ":", err)
+		}
+		fmt.Println("issued certificate for", name)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"distributedDemo/gateway"
+	"distributedDemo/health"
+	"distributedDemo/logger"
+	"distributedDemo/middleware"
+	"distributedDemo/registry"
+	"distributedDemo/service"
+	"distributedDemo/tlsutil"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// 可重复指定的-route参数
+type routes []gateway.Route
+
+func (rs *routes) String() string { return fmt.Sprint(*rs) }
+
+func (rs *routes) Set(s string) error {
+	rt, err := gateway.ParseRoute(s)
+	if err != nil {
+		return err
+	}
+	*rs = append(*rs, rt)
+	return nil
+}
+
+// 可重复指定的-cors-origin参数
+type origins []string
+
+func (o *origins) String() string { return fmt.Sprint(*o) }
+
+func (o *origins) Set(s string) error {
+	*o = append(*o, s)
+	return nil
+}
+
+func main() {
+	var config gateway.Config
+	flag.Var((*routes)(&config.Routes), "route", "route prefix=ServiceName[,public], may be repeated (default /api/grades/=GradeService)")
+	flag.Float64Var(&config.Rate, "rate", 20, "requests per second allowed per client IP (0 disables rate limiting)")
+	flag.IntVar(&config.Burst, "burst", 40, "burst of requests allowed per client IP")
+	var corsOrigins origins
+	flag.Var(&corsOrigins, "cors-origin", "origin allowed to call the gateway with credentials from a browser, may be repeated (default * without credentials)")
+	flag.Parse()
+	if len(corsOrigins) == 0 {
+		corsOrigins = origins{"*"}
+	}
+	if len(config.Routes) == 0 {
+		config.Routes = gateway.DefaultRoutes
+	}
+
+	host, port := "localhost", ":7000"
+	serviceAddress := fmt.Sprintf("%s://%s%s", tlsutil.Scheme(), host, port)
+
+	r := registry.Registration{
+		ServiceName:      registry.GatewayService,
+		ServiceURL:       serviceAddress,
+		RequiredServices: append(gateway.RequiredServices(config.Routes), registry.LoggerService),
+		ServiceUpdateURL: serviceAddress + "/services",
+		HeartbeatURL:     serviceAddress + "/heartbeat",
+	}
+	opts := []service.Option{
+		//浏览器中的页面也可以直接调用网关，只有-cors-origin列出的页面可以携带Basic认证等凭据
+		service.WithMiddleware(middleware.Logging, middleware.CORS(corsOrigins...), middleware.Gzip),
+		//按客户端IP限流，运行时可通过/ratelimits/gateway调整
+		service.WithRateLimit(gateway.NewLimiter(config)),
+		service.WithHealthCheck(health.Check{
+			Name: "logger reachable",
+			Kind: health.Informational,
+			Func: health.Reachable(func() (string, error) {
+				return registry.GetProvider(registry.LoggerService)
+			}),
+		}),
+	}
+	//某个上游服务不可用时网关只是降级，其他路由仍可使用
+	for _, name := range gateway.RequiredServices(config.Routes) {
+		name := name
+		opts = append(opts, service.WithHealthCheck(health.Check{
+			Name: string(name) + " reachable",
+			Kind: health.Informational,
+			Func: health.Reachable(func() (string, error) {
+				return registry.GetProvider(name)
+			}),
+		}))
+	}
+
+	ctx, err := service.Start(context.Background(),
+		host,
+		port,
+		r,
+		func(mux *http.ServeMux) { gateway.RegisterHandlers(mux, config) },
+		opts...)
+	if err != nil {
+		log.Fatalln("In ./cmd/gateway: func main:", err)
+	}
+	if logProvider, err := registry.GetProvider(registry.LoggerService); err == nil {
+		logger.SetClientLogger(logProvider, r.ServiceName)
+	}
+	<-ctx.Done()
+	fmt.Println("Shutting down gateway...")
+}
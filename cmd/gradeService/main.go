@@ -2,35 +2,88 @@ package main
 
 import (
 	"context"
+	"distributedDemo/events"
 	"distributedDemo/grades"
+	"distributedDemo/health"
 	"distributedDemo/logger"
+	"distributedDemo/middleware"
+	"distributedDemo/ratelimit"
 	"distributedDemo/registry"
 	"distributedDemo/service"
+	"distributedDemo/tlsutil"
+	"flag"
 	"fmt"
 	"log"
+	"net/http"
+	"time"
 )
 
 func main() {
-	host, port := "localhost", ":5000"
-	serviceAddress := fmt.Sprintf("http://%s%s", host, port)
+	//同一台机器上运行多个实例时需要使用不同的端口与事件目录
+	portNumber := flag.Int("port", 5000, "port to listen on")
+	eventsDir := flag.String("events", "./data/events", "directory storing undelivered events")
+	flag.Parse()
+
+	host, port := "localhost", fmt.Sprintf(":%d", *portNumber)
+	serviceAddress := fmt.Sprintf("%s://%s%s", tlsutil.Scheme(), host, port)
 
 	r := registry.Registration{
-		ServiceName:      registry.GradeService,
-		ServiceURL:       serviceAddress,
-		RequiredServices: []registry.ServiceName{registry.LoggerService},
+		ServiceName: registry.GradeService,
+		ServiceURL:  serviceAddress,
+		//依赖自身所在的服务以发现其他实例，修改由其中的leader处理并复制到其他实例
+		RequiredServices: []registry.ServiceName{registry.LoggerService, registry.GradeService},
 		ServiceUpdateURL: serviceAddress + "/services",
 		HeartbeatURL:     serviceAddress + "/heartbeat",
+		Protocols:        []string{registry.ProtocolHTTP, registry.ProtocolConnect},
+		//registry会推送订阅了这些事件的服务
+		Publishes: grades.PublishedEvents,
+	}
+	//未投递完的事件保存在data/events中，重启后继续投递
+	publisher, err := events.NewPublisher(string(r.ServiceName), registry.DefaultClient.Providers,
+		events.Config{Dir: *eventsDir})
+	if err != nil {
+		log.Fatalln("starting", registry.GradeService, ":", err)
+	}
+	defer publisher.Close()
+	grades.SetPublisher(publisher)
+	//service.Start为registry.DefaultClient配置证书后再开始复制，复制的接口随后注册
+	var replicator *grades.Replicator
+	registerHandlers := func(mux *http.ServeMux) {
+		replicator = grades.Replicate(registry.DefaultClient, serviceAddress)
+		grades.RegisterHandlers(mux)
 	}
 	ctx, err := service.Start(
 		context.Background(),
 		host,
 		port,
 		r,
-		grades.RegisterHandlers,
+		registerHandlers,
+		service.WithMiddleware(middleware.Logging, middleware.Timeout(5*time.Second), middleware.Gzip),
+		//每个用户的请求单独限流，避免单个客户端占满成绩服务
+		service.WithRateLimit(ratelimit.New("grades", ratelimit.Limit{Rate: 50, Burst: 100}, ratelimit.ByPrincipal)),
+		service.WithHealthCheck(health.Check{
+			Name: "store writable",
+			Kind: health.Readiness,
+			Func: grades.StoreWritable,
+		}),
+		//尚未从leader获取数据的follower会返回过时的成绩
+		service.WithHealthCheck(health.Check{
+			Name: "replica in sync",
+			Kind: health.Readiness,
+			Func: func(ctx context.Context) error { return replicator.InSync(ctx) },
+		}),
+		service.WithHealthCheck(health.Check{
+			Name: "logger reachable",
+			Kind: health.Informational,
+			Func: health.Reachable(func() (string, error) {
+				return registry.GetProvider(registry.LoggerService)
+			}),
+		}),
 	)
 	if err != nil {
 		log.Fatalln("starting", registry.GradeService, ":", err)
 	}
+	defer replicator.Close()
 	if logProvider, err := registry.GetProvider(registry.LoggerService); err == nil {
 		fmt.Println("Logger service found at:", logProvider)
 		logger.SetClientLogger(logProvider, r.ServiceName)
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"distributedDemo/health"
 	"distributedDemo/logger"
+	"distributedDemo/ratelimit"
 	"distributedDemo/registry"
 	"distributedDemo/service"
+	"distributedDemo/tlsutil"
 	"fmt"
 	"log"
 )
@@ -14,7 +17,7 @@ func main() {
 	logger.Run("./distributed.log")
 
 	host, port := "localhost", ":4000"
-	serviceAddress := fmt.Sprintf("http://%s%s", host, port)
+	serviceAddress := fmt.Sprintf("%s://%s%s", tlsutil.Scheme(), host, port)
 
 	r := registry.Registration{
 		ServiceName:      registry.LoggerService,
@@ -22,6 +25,7 @@ func main() {
 		RequiredServices: make([]registry.ServiceName, 0),
 		ServiceUpdateURL: serviceAddress + "/services",
 		HeartbeatURL:     serviceAddress + "/heartbeat",
+		Protocols:        []string{registry.ProtocolHTTP, registry.ProtocolConnect},
 	}
 	ctx, err := service.Start(
 		context.Background(),
@@ -29,6 +33,13 @@ func main() {
 		port,
 		r,
 		logger.RegisterHandlers,
+		//按调用方的服务限流，避免某个服务大量写日志拖垮日志服务
+		service.WithRateLimit(ratelimit.New("logger", ratelimit.Limit{Rate: 200, Burst: 400}, ratelimit.ByService)),
+		service.WithHealthCheck(health.Check{
+			Name: "log file writable",
+			Kind: health.Readiness,
+			Func: logger.FileWritable,
+		}),
 	)
 	if err != nil {
 		log.Fatalln("starting", registry.LoggerService, ":", err)
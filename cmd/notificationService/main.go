@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"distributedDemo/health"
+	"distributedDemo/logger"
+	"distributedDemo/middleware"
+	"distributedDemo/notification"
+	"distributedDemo/registry"
+	"distributedDemo/service"
+	"distributedDemo/tlsutil"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+func main() {
+	var config notification.Config
+	flag.StringVar(&config.SMTPAddr, "smtp", "", "address of the SMTP server used by the email channel, email is disabled when empty")
+	flag.StringVar(&config.From, "from", "notifications@localhost", "sender address of notification emails")
+	flag.StringVar(&config.TemplateDir, "templates", "", "directory with *.tmpl files overriding the built-in templates")
+	fakeSMTP := flag.String("fake-smtp", "", "start a fake SMTP server on this address that only logs mails, and send emails to it")
+	flag.Parse()
+
+	if *fakeSMTP != "" {
+		fake, err := notification.ListenFakeSMTP(*fakeSMTP)
+		if err != nil {
+			log.Fatalln("starting fake SMTP server:", err)
+		}
+		defer fake.Close()
+		config.SMTPAddr = fake.Addr()
+		fmt.Println("Fake SMTP server listening on", fake.Addr())
+	}
+	s, err := notification.NewServer(registry.DefaultClient, config)
+	if err != nil {
+		log.Fatalln("starting", registry.NotificationService, ":", err)
+	}
+
+	host, port := "localhost", ":8000"
+	serviceAddress := fmt.Sprintf("%s://%s%s", tlsutil.Scheme(), host, port)
+
+	r := registry.Registration{
+		ServiceName: registry.NotificationService,
+		ServiceURL:  serviceAddress,
+		//通知中的学生姓名与平均成绩从grade服务获取
+		RequiredServices: []registry.ServiceName{registry.LoggerService, registry.GradeService},
+		ServiceUpdateURL: serviceAddress + "/services",
+		HeartbeatURL:     serviceAddress + "/heartbeat",
+		Subscribes:       notification.SubscribedEvents,
+		EventURL:         serviceAddress + "/events",
+	}
+	ctx, err := service.Start(
+		context.Background(),
+		host,
+		port,
+		r,
+		s.RegisterHandlers,
+		service.WithMiddleware(middleware.Logging, middleware.Timeout(10*time.Second)),
+		//grade服务不可用时事件会失败并由grade服务重试，实例本身仍可以提供站内信
+		service.WithHealthCheck(health.Check{
+			Name: "grades reachable",
+			Kind: health.Informational,
+			Func: health.Reachable(func() (string, error) {
+				return registry.GetProvider(registry.GradeService)
+			}),
+		}),
+	)
+	if err != nil {
+		log.Fatalln("starting", registry.NotificationService, ":", err)
+	}
+	if logProvider, err := registry.GetProvider(registry.LoggerService); err == nil {
+		logger.SetClientLogger(logProvider, r.ServiceName)
+	}
+	<-ctx.Done()
+	fmt.Println("Shutting down notification service")
+}
@@ -2,21 +2,31 @@ package main
 
 import (
 	"context"
+	"distributedDemo/auth"
+	"distributedDemo/health"
 	"distributedDemo/logger"
+	"distributedDemo/middleware"
 	"distributedDemo/portal"
 	"distributedDemo/registry"
 	"distributedDemo/service"
+	"distributedDemo/tlsutil"
+	"flag"
 	"fmt"
 	"log"
 )
 
 func main() {
-	err := portal.ImportTemplates()
-	if err != nil {
-		log.Fatalln("In ./cmd/portal: func main:", err)
+	devUsers := flag.Bool("dev-users", false, "add the development accounts whose password equals the username, never use outside development")
+	flag.Parse()
+	if *devUsers {
+		if err := auth.AddDevUsers(); err != nil {
+			log.Fatalln("In ./cmd/portal: func main:", err)
+		}
+		log.Println("WARNING: development accounts are enabled, their passwords equal the usernames. Never use -dev-users outside development.")
 	}
+
 	host, port := "localhost", ":6000"
-	serviceAddress := fmt.Sprintf("http://%s%s", host, port)
+	serviceAddress := fmt.Sprintf("%s://%s%s", tlsutil.Scheme(), host, port)
 
 	r := registry.Registration{
 		ServiceName: registry.PortalService,
@@ -24,20 +34,48 @@ func main() {
 		RequiredServices: []registry.ServiceName{
 			registry.LoggerService,
 			registry.GradeService,
+			registry.NotificationService,
 		},
 		ServiceUpdateURL: serviceAddress + "/services",
 		HeartbeatURL:     serviceAddress + "/heartbeat",
+		//成绩变化时使缓存失效
+		Subscribes: portal.SubscribedEvents,
+		EventURL:   serviceAddress + "/events",
 	}
 
 	ctx, err := service.Start(context.Background(),
 		host,
 		port,
 		r,
-		portal.RegisterHandlers)
+		portal.RegisterHandlers,
+		service.WithMiddleware(middleware.Logging, middleware.Gzip),
+		//没有可用的grade服务时portal无法工作，应当摘除流量
+		service.WithHealthCheck(health.Check{
+			Name: "grades reachable",
+			Kind: health.Readiness,
+			Func: health.Reachable(func() (string, error) {
+				return registry.GetProvider(registry.GradeService)
+			}),
+		}),
+		//通知服务不可用时只影响站内信与通知设置
+		service.WithHealthCheck(health.Check{
+			Name: "notifications reachable",
+			Kind: health.Informational,
+			Func: health.Reachable(func() (string, error) {
+				return registry.GetProvider(registry.NotificationService)
+			}),
+		}),
+		service.WithHealthCheck(health.Check{
+			Name: "logger reachable",
+			Kind: health.Informational,
+			Func: health.Reachable(func() (string, error) {
+				return registry.GetProvider(registry.LoggerService)
+			}),
+		}))
 	if err != nil {
 		log.Fatalln("In ./cmd/portal: func main:", err)
 	}
-	if logProvider, err := registry.GetProvider(registry.LoggerService); err != nil {
+	if logProvider, err := registry.GetProvider(registry.LoggerService); err == nil {
 		logger.SetClientLogger(logProvider, r.ServiceName)
 	}
 	<-ctx.Done()
@@ -2,25 +2,75 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"distributedDemo/auth"
 	"distributedDemo/registry"
+	"distributedDemo/tlsutil"
+	"distributedDemo/trace"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func main() {
+	config := registry.DefaultProbeConfig
+	flag.DurationVar(&config.Interval, "heartbeat-interval", config.Interval, "default interval between heartbeat checks of an instance")
+	flag.DurationVar(&config.Jitter, "heartbeat-jitter", config.Jitter, "random delay added to each heartbeat interval")
+	flag.DurationVar(&config.Timeout, "heartbeat-timeout", config.Timeout, "timeout of a single heartbeat check")
+	flag.IntVar(&config.Concurrency, "heartbeat-concurrency", config.Concurrency, "maximum number of heartbeat checks in flight")
+	flag.IntVar(&config.FailureThreshold, "failure-threshold", config.FailureThreshold, "consecutive failed checks before an instance is removed")
+	flag.IntVar(&config.SuccessThreshold, "success-threshold", config.SuccessThreshold, "consecutive successful checks before a removed instance is added back")
+	flag.DurationVar(&config.ExpireAfter, "expire-after", config.ExpireAfter, "stop checking instances that have been down this long (0 keeps checking)")
+	zone := flag.String("zone", registry.LocalZone(), "zone of this registry and of instances that do not declare one")
+	peers := flag.String("peers", "", "comma separated URLs of registries in other zones to federate with")
+	federationInterval := flag.Duration("federation-interval", 5*time.Second, "interval between fetching instances from peer registries")
+	addr := flag.String("addr", registry.ServerPort, "address to listen on")
+	dnsAddr := flag.String("dns-addr", "", "address of the DNS interface, such as :8600 (disabled when empty)")
+	dnsDomain := flag.String("dns-domain", registry.DefaultDNSDomain, "domain served by the DNS interface")
+	dnsTTL := flag.Duration("dns-ttl", 5*time.Second, "TTL of DNS answers")
+	flag.Parse()
+
+	reg := registry.NewRegistry(*zone)
+	defer reg.Close()
+	//启用TLS时读取registry的证书，心跳检测、推送更新与同步时携带该证书
+	tlsConfig, err := tlsutil.Configure(reg.HTTP, string(registry.RegistryService))
+	if err != nil {
+		log.Fatalln("In ./cmd/registryService: func main:", err)
+	}
+	trace.Setup(string(registry.RegistryService), reg.HTTP)
 	//周期性测试服务
-	registry.SetupRegistryService()
-	http.Handle("/services", &registry.RegService{})
+	reg.SetupHeartbeat(config)
+	reg.SetupFederation(strings.Split(*peers, ","), *federationInterval)
+	mux := http.NewServeMux()
+	reg.RegisterHandlers(mux)
+	mux.Handle("/metrics", reg.Metrics().Handler())
+	mux.Handle("/traces", auth.Require(trace.ViewerHandler(), auth.RoleAdmin))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	var srv http.Server
-	srv.Addr = registry.ServerPort
+	srv.Addr = *addr
+	srv.Handler = trace.Middleware(string(registry.RegistryService), reg.Metrics().InstrumentHandler(mux))
+	//启用TLS时，所有调用registry的服务都必须提供证书
+	srv.TLSConfig = tlsConfig
+	if srv.TLSConfig != nil {
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	//可选的DNS接口，供不使用registry包的程序发现服务
+	if *dnsAddr != "" {
+		dns := &registry.DNSServer{Registry: reg, Addr: *dnsAddr, Domain: *dnsDomain, TTL: *dnsTTL}
+		go func() {
+			log.Println("DNS interface stopped:", dns.ListenAndServe())
+		}()
+	}
 
 	go func() {
-		log.Println(srv.ListenAndServe())
+		log.Println(tlsutil.ListenAndServe(&srv))
 		cancel()
 	}()
 
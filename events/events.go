@@ -0,0 +1,75 @@
+// Package events 服务之间的事件通知
+//
+// 发布方在Registration.Publishes中声明发布的事件类型，订阅方在Registration.Subscribes中声明订阅的事件类型及EventURL，
+// registry把订阅方的实例推送给发布方。每个事件对每个订阅的服务投递一次，由该服务的任意一个实例接收：
+//
+//	pub, err := events.NewPublisher("GradeService", registry.DefaultClient.Providers, events.Config{Dir: "./events"})
+//	pub.Publish(ctx, "GradeAdded", payload)
+//
+//	mux.Handle("/events", events.Handler(func(ctx context.Context, e events.Event) error { ... }))
+//
+// 事件至少投递一次：投递失败时按指数退避重试，待投递的事件保存在Config.Dir中，服务重启后继续投递；
+// 重试次数用尽或订阅方明确拒绝的事件转为死信，管理员可以查看并重新投递。不保证事件到达的顺序
+package events
+
+import (
+	"crypto/rand"
+	"distributedDemo/metrics"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Type 事件类型，如GradeAdded
+type Type string
+
+// Event 投递给订阅方的事件
+type Event struct {
+	//事件的唯一标识，重试投递时保持不变，订阅方据此去重
+	ID   string
+	Type Type
+	//发布事件的服务
+	Source string
+	Time   time.Time
+	//事件的内容，结构由Type决定
+	Data json.RawMessage
+}
+
+// Decode 将事件的内容解析到v中
+func (e Event) Decode(v interface{}) error {
+	if err := json.Unmarshal(e.Data, v); err != nil {
+		return fmt.Errorf("decoding %s event %s: %v", e.Type, e.ID, err)
+	}
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+var (
+	eventsPublished = metrics.NewCounterVec("events_published_total",
+		"Events published, by source and type.",
+		"source", "type")
+	eventsDelivered = metrics.NewCounterVec("events_delivered_total",
+		"Events acknowledged by subscribers, by subscribing service.",
+		"subscriber")
+	deliveryFailures = metrics.NewCounterVec("events_delivery_failures_total",
+		"Failed event delivery attempts, by subscribing service.",
+		"subscriber")
+	deadLettered = metrics.NewCounterVec("events_dead_lettered_total",
+		"Events moved to the dead letter queue, by subscribing service.",
+		"subscriber")
+	pendingDeliveries = metrics.NewGaugeVec("events_pending_deliveries",
+		"Deliveries waiting to be acknowledged, by source.",
+		"source")
+	deadLetters = metrics.NewGaugeVec("events_dead_letters",
+		"Deliveries currently in the dead letter queue, by source.",
+		"source")
+	eventsReceived = metrics.NewCounterVec("events_received_total",
+		"Events received by subscribers, by type and result.",
+		"type", "result")
+)
@@ -0,0 +1,394 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/health"
+	"distributedDemo/registry"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testEvent = Type("GradeAdded")
+
+// 订阅testEvent的服务，status返回非0时以该状态码拒绝事件，否则由Handler处理
+type subscriber struct {
+	mutex    sync.Mutex
+	status   func(attempt int) int
+	attempts int
+	received []Event
+}
+
+func (s *subscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.attempts++
+	attempt, status := s.attempts, s.status
+	s.mutex.Unlock()
+	if status != nil {
+		if code := status(attempt); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+	}
+	Handler(func(ctx context.Context, e Event) error {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.received = append(s.received, e)
+		return nil
+	}).ServeHTTP(w, r)
+}
+
+func (s *subscriber) setStatus(f func(attempt int) int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = f
+}
+
+func (s *subscriber) events() []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Event(nil), s.received...)
+}
+
+// 启动registry与订阅方，返回通过registry发现了订阅方的Providers
+func subscribedProviders(t *testing.T, sub http.Handler) *registry.Providers {
+	t.Helper()
+	reg := registry.NewRegistry("test")
+	reg.HTTP = &http.Client{}
+	regMux := http.NewServeMux()
+	reg.RegisterHandlers(regMux)
+	regSrv := httptest.NewServer(regMux)
+	t.Cleanup(func() {
+		regSrv.Close()
+		reg.Close()
+	})
+
+	subSrv := httptest.NewServer(sub)
+	t.Cleanup(subSrv.Close)
+	subClient := registry.NewClient(regSrv.URL)
+	subClient.HTTP = &http.Client{}
+	err := subClient.RegisterService(registry.Registration{
+		ServiceName: registry.NotificationService,
+		ServiceURL:  subSrv.URL,
+		Subscribes:  []string{string(testEvent)},
+		EventURL:    subSrv.URL + "/events",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//发布方注册时在响应中得到订阅方的实例
+	pubMux := http.NewServeMux()
+	pubSrv := httptest.NewServer(pubMux)
+	t.Cleanup(pubSrv.Close)
+	pubClient := registry.NewClient(regSrv.URL)
+	pubClient.HTTP = &http.Client{}
+	pubReg := registry.Registration{
+		ServiceName:      registry.GradeService,
+		ServiceURL:       pubSrv.URL,
+		ServiceUpdateURL: pubSrv.URL + "/services",
+		HeartbeatURL:     pubSrv.URL + "/heartbeat",
+		Publishes:        []string{string(testEvent)},
+	}
+	if err := pubClient.RegisterHandlers(pubMux, pubReg, health.NewChecks()); err != nil {
+		t.Fatal(err)
+	}
+	if err := pubClient.RegisterService(pubReg); err != nil {
+		t.Fatal(err)
+	}
+	if got := pubClient.Providers.Subscribers(string(testEvent)); len(got) != 1 {
+		t.Fatalf("subscribers = %v, want NotificationService", got)
+	}
+	return pubClient.Providers
+}
+
+func testConfig(dir string) Config {
+	return Config{
+		Dir:         dir,
+		RetryMin:    10 * time.Millisecond,
+		RetryMax:    40 * time.Millisecond,
+		MaxAttempts: 3,
+		Timeout:     time.Second,
+		HTTP:        &http.Client{},
+	}
+}
+
+func newTestPublisher(t *testing.T, providers *registry.Providers, config Config) *Publisher {
+	t.Helper()
+	p, err := NewPublisher(string(registry.GradeService), providers, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func waitUntil(t *testing.T, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPublishDeliversToSubscriber(t *testing.T) {
+	sub := &subscriber{}
+	p := newTestPublisher(t, subscribedProviders(t, sub), testConfig(""))
+	e, err := p.Publish(context.Background(), testEvent, map[string]int{"StudentID": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool { return len(sub.events()) == 1 && len(p.Pending()) == 0 }, "event not delivered")
+	got := sub.events()[0]
+	var data struct{ StudentID int }
+	if err := got.Decode(&data); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != e.ID || got.Source != string(registry.GradeService) || data.StudentID != 1 {
+		t.Fatalf("received %+v, want %+v", got, e)
+	}
+}
+
+func TestPublishWithoutSubscribersDropsEvent(t *testing.T) {
+	p := newTestPublisher(t, registry.NewProviders(), testConfig(""))
+	if _, err := p.Publish(context.Background(), testEvent, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.Pending()); n != 0 {
+		t.Fatalf("%d pending deliveries without subscribers", n)
+	}
+}
+
+// 5xx、408与429视为暂时的失败，按退避重试直到成功
+func TestRetriesTransientFailures(t *testing.T) {
+	sub := &subscriber{status: func(attempt int) int {
+		return map[int]int{1: http.StatusInternalServerError, 2: http.StatusTooManyRequests}[attempt]
+	}}
+	p := newTestPublisher(t, subscribedProviders(t, sub), testConfig(""))
+	if _, err := p.Publish(context.Background(), testEvent, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool { return len(sub.events()) == 1 && len(p.Pending()) == 0 }, "event not delivered after retries")
+	if n := len(p.DeadLetters()); n != 0 {
+		t.Fatalf("%d dead letters after a successful retry", n)
+	}
+}
+
+// 订阅方以4xx拒绝的事件不再重试，直接转为死信
+func TestRejectedEventIsDeadLettered(t *testing.T) {
+	sub := &subscriber{status: func(int) int { return http.StatusBadRequest }}
+	p := newTestPublisher(t, subscribedProviders(t, sub), testConfig(""))
+	if _, err := p.Publish(context.Background(), testEvent, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool { return len(p.DeadLetters()) == 1 }, "rejected event not dead-lettered")
+	if d := p.DeadLetters()[0]; d.Attempts != 1 || !strings.Contains(d.LastError, "400") {
+		t.Fatalf("dead letter = %+v, want 1 attempt rejected with 400", d)
+	}
+}
+
+// 重试次数用尽后转为死信，订阅方恢复后重新投递可以送达
+func TestDeadLetterRedrive(t *testing.T) {
+	sub := &subscriber{status: func(int) int { return http.StatusServiceUnavailable }}
+	config := testConfig("")
+	p := newTestPublisher(t, subscribedProviders(t, sub), config)
+	e, err := p.Publish(context.Background(), testEvent, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool { return len(p.DeadLetters()) == 1 }, "event not dead-lettered after %d attempts", config.MaxAttempts)
+	d := p.DeadLetters()[0]
+	if d.Attempts != config.MaxAttempts || len(p.Pending()) != 0 {
+		t.Fatalf("dead letter after %d attempts with %d pending, want %d attempts", d.Attempts, len(p.Pending()), config.MaxAttempts)
+	}
+	if n, err := p.Redrive("unknown"); n != 0 || err != nil {
+		t.Fatalf("Redrive(unknown) = %d, %v", n, err)
+	}
+
+	sub.setStatus(nil)
+	if n, err := p.Redrive(d.ID); n != 1 || err != nil {
+		t.Fatalf("Redrive = %d, %v, want 1", n, err)
+	}
+	waitUntil(t, func() bool { return len(sub.events()) == 1 && len(p.Pending()) == 0 }, "redriven event not delivered")
+	if got := sub.events()[0]; got.ID != e.ID {
+		t.Fatalf("received event %s, want the redriven event %s", got.ID, e.ID)
+	}
+	if n := len(p.DeadLetters()); n != 0 {
+		t.Fatalf("%d dead letters after the redrive", n)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	sub := &subscriber{status: func(int) int { return http.StatusForbidden }}
+	p := newTestPublisher(t, subscribedProviders(t, sub), testConfig(""))
+	for i := 0; i < 2; i++ {
+		if _, err := p.Publish(context.Background(), testEvent, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, func() bool { return len(p.DeadLetters()) == 2 }, "events not dead-lettered")
+	h := p.AdminHandler()
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	var dead []Delivery
+	rec := do(http.MethodGet, "/events/deadletters")
+	if err := json.Unmarshal(rec.Body.Bytes(), &dead); err != nil || len(dead) != 2 {
+		t.Fatalf("GET /events/deadletters = %s, %v", rec.Body, err)
+	}
+	if rec := do(http.MethodPost, "/events/deadletters/redrive?id=unknown"); rec.Code != http.StatusNotFound {
+		t.Fatalf("redrive of an unknown id: status %d, want 404", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/events/deadletters?id="+dead[0].ID); rec.Body.String() != `{"Count":1}` {
+		t.Fatalf("discard = %d %s", rec.Code, rec.Body)
+	}
+
+	sub.setStatus(nil)
+	if rec := do(http.MethodPost, "/events/deadletters/redrive"); rec.Body.String() != `{"Count":1}` {
+		t.Fatalf("redrive all = %d %s", rec.Code, rec.Body)
+	}
+	waitUntil(t, func() bool { return len(sub.events()) == 1 }, "redriven event not delivered")
+	if got := sub.events()[0]; got.ID != dead[1].Event.ID {
+		t.Fatalf("delivered %s, want the event that was not discarded", got.ID)
+	}
+	rec = do(http.MethodGet, "/events/pending")
+	if rec.Code != http.StatusOK || rec.Body.String() != "[]" {
+		t.Fatalf("GET /events/pending = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/events/pending"); rec.Code != http.StatusNotFound {
+		t.Fatalf("PUT /events/pending: status %d, want 404", rec.Code)
+	}
+}
+
+// 待投递的事件与死信保存在Dir中，重启后继续投递
+func TestPendingAndDeadLettersSurviveRestart(t *testing.T) {
+	sub := &subscriber{status: func(int) int { return http.StatusServiceUnavailable }}
+	providers := subscribedProviders(t, sub)
+	config := testConfig(t.TempDir())
+	config.MaxAttempts = 100
+	p, err := NewPublisher(string(registry.GradeService), providers, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Publish(context.Background(), testEvent, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool {
+		pending := p.Pending()
+		return len(pending) == 1 && pending[0].Attempts > 0
+	}, "delivery not attempted")
+	p.Close()
+
+	sub.setStatus(nil)
+	restarted := newTestPublisher(t, providers, config)
+	waitUntil(t, func() bool { return len(sub.events()) == 1 && len(restarted.Pending()) == 0 },
+		"pending delivery not resumed after the restart")
+
+	//死信同样保留
+	sub.setStatus(func(int) int { return http.StatusBadRequest })
+	if _, err := restarted.Publish(context.Background(), testEvent, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool { return len(restarted.DeadLetters()) == 1 }, "event not dead-lettered")
+	restarted.Close()
+	again := newTestPublisher(t, providers, config)
+	if n := len(again.DeadLetters()); n != 1 {
+		t.Fatalf("%d dead letters after the restart, want 1", n)
+	}
+}
+
+func signedEvent(t *testing.T, e Event, token string) *http.Request {
+	t.Helper()
+	body, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/events", bytes.NewReader(body))
+	if token != "" {
+		auth.SetToken(req, token)
+	}
+	if err := auth.SignRequest(req, body); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestHandler(t *testing.T) {
+	var handled []string
+	fail := true
+	h := Handler(func(ctx context.Context, e Event) error {
+		if fail {
+			fail = false
+			return context.DeadlineExceeded
+		}
+		handled = append(handled, e.ID)
+		return nil
+	})
+	token := auth.ServiceToken(string(registry.GradeService))
+	e := Event{ID: "event-1", Type: testEvent}
+	serve := func(req *http.Request) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	//处理失败时以500响应，发布方重试后再次处理
+	if code := serve(signedEvent(t, e, token)); code != http.StatusInternalServerError {
+		t.Fatalf("failing handler: status %d, want 500", code)
+	}
+	if code := serve(signedEvent(t, e, token)); code != http.StatusNoContent {
+		t.Fatalf("retried event: status %d, want 204", code)
+	}
+	//处理成功的事件再次到达时被忽略
+	if code := serve(signedEvent(t, e, token)); code != http.StatusNoContent || len(handled) != 1 {
+		t.Fatalf("duplicate event: status %d, handled %v", code, handled)
+	}
+
+	if code := serve(signedEvent(t, Event{ID: "event-2"}, "")); code != http.StatusUnauthorized {
+		t.Fatalf("event without a token: status %d, want 401", code)
+	}
+	user, err := auth.IssueToken(auth.Claims{Subject: "nick", Role: auth.RoleStudent}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(signedEvent(t, Event{ID: "event-2"}, user)); code != http.StatusUnauthorized {
+		t.Fatalf("event with a user token: status %d, want 401", code)
+	}
+	unsigned := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(`{"ID":"event-2"}`))
+	auth.SetToken(unsigned, token)
+	if code := serve(unsigned); code != http.StatusUnauthorized {
+		t.Fatalf("unsigned event: status %d, want 401", code)
+	}
+	if code := serve(signedEvent(t, Event{}, token)); code != http.StatusBadRequest {
+		t.Fatalf("event without an ID: status %d, want 400", code)
+	}
+	if code := serve(httptest.NewRequest(http.MethodGet, "/events", nil)); code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET: status %d, want 405", code)
+	}
+	if len(handled) != 1 {
+		t.Fatalf("handled %v, want only event-1", handled)
+	}
+}
+
+func TestSeenSetEvictsOldest(t *testing.T) {
+	s := newSeenSet(2)
+	s.add("a")
+	s.add("b")
+	s.add("a")
+	s.add("c")
+	if s.contains("a") || !s.contains("b") || !s.contains("c") {
+		t.Fatal("seen set did not evict the oldest id")
+	}
+}
@@ -0,0 +1,142 @@
+package events
+
+import (
+	"context"
+	"distributedDemo/auth"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// 订阅方记住的最近处理过的事件数
+const seenCapacity = 1024
+
+// Handler 订阅方接收事件的接口，只接受持有服务token且带有签名的请求
+// handle返回错误时以500响应，发布方稍后重试；同一事件可能重复到达，最近处理成功的事件会被忽略
+func Handler(handle func(ctx context.Context, e Event) error) http.Handler {
+	seen := newSeenSet(seenCapacity)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		claims, err := auth.FromRequest(r)
+		if err != nil || !claims.HasRole(auth.RoleService) {
+			log.Println("func Handler: rejected event from", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, err := auth.VerifyRequest(r)
+		if err != nil {
+			log.Println("func Handler: rejected event from", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil || e.ID == "" {
+			log.Println("func Handler: malformed event from", claims.Service, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if seen.contains(e.ID) {
+			eventsReceived.For(r.Context()).Inc(string(e.Type), "duplicate")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err := handle(auth.WithClaims(r.Context(), claims), e); err != nil {
+			log.Printf("func Handler:handling %s event %s failed: %v\n", e.Type, e.ID, err)
+			eventsReceived.For(r.Context()).Inc(string(e.Type), "error")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		seen.add(e.ID)
+		eventsReceived.For(r.Context()).Inc(string(e.Type), "ok")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// 按加入的顺序淘汰的事件ID集合
+type seenSet struct {
+	mutex sync.Mutex
+	ids   map[string]bool
+	order []string
+	next  int
+}
+
+func newSeenSet(capacity int) *seenSet {
+	return &seenSet{ids: make(map[string]bool), order: make([]string, capacity)}
+}
+
+func (s *seenSet) contains(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ids[id]
+}
+
+func (s *seenSet) add(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ids[id] {
+		return
+	}
+	delete(s.ids, s.order[s.next])
+	s.order[s.next] = id
+	s.ids[id] = true
+	s.next = (s.next + 1) % len(s.order)
+}
+
+// AdminHandler 查看待投递的事件与死信，并重新投递或删除死信，应只允许管理员访问
+//
+//	GET    /events/pending
+//	GET    /events/deadletters
+//	POST   /events/deadletters/redrive?id=   重新投递，不指定id时重新投递所有死信
+//	DELETE /events/deadletters?id=           删除，不指定id时删除所有死信
+func (p *Publisher) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimSuffix(r.URL.Path, "/")
+		id := r.URL.Query().Get("id")
+		switch {
+		case path == "/events/pending" && r.Method == http.MethodGet:
+			writeJSON(w, p.Pending())
+		case path == "/events/deadletters" && r.Method == http.MethodGet:
+			writeJSON(w, p.DeadLetters())
+		case path == "/events/deadletters/redrive" && r.Method == http.MethodPost:
+			n, err := p.Redrive(id)
+			p.writeResult(w, r, "redrive", n, err)
+		case path == "/events/deadletters" && r.Method == http.MethodDelete:
+			n, err := p.Discard(id)
+			p.writeResult(w, r, "discard", n, err)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func (p *Publisher) writeResult(w http.ResponseWriter, r *http.Request, action string, n int, err error) {
+	claims, _ := auth.FromContext(r.Context())
+	if claims != nil {
+		log.Printf("Method AdminHandler of Publisher:%s %s %d dead letters\n", claims.Subject, action, n)
+	}
+	if err != nil {
+		log.Println("Method AdminHandler of Publisher:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if n == 0 && r.URL.Query().Get("id") != "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, struct{ Count int }{n})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
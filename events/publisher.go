@@ -0,0 +1,439 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/metrics"
+	"distributedDemo/registry"
+	"distributedDemo/tlsutil"
+	"distributedDemo/trace"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	//保存在Config.Dir中的文件
+	pendingFile    = "pending.json"
+	deadLetterFile = "deadletters.json"
+	//同时进行的投递数上限
+	maxInFlight = 8
+)
+
+// Config 发布方的投递参数，未设置的参数使用DefaultConfig中的值
+type Config struct {
+	//保存待投递事件与死信的目录，为空时只保存在内存中，重启后丢失
+	Dir string
+	//投递失败后的重试间隔从RetryMin开始倍增，最长为RetryMax
+	RetryMin time.Duration
+	RetryMax time.Duration
+	//投递次数达到MaxAttempts后转为死信
+	MaxAttempts int
+	//单次投递的超时时间
+	Timeout time.Duration
+	//投递使用的http客户端，为nil时使用tlsutil.Client；同一进程内运行多个服务时使用发布方服务自己的客户端
+	HTTP *http.Client
+	//记录投递情况的指标，为nil时使用metrics.Default
+	Metrics *metrics.Registry
+}
+
+// DefaultConfig 默认的投递参数，最后一次重试约在首次投递的半小时后
+var DefaultConfig = Config{
+	RetryMin:    time.Second,
+	RetryMax:    5 * time.Minute,
+	MaxAttempts: 12,
+	Timeout:     5 * time.Second,
+}
+
+// Delivery 一个事件对一个订阅服务的投递
+type Delivery struct {
+	ID         string
+	Event      Event
+	Subscriber registry.ServiceName
+	//已经尝试投递的次数
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string `json:",omitempty"`
+
+	//正在投递中，不会被重复取出
+	inFlight bool
+}
+
+// 订阅方以4xx（408与429除外）响应表示不会接受该事件，不再重试
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+// Publisher 将事件投递给订阅的服务，同一进程内的多个服务应使用各自的Publisher
+type Publisher struct {
+	source    string
+	providers *registry.Providers
+	config    Config
+
+	//保护pending与dead，持有时写入文件，保证文件与内存一致
+	mutex   sync.Mutex
+	pending map[string]*Delivery
+	dead    []*Delivery
+
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// NewPublisher 创建以source的名义发布事件的Publisher，订阅方的实例从providers中查找
+// config.Dir中有上次未投递完的事件时继续投递
+func NewPublisher(source string, providers *registry.Providers, config Config) (*Publisher, error) {
+	if config.RetryMin <= 0 {
+		config.RetryMin = DefaultConfig.RetryMin
+	}
+	if config.RetryMax < config.RetryMin {
+		config.RetryMax = DefaultConfig.RetryMax
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultConfig.MaxAttempts
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultConfig.Timeout
+	}
+	p := &Publisher{
+		source:    source,
+		providers: providers,
+		config:    config,
+		pending:   make(map[string]*Delivery),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("func NewPublisher: %v", err)
+		}
+		var pending []*Delivery
+		if err := load(filepath.Join(config.Dir, pendingFile), &pending); err != nil {
+			return nil, fmt.Errorf("func NewPublisher: %v", err)
+		}
+		for _, d := range pending {
+			p.pending[d.ID] = d
+		}
+		if err := load(filepath.Join(config.Dir, deadLetterFile), &p.dead); err != nil {
+			return nil, fmt.Errorf("func NewPublisher: %v", err)
+		}
+		if len(pending) > 0 {
+			log.Printf("func NewPublisher:resuming %d pending deliveries from %s\n", len(pending), config.Dir)
+		}
+	}
+	p.updateGauges()
+	p.wg.Add(1)
+	go p.loop()
+	return p, nil
+}
+
+func load(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// 先写入临时文件再重命名，避免崩溃时留下不完整的文件
+func store(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 将待投递的事件与死信写入Config.Dir，调用方需持有p.mutex
+func (p *Publisher) saveLocked() error {
+	p.updateGaugesLocked()
+	if p.config.Dir == "" {
+		return nil
+	}
+	if err := store(filepath.Join(p.config.Dir, pendingFile), p.pendingLocked()); err != nil {
+		return err
+	}
+	return store(filepath.Join(p.config.Dir, deadLetterFile), p.dead)
+}
+
+// 按首次发布的时间排列待投递的事件，调用方需持有p.mutex
+func (p *Publisher) pendingLocked() []*Delivery {
+	list := make([]*Delivery, 0, len(p.pending))
+	for _, d := range p.pending {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Event.Time.Equal(list[j].Event.Time) {
+			return list[i].Event.Time.Before(list[j].Event.Time)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+func (p *Publisher) updateGauges() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.updateGaugesLocked()
+}
+
+func (p *Publisher) updateGaugesLocked() {
+	pendingDeliveries.In(p.config.Metrics).Set(float64(len(p.pending)), p.source)
+	deadLetters.In(p.config.Metrics).Set(float64(len(p.dead)), p.source)
+}
+
+// Publish 发布事件，data序列化后作为事件的内容
+// 返回前事件已经为每个订阅的服务保存，之后在后台投递；当前没有订阅方时事件被丢弃
+func (p *Publisher) Publish(ctx context.Context, t Type, data interface{}) (Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, fmt.Errorf("method Publish of Publisher: %v", err)
+	}
+	e := Event{ID: newID(), Type: t, Source: p.source, Time: time.Now().UTC(), Data: raw}
+	eventsPublished.In(p.config.Metrics).Inc(p.source, string(t))
+	subscribers := p.providers.Subscribers(string(t))
+	if len(subscribers) == 0 {
+		trace.Printf(ctx, "Method Publish of Publisher:no subscribers for %s event %s\n", t, e.ID)
+		return e, nil
+	}
+	p.mutex.Lock()
+	for _, name := range subscribers {
+		d := &Delivery{ID: e.ID + "-" + string(name), Event: e, Subscriber: name, NextAttempt: e.Time}
+		p.pending[d.ID] = d
+	}
+	err = p.saveLocked()
+	p.mutex.Unlock()
+	p.signal()
+	if err != nil {
+		//事件仍在内存中，会继续投递，但重启后将丢失
+		return e, fmt.Errorf("method Publish of Publisher:event %s not persisted: %v", e.ID, err)
+	}
+	trace.Printf(ctx, "Method Publish of Publisher:%s event %s queued for %v\n", t, e.ID, subscribers)
+	return e, nil
+}
+
+func (p *Publisher) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close 停止投递并等待正在进行的投递结束，未投递的事件保留在Config.Dir中
+func (p *Publisher) Close() {
+	p.once.Do(func() {
+		close(p.done)
+	})
+	p.wg.Wait()
+}
+
+// 取出到期的投递，返回距离下一次到期的时间
+func (p *Publisher) due(now time.Time) ([]*Delivery, time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var due []*Delivery
+	wait := time.Duration(-1)
+	for _, d := range p.pendingLocked() {
+		if d.inFlight {
+			continue
+		}
+		if !d.NextAttempt.After(now) {
+			d.inFlight = true
+			due = append(due, d)
+			continue
+		}
+		if w := d.NextAttempt.Sub(now); wait < 0 || w < wait {
+			wait = w
+		}
+	}
+	return due, wait
+}
+
+func (p *Publisher) loop() {
+	defer p.wg.Done()
+	slots := make(chan struct{}, maxInFlight)
+	for {
+		due, wait := p.due(time.Now())
+		for _, d := range due {
+			select {
+			case slots <- struct{}{}:
+			case <-p.done:
+				return
+			}
+			p.wg.Add(1)
+			go func(d *Delivery) {
+				defer p.wg.Done()
+				err := p.send(d)
+				<-slots
+				p.complete(d, err)
+			}(d)
+		}
+		var timer <-chan time.Time
+		if wait >= 0 {
+			timer = time.After(wait)
+		}
+		select {
+		case <-p.wake:
+		case <-timer:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// 将事件POST到订阅服务的一个实例，每次重试都重新选择实例
+func (p *Publisher) send(d *Delivery) error {
+	url, err := p.providers.EventURL(d.Subscriber, string(d.Event.Type))
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		return permanentError{err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	//订阅方只接受持有服务token且带有签名的事件
+	auth.SetToken(req, auth.ServiceToken(p.source))
+	if err := auth.SignRequest(req, body); err != nil {
+		return err
+	}
+	hc := p.config.HTTP
+	if hc == nil {
+		hc = tlsutil.Client
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return nil
+	case res.StatusCode >= 400 && res.StatusCode < 500 &&
+		res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests:
+		return permanentError{fmt.Errorf("%s rejected event with code %d", url, res.StatusCode)}
+	default:
+		return fmt.Errorf("%s responded with code %d", url, res.StatusCode)
+	}
+}
+
+// 记录投递的结果：成功时移除，失败时安排重试或转为死信
+func (p *Publisher) complete(d *Delivery, err error) {
+	//投递中的事件不计入loop等待的时间，需要唤醒loop按新的NextAttempt重新计算
+	defer p.signal()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	d.inFlight = false
+	if _, ok := p.pending[d.ID]; !ok {
+		return
+	}
+	subscriber := string(d.Subscriber)
+	if err == nil {
+		delete(p.pending, d.ID)
+		eventsDelivered.In(p.config.Metrics).Inc(subscriber)
+	} else {
+		d.Attempts++
+		d.LastError = err.Error()
+		deliveryFailures.In(p.config.Metrics).Inc(subscriber)
+		var perm permanentError
+		if errors.As(err, &perm) || d.Attempts >= p.config.MaxAttempts {
+			log.Printf("Method complete of Publisher:dead-lettering %s after %d attempts: %v\n", d.ID, d.Attempts, err)
+			delete(p.pending, d.ID)
+			p.dead = append(p.dead, d)
+			deadLettered.In(p.config.Metrics).Inc(subscriber)
+		} else {
+			backoff := p.config.RetryMin << (d.Attempts - 1)
+			if backoff > p.config.RetryMax || backoff <= 0 {
+				backoff = p.config.RetryMax
+			}
+			d.NextAttempt = time.Now().Add(backoff)
+			log.Printf("Method complete of Publisher:delivery %s failed, retrying in %v: %v\n", d.ID, backoff, err)
+		}
+	}
+	if err := p.saveLocked(); err != nil {
+		log.Println("Method complete of Publisher:", err)
+	}
+}
+
+// Pending 返回待投递的事件
+func (p *Publisher) Pending() []Delivery {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return copyDeliveries(p.pendingLocked())
+}
+
+// DeadLetters 返回死信
+func (p *Publisher) DeadLetters() []Delivery {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return copyDeliveries(p.dead)
+}
+
+func copyDeliveries(list []*Delivery) []Delivery {
+	out := make([]Delivery, len(list))
+	for i, d := range list {
+		out[i] = *d
+	}
+	return out
+}
+
+// Redrive 将死信重新放入投递队列并重置投递次数，id为空时重新投递所有死信，返回重新投递的数量
+func (p *Publisher) Redrive(id string) (int, error) {
+	return p.takeDead(id, func(d *Delivery) {
+		d.Attempts, d.LastError, d.NextAttempt = 0, "", time.Now()
+		p.pending[d.ID] = d
+	})
+}
+
+// Discard 删除死信，id为空时删除所有死信，返回删除的数量
+func (p *Publisher) Discard(id string) (int, error) {
+	return p.takeDead(id, func(*Delivery) {})
+}
+
+// 从死信中取出id对应的投递（id为空时取出全部）交给fn处理
+func (p *Publisher) takeDead(id string, fn func(d *Delivery)) (int, error) {
+	p.mutex.Lock()
+	kept := p.dead[:0]
+	n := 0
+	for _, d := range p.dead {
+		if id == "" || d.ID == id {
+			fn(d)
+			n++
+			continue
+		}
+		kept = append(kept, d)
+	}
+	p.dead = kept
+	err := p.saveLocked()
+	p.mutex.Unlock()
+	if n > 0 {
+		p.signal()
+	}
+	return n, err
+}
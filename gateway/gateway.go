@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"distributedDemo/auth"
+	"distributedDemo/metrics"
+	"distributedDemo/ratelimit"
+	"distributedDemo/registry"
+	"distributedDemo/trace"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Route 以Prefix开头的请求转发给Service的健康实例，转发时去掉Prefix
+// 如/api/grades/students/1转发为GradeService的/students/1
+type Route struct {
+	Prefix  string
+	Service registry.ServiceName
+	//为true时网关不校验token，由上游服务自行处理
+	Public bool
+}
+
+// DefaultRoutes 未指定路由时使用的路由
+var DefaultRoutes = []Route{
+	{Prefix: "/api/grades/", Service: registry.GradeService},
+}
+
+// ParseRoute 解析"prefix=ServiceName"或"prefix=ServiceName,public"形式的路由
+func ParseRoute(s string) (Route, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || parts[1] == "" {
+		return Route{}, fmt.Errorf("invalid route %q, want prefix=ServiceName[,public]", s)
+	}
+	rt := Route{Prefix: parts[0], Service: registry.ServiceName(parts[1])}
+	if name := strings.TrimSuffix(parts[1], ",public"); name != parts[1] {
+		rt.Service, rt.Public = registry.ServiceName(name), true
+	}
+	//以/结尾才能匹配前缀下的所有路径
+	if !strings.HasSuffix(rt.Prefix, "/") {
+		rt.Prefix += "/"
+	}
+	return rt, nil
+}
+
+var gatewayRequests = metrics.NewCounterVec("gateway_requests_total",
+	"Requests proxied by the gateway, by route and status code.",
+	"route", "code")
+
+// Config 网关的路由与限流设置
+type Config struct {
+	Routes []Route
+	//每个客户端IP每秒允许的请求数及突发的请求数，运行时可通过/ratelimits/gateway调整
+	Rate  float64
+	Burst int
+	//发现上游服务并转发请求使用的registry客户端，为nil时使用registry.DefaultClient
+	Client *registry.Client
+}
+
+// NewLimiter 按config创建网关的限流器，通过service.WithRateLimit使用
+func NewLimiter(config Config) *ratelimit.Limiter {
+	return ratelimit.New("gateway", ratelimit.Limit{Rate: config.Rate, Burst: config.Burst}, ratelimit.ByIP)
+}
+
+// RegisterHandlers 为每条路由注册转发的handler
+// 校验token或用户名与密码，最后转发给上游服务，限流与请求ID由service.Start的middleware处理
+func RegisterHandlers(mux *http.ServeMux, config Config) {
+	client := config.Client
+	if client == nil {
+		client = registry.DefaultClient
+	}
+	for _, rt := range config.Routes {
+		var h http.Handler = &proxy{route: rt, client: client}
+		if !rt.Public {
+			h = withBasicAuth(auth.Require(h))
+		}
+		mux.Handle(rt.Prefix, h)
+	}
+}
+
+// RequiredServices 路由所涉及的服务，网关注册时声明依赖这些服务以获取其实例
+func RequiredServices(routes []Route) []registry.ServiceName {
+	var names []registry.ServiceName
+	seen := make(map[registry.ServiceName]bool)
+	for _, rt := range routes {
+		if !seen[rt.Service] {
+			seen[rt.Service] = true
+			names = append(names, rt.Service)
+		}
+	}
+	return names
+}
+
+// 携带用户名与密码的客户端换成有效期较短的token，上游服务只接受token
+func withBasicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u, err := auth.Authenticate(username, password)
+		if err != nil {
+			trace.Println(r.Context(), "func withBasicAuth:", username, err)
+			w.Header().Set("WWW-Authenticate", `Basic realm="gateway"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token, err := u.Token(string(registry.GatewayService), time.Minute)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		auth.SetToken(r, token)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,169 @@
+package gateway
+
+import (
+	"bytes"
+	"distributedDemo/idempotency"
+	"distributedDemo/metrics"
+	"distributedDemo/middleware"
+	"distributedDemo/registry"
+	"distributedDemo/trace"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxAttempts 转发给上游服务的最大尝试次数
+	MaxAttempts = 3
+	//重试时需要重新发送请求体，因此请求体有大小限制
+	maxBodySize = 1 << 20
+)
+
+var upstreamRetries = metrics.NewCounterVec("gateway_upstream_retries_total",
+	"Requests retried against another upstream instance, by service.",
+	"service")
+
+// 逐跳的请求头只在相邻的两个节点之间有效，不能转发
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+type proxy struct {
+	route  Route
+	client *registry.Client
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxBodySize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	path := "/" + strings.TrimPrefix(r.URL.Path, p.route.Prefix)
+
+	var res *http.Response
+	tried := make(map[string]bool)
+	for attempt := 1; attempt <= MaxAttempts; attempt++ {
+		target, err := p.pick(tried)
+		if err != nil {
+			trace.Println(r.Context(), "Method ServeHTTP of proxy:", middleware.RequestIDFromContext(r.Context()), err)
+			break
+		}
+		tried[target] = true
+		if attempt > 1 {
+			upstreamRetries.For(r.Context()).Inc(string(p.route.Service))
+		}
+		res, err = p.forward(r, target, path, body)
+		if err == nil && !(retryableStatus(res.StatusCode) && idempotent(r) && attempt < MaxAttempts) {
+			break
+		}
+		if err != nil {
+			trace.Printf(r.Context(), "Method ServeHTTP of proxy:%s attempt %d to %s failed: %v\n",
+				middleware.RequestIDFromContext(r.Context()), attempt, target, err)
+			//非幂等的请求只在连接建立前失败时重试，避免重复执行
+			if !idempotent(r) && !dialError(err) {
+				break
+			}
+			continue
+		}
+		res.Body.Close()
+		res = nil
+	}
+	if res == nil {
+		gatewayRequests.For(r.Context()).Inc(p.route.Prefix, strconv.Itoa(http.StatusBadGateway))
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	gatewayRequests.For(r.Context()).Inc(p.route.Prefix, strconv.Itoa(res.StatusCode))
+	for k, vv := range res.Header {
+		//请求ID、Vary等可能已由网关的middleware设置，不重复添加
+		for _, v := range vv {
+			if !hasValue(w.Header()[k], v) {
+				w.Header().Add(k, v)
+			}
+		}
+	}
+	removeHopHeaders(w.Header())
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
+
+// 尽量选择尚未尝试过的实例
+func (p *proxy) pick(tried map[string]bool) (string, error) {
+	var target string
+	var err error
+	for i := 0; i < MaxAttempts; i++ {
+		target, err = p.client.GetProvider(p.route.Service)
+		if err != nil || !tried[target] {
+			break
+		}
+	}
+	return target, err
+}
+
+func (p *proxy) forward(r *http.Request, target, path string, body []byte) (*http.Response, error) {
+	u := strings.TrimSuffix(target, "/") + path
+	if r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+	out, err := http.NewRequestWithContext(r.Context(), r.Method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	out.Header = r.Header.Clone()
+	removeHopHeaders(out.Header)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		out.Header.Set("X-Forwarded-For", host)
+	}
+	out.Header.Set("X-Forwarded-Host", r.Host)
+	out.Header.Set("X-Forwarded-Proto", map[bool]string{true: "https", false: "http"}[r.TLS != nil])
+	res, err := p.client.HTTP.Do(out)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", r.Method, u, err)
+	}
+	return res, nil
+}
+
+func hasValue(values []string, v string) bool {
+	for _, existing := range values {
+		if existing == v {
+			return true
+		}
+	}
+	return false
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// 携带Idempotency-Key的请求由上游去重，与幂等的方法一样可以重试
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get(idempotency.Header) != ""
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+// 连接未建立时请求一定没有被上游处理
+func dialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,310 @@
+// Package client grade服务的Go客户端，通过registry查找服务实例，并将状态码转换为错误
+//
+//	c := client.New(registry.DefaultClient, client.WithToken(func(ctx context.Context) (string, error) {
+//		return auth.ServiceToken("MyService"), nil
+//	}))
+//	s, err := c.GetStudent(ctx, 1)
+//	if errors.Is(err, client.ErrNotFound) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/grades"
+	"distributedDemo/idempotency"
+	"distributedDemo/registry"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 可以通过errors.Is判断的错误
+var (
+	ErrBadRequest   = errors.New("grades: bad request")
+	ErrUnauthorized = errors.New("grades: unauthorized")
+	ErrForbidden    = errors.New("grades: forbidden")
+	ErrNotFound     = errors.New("grades: not found")
+	ErrConflict     = errors.New("grades: conflict")
+	//通过IfVersion指定的版本不是学生当前的版本，即其他客户端已经修改了该学生
+	ErrVersionMismatch = errors.New("grades: student has been modified")
+	//没有可用的实例，或重试后实例仍不可用
+	ErrUnavailable = errors.New("grades: service unavailable")
+)
+
+// Error grade服务以非成功的状态码响应
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("grades: %s %s responded with code %d", e.Method, e.URL, e.StatusCode)
+}
+
+// Is 使errors.Is(err, ErrNotFound)等判断可以用于Error
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return target == ErrBadRequest
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusPreconditionFailed:
+		return target == ErrVersionMismatch
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return target == ErrUnavailable
+	}
+	return false
+}
+
+// TokenFunc 返回调用grade服务使用的token，如当前登录用户的token
+type TokenFunc func(ctx context.Context) (string, error)
+
+const (
+	// DefaultTimeout 单次请求的默认超时时间
+	DefaultTimeout = 5 * time.Second
+	// DefaultAttempts 默认的最大尝试次数
+	DefaultAttempts = 3
+	//两次尝试之间的等待时间，按尝试次数递增
+	retryDelay = 100 * time.Millisecond
+)
+
+// Client grade服务的客户端，可以被多个goroutine同时使用
+type Client struct {
+	resolve  func() (string, error)
+	token    TokenFunc
+	http     *http.Client
+	timeout  time.Duration
+	attempts int
+}
+
+// Option 创建客户端时的可选配置
+type Option func(*Client)
+
+// WithToken 每次请求时调用f获取token，未指定时不携带token
+func WithToken(f TokenFunc) Option {
+	return func(c *Client) {
+		c.token = f
+	}
+}
+
+// WithTimeout 单次请求的超时时间，包括读取响应
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithAttempts 最大尝试次数，为1时不重试
+// 请求在连接失败或实例不可用时重试，修改的每次尝试都携带同一个Idempotency-Key，不会重复添加
+func WithAttempts(n int) Option {
+	return func(c *Client) {
+		c.attempts = n
+	}
+}
+
+// WithHTTPClient 使用指定的http.Client，未指定时使用rc的HTTP
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// New 创建通过rc查找grade服务实例的客户端，rc需在所依赖的服务中声明了GradeService
+func New(rc *registry.Client, opts ...Option) *Client {
+	c := &Client{
+		resolve: func() (string, error) {
+			return rc.GetProvider(registry.GradeService)
+		},
+		http:     rc.HTTP,
+		timeout:  DefaultTimeout,
+		attempts: DefaultAttempts,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.attempts < 1 {
+		c.attempts = 1
+	}
+	return c
+}
+
+type versionKey struct{}
+
+// IfVersion 返回的ctx用于修改成绩时，只在学生仍为version版本时修改，否则返回ErrVersionMismatch
+//
+//	s, err := c.GetStudent(ctx, id)
+//	...
+//	_, err = c.AddGrade(client.IfVersion(ctx, s.Version), id, g)
+func IfVersion(ctx context.Context, version int) context.Context {
+	return context.WithValue(ctx, versionKey{}, version)
+}
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey 返回的ctx用于修改时携带key，如页面表单中生成的key，重复提交的表单只会被执行一次
+// 未指定时每次调用生成一个新的key
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// ListStudents 当前token有权限查看的所有学生
+func (c *Client) ListStudents(ctx context.Context) (grades.Students, error) {
+	var s grades.Students
+	err := c.do(ctx, http.MethodGet, "/students", nil, http.StatusOK, &s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetStudent 查询学生及其成绩，学生不存在时返回ErrNotFound
+func (c *Client) GetStudent(ctx context.Context, id int) (*grades.Student, error) {
+	var s grades.Student
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/students/%d", id), nil, http.StatusOK, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// AddGrade 为学生添加一项成绩，返回grade服务保存的成绩
+func (c *Client) AddGrade(ctx context.Context, id int, g grades.Grade) (grades.Grade, error) {
+	body, err := json.Marshal(g)
+	if err != nil {
+		return grades.Grade{}, err
+	}
+	var saved grades.Grade
+	err = c.do(ctx, http.MethodPost, fmt.Sprintf("/students/%d/grades", id), body, http.StatusCreated, &saved)
+	if err != nil {
+		return grades.Grade{}, err
+	}
+	return saved, nil
+}
+
+// UpdateGrade 修改学生的第index个成绩，返回grade服务保存的成绩
+func (c *Client) UpdateGrade(ctx context.Context, id, index int, g grades.Grade) (grades.Grade, error) {
+	body, err := json.Marshal(g)
+	if err != nil {
+		return grades.Grade{}, err
+	}
+	var saved grades.Grade
+	err = c.do(ctx, http.MethodPut, fmt.Sprintf("/students/%d/grades/%d", id, index), body, http.StatusOK, &saved)
+	if err != nil {
+		return grades.Grade{}, err
+	}
+	return saved, nil
+}
+
+// DeleteGrade 删除学生的第index个成绩，之后的成绩前移
+func (c *Client) DeleteGrade(ctx context.Context, id, index int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/students/%d/grades/%d", id, index), nil, http.StatusNoContent, nil)
+}
+
+// CreateStudent 添加学生，s.ID为0时由grade服务分配，返回添加后的学生
+// 缺少必填的字段时返回ErrBadRequest，可以事先通过Student.Problems检查
+func (c *Client) CreateStudent(ctx context.Context, s grades.Student) (*grades.Student, error) {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	var created grades.Student
+	err = c.do(ctx, http.MethodPost, "/students", body, http.StatusCreated, &created)
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// 发送请求并将响应解析到out，out为nil时忽略响应体，按需重试，每次尝试都重新查找实例
+func (c *Client) do(ctx context.Context, method, path string, body []byte, want int, out interface{}) error {
+	//重试时使用同一个key，grade服务只会执行一次
+	var key string
+	if method != http.MethodGet {
+		key, _ = ctx.Value(idempotencyKey{}).(string)
+		if key == "" {
+			key = idempotency.NewKey()
+		}
+	}
+	var err error
+	for attempt := 1; attempt <= c.attempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt-1) * retryDelay):
+			}
+		}
+		var retry bool
+		retry, err = c.try(ctx, method, path, key, body, want, out)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// 发送一次请求，返回失败时是否可以重试
+func (c *Client) try(ctx context.Context, method, path, key string, body []byte, want int, out interface{}) (bool, error) {
+	serviceURL, err := c.resolve()
+	if err != nil {
+		return true, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	u := strings.TrimSuffix(serviceURL, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if key != "" {
+		req.Header.Set(idempotency.Header, key)
+	}
+	if version, ok := ctx.Value(versionKey{}).(int); ok && method != http.MethodGet {
+		req.Header.Set("If-Match", grades.Student{Version: version}.ETag())
+	}
+	if c.token != nil {
+		token, err := c.token(ctx)
+		if err != nil {
+			return false, err
+		}
+		auth.SetToken(req, token)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != want {
+		_, _ = io.Copy(io.Discard, res.Body)
+		e := &Error{Method: method, URL: u, StatusCode: res.StatusCode}
+		//同一个key的上一次尝试仍在进行中，稍后重试可以得到它的响应
+		inProgress := res.StatusCode == http.StatusConflict && res.Header.Get("Retry-After") != ""
+		return errors.Is(e, ErrUnavailable) || inProgress, e
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, res.Body)
+		return false, nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return false, fmt.Errorf("grades: decoding response of %s %s: %v", method, u, err)
+	}
+	return false, nil
+}
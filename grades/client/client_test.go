@@ -0,0 +1,245 @@
+package client
+
+import (
+	"context"
+	"distributedDemo/grades"
+	"distributedDemo/idempotency"
+	"distributedDemo/registry"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录收到的请求，第n次请求以statuses[n]响应，超出时以最后一个状态码响应
+type fakeGrades struct {
+	statuses []int
+	header   http.Header
+
+	mutex    sync.Mutex
+	requests []*http.Request
+}
+
+func (fg *fakeGrades) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.mutex.Lock()
+	fg.requests = append(fg.requests, r)
+	code := fg.statuses[len(fg.statuses)-1]
+	if n := len(fg.requests) - 1; n < len(fg.statuses) {
+		code = fg.statuses[n]
+	}
+	fg.mutex.Unlock()
+	for k, v := range fg.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(code)
+	switch {
+	case code >= 300:
+	case r.URL.Path == "/students":
+		_ = json.NewEncoder(w).Encode(grades.Students{{ID: 1, FirstName: "Nick"}})
+	case r.Method == http.MethodPost:
+		var g grades.Grade
+		_ = json.NewDecoder(r.Body).Decode(&g)
+		_ = json.NewEncoder(w).Encode(g)
+	default:
+		_ = json.NewEncoder(w).Encode(grades.Student{ID: 1, FirstName: "Nick", Version: 3})
+	}
+}
+
+func (fg *fakeGrades) received() []*http.Request {
+	fg.mutex.Lock()
+	defer fg.mutex.Unlock()
+	return append([]*http.Request(nil), fg.requests...)
+}
+
+func newTestClient(t *testing.T, fg *fakeGrades, opts ...Option) *Client {
+	t.Helper()
+	srv := httptest.NewServer(fg)
+	t.Cleanup(srv.Close)
+	c := New(registry.NewClient("http://registry.invalid"), opts...)
+	c.http = srv.Client()
+	c.resolve = func() (string, error) { return srv.URL + "/", nil }
+	return c
+}
+
+func TestErrorIs(t *testing.T) {
+	tests := []struct {
+		code int
+		want error
+	}{
+		{http.StatusBadRequest, ErrBadRequest},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusConflict, ErrConflict},
+		{http.StatusPreconditionFailed, ErrVersionMismatch},
+		{http.StatusBadGateway, ErrUnavailable},
+		{http.StatusServiceUnavailable, ErrUnavailable},
+		{http.StatusGatewayTimeout, ErrUnavailable},
+		{http.StatusInternalServerError, nil},
+	}
+	all := []error{ErrBadRequest, ErrUnauthorized, ErrForbidden, ErrNotFound, ErrConflict, ErrVersionMismatch, ErrUnavailable}
+	for _, tt := range tests {
+		err := fmt.Errorf("wrapped: %w", &Error{Method: http.MethodGet, URL: "/students", StatusCode: tt.code})
+		for _, target := range all {
+			if got := errors.Is(err, target); got != (target == tt.want) {
+				t.Errorf("status %d: errors.Is(err, %v) = %v", tt.code, target, got)
+			}
+		}
+	}
+}
+
+func TestGetStudentDecodesResponse(t *testing.T) {
+	fg := &fakeGrades{statuses: []int{http.StatusOK}}
+	c := newTestClient(t, fg, WithToken(func(ctx context.Context) (string, error) { return "user-token", nil }))
+	s, err := c.GetStudent(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != 1 || s.Version != 3 {
+		t.Fatalf("student = %+v", s)
+	}
+	req := fg.received()[0]
+	if req.URL.Path != "/students/1" || req.Header.Get("Authorization") != "Bearer user-token" {
+		t.Fatalf("request %s with Authorization %q", req.URL.Path, req.Header.Get("Authorization"))
+	}
+	//查询不携带Idempotency-Key
+	if req.Header.Get(idempotency.Header) != "" {
+		t.Fatal("GET sent an Idempotency-Key")
+	}
+}
+
+// 实例不可用时重试，每次尝试都携带同一个Idempotency-Key
+func TestRetriesUnavailableWithSameKey(t *testing.T) {
+	fg := &fakeGrades{statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusCreated}}
+	c := newTestClient(t, fg)
+	g, err := c.AddGrade(context.Background(), 1, grades.Grade{Title: "Quiz", Type: grades.GradeQuiz, Score: 90})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Title != "Quiz" {
+		t.Fatalf("saved grade = %+v", g)
+	}
+	reqs := fg.received()
+	if len(reqs) != 3 {
+		t.Fatalf("%d attempts, want 3", len(reqs))
+	}
+	key := reqs[0].Header.Get(idempotency.Header)
+	if key == "" {
+		t.Fatal("POST without an Idempotency-Key")
+	}
+	for i, req := range reqs {
+		if got := req.Header.Get(idempotency.Header); got != key {
+			t.Fatalf("attempt %d used key %q, want %q", i+1, got, key)
+		}
+	}
+}
+
+func TestGivesUpAfterAttempts(t *testing.T) {
+	fg := &fakeGrades{statuses: []int{http.StatusServiceUnavailable}}
+	c := newTestClient(t, fg, WithAttempts(2))
+	_, err := c.ListStudents(context.Background())
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("err = %v, want ErrUnavailable", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want *Error with status 503", err)
+	}
+	if n := len(fg.received()); n != 2 {
+		t.Fatalf("%d attempts, want 2", n)
+	}
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	for _, code := range []int{http.StatusNotFound, http.StatusForbidden, http.StatusConflict, http.StatusPreconditionFailed} {
+		fg := &fakeGrades{statuses: []int{code, http.StatusOK}}
+		c := newTestClient(t, fg)
+		if err := c.DeleteGrade(context.Background(), 1, 0); err == nil {
+			t.Fatalf("status %d: no error", code)
+		}
+		if n := len(fg.received()); n != 1 {
+			t.Fatalf("status %d: %d attempts, want 1", code, n)
+		}
+	}
+}
+
+// 同一个key的上一次尝试仍在进行中时，grade服务以409和Retry-After响应，稍后重试
+func TestRetriesRequestInProgress(t *testing.T) {
+	fg := &fakeGrades{
+		statuses: []int{http.StatusConflict, http.StatusNoContent},
+		header:   http.Header{"Retry-After": {"1"}},
+	}
+	c := newTestClient(t, fg)
+	if err := c.DeleteGrade(context.Background(), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(fg.received()); n != 2 {
+		t.Fatalf("%d attempts, want 2", n)
+	}
+}
+
+func TestUnavailableWithoutInstance(t *testing.T) {
+	c := New(registry.NewClient("http://registry.invalid"), WithAttempts(2))
+	_, err := c.GetStudent(context.Background(), 1)
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("err = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestIfVersionAndIdempotencyKey(t *testing.T) {
+	fg := &fakeGrades{statuses: []int{http.StatusPreconditionFailed}}
+	c := newTestClient(t, fg)
+	ctx := WithIdempotencyKey(IfVersion(context.Background(), 3), "form-key")
+	_, err := c.UpdateGrade(ctx, 1, 0, grades.Grade{Title: "Quiz", Type: grades.GradeQuiz, Score: 90})
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("err = %v, want ErrVersionMismatch", err)
+	}
+	req := fg.received()[0]
+	if got, want := req.Header.Get("If-Match"), (grades.Student{Version: 3}).ETag(); got != want {
+		t.Fatalf("If-Match = %q, want %q", got, want)
+	}
+	if got := req.Header.Get(idempotency.Header); got != "form-key" {
+		t.Fatalf("Idempotency-Key = %q, want form-key", got)
+	}
+
+	//查询不受IfVersion影响
+	fg = &fakeGrades{statuses: []int{http.StatusOK}}
+	c = newTestClient(t, fg)
+	if _, err := c.GetStudent(IfVersion(context.Background(), 3), 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := fg.received()[0].Header.Get("If-Match"); got != "" {
+		t.Fatalf("GET sent If-Match %q", got)
+	}
+}
+
+func TestTimeoutIsRetried(t *testing.T) {
+	var calls int
+	var mutex sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		calls++
+		first := calls == 1
+		mutex.Unlock()
+		if first {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_ = json.NewEncoder(w).Encode(grades.Student{ID: 1})
+	}))
+	defer srv.Close()
+	c := New(registry.NewClient("http://registry.invalid"), WithTimeout(50*time.Millisecond))
+	c.http = srv.Client()
+	c.resolve = func() (string, error) { return srv.URL, nil }
+	if _, err := c.GetStudent(context.Background(), 1); err != nil {
+		t.Fatalf("GetStudent after a timed out attempt: %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if calls != 2 {
+		t.Fatalf("%d attempts, want 2", calls)
+	}
+}
@@ -0,0 +1,62 @@
+package grades
+
+import (
+	"context"
+	"distributedDemo/events"
+	"distributedDemo/trace"
+)
+
+// 成绩服务发布的事件
+const (
+	GradeAdded     = events.Type("GradeAdded")
+	GradeUpdated   = events.Type("GradeUpdated")
+	GradeDeleted   = events.Type("GradeDeleted")
+	StudentCreated = events.Type("StudentCreated")
+)
+
+// PublishedEvents 成绩服务在Registration.Publishes中声明的事件类型
+var PublishedEvents = []string{string(GradeAdded), string(GradeUpdated), string(GradeDeleted), string(StudentCreated)}
+
+// GradeEvent GradeAdded、GradeUpdated与GradeDeleted事件的内容，GradeDeleted事件中Grade为删除的成绩
+type GradeEvent struct {
+	StudentID int
+	Class     string
+	//成绩在Student.Grades中的位置，删除后之后的成绩前移
+	Index int
+	Grade Grade
+	//GradeUpdated事件中修改前的成绩
+	Previous *Grade `json:",omitempty"`
+	//修改后学生的版本
+	Version int
+	//进行修改的用户或服务
+	By string
+}
+
+// StudentEvent StudentCreated事件的内容
+type StudentEvent struct {
+	Student Student
+	By      string
+}
+
+// SetPublisher 默认实例通过p发布事件
+func SetPublisher(p *events.Publisher) {
+	server.SetPublisher(p)
+}
+
+// SetPublisher 修改成绩或添加学生后通过p发布事件，为nil时不发布
+// 应在RegisterHandlers之前调用，否则不会注册事件的管理接口
+func (gs *GradesServer) SetPublisher(p *events.Publisher) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	gs.events = p
+}
+
+// 在修改所在的锁内调用，事件保存后才返回，修改本身不会因发布失败而回滚
+func (gs *GradesServer) publishLocked(ctx context.Context, t events.Type, data interface{}) {
+	if gs.events == nil {
+		return
+	}
+	if _, err := gs.events.Publish(ctx, t, data); err != nil {
+		trace.Println(ctx, "Method publishLocked of GradesServer:", err)
+	}
+}
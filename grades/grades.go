@@ -1,15 +1,35 @@
 package grades
 
 import (
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/events"
+	"distributedDemo/idempotency"
+	"distributedDemo/metrics"
+	"distributedDemo/trace"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Student struct {
-	ID        int
+	ID int
+	//学生所在的班级，老师只能查看与修改所教班级的成绩
+	Class     string
 	FirstName string
 	LastName  string
 	Grades    []Grade
+	//每次修改成绩后加1，客户端通过If-Match或请求中的Version指定修改所基于的版本
+	Version int
+}
+
+// ETag 学生当前版本对应的ETag
+func (s Student) ETag() string {
+	return strconv.Quote(strconv.Itoa(s.Version))
 }
 
 // Average 计算一名学生的平均成绩
@@ -24,12 +44,269 @@ func (s Student) Average() float32 {
 
 type Students []Student
 
-var (
+// GradesServer 成绩服务，各自持有一份学生数据，同一进程内可以运行多个互不影响的实例
+type GradesServer struct {
 	students Students
 	//students是一个集合,可能是并发访问,需要加互斥锁以保证并发安全
-	studentsMutex sync.Mutex
+	mutex sync.Mutex
+	//为nil时不发布事件
+	events *events.Publisher
+
+	//复制日志，见replication.go
+	seq     int64
+	journal []replicationEntry
+	//有新的记录时关闭并替换
+	changed chan struct{}
+	//为nil时不与其他实例复制数据
+	replicator *Replicator
+	//修改请求的Idempotency-Key及其响应
+	idempotency *idempotency.Store
+	//复制等后台任务记录的指标，为nil时使用metrics.Default
+	metrics *metrics.Registry
+}
+
+// NewGradesServer 创建使用students作为初始数据的成绩服务
+func NewGradesServer(students Students) *GradesServer {
+	//版本从1开始，0表示修改时不检查版本
+	for i := range students {
+		if students[i].Version == 0 {
+			students[i].Version = 1
+		}
+	}
+	return &GradesServer{
+		students:    students,
+		changed:     make(chan struct{}),
+		idempotency: idempotency.NewStore(idempotency.DefaultWindow),
+	}
+}
+
+// SetMetrics 后台的复制任务将指标记录在m中，应与启动服务时使用的Registry相同，并在Replicate之前调用
+// 处理请求时的指标记录在请求所属的Registry中，见metrics.For
+func (gs *GradesServer) SetMetrics(m *metrics.Registry) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	gs.metrics = m
+}
+
+// 每个进程只运行一个成绩服务时使用的实例
+var server = NewGradesServer(MockStudents())
+
+// StoreWritable 使用默认实例的健康检查，见GradesServer.StoreWritable
+func StoreWritable(ctx context.Context) error {
+	return server.StoreWritable(ctx)
+}
+
+// StoreWritable 健康检查：能在超时前获得students的写锁
+func (gs *GradesServer) StoreWritable(ctx context.Context) error {
+	for !gs.mutex.TryLock() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("student store is locked: %v", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	gs.mutex.Unlock()
+	return nil
+}
+
+// HTTP接口与RPC共用的错误，分别转换为对应的状态码与错误码
+var (
+	errNotFound  = errors.New("student not found")
+	errForbidden = errors.New("permission denied")
+	errInvalid   = errors.New("invalid request")
+	errConflict  = errors.New("student already exists")
+	//修改所基于的版本不是学生当前的版本
+	errVersionMismatch = errors.New("student has been modified")
 )
 
+// 检查修改所基于的版本，expected为0时不检查
+func checkVersion(student *Student, expected int) error {
+	if expected != 0 && expected != student.Version {
+		return fmt.Errorf("%w: student %d is at version %d, not %d", errVersionMismatch, student.ID, student.Version, expected)
+	}
+	return nil
+}
+
+// 返回claims有权限查看的学生
+func (gs *GradesServer) list(claims *auth.Claims) Students {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	visible := make(Students, 0, len(gs.students))
+	for _, s := range gs.students {
+		if claims.CanReadStudent(s.ID, s.Class) {
+			visible = append(visible, s)
+		}
+	}
+	return visible
+}
+
+// 返回学生的副本，释放锁后仍可安全地序列化
+func (gs *GradesServer) get(ctx context.Context, claims *auth.Claims, id int) (Student, error) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	student, err := gs.students.GetByID(id)
+	if err != nil {
+		trace.Println(ctx, err)
+		return Student{}, fmt.Errorf("%w: %v", errNotFound, err)
+	}
+	if !claims.CanReadStudent(student.ID, student.Class) {
+		trace.Printf(ctx, "Method get of GradesServer: %s is not allowed to read student %d\n", claims.Subject, id)
+		return Student{}, errForbidden
+	}
+	s := *student
+	s.Grades = append([]Grade(nil), student.Grades...)
+	return s, nil
+}
+
+// 为学生添加成绩，expected为修改所基于的版本，返回修改后的版本
+func (gs *GradesServer) addGrade(ctx context.Context, claims *auth.Claims, id, expected int, g Grade) (int, error) {
+	if err := problemsError(g.Problems()); err != nil {
+		return 0, err
+	}
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	student, err := gs.students.GetByID(id)
+	if err != nil {
+		trace.Println(ctx, err)
+		return 0, fmt.Errorf("%w: %v", errNotFound, err)
+	}
+	if !claims.CanWriteGrades(student.Class) {
+		trace.Printf(ctx, "Method addGrade of GradesServer: %s is not allowed to grade student %d\n", claims.Subject, id)
+		return 0, errForbidden
+	}
+	if err := checkVersion(student, expected); err != nil {
+		trace.Println(ctx, "Method addGrade of GradesServer:", err)
+		return 0, err
+	}
+	student.Grades = append(student.Grades, g)
+	student.Version++
+	gs.recordLocked(student)
+	gradeMutations.For(ctx).Inc("add_grade")
+	trace.Printf(ctx, "Method addGrade of GradesServer: %s added %q to student %d\n", claims.Subject, g.Title, id)
+	gs.publishLocked(ctx, GradeAdded, GradeEvent{
+		StudentID: id,
+		Class:     student.Class,
+		Index:     len(student.Grades) - 1,
+		Grade:     g,
+		Version:   student.Version,
+		By:        claims.Subject,
+	})
+	return student.Version, nil
+}
+
+// 修改学生的第index个成绩，其他客户端在此之前添加或修改了成绩时index可能已经指向别的成绩，应指定expected
+func (gs *GradesServer) updateGrade(ctx context.Context, claims *auth.Claims, id, index, expected int, g Grade) (int, error) {
+	if err := problemsError(g.Problems()); err != nil {
+		return 0, err
+	}
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	student, err := gs.students.GetByID(id)
+	if err != nil {
+		trace.Println(ctx, err)
+		return 0, fmt.Errorf("%w: %v", errNotFound, err)
+	}
+	if !claims.CanWriteGrades(student.Class) {
+		trace.Printf(ctx, "Method updateGrade of GradesServer: %s is not allowed to grade student %d\n", claims.Subject, id)
+		return 0, errForbidden
+	}
+	if err := checkVersion(student, expected); err != nil {
+		trace.Println(ctx, "Method updateGrade of GradesServer:", err)
+		return 0, err
+	}
+	if index < 0 || index >= len(student.Grades) {
+		return 0, fmt.Errorf("%w: student %d has no grade %d", errNotFound, id, index)
+	}
+	previous := student.Grades[index]
+	student.Grades[index] = g
+	student.Version++
+	gs.recordLocked(student)
+	gradeMutations.For(ctx).Inc("update_grade")
+	trace.Printf(ctx, "Method updateGrade of GradesServer: %s changed grade %d of student %d\n", claims.Subject, index, id)
+	gs.publishLocked(ctx, GradeUpdated, GradeEvent{
+		StudentID: id,
+		Class:     student.Class,
+		Index:     index,
+		Grade:     g,
+		Previous:  &previous,
+		Version:   student.Version,
+		By:        claims.Subject,
+	})
+	return student.Version, nil
+}
+
+// 删除学生的第index个成绩，之后的成绩前移，返回删除的成绩与修改后的版本
+func (gs *GradesServer) deleteGrade(ctx context.Context, claims *auth.Claims, id, index, expected int) (Grade, int, error) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	student, err := gs.students.GetByID(id)
+	if err != nil {
+		trace.Println(ctx, err)
+		return Grade{}, 0, fmt.Errorf("%w: %v", errNotFound, err)
+	}
+	if !claims.CanWriteGrades(student.Class) {
+		trace.Printf(ctx, "Method deleteGrade of GradesServer: %s is not allowed to grade student %d\n", claims.Subject, id)
+		return Grade{}, 0, errForbidden
+	}
+	if err := checkVersion(student, expected); err != nil {
+		trace.Println(ctx, "Method deleteGrade of GradesServer:", err)
+		return Grade{}, 0, err
+	}
+	if index < 0 || index >= len(student.Grades) {
+		return Grade{}, 0, fmt.Errorf("%w: student %d has no grade %d", errNotFound, id, index)
+	}
+	deleted := student.Grades[index]
+	student.Grades = append(student.Grades[:index], student.Grades[index+1:]...)
+	student.Version++
+	gs.recordLocked(student)
+	gradeMutations.For(ctx).Inc("delete_grade")
+	trace.Printf(ctx, "Method deleteGrade of GradesServer: %s deleted grade %d of student %d\n", claims.Subject, index, id)
+	gs.publishLocked(ctx, GradeDeleted, GradeEvent{
+		StudentID: id,
+		Class:     student.Class,
+		Index:     index,
+		Grade:     deleted,
+		Version:   student.Version,
+		By:        claims.Subject,
+	})
+	return deleted, student.Version, nil
+}
+
+// 添加学生，ID为0时分配一个未使用的ID，返回添加后的学生
+func (gs *GradesServer) createStudent(ctx context.Context, claims *auth.Claims, s Student) (Student, error) {
+	if err := problemsError(s.Problems()); err != nil {
+		return Student{}, err
+	}
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	if !claims.CanWriteGrades(s.Class) {
+		trace.Printf(ctx, "Method createStudent of GradesServer: %s is not allowed to add students to class %s\n", claims.Subject, s.Class)
+		return Student{}, errForbidden
+	}
+	if s.ID == 0 {
+		for _, existing := range gs.students {
+			if existing.ID > s.ID {
+				s.ID = existing.ID
+			}
+		}
+		s.ID++
+	} else if _, err := gs.students.GetByID(s.ID); err == nil {
+		return Student{}, fmt.Errorf("%w: ID %d", errConflict, s.ID)
+	}
+	if s.Grades == nil {
+		s.Grades = []Grade{}
+	}
+	s.Version = 1
+	gs.students = append(gs.students, s)
+	gs.recordLocked(&gs.students[len(gs.students)-1])
+	gradeMutations.For(ctx).Inc("create_student")
+	trace.Printf(ctx, "Method createStudent of GradesServer: %s added student %d to class %s\n", claims.Subject, s.ID, s.Class)
+	created := s
+	created.Grades = append([]Grade{}, s.Grades...)
+	gs.publishLocked(ctx, StudentCreated, StudentEvent{Student: created, By: claims.Subject})
+	return created, nil
+}
+
 func (ss Students) GetByID(id int) (*Student, error) {
 	for i := range ss {
 		if ss[i].ID == id {
@@ -48,8 +325,78 @@ const (
 	GradeExam = GradeType("Exam")
 )
 
+// GradeTypes 所有已定义的成绩类型，页面中的选项按此顺序显示
+var GradeTypes = []GradeType{GradeQuiz, GradeTest, GradeExam}
+
+// Valid 是否为已定义的成绩类型
+func (t GradeType) Valid() bool {
+	for _, gt := range GradeTypes {
+		if t == gt {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxScore 成绩的满分
+const MaxScore = 100
+
 type Grade struct {
 	Title string
 	Type  GradeType
 	Score float32
 }
+
+// Problems 检查成绩的各个字段，返回字段名到错误信息的映射，合法时返回nil
+func (g Grade) Problems() map[string]string {
+	problems := make(map[string]string)
+	if strings.TrimSpace(g.Title) == "" {
+		problems["Title"] = "Title is required"
+	}
+	if !g.Type.Valid() {
+		problems["Type"] = fmt.Sprintf("Type must be one of %v", GradeTypes)
+	}
+	//同时排除NaN
+	if !(g.Score >= 0 && g.Score <= MaxScore) {
+		problems["Score"] = fmt.Sprintf("Score must be between 0 and %d", MaxScore)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// Problems 检查添加学生时必填的字段，返回值与Grade.Problems相同
+func (s Student) Problems() map[string]string {
+	problems := make(map[string]string)
+	if strings.TrimSpace(s.FirstName) == "" {
+		problems["FirstName"] = "First name is required"
+	}
+	if strings.TrimSpace(s.LastName) == "" {
+		problems["LastName"] = "Last name is required"
+	}
+	if strings.TrimSpace(s.Class) == "" {
+		problems["Class"] = "Class is required"
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// 将Problems的结果转换为errInvalid，字段按名称排序，错误信息保持稳定
+func problemsError(problems map[string]string) error {
+	if problems == nil {
+		return nil
+	}
+	fields := make([]string, 0, len(problems))
+	for field := range problems {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	messages := make([]string, 0, len(fields))
+	for _, field := range fields {
+		messages = append(messages, problems[field])
+	}
+	return fmt.Errorf("%w: %s", errInvalid, strings.Join(messages, "; "))
+}
@@ -1,9 +1,11 @@
 package grades
 
-func init() {
-	students = []Student{
+// MockStudents 返回一份新的示例数据，各GradesServer使用的数据互不影响
+func MockStudents() Students {
+	return Students{
 		{
 			ID:        1,
+			Class:     "A",
 			FirstName: "Nick",
 			LastName:  "Carter",
 			Grades: []Grade{
@@ -26,6 +28,7 @@ func init() {
 		},
 		{
 			ID:        2,
+			Class:     "A",
 			FirstName: "Roberto",
 			LastName:  "Baggio",
 			Grades: []Grade{
@@ -48,6 +51,7 @@ func init() {
 		},
 		{
 			ID:        3,
+			Class:     "B",
 			FirstName: "Emma",
 			LastName:  "Stone",
 			Grades: []Grade{
@@ -70,6 +74,7 @@ func init() {
 		},
 		{
 			ID:        4,
+			Class:     "B",
 			FirstName: "Rachel",
 			LastName:  "McAdams",
 			Grades: []Grade{
@@ -92,6 +97,7 @@ func init() {
 		},
 		{
 			ID:        5,
+			Class:     "A",
 			FirstName: "Kelly",
 			LastName:  "Clarkson",
 			Grades: []Grade{
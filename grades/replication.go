@@ -0,0 +1,583 @@
+package grades
+
+// 多个成绩服务实例之间的复制：
+//
+// 每次修改后，被修改的学生的完整内容作为一条记录追加到复制日志，记录按seq依次编号。
+// follower长轮询leader的/replication/log获取新的记录并覆盖本地的学生，落后太多或leader变化时改为获取完整的快照。
+// 修改请求只由leader处理，follower收到后转发给leader，等到本地复制了这次修改再响应；查询由收到请求的实例直接处理。
+//
+// leader的选举不依赖共识算法：每个实例定期查询registry中同一服务的所有已注册实例(不论是否就绪)的状态，已经有实例声明为leader时
+// 跟随其中seq最大的一个，否则选出seq最大的实例，seq相同时选URL最小的。网络分区等情况下可能短暂出现两个leader，
+// 落选的leader上尚未复制的修改会丢失
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/metrics"
+	"distributedDemo/registry"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicationPath 实例之间复制数据的接口的路径前缀，只接受grade服务自身的token
+const ReplicationPath = "/replication/"
+
+const (
+	//leader在修改的响应中返回的复制日志位置
+	seqHeader = "Grades-Replication-Seq"
+	//follower转发的请求，收到的实例不是leader时不再转发，避免循环
+	forwardedHeader = "Grades-Forwarded-By"
+	//leader保留的记录数，落后更多的follower需要获取快照
+	journalCapacity = 1024
+	//两次选举之间的间隔，启动后也先等待一个间隔，以便registry推送其他实例
+	electionInterval = time.Second
+	//长轮询的最长等待时间，需要小于服务的超时时间
+	pollWait = 2 * time.Second
+	//转发修改后等待本地复制的最长时间
+	catchUpWait = 2 * time.Second
+)
+
+var (
+	replicationSeq = metrics.NewGaugeVec("grades_replication_seq",
+		"Position of the last change applied to this instance's gradebook.")
+	replicationLeader = metrics.NewGaugeVec("grades_replication_leader",
+		"1 if this instance currently accepts writes as the leader, 0 otherwise.")
+	replicationForwarded = metrics.NewCounterVec("grades_replication_forwarded_total",
+		"Write requests forwarded from a follower to the leader, by result.",
+		"result")
+	replicationSnapshots = metrics.NewCounterVec("grades_replication_snapshots_total",
+		"Full snapshots fetched from the leader.")
+)
+
+// 复制日志中的一条记录，即修改后学生的完整内容
+type replicationEntry struct {
+	Seq     int64
+	Student Student
+}
+
+// GET /replication/status
+type replicationStatus struct {
+	Leader bool
+	Seq    int64
+}
+
+// GET /replication/log?after={seq}
+type replicationLog struct {
+	Seq     int64
+	Entries []replicationEntry
+}
+
+// GET /replication/snapshot
+type replicationSnapshot struct {
+	Seq      int64
+	Students Students
+}
+
+func copyStudent(s Student) Student {
+	s.Grades = append([]Grade{}, s.Grades...)
+	return s
+}
+
+// 在修改所在的锁内调用，将修改后的学生追加到复制日志
+func (gs *GradesServer) recordLocked(s *Student) {
+	gs.appendLocked(replicationEntry{Seq: gs.seq + 1, Student: copyStudent(*s)})
+}
+
+func (gs *GradesServer) appendLocked(e replicationEntry) {
+	gs.seq = e.Seq
+	gs.journal = append(gs.journal, e)
+	if len(gs.journal) > journalCapacity {
+		gs.journal = append([]replicationEntry(nil), gs.journal[len(gs.journal)-journalCapacity:]...)
+	}
+	replicationSeq.In(gs.metrics).Set(float64(gs.seq))
+	//唤醒等待新记录的长轮询
+	close(gs.changed)
+	gs.changed = make(chan struct{})
+}
+
+// follower应用leader的记录，同样追加到本地的日志中
+func (gs *GradesServer) applyLocked(e replicationEntry) {
+	if student, err := gs.students.GetByID(e.Student.ID); err == nil {
+		*student = copyStudent(e.Student)
+	} else {
+		gs.students = append(gs.students, copyStudent(e.Student))
+	}
+	gs.appendLocked(e)
+}
+
+func (gs *GradesServer) snapshot() replicationSnapshot {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	students := make(Students, len(gs.students))
+	for i, s := range gs.students {
+		students[i] = copyStudent(s)
+	}
+	return replicationSnapshot{Seq: gs.seq, Students: students}
+}
+
+// 以快照替换本地的数据，之前的日志不再有效
+func (gs *GradesServer) restore(snap replicationSnapshot) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	gs.students = snap.Students
+	gs.seq = snap.Seq
+	gs.journal = nil
+	replicationSeq.In(gs.metrics).Set(float64(gs.seq))
+	close(gs.changed)
+	gs.changed = make(chan struct{})
+}
+
+func (gs *GradesServer) currentSeq() int64 {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	return gs.seq
+}
+
+// 返回after之后的记录；没有新记录时返回等待新记录的channel；
+// 日志中已经没有after之后的全部记录，或after来自其他leader的日志时ok为false，需要获取快照
+func (gs *GradesServer) entriesAfter(after int64) (l replicationLog, wait <-chan struct{}, ok bool) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	switch {
+	case after > gs.seq:
+		return replicationLog{}, nil, false
+	case after == gs.seq:
+		return replicationLog{Seq: gs.seq}, gs.changed, true
+	case len(gs.journal) == 0 || gs.journal[0].Seq > after+1:
+		return replicationLog{}, nil, false
+	}
+	l.Seq = gs.seq
+	for _, e := range gs.journal {
+		if e.Seq > after {
+			l.Entries = append(l.Entries, e)
+		}
+	}
+	return l, nil, true
+}
+
+// 等待本地的日志到达seq，超时或ctx取消时返回false
+func (gs *GradesServer) waitSeq(ctx context.Context, seq int64, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		gs.mutex.Lock()
+		current, changed := gs.seq, gs.changed
+		gs.mutex.Unlock()
+		if current >= seq {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Replicator 通过registry发现同一服务的其他实例，选出leader并在实例之间复制数据
+type Replicator struct {
+	gs   *GradesServer
+	self string
+	rc   *registry.Client
+	http *http.Client
+	//与GradesServer的指标相同
+	metrics *metrics.Registry
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mutex  sync.Mutex
+	leader string
+	//已经从当前的leader获取过快照，或自己就是leader
+	synced bool
+}
+
+// Replicate 默认实例通过rc发现其他实例并复制数据，见GradesServer.Replicate
+func Replicate(rc *registry.Client, self string) *Replicator {
+	return server.Replicate(rc, self)
+}
+
+// Replicate 与registry中GradeService的其他实例复制数据，self为本实例注册的ServiceURL
+// rc需在所依赖的服务中声明了GradeService；应在RegisterHandlers之前调用，否则不会注册复制的接口，修改也不会转发给leader
+func (gs *GradesServer) Replicate(rc *registry.Client, self string) *Replicator {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replicator{
+		gs:     gs,
+		self:   self,
+		rc:     rc,
+		http:   rc.HTTP,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	gs.mutex.Lock()
+	r.metrics = gs.metrics
+	gs.replicator = r
+	gs.mutex.Unlock()
+	go r.run(ctx)
+	return r
+}
+
+// Close 停止复制，不再参与选举
+func (r *Replicator) Close() {
+	r.cancel()
+	<-r.done
+}
+
+// Leader 当前的leader的URL，尚未完成选举时为空
+func (r *Replicator) Leader() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.leader
+}
+
+// InSync 健康检查：本实例是leader，或已经从leader获取了数据，否则查询会返回过时的数据
+func (r *Replicator) InSync(ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.synced {
+		if r.leader == "" {
+			return fmt.Errorf("no leader elected yet")
+		}
+		return fmt.Errorf("not yet synchronized with leader %s", r.leader)
+	}
+	return nil
+}
+
+func (r *Replicator) run(ctx context.Context) {
+	defer close(r.done)
+	//本地的数据来自这个leader的日志
+	following := ""
+	sleep(ctx, electionInterval)
+	for ctx.Err() == nil {
+		leader := r.elect(ctx)
+		if leader == r.self {
+			following = ""
+			sleep(ctx, electionInterval)
+			continue
+		}
+		if following != leader {
+			if err := r.fetchSnapshot(ctx, leader); err != nil {
+				log.Println("Method run of Replicator:", err)
+				sleep(ctx, electionInterval)
+				continue
+			}
+			following = leader
+			r.mutex.Lock()
+			r.synced = r.leader == leader
+			r.mutex.Unlock()
+		}
+		ok, err := r.pull(ctx, leader)
+		if !ok {
+			following = ""
+		}
+		if err != nil {
+			log.Println("Method run of Replicator:", err)
+			sleep(ctx, electionInterval)
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// 查询所有实例的状态并选出leader
+func (r *Replicator) elect(ctx context.Context) string {
+	type candidate struct {
+		url string
+		replicationStatus
+	}
+	r.mutex.Lock()
+	self := candidate{url: r.self, replicationStatus: replicationStatus{Leader: r.leader == r.self}}
+	r.mutex.Unlock()
+	self.Seq = r.gs.currentSeq()
+
+	candidates := []candidate{self}
+	for _, peer := range r.peers(ctx) {
+		if peer == r.self {
+			continue
+		}
+		var st replicationStatus
+		if err := r.get(ctx, peer, "status", &st); err != nil {
+			//无法连接的实例不参与选举，registry稍后会将其移除
+			continue
+		}
+		candidates = append(candidates, candidate{url: peer, replicationStatus: st})
+	}
+	var claimed []candidate
+	for _, c := range candidates {
+		if c.Leader {
+			claimed = append(claimed, c)
+		}
+	}
+	if len(claimed) > 0 {
+		candidates = claimed
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.Seq > best.Seq || (c.Seq == best.Seq && c.url < best.url) {
+			best = c
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if best.url != r.leader {
+		log.Printf("Method elect of Replicator:%s elected %s as leader (seq %d)\n", r.self, best.url, best.Seq)
+		r.leader = best.url
+		//跟随新的leader前需要重新获取快照
+		r.synced = best.url == r.self
+	}
+	if r.synced && best.url == r.self {
+		replicationLeader.In(r.metrics).Set(1)
+	} else {
+		replicationLeader.In(r.metrics).Set(0)
+	}
+	return best.url
+}
+
+// 参与选举的实例：registry中所有已注册的实例，不论是否就绪，以及registry推送的其他可用区的实例
+// 就绪检查包括replica in sync，只看推送的实例时，同时启动的实例彼此不可见，会各自选出自己
+func (r *Replicator) peers(ctx context.Context) []string {
+	urls, err := r.rc.Peers(ctx, registry.GradeService)
+	if err != nil {
+		log.Println("Method peers of Replicator:", err)
+	}
+	for _, url := range r.rc.Providers.All(registry.GradeService) {
+		if !contains(urls, url) {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Replicator) fetchSnapshot(ctx context.Context, leader string) error {
+	var snap replicationSnapshot
+	if err := r.get(ctx, leader, "snapshot", &snap); err != nil {
+		return err
+	}
+	r.gs.restore(snap)
+	replicationSnapshots.In(r.metrics).Inc()
+	log.Printf("Method fetchSnapshot of Replicator:%s restored %d students at seq %d from %s\n", r.self, len(snap.Students), snap.Seq, leader)
+	return nil
+}
+
+// 长轮询leader的新记录并应用，leader的日志无法衔接本地的日志时ok为false
+func (r *Replicator) pull(ctx context.Context, leader string) (ok bool, err error) {
+	var l replicationLog
+	err = r.get(ctx, leader, fmt.Sprintf("log?after=%d", r.gs.currentSeq()), &l)
+	if err == errGone {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	r.gs.mutex.Lock()
+	defer r.gs.mutex.Unlock()
+	for _, e := range l.Entries {
+		//另一个pull可能已经应用了这些记录
+		if e.Seq != r.gs.seq+1 {
+			if e.Seq <= r.gs.seq {
+				continue
+			}
+			return false, fmt.Errorf("gap in replication log from %s: have %d, received %d", leader, r.gs.seq, e.Seq)
+		}
+		r.gs.applyLocked(e)
+	}
+	return true, nil
+}
+
+var errGone = errors.New("replication log no longer available")
+
+func (r *Replicator) get(ctx context.Context, peer, path string, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, pollWait+time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(peer, "/")+ReplicationPath+path, nil)
+	if err != nil {
+		return err
+	}
+	auth.SetToken(req, auth.ServiceToken(string(registry.GradeService)))
+	res, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusGone {
+		return errGone
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s%s%s responded with code %d", peer, ReplicationPath, path, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// 复制的接口
+//
+//	GET /replication/status
+//	GET /replication/log?after={seq}  没有新记录时最多等待pollWait，日志无法衔接时以410响应
+//	GET /replication/snapshot
+func (r *Replicator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	claims, _ := auth.FromContext(req.Context())
+	if claims.Service != string(registry.GradeService) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	switch strings.TrimPrefix(req.URL.Path, ReplicationPath) {
+	case "status":
+		r.mutex.Lock()
+		st := replicationStatus{Leader: r.leader == r.self}
+		r.mutex.Unlock()
+		st.Seq = r.gs.currentSeq()
+		writeReplicationJSON(w, st)
+	case "log":
+		after, err := strconv.ParseInt(req.URL.Query().Get("after"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		l, wait, ok := r.gs.entriesAfter(after)
+		if wait != nil {
+			select {
+			case <-wait:
+				l, _, ok = r.gs.entriesAfter(after)
+			case <-time.After(pollWait):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		if !ok {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		writeReplicationJSON(w, l)
+	case "snapshot":
+		writeReplicationJSON(w, r.gs.snapshot())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeReplicationJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// 包含修改的接口：有多个实例时修改由leader处理，并按Idempotency-Key去重
+// 去重在leader上进行，通过不同的follower重试的请求也只会执行一次
+func (gs *GradesServer) mutating(r *Replicator, next http.Handler) http.Handler {
+	return gs.leaderOnly(r, gs.idempotency.Middleware(next))
+}
+
+// 修改请求只由leader处理，其他实例转发给leader；replicator为nil时直接处理
+func (gs *GradesServer) leaderOnly(r *Replicator, next http.Handler) http.Handler {
+	if r == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			next.ServeHTTP(w, req)
+			return
+		}
+		leader := r.Leader()
+		switch {
+		case leader == r.self:
+			next.ServeHTTP(&seqWriter{ResponseWriter: w, gs: gs}, req)
+		case leader == "" || req.Header.Get(forwardedHeader) != "":
+			//尚未选出leader，或发出转发的实例与本实例对leader的判断不一致
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			r.forward(w, req, leader)
+		}
+	})
+}
+
+// leader在修改的响应头中写入当前的复制日志位置
+type seqWriter struct {
+	http.ResponseWriter
+	gs          *GradesServer
+	wroteHeader bool
+}
+
+func (sw *seqWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		sw.Header().Set(seqHeader, strconv.FormatInt(sw.gs.currentSeq(), 10))
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *seqWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// 将修改请求转发给leader，并等待本地复制到这次修改，随后在本实例上的查询可以看到修改
+func (r *Replicator) forward(w http.ResponseWriter, req *http.Request, leader string) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	out, err := http.NewRequestWithContext(req.Context(), req.Method,
+		strings.TrimSuffix(leader, "/")+req.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	out.Header = req.Header.Clone()
+	out.Header.Set(forwardedHeader, r.self)
+	res, err := r.http.Do(out)
+	if err != nil {
+		log.Printf("Method forward of Replicator:forwarding %s %s to %s failed: %v\n", req.Method, req.URL.Path, leader, err)
+		replicationForwarded.In(r.metrics).Inc("error")
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	replicationForwarded.In(r.metrics).Inc("ok")
+	if seq, err := strconv.ParseInt(res.Header.Get(seqHeader), 10, 64); err == nil {
+		if !r.gs.waitSeq(req.Context(), seq, catchUpWait) {
+			log.Printf("Method forward of Replicator:%s has not replicated seq %d yet\n", r.self, seq)
+		}
+	}
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
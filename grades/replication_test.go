@@ -0,0 +1,374 @@
+package grades
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/health"
+	"distributedDemo/registry"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var admin = &auth.Claims{Subject: "admin", Role: auth.RoleAdmin}
+
+// 测试中的一个grade服务实例，与cmd/gradeService一样以replica in sync作为就绪检查，
+// 未就绪时registry不会把它推送给其他实例
+type replica struct {
+	url  string
+	gs   *GradesServer
+	r    *Replicator
+	rc   *registry.Client
+	srv  *httptest.Server
+	once sync.Once
+}
+
+// 启动每100ms进行一次心跳检测的registry，返回其地址
+func startTestRegistry(t *testing.T) string {
+	t.Helper()
+	reg := registry.NewRegistry("test")
+	reg.HTTP = &http.Client{}
+	reg.SetupHeartbeat(registry.ProbeConfig{
+		Interval:         100 * time.Millisecond,
+		Timeout:          time.Second,
+		Concurrency:      8,
+		FailureThreshold: 3,
+		SuccessThreshold: 1,
+	})
+	mux := http.NewServeMux()
+	reg.RegisterHandlers(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		reg.Close()
+	})
+	return srv.URL
+}
+
+func startReplica(t *testing.T, registryURL string, students Students) *replica {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	rp := &replica{url: srv.URL, gs: NewGradesServer(students), rc: registry.NewClient(registryURL), srv: srv}
+	rp.rc.HTTP = &http.Client{}
+	rp.r = rp.gs.Replicate(rp.rc, rp.url)
+	rp.gs.RegisterHandlers(mux)
+	t.Cleanup(rp.stop)
+	checks := health.NewChecks()
+	checks.Register(health.Check{Name: "replica in sync", Kind: health.Readiness, Func: rp.r.InSync})
+	reg := registry.Registration{
+		ServiceName:      registry.GradeService,
+		ServiceURL:       rp.url,
+		RequiredServices: []registry.ServiceName{registry.GradeService},
+		ServiceUpdateURL: rp.url + "/services",
+		HeartbeatURL:     rp.url + "/heartbeat",
+	}
+	if err := rp.rc.RegisterHandlers(mux, reg, checks); err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.rc.RegisterService(reg); err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+// 停止复制并取消注册，可以重复调用
+func (rp *replica) stop() {
+	rp.once.Do(func() {
+		_ = rp.rc.ShutdownService(registry.GradeService, rp.url)
+		rp.r.Close()
+		rp.srv.Close()
+	})
+}
+
+// 同时启动n个实例，它们在第一次选举时都还没有就绪
+func startReplicas(t *testing.T, n int, students func() Students) []*replica {
+	t.Helper()
+	registryURL := startTestRegistry(t)
+	replicas := make([]*replica, n)
+	for i := range replicas {
+		replicas[i] = startReplica(t, registryURL, students())
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].url < replicas[j].url })
+	return replicas
+}
+
+// 等待所有实例跟随同一个leader并完成同步，返回leader
+func waitForLeader(t *testing.T, replicas []*replica) *replica {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		leader := replicas[0].r.Leader()
+		agreed := leader != ""
+		for _, rp := range replicas {
+			if rp.r.Leader() != leader || rp.r.InSync(context.Background()) != nil {
+				agreed = false
+			}
+		}
+		if agreed {
+			for _, rp := range replicas {
+				if rp.url == leader {
+					return rp
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			var state []string
+			for _, rp := range replicas {
+				state = append(state, fmt.Sprintf("%s follows %q (%v)", rp.url, rp.r.Leader(), rp.r.InSync(context.Background())))
+			}
+			t.Fatalf("replicas did not agree on a leader: %v", state)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func adminRequest(t *testing.T, method, url string, body interface{}) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.IssueToken(*admin, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.SetToken(req, token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func gradesOf(t *testing.T, gs *GradesServer, id int) []string {
+	t.Helper()
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	student, err := gs.students.GetByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, g := range student.Grades {
+		titles = append(titles, g.Title)
+	}
+	return titles
+}
+
+// 同时启动的实例在选出leader之前都未就绪，彼此不在registry推送的列表中，选举仍需看到所有已注册的实例，只选出一个leader
+func TestFreshReplicasElectSingleLeader(t *testing.T) {
+	replicas := startReplicas(t, 3, func() Students { return Students{} })
+	//在所有实例达成一致之前，任何时刻都最多只有一个实例认为自己是leader
+	deadline := time.Now().Add(10 * time.Second)
+	for agreed := false; !agreed; {
+		var leaders []string
+		agreed = true
+		for _, rp := range replicas {
+			if rp.r.Leader() == rp.url {
+				leaders = append(leaders, rp.url)
+			}
+			if rp.r.Leader() != replicas[0].r.Leader() || rp.r.InSync(context.Background()) != nil {
+				agreed = false
+			}
+		}
+		if len(leaders) > 1 {
+			t.Fatalf("split brain: %v all act as leader", leaders)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replicas did not agree on a leader")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	leader := waitForLeader(t, replicas)
+	//seq都为0时选择URL最小的实例
+	if leader != replicas[0] {
+		t.Fatalf("leader is %s, want the smallest URL %s", leader.url, replicas[0].url)
+	}
+	for _, rp := range replicas[1:] {
+		res := adminRequest(t, http.MethodGet, rp.url+"/students", nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET /students on follower %s: status %d", rp.url, res.StatusCode)
+		}
+	}
+}
+
+// follower将修改转发给leader，等到本地复制了这次修改再响应，随后在follower上的查询可以看到修改
+func TestFollowerForwardsWritesAndWaitsForReplication(t *testing.T) {
+	replicas := startReplicas(t, 2, MockStudents)
+	leader := waitForLeader(t, replicas)
+	follower := replicas[0]
+	if follower == leader {
+		follower = replicas[1]
+	}
+
+	for i := 0; i < 5; i++ {
+		title := "Quiz " + strconv.Itoa(i+10)
+		res := adminRequest(t, http.MethodPost, follower.url+"/students/1/grades",
+			Grade{Title: title, Type: GradeQuiz, Score: 90})
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("POST through follower: status %d, want 201", res.StatusCode)
+		}
+		if seq, _ := strconv.ParseInt(res.Header.Get(seqHeader), 10, 64); seq != leader.gs.currentSeq() {
+			t.Fatalf("response seq %q, want the leader's seq %d", res.Header.Get(seqHeader), leader.gs.currentSeq())
+		}
+		titles := gradesOf(t, follower.gs, 1)
+		if titles[len(titles)-1] != title {
+			t.Fatalf("follower has grades %q right after the write, want %q last", titles, title)
+		}
+	}
+	if !reflect.DeepEqual(gradesOf(t, follower.gs, 1), gradesOf(t, leader.gs, 1)) {
+		t.Fatal("follower and leader have different grades")
+	}
+
+	//发出转发的实例与收到的实例对leader的判断不一致时不再转发
+	req := httptest.NewRequest(http.MethodPost, "/students/1/grades", nil)
+	req.Header.Set(forwardedHeader, leader.url)
+	rec := httptest.NewRecorder()
+	follower.gs.leaderOnly(follower.r, http.NotFoundHandler()).ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("forwarded request reaching a follower: status %d, want 503", rec.Code)
+	}
+}
+
+func TestWaitSeq(t *testing.T) {
+	gs := NewGradesServer(MockStudents())
+	if !gs.waitSeq(context.Background(), 0, time.Millisecond) {
+		t.Fatal("waitSeq for the current seq returned false")
+	}
+	if gs.waitSeq(context.Background(), 1, 50*time.Millisecond) {
+		t.Fatal("waitSeq returned true before the change was applied")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if gs.waitSeq(ctx, 1, time.Minute) {
+		t.Fatal("waitSeq returned true after ctx was canceled")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(20 * time.Millisecond)
+		for i := 0; i < 2; i++ {
+			if _, err := gs.addGrade(context.Background(), admin, 1, 0, Grade{Title: "Quiz", Type: GradeQuiz, Score: 1}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	if !gs.waitSeq(context.Background(), 2, 5*time.Second) {
+		t.Fatal("waitSeq did not see the applied changes")
+	}
+	wg.Wait()
+}
+
+// leader的日志只保留journalCapacity条记录，落后更多的follower收到410，改为获取快照
+func TestJournalTruncationFallsBackToSnapshot(t *testing.T) {
+	replicas := startReplicas(t, 2, MockStudents)
+	leader := waitForLeader(t, replicas)
+	follower := replicas[0]
+	if follower == leader {
+		follower = replicas[1]
+	}
+	//follower停止复制，之后的修改只在leader上
+	follower.r.Close()
+	behind := follower.gs.currentSeq()
+	for i := 0; i < journalCapacity+10; i++ {
+		if _, err := leader.gs.addGrade(context.Background(), admin, 1, 0, Grade{Title: strconv.Itoa(i), Type: GradeQuiz, Score: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok := leader.gs.entriesAfter(behind); ok {
+		t.Fatalf("entriesAfter(%d) ok after the journal was truncated", behind)
+	}
+	//日志中仍然保留的记录可以衔接
+	if l, _, ok := leader.gs.entriesAfter(leader.gs.currentSeq() - journalCapacity); !ok || len(l.Entries) != journalCapacity {
+		t.Fatalf("entriesAfter the oldest kept entry = %d entries, %v, want %d entries", len(l.Entries), ok, journalCapacity)
+	}
+	//来自其他leader的日志，位置超过了当前的日志
+	if _, _, ok := leader.gs.entriesAfter(leader.gs.currentSeq() + 1); ok {
+		t.Fatal("entriesAfter a seq beyond the leader's log ok")
+	}
+
+	ok, err := follower.r.pull(context.Background(), leader.url)
+	if ok || err != nil {
+		t.Fatalf("pull after the journal was truncated = %v, %v, want false and no error", ok, err)
+	}
+	if follower.gs.currentSeq() != behind {
+		t.Fatalf("follower applied entries from a log it cannot follow: seq %d, want %d", follower.gs.currentSeq(), behind)
+	}
+	if err := follower.r.fetchSnapshot(context.Background(), leader.url); err != nil {
+		t.Fatal(err)
+	}
+	if follower.gs.currentSeq() != leader.gs.currentSeq() ||
+		!reflect.DeepEqual(gradesOf(t, follower.gs, 1), gradesOf(t, leader.gs, 1)) {
+		t.Fatalf("follower at seq %d after the snapshot, want the leader's state at seq %d",
+			follower.gs.currentSeq(), leader.gs.currentSeq())
+	}
+	//快照之后的修改可以继续通过日志复制
+	if _, err := leader.gs.addGrade(context.Background(), admin, 1, 0, Grade{Title: "after", Type: GradeQuiz, Score: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := follower.r.pull(context.Background(), leader.url); !ok || err != nil {
+		t.Fatalf("pull after the snapshot = %v, %v", ok, err)
+	}
+	if follower.gs.currentSeq() != leader.gs.currentSeq() {
+		t.Fatalf("follower at seq %d, want %d", follower.gs.currentSeq(), leader.gs.currentSeq())
+	}
+}
+
+// leader下线后，剩余的实例选出新的leader，已经复制的修改保留，之后的修改由新的leader处理
+func TestLeaderChange(t *testing.T) {
+	replicas := startReplicas(t, 3, MockStudents)
+	leader := waitForLeader(t, replicas)
+	res := adminRequest(t, http.MethodPost, leader.url+"/students/1/grades", Grade{Title: "before", Type: GradeQuiz, Score: 80})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST to the leader: status %d", res.StatusCode)
+	}
+	seq := leader.gs.currentSeq()
+
+	leader.stop()
+	var rest []*replica
+	for _, rp := range replicas {
+		if rp != leader {
+			rest = append(rest, rp)
+		}
+	}
+	next := waitForLeader(t, rest)
+	if next == leader {
+		t.Fatal("the stopped instance is still the leader")
+	}
+	for _, rp := range rest {
+		if rp.gs.currentSeq() < seq {
+			t.Fatalf("%s at seq %d after the leader change, lost changes up to %d", rp.url, rp.gs.currentSeq(), seq)
+		}
+	}
+
+	follower := rest[0]
+	if follower == next {
+		follower = rest[1]
+	}
+	res = adminRequest(t, http.MethodPost, follower.url+"/students/1/grades", Grade{Title: "after", Type: GradeQuiz, Score: 90})
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST through follower after the leader change: status %d", res.StatusCode)
+	}
+	want := gradesOf(t, next.gs, 1)
+	if got := gradesOf(t, follower.gs, 1); !reflect.DeepEqual(got, want) || got[len(got)-1] != "after" {
+		t.Fatalf("follower has %q, new leader has %q", got, want)
+	}
+}
@@ -0,0 +1,122 @@
+package grades
+
+import (
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/rpc"
+	"errors"
+	"net/http"
+)
+
+// ServicePath 成绩服务RPC的路径前缀，过程名称附加在其后
+const ServicePath = "/distributed.grades.v1.GradesService/"
+
+type ListStudentsRequest struct{}
+
+type ListStudentsResponse struct {
+	Students Students
+}
+
+type GetStudentRequest struct {
+	ID int
+}
+
+type AddGradeRequest struct {
+	StudentID int
+	Grade     Grade
+	//与HTTP接口的If-Match相同，不为0且不是学生当前的版本时返回failed_precondition
+	Version int
+}
+
+type UpdateGradeRequest struct {
+	StudentID int
+	//成绩在Student.Grades中的位置
+	Index   int
+	Grade   Grade
+	Version int
+}
+
+type DeleteGradeRequest struct {
+	StudentID int
+	Index     int
+	Version   int
+}
+
+type CreateStudentRequest struct {
+	Student Student
+}
+
+// 与/students等HTTP接口相同，所有过程都需要携带token，修改的过程由leader处理
+func (gs *GradesServer) registerRPC(mux *http.ServeMux, replicator *Replicator) {
+	mux.Handle(ServicePath+"ListStudents", auth.Require(rpc.Unary(gs.listStudentsRPC)))
+	mux.Handle(ServicePath+"GetStudent", auth.Require(rpc.Unary(gs.getStudentRPC)))
+	mux.Handle(ServicePath+"AddGrade", gs.mutating(replicator, auth.Require(rpc.Unary(gs.addGradeRPC))))
+	mux.Handle(ServicePath+"UpdateGrade", gs.mutating(replicator, auth.Require(rpc.Unary(gs.updateGradeRPC))))
+	mux.Handle(ServicePath+"DeleteGrade", gs.mutating(replicator, auth.Require(rpc.Unary(gs.deleteGradeRPC))))
+	mux.Handle(ServicePath+"CreateStudent", gs.mutating(replicator, auth.Require(rpc.Unary(gs.createStudentRPC))))
+}
+
+func (gs *GradesServer) listStudentsRPC(ctx context.Context, _ *ListStudentsRequest) (*ListStudentsResponse, error) {
+	claims, _ := auth.FromContext(ctx)
+	return &ListStudentsResponse{Students: gs.list(claims)}, nil
+}
+
+func (gs *GradesServer) getStudentRPC(ctx context.Context, req *GetStudentRequest) (*Student, error) {
+	claims, _ := auth.FromContext(ctx)
+	s, err := gs.get(ctx, claims, req.ID)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &s, nil
+}
+
+func (gs *GradesServer) addGradeRPC(ctx context.Context, req *AddGradeRequest) (*Grade, error) {
+	claims, _ := auth.FromContext(ctx)
+	if _, err := gs.addGrade(ctx, claims, req.StudentID, req.Version, req.Grade); err != nil {
+		return nil, rpcError(err)
+	}
+	return &req.Grade, nil
+}
+
+func (gs *GradesServer) updateGradeRPC(ctx context.Context, req *UpdateGradeRequest) (*Grade, error) {
+	claims, _ := auth.FromContext(ctx)
+	if _, err := gs.updateGrade(ctx, claims, req.StudentID, req.Index, req.Version, req.Grade); err != nil {
+		return nil, rpcError(err)
+	}
+	return &req.Grade, nil
+}
+
+// 返回删除的成绩
+func (gs *GradesServer) deleteGradeRPC(ctx context.Context, req *DeleteGradeRequest) (*Grade, error) {
+	claims, _ := auth.FromContext(ctx)
+	g, _, err := gs.deleteGrade(ctx, claims, req.StudentID, req.Index, req.Version)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &g, nil
+}
+
+func (gs *GradesServer) createStudentRPC(ctx context.Context, req *CreateStudentRequest) (*Student, error) {
+	claims, _ := auth.FromContext(ctx)
+	s, err := gs.createStudent(ctx, claims, req.Student)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &s, nil
+}
+
+func rpcError(err error) error {
+	switch {
+	case errors.Is(err, errNotFound):
+		return rpc.Errorf(rpc.CodeNotFound, "%v", err)
+	case errors.Is(err, errForbidden):
+		return rpc.Errorf(rpc.CodePermissionDenied, "%v", err)
+	case errors.Is(err, errInvalid):
+		return rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+	case errors.Is(err, errConflict):
+		return rpc.Errorf(rpc.CodeAlreadyExists, "%v", err)
+	case errors.Is(err, errVersionMismatch):
+		return rpc.Errorf(rpc.CodeFailedPrecondition, "%v", err)
+	}
+	return err
+}
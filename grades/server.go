@@ -2,114 +2,297 @@ package grades
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"distributedDemo/auth"
+	"distributedDemo/metrics"
+	"distributedDemo/trace"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
-func RegisterHandlers() {
-	handler := new(studentsHandler)
+var gradeMutations = metrics.NewCounterVec("grades_mutations_total",
+	"Mutations applied to the gradebook, by operation.",
+	"operation")
+
+// RegisterHandlers 在mux上注册默认实例的接口
+func RegisterHandlers(mux *http.ServeMux) {
+	server.RegisterHandlers(mux)
+}
+
+// RegisterHandlers 注册路由
+func (gs *GradesServer) RegisterHandlers(mux *http.ServeMux) {
+	gs.mutex.Lock()
+	replicator := gs.replicator
+	gs.mutex.Unlock()
+	//所有请求都需要携带token
+	handler := gs.mutating(replicator, auth.Require(&studentsHandler{gs: gs}))
 	//对应集合类资源（如查询所有学生的成绩）
-	http.Handle("/students", handler)
+	mux.Handle("/students", handler)
 	//查询具体的某个学生
-	http.Handle("/students/", handler)
+	mux.Handle("/students/", handler)
+	//同样的功能也以RPC的形式提供
+	gs.registerRPC(mux, replicator)
+	if replicator != nil {
+		mux.Handle(ReplicationPath, auth.Require(replicator, auth.RoleService))
+	}
+	//事件的待投递队列与死信
+	if gs.events != nil {
+		mux.Handle("/events/", auth.Require(gs.events.AdminHandler(), auth.RoleAdmin))
+	}
 }
 
-//让这个空类型实现serveHTTP的方法
-type studentsHandler struct{}
+//让这个类型实现serveHTTP的方法
+type studentsHandler struct {
+	gs *GradesServer
+}
 
 // /students
 // /students/{id}
 // /students/{id}/grades
+// /students/{id}/grades/{index}
 //todo 通常提取id等参数需要使用正则表达式或第三方库来做校验，此处简单化处理
 func (sh studentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	pathSegments := strings.Split(r.URL.Path, "/")
 	switch len(pathSegments) {
 	case 2:
-		sh.getAll(w, r)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			sh.getAll(w, r)
+		case http.MethodPost:
+			sh.createStudent(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
 	case 3:
 		id, err := strconv.Atoi(pathSegments[2])
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		sh.getOne(w, r, id)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			sh.getOne(w, r, id)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
 	case 4:
 		id, err := strconv.Atoi(pathSegments[2])
+		if err != nil || pathSegments[3] != "grades" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			sh.addGrade(w, r, id)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case 5:
+		id, err := strconv.Atoi(pathSegments[2])
+		if err != nil || pathSegments[3] != "grades" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		index, err := strconv.Atoi(pathSegments[4])
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		sh.addGrade(w, r, id)
+		switch r.Method {
+		case http.MethodPut:
+			sh.updateGrade(w, r, id, index)
+		case http.MethodDelete:
+			sh.deleteGrade(w, r, id, index)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
 	default:
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
 func (sh studentsHandler) getAll(w http.ResponseWriter, r *http.Request) {
-	studentsMutex.Lock()
-	defer studentsMutex.Unlock()
-
-	data, err := sh.toJSON(students)
+	claims, _ := auth.FromContext(r.Context())
+	data, err := sh.toJSON(sh.gs.list(claims))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Method getAll: ", err)
+		trace.Println(r.Context(), "Method getAll: ", err)
 		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	_, _ = w.Write(data)
+	sum := sha256.Sum256(data)
+	//列表的内容因用户而异，以响应体的摘要作为ETag；经过Gzip中间件后响应体的字节会变化，因此使用弱ETag
+	writeCacheable(w, r, `W/"`+hex.EncodeToString(sum[:16])+`"`, data)
 }
 func (sh studentsHandler) getOne(w http.ResponseWriter, r *http.Request, id int) {
-	studentsMutex.Lock()
-	defer studentsMutex.Unlock()
-
-	student, err := students.GetByID(id)
+	claims, _ := auth.FromContext(r.Context())
+	student, err := sh.gs.get(r.Context(), claims, id)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		log.Println(err)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
 
 	data, err := sh.toJSON(student)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("Failed to serialize student: ", err)
+		trace.Println(r.Context(), "Failed to serialize student: ", err)
+		return
+	}
+	//学生的ETag即版本，可以在修改时通过If-Match使用
+	writeCacheable(w, r, student.ETag(), data)
+}
+
+// 以etag写出查询结果，If-None-Match匹配时以304响应
+// 同一资源对不同用户可见的内容不同，因此只允许客户端私有缓存，且每次使用前需要重新确认
+func writeCacheable(w http.ResponseWriter, r *http.Request, etag string, data []byte) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(data)
 }
 
-func (sh studentsHandler) addGrade(w http.ResponseWriter, r *http.Request, id int) {
-	studentsMutex.Lock()
-	defer studentsMutex.Unlock()
+// header中的ETag列表是否包含etag，按弱比较的规则忽略W/前缀
+func etagMatch(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
 
-	student, err := students.GetByID(id)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		log.Println(err)
-		return
+// If-Match中的版本，没有If-Match或为*时返回0，即不检查版本
+// 只支持一个ETag，无法解析时返回-1，与任何版本都不匹配
+func expectedVersion(r *http.Request) int {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		return 0
 	}
+	v, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(h, "W/"), `"`))
+	if err != nil || v <= 0 {
+		return -1
+	}
+	return v
+}
+
+func (sh studentsHandler) addGrade(w http.ResponseWriter, r *http.Request, id int) {
 	var g Grade
 	dec := json.NewDecoder(r.Body)
-	err = dec.Decode(&g)
+	err := dec.Decode(&g)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		log.Println(err)
+		trace.Println(r.Context(), err)
+		return
+	}
+	claims, _ := auth.FromContext(r.Context())
+	version, err := sh.gs.addGrade(r.Context(), claims, id, expectedVersion(r), g)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
 		return
 	}
-	student.Grades = append(student.Grades, g)
+	w.Header().Set("ETag", Student{Version: version}.ETag())
+	data, err := sh.toJSON(g)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		trace.Println(r.Context(), err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(data)
+}
+
+func (sh studentsHandler) updateGrade(w http.ResponseWriter, r *http.Request, id, index int) {
+	var g Grade
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		trace.Println(r.Context(), err)
+		return
+	}
+	claims, _ := auth.FromContext(r.Context())
+	version, err := sh.gs.updateGrade(r.Context(), claims, id, index, expectedVersion(r), g)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	w.Header().Set("ETag", Student{Version: version}.ETag())
 	data, err := sh.toJSON(g)
 	if err != nil {
-		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		trace.Println(r.Context(), err)
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
 	_, _ = w.Write(data)
 }
+
+// 删除成功时以204响应，ETag为删除后学生的版本
+func (sh studentsHandler) deleteGrade(w http.ResponseWriter, r *http.Request, id, index int) {
+	claims, _ := auth.FromContext(r.Context())
+	_, version, err := sh.gs.deleteGrade(r.Context(), claims, id, index, expectedVersion(r))
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	w.Header().Set("ETag", Student{Version: version}.ETag())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (sh studentsHandler) createStudent(w http.ResponseWriter, r *http.Request) {
+	var s Student
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		trace.Println(r.Context(), err)
+		return
+	}
+	claims, _ := auth.FromContext(r.Context())
+	created, err := sh.gs.createStudent(r.Context(), claims, s)
+	if err != nil {
+		trace.Println(r.Context(), err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	data, err := sh.toJSON(created)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		trace.Println(r.Context(), err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/students/%d", created.ID))
+	w.Header().Set("ETag", created.ETag())
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(data)
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errConflict):
+		return http.StatusConflict
+	case errors.Is(err, errVersionMismatch):
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
 func (sh studentsHandler) toJSON(obj interface{}) ([]byte, error) {
 	var b bytes.Buffer
 	enc := json.NewEncoder(&b)
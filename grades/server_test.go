@@ -0,0 +1,208 @@
+package grades
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/rpc"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 不复制数据的单个实例，使用示例数据
+func startGradesServer(t *testing.T) (*GradesServer, string) {
+	t.Helper()
+	gs := NewGradesServer(MockStudents())
+	mux := http.NewServeMux()
+	gs.RegisterHandlers(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return gs, srv.URL
+}
+
+// 以admin身份发送请求，header中的值（如If-Match）原样设置
+func conditionalRequest(t *testing.T, method, url string, body interface{}, header map[string]string) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.IssueToken(*admin, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.SetToken(req, token)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func TestGetStudentETag(t *testing.T) {
+	_, url := startGradesServer(t)
+	res := conditionalRequest(t, http.MethodGet, url+"/students/1", nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET = %d", res.StatusCode)
+	}
+	if etag := res.Header.Get("ETag"); etag != `"1"` {
+		t.Fatalf("ETag = %q, want the initial version", etag)
+	}
+	for _, inm := range []string{`"1"`, `W/"1"`, `"7", "1"`, "*"} {
+		res = conditionalRequest(t, http.MethodGet, url+"/students/1", nil, map[string]string{"If-None-Match": inm})
+		if res.StatusCode != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: status %d, want 304", inm, res.StatusCode)
+		}
+	}
+	res = conditionalRequest(t, http.MethodGet, url+"/students/1", nil, map[string]string{"If-None-Match": `"2"`})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("stale If-None-Match: status %d, want 200", res.StatusCode)
+	}
+}
+
+// 以过期的If-Match修改时返回412且不修改数据，使用当前的ETag时成功并返回新的ETag
+func TestStaleWriteIsRejected(t *testing.T) {
+	gs, url := startGradesServer(t)
+	quiz := Grade{Title: "Quiz 3", Type: GradeQuiz, Score: 90}
+	before := gradesOf(t, gs, 1)
+
+	res := conditionalRequest(t, http.MethodPost, url+"/students/1/grades", quiz, map[string]string{"If-Match": `"1"`})
+	if res.StatusCode != http.StatusCreated || res.Header.Get("ETag") != `"2"` {
+		t.Fatalf("POST with the current version: status %d, ETag %q", res.StatusCode, res.Header.Get("ETag"))
+	}
+	after := gradesOf(t, gs, 1)
+
+	//其他客户端已经修改过，仍携带版本1的请求都被拒绝
+	stale := map[string]string{"If-Match": `"1"`}
+	for _, tt := range []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{http.MethodPost, "/students/1/grades", quiz},
+		{http.MethodPut, "/students/1/grades/0", quiz},
+		{http.MethodDelete, "/students/1/grades/0", nil},
+	} {
+		res := conditionalRequest(t, tt.method, url+tt.path, tt.body, stale)
+		if res.StatusCode != http.StatusPreconditionFailed {
+			t.Errorf("%s %s with a stale version: status %d, want 412", tt.method, tt.path, res.StatusCode)
+		}
+	}
+	//无法解析的If-Match与任何版本都不匹配
+	res = conditionalRequest(t, http.MethodDelete, url+"/students/1/grades/0", nil, map[string]string{"If-Match": "latest"})
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("DELETE with a malformed If-Match: status %d, want 412", res.StatusCode)
+	}
+	if got := gradesOf(t, gs, 1); !reflect.DeepEqual(got, after) || len(got) != len(before)+1 {
+		t.Fatalf("grades after rejected writes = %v, want %v", got, after)
+	}
+
+	res = conditionalRequest(t, http.MethodPut, url+"/students/1/grades/0", quiz, map[string]string{"If-Match": `W/"2"`})
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") != `"3"` {
+		t.Fatalf("PUT with the current version: status %d, ETag %q", res.StatusCode, res.Header.Get("ETag"))
+	}
+}
+
+// 没有If-Match或为*时不检查版本
+func TestUnconditionalWrite(t *testing.T) {
+	gs, url := startGradesServer(t)
+	res := conditionalRequest(t, http.MethodDelete, url+"/students/1/grades/2", nil, nil)
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("ETag") != `"2"` {
+		t.Fatalf("DELETE without If-Match: status %d, ETag %q", res.StatusCode, res.Header.Get("ETag"))
+	}
+	res = conditionalRequest(t, http.MethodDelete, url+"/students/1/grades/1", nil, map[string]string{"If-Match": "*"})
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("ETag") != `"3"` {
+		t.Fatalf("DELETE with If-Match *: status %d, ETag %q", res.StatusCode, res.Header.Get("ETag"))
+	}
+	if got := gradesOf(t, gs, 1); !reflect.DeepEqual(got, []string{"Quiz 1"}) {
+		t.Fatalf("grades = %v", got)
+	}
+}
+
+// RPC接口以请求中的Version代替If-Match，不匹配时返回failed_precondition
+func TestStaleRPCWriteIsRejected(t *testing.T) {
+	gs, url := startGradesServer(t)
+	token, err := auth.IssueToken(*admin, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &rpc.Client{BaseURL: url, Prepare: func(req *http.Request, _ []byte) error {
+		auth.SetToken(req, token)
+		return nil
+	}}
+	ctx := context.Background()
+	quiz := Grade{Title: "Quiz 3", Type: GradeQuiz, Score: 90}
+	if _, err := rpc.Call[AddGradeRequest, Grade](ctx, c, ServicePath+"AddGrade", &AddGradeRequest{StudentID: 1, Grade: quiz, Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = rpc.Call[AddGradeRequest, Grade](ctx, c, ServicePath+"AddGrade", &AddGradeRequest{StudentID: 1, Grade: quiz, Version: 1})
+	if rpc.CodeOf(err) != rpc.CodeFailedPrecondition {
+		t.Fatalf("AddGrade with a stale version: err = %v, want failed_precondition", err)
+	}
+	_, err = rpc.Call[UpdateGradeRequest, Grade](ctx, c, ServicePath+"UpdateGrade", &UpdateGradeRequest{StudentID: 1, Index: 0, Grade: quiz, Version: 1})
+	if rpc.CodeOf(err) != rpc.CodeFailedPrecondition {
+		t.Fatalf("UpdateGrade with a stale version: err = %v, want failed_precondition", err)
+	}
+	if got := gradesOf(t, gs, 1); len(got) != 4 || got[0] != "Quiz 1" {
+		t.Fatalf("grades after a rejected write = %v", got)
+	}
+}
+
+func TestExpectedVersion(t *testing.T) {
+	for header, want := range map[string]int{
+		"":         0,
+		"*":        0,
+		` * `:      0,
+		`"3"`:      3,
+		`W/"3"`:    3,
+		"3":        3,
+		`"0"`:      -1,
+		`"-2"`:     -1,
+		`"x"`:      -1,
+		`"1", "2"`: -1,
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/students/1/grades/0", nil)
+		if header != "" {
+			r.Header.Set("If-Match", header)
+		}
+		if got := expectedVersion(r); got != want {
+			t.Errorf("If-Match %q: expectedVersion = %d, want %d", header, got, want)
+		}
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		etag   string
+		want   bool
+	}{
+		{"", `"1"`, false},
+		{`"1"`, `"1"`, true},
+		{`W/"1"`, `"1"`, true},
+		{`"1"`, `W/"1"`, true},
+		{`"2", W/"1"`, `"1"`, true},
+		{"*", `"1"`, true},
+		{`"2"`, `"1"`, false},
+		{`"12"`, `"1"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatch(tt.header, tt.etag); got != tt.want {
+			t.Errorf("etagMatch(%q, %q) = %v, want %v", tt.header, tt.etag, got, tt.want)
+		}
+	}
+}
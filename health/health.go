@@ -0,0 +1,232 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status 实例整体的健康状态
+type Status string
+
+const (
+	StatusUp = Status("up")
+	//存活且可以接收流量，但部分非关键的依赖不可用
+	StatusDegraded = Status("degraded")
+	//存活但不应接收流量
+	StatusNotReady = Status("not_ready")
+	StatusDown     = Status("down")
+)
+
+// Kind 决定检查失败时对实例状态的影响
+type Kind string
+
+const (
+	// Liveness 失败时实例视为宕机，registry会将其移除
+	Liveness = Kind("liveness")
+	// Readiness 失败时实例仍存活，但registry会把流量从该实例摘除
+	Readiness = Kind("readiness")
+	// Informational 失败时实例只是降级，仍然接收流量
+	Informational = Kind("informational")
+)
+
+// CheckFunc 返回nil表示检查通过
+type CheckFunc func(ctx context.Context) error
+
+// Check 一项自定义的健康检查，如"logger reachable"或"store writable"
+type Check struct {
+	Name string
+	Kind Kind
+	Func CheckFunc
+}
+
+// CheckResult 单项检查的结果
+type CheckResult struct {
+	Name     string
+	Kind     Kind
+	OK       bool
+	Error    string `json:",omitempty"`
+	Duration time.Duration
+}
+
+// Report 心跳检测接口返回的JSON
+type Report struct {
+	Status Status
+	Live   bool
+	Ready  bool
+	Checks []CheckResult
+	Time   time.Time
+}
+
+// CheckTimeout 单项检查的超时时间
+const CheckTimeout = 2 * time.Second
+
+// Checks 一个服务的所有健康检查，同一进程内的多个服务各自使用一个Checks
+type Checks struct {
+	checks map[string]Check
+	mutex  sync.RWMutex
+}
+
+// NewChecks 创建空的检查集合
+func NewChecks() *Checks {
+	return &Checks{checks: make(map[string]Check)}
+}
+
+// DefaultChecks Register等包级函数使用的集合
+var DefaultChecks = NewChecks()
+
+// Register 在默认的集合中注册一项健康检查，同名的检查会被覆盖
+func Register(c Check) {
+	DefaultChecks.Register(c)
+}
+
+// Evaluate 执行默认集合中的所有检查
+func Evaluate(ctx context.Context) Report {
+	return DefaultChecks.Evaluate(ctx)
+}
+
+// Handler 返回默认集合的检查结果的心跳检测接口
+func Handler() http.Handler {
+	return DefaultChecks.Handler()
+}
+
+// Register 注册一项健康检查，同名的检查会被覆盖
+func (cs *Checks) Register(c Check) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.checks[c.Name] = c
+}
+
+// Evaluate 并发执行所有检查并汇总结果
+func (cs *Checks) Evaluate(ctx context.Context) Report {
+	cs.mutex.RLock()
+	list := make([]Check, 0, len(cs.checks))
+	for _, c := range cs.checks {
+		list = append(list, c)
+	}
+	cs.mutex.RUnlock()
+
+	results := make([]CheckResult, len(list))
+	var wg sync.WaitGroup
+	for i, c := range list {
+		wg.Add(1)
+		go func(i int, c Check) {
+			defer wg.Done()
+			results[i] = run(ctx, c)
+		}(i, c)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+
+	report := Report{Status: StatusUp, Live: true, Ready: true, Checks: results, Time: time.Now()}
+	degraded := false
+	for _, res := range results {
+		if res.OK {
+			continue
+		}
+		switch res.Kind {
+		case Liveness:
+			report.Live, report.Ready = false, false
+		case Readiness:
+			report.Ready = false
+		default:
+			degraded = true
+		}
+	}
+	switch {
+	case !report.Live:
+		report.Status = StatusDown
+	case !report.Ready:
+		report.Status = StatusNotReady
+	case degraded:
+		report.Status = StatusDegraded
+	}
+	return report
+}
+
+func run(ctx context.Context, c Check) (res CheckResult) {
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+	res = CheckResult{Name: c.Name, Kind: c.Kind}
+	start := time.Now()
+	defer func() { res.Duration = time.Since(start) }()
+	done := make(chan error, 1)
+	go func() {
+		//检查函数panic时视为检查失败，不影响服务本身
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("panic: %v", p)
+			}
+		}()
+		done <- c.Func(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		res.OK = true
+	case <-ctx.Done():
+		res.Error = ctx.Err().Error()
+	}
+	return res
+}
+
+// Handler 心跳检测接口，返回JSON格式的Report
+// 可以接收流量时返回200，否则返回503，registry根据Live区分存活与宕机
+func (cs *Checks) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := cs.Evaluate(r.Context())
+		data, err := json.Marshal(report)
+		if err != nil {
+			log.Println("func Handler of health:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write(data)
+	})
+}
+
+// Reachable 检查resolve返回的服务地址能否建立TCP连接，用于"logger reachable"这类依赖检查
+func Reachable(resolve func() (string, error)) CheckFunc {
+	return func(ctx context.Context) error {
+		serviceURL, err := resolve()
+		if err != nil {
+			return err
+		}
+		u, err := url.Parse(serviceURL)
+		if err != nil {
+			return err
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// ReadReport 解析心跳检测的响应，不返回JSON的旧版本服务以状态码200作为存活且可接收流量
+func ReadReport(res *http.Response) Report {
+	var report Report
+	if err := json.NewDecoder(res.Body).Decode(&report); err == nil && report.Status != "" {
+		return report
+	}
+	if res.StatusCode == http.StatusOK {
+		return Report{Status: StatusUp, Live: true, Ready: true, Time: time.Now()}
+	}
+	return Report{Status: StatusDown, Time: time.Now()}
+}
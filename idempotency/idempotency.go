@@ -0,0 +1,239 @@
+// Package idempotency 为修改类的请求提供Idempotency-Key支持
+//
+// 调用方为每个修改生成一个key，重试或重复提交时携带同一个key。服务端在窗口期内记录每个key的响应，
+// 同一调用方以相同的key再次发送的请求不会再次执行，而是重放第一次的响应：
+//
+//	store := idempotency.NewStore(idempotency.DefaultWindow)
+//	mux.Handle("/students/", store.Middleware(handler))
+//
+// key按token中的用户区分，同一个key用于不同的请求（方法、路径或请求体不同）时以422拒绝，
+// 第一次的请求尚未完成时重复的请求以409拒绝。只记录2xx与不会因重试而改变结果的4xx响应，
+// 5xx以及401、403、408、409、412、425、429等响应不会被记录，调用方可以用同一个key重试
+//
+// 请求体需要读入内存计算摘要，超过MaxBodySize的请求以413拒绝，不会交给next
+//
+// 记录只保存在当前进程的内存中，不会复制到其他实例：重启或leader切换后，以同一个key重试的修改可能再次执行
+package idempotency
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"distributedDemo/auth"
+	"distributedDemo/metrics"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Header 请求中携带key的请求头
+	Header = "Idempotency-Key"
+	// ReplayedHeader 重放的响应带有该响应头
+	ReplayedHeader = "Idempotent-Replayed"
+	// DefaultWindow 默认记录响应的时间
+	DefaultWindow = 24 * time.Hour
+	//key的最大长度
+	maxKeyLength = 255
+	//超出时先清理过期的记录，再淘汰最早的记录
+	maxEntries = 10000
+	// MaxBodySize 携带key的请求的请求体的最大长度
+	MaxBodySize = 1 << 20
+)
+
+var idempotentRequests = metrics.NewCounterVec("idempotency_requests_total",
+	"Requests carrying an Idempotency-Key, by result (executed, replayed, in_progress or mismatch).",
+	"result")
+
+// NewKey 生成一个随机的key
+func NewKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type entry struct {
+	//方法、路径与请求体的摘要，同一个key只能用于相同的请求
+	fingerprint string
+	//第一次的请求完成后为true
+	complete bool
+	status   int
+	header   http.Header
+	body     []byte
+	stored   time.Time
+}
+
+// Store 记录窗口期内每个key的响应，可以被多个goroutine同时使用
+type Store struct {
+	window  time.Duration
+	mutex   sync.Mutex
+	entries map[string]*entry
+}
+
+// NewStore 创建在window内记录响应的Store
+func NewStore(window time.Duration) *Store {
+	return &Store{window: window, entries: make(map[string]*entry)}
+}
+
+// Middleware 对携带Idempotency-Key的非GET、HEAD请求去重，其他请求直接交给next
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+		//Middleware可能位于认证之前，限制读入内存的长度
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+		if err != nil {
+			//读满上限后仍有数据时MaxBytesReader返回错误，Go 1.18中没有可以判断的错误类型
+			if len(body) >= MaxBodySize {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		//token无效时请求会被next拒绝，此时不区分用户也不会泄露其他用户的响应
+		var subject string
+		if claims, err := auth.FromRequest(r); err == nil {
+			subject = claims.Subject
+		}
+		id := subject + "\x00" + key
+		sum := sha256.Sum256(body)
+		fingerprint := r.Method + " " + r.URL.Path + " " + hex.EncodeToString(sum[:])
+
+		s.mutex.Lock()
+		e, ok := s.entries[id]
+		if ok && time.Since(e.stored) > s.window {
+			delete(s.entries, id)
+			ok = false
+		}
+		switch {
+		case ok && e.fingerprint != fingerprint:
+			s.mutex.Unlock()
+			idempotentRequests.For(r.Context()).Inc("mismatch")
+			http.Error(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+			return
+		case ok && !e.complete:
+			s.mutex.Unlock()
+			idempotentRequests.For(r.Context()).Inc("in_progress")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "a request with this Idempotency-Key is in progress", http.StatusConflict)
+			return
+		case ok:
+			status, header, body := e.status, e.header, e.body
+			s.mutex.Unlock()
+			idempotentRequests.For(r.Context()).Inc("replayed")
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.Header().Set(ReplayedHeader, "true")
+			w.WriteHeader(status)
+			_, _ = w.Write(body)
+			return
+		}
+		e = &entry{fingerprint: fingerprint, stored: time.Now()}
+		s.entries[id] = e
+		s.evictLocked()
+		s.mutex.Unlock()
+
+		idempotentRequests.For(r.Context()).Inc("executed")
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		finished := false
+		defer func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			//next发生panic时没有完整的响应，与可以重试的响应一样，允许用同一个key重试
+			if !finished || !replayable(rec.status) {
+				delete(s.entries, id)
+				return
+			}
+			if rec.header == nil {
+				rec.header = w.Header().Clone()
+			}
+			e.status, e.header, e.body = rec.status, rec.header, rec.body.Bytes()
+			e.complete = true
+		}()
+		next.ServeHTTP(rec, r)
+		finished = true
+	})
+}
+
+// 是否记录并重放status的响应：2xx，以及以相同的请求重试也会得到相同结果的4xx
+// 服务端错误可能是暂时的；认证、权限、版本冲突与限流的结果会随token、数据或时间变化，重试可能成功
+func replayable(status int) bool {
+	switch {
+	case status >= 200 && status < 300:
+		return true
+	case status < 400 || status >= 500:
+		return false
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusConflict,
+		http.StatusPreconditionFailed, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return true
+}
+
+// 调用方需持有s.mutex
+func (s *Store) evictLocked() {
+	if len(s.entries) <= maxEntries {
+		return
+	}
+	for id, e := range s.entries {
+		if e.complete && time.Since(e.stored) > s.window {
+			delete(s.entries, id)
+		}
+	}
+	for len(s.entries) > maxEntries {
+		var oldest string
+		var oldestTime time.Time
+		for id, e := range s.entries {
+			if e.complete && (oldestTime.IsZero() || e.stored.Before(oldestTime)) {
+				oldest, oldestTime = id, e.stored
+			}
+		}
+		if oldest == "" {
+			log.Println("Method evictLocked of Store: all entries are in progress")
+			return
+		}
+		delete(s.entries, oldest)
+	}
+}
+
+// 在写出响应的同时记录状态码、响应头与响应体
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.wroteHeader {
+		return
+	}
+	rec.wroteHeader = true
+	rec.status = code
+	rec.header = rec.Header().Clone()
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
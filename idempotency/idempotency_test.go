@@ -0,0 +1,201 @@
+package idempotency
+
+import (
+	"distributedDemo/auth"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 每次执行都返回递增编号的handler，status为其响应的状态码
+type countingHandler struct {
+	calls  int32
+	status int32
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&h.calls, 1)
+	w.Header().Set("X-Call", fmt.Sprint(n))
+	if status := atomic.LoadInt32(&h.status); status != 0 {
+		w.WriteHeader(int(status))
+	}
+	fmt.Fprintf(w, "call %d", n)
+}
+
+func send(h http.Handler, method, path, key, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(Header, key)
+	}
+	if token != "" {
+		auth.SetToken(req, token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func tokenFor(t *testing.T, subject string) string {
+	t.Helper()
+	token, err := auth.IssueToken(auth.Claims{Subject: subject, Role: auth.RoleTeacher}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestReplaysCompletedResponse(t *testing.T) {
+	next := &countingHandler{status: http.StatusCreated}
+	h := NewStore(time.Hour).Middleware(next)
+	token := tokenFor(t, "teacherA")
+
+	first := send(h, http.MethodPost, "/students/1/grades", "k1", token, `{"Score":90}`)
+	second := send(h, http.MethodPost, "/students/1/grades", "k1", token, `{"Score":90}`)
+	if n := atomic.LoadInt32(&next.calls); n != 1 {
+		t.Fatalf("handler executed %d times, want 1", n)
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != "call 1" || second.Header().Get("X-Call") != "1" {
+		t.Fatalf("replay = %d %q X-Call %q, want the first response", second.Code, second.Body.String(), second.Header().Get("X-Call"))
+	}
+	if first.Header().Get(ReplayedHeader) != "" || second.Header().Get(ReplayedHeader) != "true" {
+		t.Fatalf("%s = %q and %q, want only the replay marked", ReplayedHeader,
+			first.Header().Get(ReplayedHeader), second.Header().Get(ReplayedHeader))
+	}
+
+	//不同的key、不同的用户以及不带key的请求都会执行
+	send(h, http.MethodPost, "/students/1/grades", "k2", token, `{"Score":90}`)
+	send(h, http.MethodPost, "/students/1/grades", "k1", tokenFor(t, "teacherB"), `{"Score":90}`)
+	send(h, http.MethodPost, "/students/1/grades", "", token, `{"Score":90}`)
+	send(h, http.MethodGet, "/students/1", "k1", token, "")
+	if n := atomic.LoadInt32(&next.calls); n != 5 {
+		t.Fatalf("handler executed %d times, want 5", n)
+	}
+}
+
+func TestRejectsKeyReusedForDifferentRequest(t *testing.T) {
+	next := &countingHandler{}
+	h := NewStore(time.Hour).Middleware(next)
+	send(h, http.MethodPost, "/students/1/grades", "k", "", `{"Score":90}`)
+	for _, tt := range []struct{ method, path, body string }{
+		{http.MethodPost, "/students/1/grades", `{"Score":80}`},
+		{http.MethodPost, "/students/2/grades", `{"Score":90}`},
+		{http.MethodPut, "/students/1/grades", `{"Score":90}`},
+	} {
+		if rec := send(h, tt.method, tt.path, "k", "", tt.body); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s %s %s: status %d, want 422", tt.method, tt.path, tt.body, rec.Code)
+		}
+	}
+	if n := atomic.LoadInt32(&next.calls); n != 1 {
+		t.Fatalf("handler executed %d times, want 1", n)
+	}
+}
+
+func TestRejectsDuplicateWhileInProgress(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := NewStore(time.Hour).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send(h, http.MethodPost, "/grades", "k", "", "body") }()
+	<-entered
+
+	rec := send(h, http.MethodPost, "/grades", "k", "", "body")
+	if rec.Code != http.StatusConflict || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("duplicate in progress: status %d, Retry-After %q, want 409 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	close(release)
+	if first := <-done; first.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", first.Code)
+	}
+	if rec := send(h, http.MethodPost, "/grades", "k", "", "body"); rec.Header().Get(ReplayedHeader) != "true" {
+		t.Fatal("request after the first one completed was not replayed")
+	}
+}
+
+func TestExecutesAgainAfterWindow(t *testing.T) {
+	next := &countingHandler{}
+	s := NewStore(time.Hour)
+	h := s.Middleware(next)
+	send(h, http.MethodPost, "/grades", "k", "", "body")
+	s.mutex.Lock()
+	for _, e := range s.entries {
+		e.stored = time.Now().Add(-2 * time.Hour)
+	}
+	s.mutex.Unlock()
+	rec := send(h, http.MethodPost, "/grades", "k", "", "body")
+	if rec.Header().Get(ReplayedHeader) != "" || atomic.LoadInt32(&next.calls) != 2 {
+		t.Fatalf("request after the window: replayed %q, %d calls, want a second execution",
+			rec.Header().Get(ReplayedHeader), atomic.LoadInt32(&next.calls))
+	}
+}
+
+func TestDoesNotRecordRetryableResponses(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable,
+		http.StatusUnauthorized, http.StatusConflict, http.StatusPreconditionFailed, http.StatusTooManyRequests} {
+		next := &countingHandler{status: int32(status)}
+		h := NewStore(time.Hour).Middleware(next)
+		send(h, http.MethodPost, "/grades", "k", "", "body")
+		//服务恢复后以同一个key重试，会再次执行并记录成功的响应
+		atomic.StoreInt32(&next.status, http.StatusCreated)
+		if rec := send(h, http.MethodPost, "/grades", "k", "", "body"); rec.Code != http.StatusCreated || rec.Header().Get(ReplayedHeader) != "" {
+			t.Errorf("retry after %d: status %d replayed %q, want a new execution", status, rec.Code, rec.Header().Get(ReplayedHeader))
+		}
+		if rec := send(h, http.MethodPost, "/grades", "k", "", "body"); rec.Header().Get(ReplayedHeader) != "true" {
+			t.Errorf("after %d and a successful retry: the success was not replayed", status)
+		}
+	}
+
+	//不会因重试而改变结果的4xx被记录
+	next := &countingHandler{status: http.StatusNotFound}
+	h := NewStore(time.Hour).Middleware(next)
+	send(h, http.MethodPost, "/grades", "k", "", "body")
+	if rec := send(h, http.MethodPost, "/grades", "k", "", "body"); rec.Code != http.StatusNotFound || rec.Header().Get(ReplayedHeader) != "true" {
+		t.Fatalf("404: status %d replayed %q, want the 404 replayed", rec.Code, rec.Header().Get(ReplayedHeader))
+	}
+}
+
+func TestRetriesAfterPanic(t *testing.T) {
+	var calls int32
+	h := NewStore(time.Hour).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			panic("handler failed")
+		}
+	}))
+	func() {
+		defer func() { _ = recover() }()
+		send(h, http.MethodPost, "/grades", "k", "", "body")
+	}()
+	if rec := send(h, http.MethodPost, "/grades", "k", "", "body"); rec.Code != http.StatusOK || atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("retry after a panic: status %d, %d calls, want a second execution", rec.Code, atomic.LoadInt32(&calls))
+	}
+}
+
+func TestRejectsLargeBody(t *testing.T) {
+	next := &countingHandler{}
+	h := NewStore(time.Hour).Middleware(next)
+	if rec := send(h, http.MethodPost, "/grades", "k", "", strings.Repeat("a", MaxBodySize+1)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("body over the limit: status %d, want 413", rec.Code)
+	}
+	if rec := send(h, http.MethodPost, "/grades", "k", "", strings.Repeat("a", MaxBodySize)); rec.Code != http.StatusOK {
+		t.Fatalf("body at the limit: status %d, want 200", rec.Code)
+	}
+	if n := atomic.LoadInt32(&next.calls); n != 1 {
+		t.Fatalf("handler executed %d times, want only the request within the limit", n)
+	}
+	//不带key的请求不经过去重，由next自行限制
+	if rec := send(h, http.MethodPost, "/grades", "", "", strings.Repeat("a", MaxBodySize+1)); rec.Code != http.StatusOK {
+		t.Fatalf("request without a key: status %d, want 200", rec.Code)
+	}
+}
+
+func TestRejectsLongKey(t *testing.T) {
+	h := NewStore(time.Hour).Middleware(&countingHandler{})
+	if rec := send(h, http.MethodPost, "/grades", strings.Repeat("k", maxKeyLength+1), "", "body"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("long key: status %d, want 400", rec.Code)
+	}
+}
@@ -3,6 +3,7 @@ package logger
 import (
 	"bytes"
 	"distributedDemo/registry"
+	"distributedDemo/tlsutil"
 	"fmt"
 	"log"
 	"net/http"
@@ -20,10 +21,11 @@ type clientLogger struct {
 
 func (cl clientLogger) Write(data []byte) (int, error) {
 	b := bytes.NewBuffer([]byte(data))
-	res, err := http.Post(cl.url+"/logger", "text/plain", b)
+	res, err := tlsutil.Client.Post(cl.url+"/log", "text/plain", b)
 	if err != nil {
 		return 0, err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
 		return 0, fmt.Errorf("failed to send logger message. Service responded with %d - %s", res.StatusCode, res.Status)
 	}
@@ -0,0 +1,56 @@
+package logger
+
+import (
+	"context"
+	"distributedDemo/rpc"
+	"distributedDemo/tlsutil"
+	"io"
+	"net/http"
+)
+
+// ServicePath 日志服务RPC的路径前缀
+const ServicePath = "/distributed.logger.v1.LoggerService/"
+
+type WriteRequest struct {
+	Message string
+}
+
+type WriteResponse struct{}
+
+type IngestResponse struct {
+	//写入的日志条数
+	Count int
+}
+
+// 与/log相同，启用TLS时只接受持有CA签发证书的服务
+func (s *Server) registerRPC(mux *http.ServeMux) {
+	mux.Handle(ServicePath+"Write", tlsutil.RequirePeer(rpc.Unary(s.writeRPC)))
+	//一次调用中持续发送多条日志，避免每条日志一个请求
+	mux.Handle(ServicePath+"Ingest", tlsutil.RequirePeer(rpc.ClientStream(s.ingestRPC)))
+}
+
+func (s *Server) writeRPC(ctx context.Context, req *WriteRequest) (*WriteResponse, error) {
+	if req.Message == "" {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "empty message")
+	}
+	s.receive(ctx, req.Message)
+	return &WriteResponse{}, nil
+}
+
+func (s *Server) ingestRPC(ctx context.Context, recv func() (*WriteRequest, error)) (*IngestResponse, error) {
+	res := &IngestResponse{}
+	for {
+		req, err := recv()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if req.Message == "" {
+			continue
+		}
+		s.receive(ctx, req.Message)
+		res.Count++
+	}
+}
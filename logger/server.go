@@ -1,19 +1,50 @@
 package logger
 
 import (
+	"context"
+	"distributedDemo/metrics"
+	"distributedDemo/tlsutil"
+	"distributedDemo/trace"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 )
 
-var logger *log.Logger
+// Server 日志服务，将收到的日志写入文件，同一进程内的多个Server可以写入不同的文件
+type Server struct {
+	logger *log.Logger
+}
+
+// NewServer 创建将日志写入destination的日志服务
+func NewServer(destination string) *Server {
+	return &Server{logger: log.New(fileLog(destination), "[go] - ", log.LstdFlags)}
+}
+
+// 由Run创建，每个进程只运行一个日志服务时使用
+var server *Server
+
+var (
+	logMessages = metrics.NewCounterVec("logger_messages_received_total",
+		"Log messages received by the logger service.")
+	logBytes = metrics.NewCounterVec("logger_bytes_received_total",
+		"Bytes of log messages received by the logger service.")
+)
 
 type fileLog string
 
+// RegisterHandlers 在mux上注册Run创建的日志服务的接口
+func RegisterHandlers(mux *http.ServeMux) {
+	server.RegisterHandlers(mux)
+}
+
 // RegisterHandlers 注册路由
-func RegisterHandlers() {
-	http.HandleFunc("/log", func(w http.ResponseWriter, r *http.Request) {
+func (s *Server) RegisterHandlers(mux *http.ServeMux) {
+	//logger服务同时作为本地开发用的trace collector，/traces 可以查看所有服务的调用链
+	mux.Handle("/v1/traces", tlsutil.RequirePeer(trace.CollectorHandler()))
+
+	//启用TLS时只接受持有CA签发证书的服务发送的日志
+	mux.Handle("/log", tlsutil.RequirePeer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
 			msg, err := ioutil.ReadAll(r.Body)
@@ -21,12 +52,13 @@ func RegisterHandlers() {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			write(string(msg))
+			s.receive(r.Context(), string(msg))
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-	})
+	})))
+	s.registerRPC(mux)
 }
 
 //将日志数据写入文件
@@ -45,13 +77,38 @@ func (fl fileLog) Write(data []byte) (int, error) {
 	return f.Write(data)
 }
 
+// FileWritable 检查Run创建的日志服务，见Server.FileWritable
+func FileWritable(ctx context.Context) error {
+	return server.FileWritable(ctx)
+}
+
+// FileWritable 健康检查：日志文件可以被打开并追加写入
+func (s *Server) FileWritable(ctx context.Context) error {
+	fl, ok := s.logger.Writer().(fileLog)
+	if !ok {
+		return nil
+	}
+	f, err := os.OpenFile(string(fl), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 // Run 存储日志文件的路径
 func Run(destination string) {
-	logger = log.New(fileLog(destination), "[go] - ", log.LstdFlags)
+	server = NewServer(destination)
+}
+
+// 记录指标并写入文件
+func (s *Server) receive(ctx context.Context, message string) {
+	logMessages.For(ctx).Inc()
+	logBytes.For(ctx).Add(float64(len(message)))
+	s.write(message)
 }
 
-func write(message string) {
-	log.Println("func write:\n", message)
+func (s *Server) write(message string) {
+	log.Println("Method write of Server:\n", message)
 	//由此写入文件
-	logger.Printf("%v\n", message)
+	s.logger.Printf("%v\n", message)
 }
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = NewCounterVec("http_requests_total",
+		"Total number of HTTP requests by route, method and status code.",
+		"route", "method", "code")
+	httpDuration = NewHistogramVec("http_request_duration_seconds",
+		"HTTP request latencies in seconds by route and method.",
+		DefaultBuckets, "route", "method")
+)
+
+// Handler 输出Default中的指标，即 /metrics 接口
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Handler 以Prometheus文本格式输出r中的指标，即 /metrics 接口
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			log.Println("Method Handler of Registry:", err)
+		}
+	})
+}
+
+// InstrumentHandler 将经过mux的请求统计在Default中
+func InstrumentHandler(mux *http.ServeMux) http.Handler {
+	return Default.InstrumentHandler(mux)
+}
+
+// InstrumentHandler 将经过mux的每个请求统计在reg中，route取mux中匹配到的路由，避免路径参数导致标签过多
+// 匹配到Mount挂载的handler时，route取被挂载的mux中匹配到的路由
+// 请求的ctx中带有reg，处理请求时通过For使用的指标也记录在reg中
+func (reg *Registry) InstrumentHandler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(WithRegistry(r.Context(), reg))
+		h, route := mux.Handler(r)
+		if m, ok := h.(*mounted); ok {
+			_, route = m.routes.Handler(r)
+		}
+		if route == "" {
+			route = "unmatched"
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(rec, r)
+		httpDuration.In(reg).Observe(time.Since(start).Seconds(), route, r.Method)
+		httpRequests.In(reg).Inc(route, r.Method, strconv.Itoa(rec.status))
+	})
+}
+
+// 挂载在另一个mux中的routes，next为经过middleware包装后的routes
+type mounted struct {
+	routes *http.ServeMux
+	next   http.Handler
+}
+
+// Mount 将routes（可能经过middleware包装为next）挂载到InstrumentHandler的mux中，
+// 经过next的请求按routes中的路由统计，而不是统计为挂载的路由
+func Mount(routes *http.ServeMux, next http.Handler) http.Handler {
+	return &mounted{routes: routes, next: next}
+}
+
+func (m *mounted) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.next.ServeHTTP(w, r)
+}
+
+// 记录handler写入的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.status = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	sr.wroteHeader = true
+	return sr.ResponseWriter.Write(b)
+}
+
+// Flush 支持流式响应
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,328 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 指标类型，对应Prometheus文本格式中的TYPE
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefaultBuckets 耗时直方图默认的桶（单位：秒）
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// 同一个指标名称下，按标签值区分的一组时间序列
+type vec struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*series
+	mutex      sync.Mutex
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	//以下仅用于直方图
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newVec(name, help, metricType string, buckets []float64, labelNames []string) *vec {
+	v := &vec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	Default.register(v)
+	return v
+}
+
+// 与v定义相同但没有时间序列的指标，用于在其他Registry中创建
+func (v *vec) clone() *vec {
+	return &vec{
+		name:       v.name,
+		help:       v.help,
+		metricType: v.metricType,
+		labelNames: v.labelNames,
+		buckets:    v.buckets,
+		series:     make(map[string]*series),
+	}
+}
+
+// 调用方需持有v.mutex
+func (v *vec) with(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d",
+			v.name, len(v.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if v.metricType == typeHistogram {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// CounterVec 只增不减的计数器
+type CounterVec struct{ v *vec }
+
+// NewCounterVec 创建并注册一个计数器
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, typeCounter, nil, labelNames)}
+}
+
+// In 返回r中的同一指标，r中还没有时按相同的定义创建，r为nil时返回Default中的指标
+func (c *CounterVec) In(r *Registry) *CounterVec {
+	return &CounterVec{r.vecOf(c.v)}
+}
+
+// For 返回ctx所属的Registry中的同一指标，见FromContext
+func (c *CounterVec) For(ctx context.Context) *CounterVec {
+	return c.In(FromContext(ctx))
+}
+
+// Inc 计数加一
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add 计数增加delta，delta不能为负数
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.v.mutex.Lock()
+	defer c.v.mutex.Unlock()
+	c.v.with(labelValues).value += delta
+}
+
+// GaugeVec 可增可减的瞬时值
+type GaugeVec struct{ v *vec }
+
+// NewGaugeVec 创建并注册一个瞬时值指标
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, typeGauge, nil, labelNames)}
+}
+
+// In 返回r中的同一指标，r中还没有时按相同的定义创建，r为nil时返回Default中的指标
+func (g *GaugeVec) In(r *Registry) *GaugeVec {
+	return &GaugeVec{r.vecOf(g.v)}
+}
+
+// For 返回ctx所属的Registry中的同一指标，见FromContext
+func (g *GaugeVec) For(ctx context.Context) *GaugeVec {
+	return g.In(FromContext(ctx))
+}
+
+// Set 设置为value
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.v.mutex.Lock()
+	defer g.v.mutex.Unlock()
+	g.v.with(labelValues).value = value
+}
+
+// Add 增加delta，delta可以为负数
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.v.mutex.Lock()
+	defer g.v.mutex.Unlock()
+	g.v.with(labelValues).value += delta
+}
+
+// Reset 清空所有时间序列，用于按当前状态整体重新设置
+func (g *GaugeVec) Reset() {
+	g.v.mutex.Lock()
+	defer g.v.mutex.Unlock()
+	g.v.series = make(map[string]*series)
+}
+
+// HistogramVec 按桶统计观测值的分布
+type HistogramVec struct{ v *vec }
+
+// NewHistogramVec 创建并注册一个直方图，buckets需按升序排列
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{newVec(name, help, typeHistogram, buckets, labelNames)}
+}
+
+// In 返回r中的同一指标，r中还没有时按相同的定义创建，r为nil时返回Default中的指标
+func (h *HistogramVec) In(r *Registry) *HistogramVec {
+	return &HistogramVec{r.vecOf(h.v)}
+}
+
+// For 返回ctx所属的Registry中的同一指标，见FromContext
+func (h *HistogramVec) For(ctx context.Context) *HistogramVec {
+	return h.In(FromContext(ctx))
+}
+
+// Observe 记录一次观测值
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.v.mutex.Lock()
+	defer h.v.mutex.Unlock()
+	s := h.v.with(labelValues)
+	for i, upper := range h.v.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// Registry 一组指标，通过/metrics接口一起输出
+// 同一进程内运行多个服务时，每个服务使用各自的Registry，互不影响
+type Registry struct {
+	vecs  map[string]*vec
+	mutex sync.Mutex
+}
+
+// NewRegistry 创建空的Registry，其中的指标在第一次通过In或For使用时创建
+func NewRegistry() *Registry {
+	return &Registry{vecs: make(map[string]*vec)}
+}
+
+// Default 包级的NewCounterVec等函数创建的指标所在的Registry，每个进程只运行一个服务时使用
+var Default = NewRegistry()
+
+func (r *Registry) register(v *vec) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.vecs[v.name]; ok {
+		panic("metrics: duplicate metric " + v.name)
+	}
+	r.vecs[v.name] = v
+}
+
+// 返回r中与v同名的指标，不存在时按v的定义创建
+func (r *Registry) vecOf(v *vec) *vec {
+	if r == nil {
+		r = Default
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	existing, ok := r.vecs[v.name]
+	if !ok {
+		existing = v.clone()
+		r.vecs[v.name] = existing
+		return existing
+	}
+	if existing.metricType != v.metricType || strings.Join(existing.labelNames, ",") != strings.Join(v.labelNames, ",") {
+		panic("metrics: conflicting definitions of " + v.name)
+	}
+	return existing
+}
+
+type registryKey struct{}
+
+// WithRegistry 返回带有r的ctx，之后通过For使用的指标记录在r中
+func WithRegistry(ctx context.Context, r *Registry) context.Context {
+	return context.WithValue(ctx, registryKey{}, r)
+}
+
+// FromContext 返回ctx所属的Registry，即处理请求的服务的Registry，没有时返回Default
+func FromContext(ctx context.Context) *Registry {
+	if r, ok := ctx.Value(registryKey{}).(*Registry); ok {
+		return r
+	}
+	return Default
+}
+
+// WriteTo 以Prometheus文本格式输出Default中的所有指标
+func WriteTo(w io.Writer) error {
+	return Default.WriteText(w)
+}
+
+// WriteText 以Prometheus文本格式输出r中的所有指标
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	vecs := make([]*vec, 0, len(r.vecs))
+	for _, v := range r.vecs {
+		vecs = append(vecs, v)
+	}
+	r.mutex.Unlock()
+	sort.Slice(vecs, func(i, j int) bool { return vecs[i].name < vecs[j].name })
+
+	var b strings.Builder
+	for _, v := range vecs {
+		v.write(&b)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (v *vec) write(b *strings.Builder) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", v.name, helpEscaper.Replace(v.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", v.name, v.metricType)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		if v.metricType != typeHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", v.name, labels(v.labelNames, s.labelValues, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, upper := range v.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", v.name,
+				labels(v.labelNames, s.labelValues, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", v.name, labels(v.labelNames, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", v.name, labels(v.labelNames, s.labelValues, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", v.name, labels(v.labelNames, s.labelValues, "", ""), s.count)
+	}
+}
+
+// 拼接标签，extraName不为空时追加一个额外的标签（如直方图的le）
+func labels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// 标签值需要转义反斜杠、双引号与换行，HELP只需转义反斜杠与换行
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"distributedDemo/auth"
+	"distributedDemo/trace"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Middleware 包装handler，加上日志、认证等与业务无关的处理
+type Middleware func(http.Handler) http.Handler
+
+// Chain 按顺序包装h，第一个middleware最先处理请求
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// RequestIDHeader 请求ID所在的请求头与响应头
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// RequestIDFromContext 取出RequestID分配的请求ID
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestID 沿用上游传入的请求ID，没有时生成一个，并随响应返回
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			b := make([]byte, 8)
+			_, _ = rand.Read(b)
+			id = hex.EncodeToString(b)
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Recover handler发生panic时记录调用栈并返回500，不影响其他请求
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				//http.ErrAbortHandler用于主动中断响应，交给net/http处理
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				trace.Printf(r.Context(), "func Recover:panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Logging 记录每个请求的方法、路径、状态码与耗时
+func Logging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		trace.Printf(r.Context(), "%s %s %d %v request_id=%s\n",
+			r.Method, r.URL.RequestURI(), rec.status, time.Since(start), RequestIDFromContext(r.Context()))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.status = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	sr.wroteHeader = true
+	return sr.ResponseWriter.Write(b)
+}
+
+// Flush 流式响应（如rpc的流式调用）需要及时发出
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Timeout 处理超过d的请求返回503，handler应通过请求的context感知超时
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, d, "request timed out")
+	}
+}
+
+// CORS 允许origins中的网页跨域访问，只有明确列出的来源可以携带cookie或Basic认证等凭据
+// origins包含"*"时其他来源也可以访问，但响应中的Access-Control-Allow-Origin为"*"，浏览器不会携带凭据
+func CORS(origins ...string) Middleware {
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !(allowed["*"] || allowed[origin]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			h := w.Header()
+			if allowed[origin] {
+				h.Set("Access-Control-Allow-Origin", origin)
+				h.Add("Vary", "Origin")
+				h.Set("Access-Control-Allow-Credentials", "true")
+			} else {
+				h.Set("Access-Control-Allow-Origin", "*")
+			}
+			h.Set("Access-Control-Expose-Headers", RequestIDHeader+", Retry-After")
+			//预检请求直接返回
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+				h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+RequestIDHeader)
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int((10 * time.Minute).Seconds())))
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Gzip 客户端支持时压缩响应
+func Gzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// 只有带响应体的响应才会被压缩，gzip.Writer在第一次写入时才创建
+type gzipWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+	skip        bool
+}
+
+func (gw *gzipWriter) WriteHeader(code int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	h := gw.Header()
+	//已经压缩过的响应或没有响应体的状态码不再压缩
+	gw.skip = h.Get("Content-Encoding") != "" || code == http.StatusNoContent || code == http.StatusNotModified || code < 200
+	if !gw.skip {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+	}
+	gw.ResponseWriter.WriteHeader(code)
+}
+
+func (gw *gzipWriter) Write(b []byte) (int, error) {
+	if !gw.wroteHeader {
+		if gw.Header().Get("Content-Type") == "" {
+			gw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.skip {
+		return gw.ResponseWriter.Write(b)
+	}
+	if gw.gz == nil {
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	return gw.gz.Write(b)
+}
+
+// Flush 先写出已压缩的数据，流式响应才能及时到达客户端
+func (gw *gzipWriter) Flush() {
+	if gw.gz != nil {
+		_ = gw.gz.Flush()
+	}
+	if f, ok := gw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (gw *gzipWriter) Close() {
+	//已声明压缩但没有响应体时也要写出完整的gzip格式
+	if gw.gz == nil && gw.wroteHeader && !gw.skip {
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	if gw.gz != nil {
+		_ = gw.gz.Close()
+	}
+}
+
+// Auth 要求请求携带token，roles不为空时还要求具有其中某个角色，见auth.Require
+func Auth(roles ...auth.Role) Middleware {
+	return func(next http.Handler) http.Handler {
+		return auth.Require(next, roles...)
+	}
+}
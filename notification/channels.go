@@ -0,0 +1,138 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 每名学生的站内信数量上限，超出时删除最早的通知
+const inboxCapacity = 100
+
+// ErrNotFound 站内信中没有对应的通知
+var ErrNotFound = errors.New("notification not found")
+
+// Inbox 站内信渠道，通知保存在内存中，学生通过portal查看
+type Inbox struct {
+	mutex    sync.RWMutex
+	messages map[int][]Notification
+}
+
+// NewInbox 创建空的站内信
+func NewInbox() *Inbox {
+	return &Inbox{messages: make(map[int][]Notification)}
+}
+
+func (in *Inbox) Name() string { return ChannelInbox }
+
+// Send 将通知放入学生的站内信，相同ID的通知只保存一次
+func (in *Inbox) Send(_ context.Context, n Notification, _ Preferences) error {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	list := in.messages[n.StudentID]
+	for _, existing := range list {
+		if existing.ID == n.ID {
+			return nil
+		}
+	}
+	list = append(list, n)
+	if len(list) > inboxCapacity {
+		list = list[len(list)-inboxCapacity:]
+	}
+	in.messages[n.StudentID] = list
+	return nil
+}
+
+// List 按时间倒序返回学生的通知
+func (in *Inbox) List(studentID int) []Notification {
+	in.mutex.RLock()
+	defer in.mutex.RUnlock()
+	list := append([]Notification{}, in.messages[studentID]...)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	return list
+}
+
+// MarkRead 将学生的一条通知标记为已读
+func (in *Inbox) MarkRead(studentID int, id string) error {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	for i, n := range in.messages[studentID] {
+		if n.ID == id {
+			in.messages[studentID][i].Read = true
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// 单次webhook请求的超时时间，包括连接与读取响应
+const webhookTimeout = 10 * time.Second
+
+// webhook的地址由学生填写，因此不使用携带服务证书的tlsutil.Client，
+// 连接时再次检查地址，避免通过DNS解析或重定向访问内网
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(_, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+					return fmt.Errorf("webhook target %s is not a public address", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   webhookTimeout,
+		ResponseHeaderTimeout: webhookTimeout,
+	},
+}
+
+// WebhookChannel 将通知以JSON格式POST到学生设置的WebhookURL
+type WebhookChannel struct {
+	//为nil时使用webhookClient，不携带客户端证书且只连接公网地址
+	HTTP *http.Client
+}
+
+func (WebhookChannel) Name() string { return ChannelWebhook }
+
+func (wc WebhookChannel) Send(ctx context.Context, n Notification, prefs Preferences) error {
+	if prefs.WebhookURL == "" {
+		return errors.New("no webhook URL configured")
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, prefs.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	hc := wc.HTTP
+	if hc == nil {
+		hc = webhookClient
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded with code %d", prefs.WebhookURL, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/registry"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenFunc 返回调用通知服务使用的token
+type TokenFunc func(ctx context.Context) (string, error)
+
+// Client 通知服务的客户端，通过registry查找服务实例
+type Client struct {
+	rc    *registry.Client
+	token TokenFunc
+}
+
+// NewClient 创建通过rc查找通知服务的客户端，rc需在所依赖的服务中声明了NotificationService
+func NewClient(rc *registry.Client, token TokenFunc) *Client {
+	return &Client{rc: rc, token: token}
+}
+
+// StatusError 通知服务以非成功的状态码响应
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("notification service responded with code %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("notification service responded with code %d", e.StatusCode)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, studentID int, body, out interface{}) error {
+	base, err := c.rc.GetProvider(registry.NotificationService)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	u := base + path + "?student=" + url.QueryEscape(strconv.Itoa(studentID))
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := c.token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := c.rc.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return &StatusError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Inbox 学生的通知，按时间倒序排列
+func (c *Client) Inbox(ctx context.Context, studentID int) ([]Notification, error) {
+	var list []Notification
+	err := c.do(ctx, http.MethodGet, "/inbox", studentID, nil, &list)
+	return list, err
+}
+
+// MarkRead 将学生的一条通知标记为已读
+func (c *Client) MarkRead(ctx context.Context, studentID int, id string) error {
+	return c.do(ctx, http.MethodPost, "/inbox/"+url.PathEscape(id)+"/read", studentID, nil, nil)
+}
+
+// Preferences 返回学生的偏好设置及通知服务可用的渠道
+func (c *Client) Preferences(ctx context.Context, studentID int) (Preferences, []string, error) {
+	var res preferencesResponse
+	err := c.do(ctx, http.MethodGet, "/preferences", studentID, nil, &res)
+	return res.Preferences, res.Available, err
+}
+
+// SetPreferences 修改学生的偏好设置，设置不完整时返回*StatusError
+func (c *Client) SetPreferences(ctx context.Context, studentID int, p Preferences) error {
+	return c.do(ctx, http.MethodPut, "/preferences", studentID, p, nil)
+}
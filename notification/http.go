@@ -0,0 +1,120 @@
+package notification
+
+import (
+	"distributedDemo/auth"
+	"distributedDemo/events"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RegisterHandlers 注册接收事件、站内信与偏好设置的接口
+//
+//	POST /events                       grade服务投递的事件
+//	GET  /inbox?student={id}           学生的通知
+//	POST /inbox/{notificationID}/read?student={id}
+//	GET  /preferences?student={id}
+//	PUT  /preferences?student={id}
+//
+// 学生只能访问自己的通知与设置，可以省略student；管理员与服务需要指定student
+func (s *Server) RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/events", events.Handler(s.handleEvent))
+	mux.Handle("/inbox", auth.Require(http.HandlerFunc(s.inboxHandler)))
+	mux.Handle("/inbox/", auth.Require(http.HandlerFunc(s.inboxHandler)))
+	mux.Handle("/preferences", auth.Require(http.HandlerFunc(s.preferencesHandler)))
+}
+
+// 请求所针对的学生，无法确定或无权访问时返回非0的状态码
+func studentFor(r *http.Request) (int, int) {
+	claims, _ := auth.FromContext(r.Context())
+	param := r.URL.Query().Get("student")
+	var id int
+	if param != "" {
+		var err error
+		id, err = strconv.Atoi(param)
+		if err != nil {
+			return 0, http.StatusBadRequest
+		}
+	}
+	switch claims.Role {
+	case auth.RoleStudent:
+		if param != "" && id != claims.StudentID {
+			log.Printf("func studentFor:%s is not allowed to access student %d\n", claims.Subject, id)
+			return 0, http.StatusForbidden
+		}
+		return claims.StudentID, 0
+	case auth.RoleAdmin, auth.RoleService:
+		if param == "" {
+			return 0, http.StatusBadRequest
+		}
+		return id, 0
+	}
+	return 0, http.StatusForbidden
+}
+
+func (s *Server) inboxHandler(w http.ResponseWriter, r *http.Request) {
+	studentID, status := studentFor(r)
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/inbox"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		writeJSON(w, s.inbox.List(studentID))
+	case strings.HasSuffix(path, "/read") && r.Method == http.MethodPost:
+		id := strings.TrimSuffix(path, "/read")
+		if err := s.inbox.MarkRead(studentID, id); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case path == "":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// 返回偏好设置时同时返回可用的渠道，供页面显示
+type preferencesResponse struct {
+	Preferences
+	Available []string
+}
+
+func (s *Server) preferencesHandler(w http.ResponseWriter, r *http.Request) {
+	studentID, status := studentFor(r)
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, preferencesResponse{Preferences: s.prefs.Get(studentID), Available: s.Channels()})
+	case http.MethodPut:
+		var p Preferences
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := s.prefs.Set(studentID, p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, preferencesResponse{Preferences: p, Available: s.Channels()})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,260 @@
+// Package notification 订阅grade服务的成绩事件，按学生的偏好设置通过各渠道发送通知
+//
+// 通知的标题与正文由模板生成，内置的模板位于templates目录，可以通过Config.TemplateDir覆盖。
+// 渠道实现Channel接口，内置站内信（inbox）、邮件（email）与webhook三种，也可以通过AddChannel添加
+package notification
+
+import (
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/events"
+	"distributedDemo/grades"
+	gradesclient "distributedDemo/grades/client"
+	"distributedDemo/metrics"
+	"distributedDemo/registry"
+	"distributedDemo/trace"
+	"embed"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// SubscribedEvents 通知服务在Registration.Subscribes中声明的事件类型
+var SubscribedEvents = []string{string(grades.GradeAdded), string(grades.GradeUpdated)}
+
+// Notification 发给一名学生的通知
+type Notification struct {
+	ID        string
+	StudentID int
+	//触发通知的事件
+	EventID string
+	Type    events.Type
+	Subject string
+	Body    string
+	Time    time.Time
+	//学生在站内信中标记为已读
+	Read bool
+}
+
+// Channel 发送通知的渠道，如邮件，prefs为接收通知的学生的偏好设置
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, n Notification, prefs Preferences) error
+}
+
+// Config 通知服务的配置
+type Config struct {
+	//为空时只使用内置的模板，否则加载该目录中的*.tmpl覆盖同名的模板
+	TemplateDir string
+	//SMTP服务器的地址，如localhost:1025，为空时不提供邮件渠道
+	SMTPAddr string
+	//邮件的发件人
+	From string
+}
+
+//go:embed templates/*.tmpl
+var builtinTemplates embed.FS
+
+var notificationsSent = metrics.NewCounterVec("notifications_sent_total",
+	"Notifications sent, by channel and result.",
+	"channel", "result")
+
+// Server 通知服务，各自持有站内信与偏好设置
+type Server struct {
+	grades    *gradesclient.Client
+	templates *template.Template
+	inbox     *Inbox
+	prefs     *PreferenceStore
+
+	mutex    sync.RWMutex
+	channels map[string]Channel
+	//已经成功发送的事件与渠道，事件重试时不再重复发送
+	sent *sentSet
+}
+
+// NewServer 创建通过rc查找grade服务的通知服务，rc需在所依赖的服务中声明了GradeService
+func NewServer(rc *registry.Client, config Config) (*Server, error) {
+	t, err := template.ParseFS(builtinTemplates, "templates/*.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("func NewServer: %v", err)
+	}
+	if config.TemplateDir != "" {
+		t, err = t.ParseGlob(filepath.Join(config.TemplateDir, "*.tmpl"))
+		if err != nil {
+			return nil, fmt.Errorf("func NewServer: %v", err)
+		}
+	}
+	s := &Server{
+		//以服务自身的身份查询学生
+		grades: gradesclient.New(rc, gradesclient.WithToken(func(context.Context) (string, error) {
+			return auth.ServiceToken(string(registry.NotificationService)), nil
+		})),
+		templates: t,
+		inbox:     NewInbox(),
+		prefs:     NewPreferenceStore(),
+		channels:  make(map[string]Channel),
+		sent:      newSentSet(),
+	}
+	s.AddChannel(s.inbox)
+	s.AddChannel(WebhookChannel{})
+	if config.SMTPAddr != "" {
+		s.AddChannel(SMTPChannel{Addr: config.SMTPAddr, From: config.From})
+	}
+	return s, nil
+}
+
+// AddChannel 添加或替换同名的渠道，学生在偏好设置中按名称启用
+func (s *Server) AddChannel(c Channel) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.channels[c.Name()] = c
+}
+
+// Channels 可用的渠道名称
+func (s *Server) Channels() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	names := make([]string, 0, len(s.channels))
+	for name := range s.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Inbox 站内信
+func (s *Server) Inbox() *Inbox {
+	return s.inbox
+}
+
+// Preferences 学生的偏好设置
+func (s *Server) Preferences() *PreferenceStore {
+	return s.prefs
+}
+
+// 模板中可以使用的数据
+type templateData struct {
+	Type     events.Type
+	Student  grades.Student
+	Grade    grades.Grade
+	Previous *grades.Grade
+	By       string
+}
+
+// 处理一个成绩事件，任何一个渠道发送失败时返回错误，事件重试时只重新发送失败的渠道
+func (s *Server) handleEvent(ctx context.Context, e events.Event) error {
+	var ge grades.GradeEvent
+	if err := e.Decode(&ge); err != nil {
+		//无法解析的事件重试也不会成功
+		trace.Println(ctx, "Method handleEvent of Server:", err)
+		return nil
+	}
+	prefs := s.prefs.Get(ge.StudentID)
+	if !prefs.Wants(e.Type) {
+		return nil
+	}
+	student, err := s.grades.GetStudent(ctx, ge.StudentID)
+	if errors.Is(err, gradesclient.ErrNotFound) {
+		trace.Println(ctx, "Method handleEvent of Server:", err)
+		return nil
+	}
+	if err != nil {
+		//grade服务暂时不可用，事件稍后会重新投递
+		return fmt.Errorf("loading student %d: %v", ge.StudentID, err)
+	}
+	n, err := s.render(e, templateData{
+		Type:     e.Type,
+		Student:  *student,
+		Grade:    ge.Grade,
+		Previous: ge.Previous,
+		By:       ge.By,
+	})
+	if err != nil {
+		//模板错误需要修改模板后才能恢复，不重试
+		trace.Println(ctx, "Method handleEvent of Server:", err)
+		return nil
+	}
+
+	var failed []string
+	for _, name := range prefs.Channels {
+		s.mutex.RLock()
+		c, ok := s.channels[name]
+		s.mutex.RUnlock()
+		if !ok || s.sent.contains(e.ID, name) {
+			continue
+		}
+		if err := c.Send(ctx, n, prefs); err != nil {
+			trace.Printf(ctx, "Method handleEvent of Server:sending %s via %s failed: %v\n", n.ID, name, err)
+			notificationsSent.For(ctx).Inc(name, "failure")
+			failed = append(failed, name)
+			continue
+		}
+		notificationsSent.For(ctx).Inc(name, "ok")
+		s.sent.add(e.ID, name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("channels %s failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// 以事件类型对应的模板生成通知，如GradeAdded.subject与GradeAdded.body
+func (s *Server) render(e events.Event, data templateData) (Notification, error) {
+	var subject, body strings.Builder
+	if err := s.templates.ExecuteTemplate(&subject, string(e.Type)+".subject", data); err != nil {
+		return Notification{}, err
+	}
+	if err := s.templates.ExecuteTemplate(&body, string(e.Type)+".body", data); err != nil {
+		return Notification{}, err
+	}
+	return Notification{
+		//同一事件重试时生成相同的ID
+		ID:        e.ID,
+		StudentID: data.Student.ID,
+		EventID:   e.ID,
+		Type:      e.Type,
+		Subject:   strings.TrimSpace(subject.String()),
+		Body:      strings.TrimSpace(body.String()),
+		Time:      e.Time,
+	}, nil
+}
+
+// 记录最近成功发送的事件与渠道
+type sentSet struct {
+	mutex sync.Mutex
+	keys  map[string]bool
+	order []string
+}
+
+// 超出时淘汰最早的记录
+const sentCapacity = 4096
+
+func newSentSet() *sentSet {
+	return &sentSet{keys: make(map[string]bool)}
+}
+
+func (s *sentSet) contains(eventID, channel string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.keys[eventID+"/"+channel]
+}
+
+func (s *sentSet) add(eventID, channel string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := eventID + "/" + channel
+	if s.keys[key] {
+		return
+	}
+	s.keys[key] = true
+	s.order = append(s.order, key)
+	if len(s.order) > sentCapacity {
+		delete(s.keys, s.order[0])
+		s.order = s.order[1:]
+	}
+}
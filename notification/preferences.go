@@ -0,0 +1,131 @@
+package notification
+
+import (
+	"distributedDemo/events"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// 内置渠道的名称
+const (
+	ChannelInbox   = "inbox"
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+// Preferences 学生对通知的偏好设置
+type Preferences struct {
+	//为false时不发送任何通知
+	Enabled bool
+	//启用的渠道
+	Channels []string
+	//接收通知的事件类型，为空时接收所有事件
+	Events []events.Type `json:",omitempty"`
+	//email渠道的收件地址
+	Email string `json:",omitempty"`
+	//webhook渠道POST通知的地址
+	WebhookURL string `json:",omitempty"`
+}
+
+// DefaultPreferences 未设置过偏好的学生只接收站内信
+var DefaultPreferences = Preferences{Enabled: true, Channels: []string{ChannelInbox}}
+
+// Wants 是否需要为t类型的事件发送通知
+func (p Preferences) Wants(t events.Type) bool {
+	if !p.Enabled {
+		return false
+	}
+	if len(p.Events) == 0 {
+		return true
+	}
+	for _, e := range p.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate 检查启用的渠道所需的地址是否已填写，webhook的地址不能指向本机或内网
+func (p Preferences) Validate() error {
+	for _, c := range p.Channels {
+		switch c {
+		case ChannelEmail:
+			if p.Email == "" {
+				return fmt.Errorf("email channel requires an email address")
+			}
+		case ChannelWebhook:
+			u, err := url.Parse(p.WebhookURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("webhook channel requires an http(s) URL")
+			}
+			if err := checkWebhookHost(u.Hostname()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// webhook只能指向公网地址，不允许以通知服务的身份访问本机或内网的服务
+func checkWebhookHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("webhook URL must not point to a loopback address")
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return fmt.Errorf("cannot resolve webhook host %s: %v", host, err)
+		}
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return fmt.Errorf("webhook URL must not point to a loopback or private address")
+		}
+	}
+	return nil
+}
+
+// 排除回环、私有、链路本地、未指定与组播地址
+func publicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsMulticast()
+}
+
+// PreferenceStore 以学生ID为键保存偏好设置
+type PreferenceStore struct {
+	mutex sync.RWMutex
+	prefs map[int]Preferences
+}
+
+// NewPreferenceStore 创建空的偏好设置，所有学生使用DefaultPreferences
+func NewPreferenceStore() *PreferenceStore {
+	return &PreferenceStore{prefs: make(map[int]Preferences)}
+}
+
+// Get 返回学生的偏好设置，未设置过时返回DefaultPreferences
+func (ps *PreferenceStore) Get(studentID int) Preferences {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+	p, ok := ps.prefs[studentID]
+	if !ok {
+		return DefaultPreferences
+	}
+	return p
+}
+
+// Set 校验并保存学生的偏好设置
+func (ps *PreferenceStore) Set(studentID int, p Preferences) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.prefs[studentID] = p
+	return nil
+}
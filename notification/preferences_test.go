@@ -0,0 +1,148 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"172.32.0.1", true},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckWebhookHost(t *testing.T) {
+	tests := []struct {
+		host string
+		ok   bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"localhost", false},
+		{"LocalHost.", false},
+		{"grades.localhost", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"169.254.169.254", false},
+		//无法解析的主机名同样被拒绝
+		{"webhook.invalid", false},
+	}
+	for _, tt := range tests {
+		if err := checkWebhookHost(tt.host); (err == nil) != tt.ok {
+			t.Errorf("checkWebhookHost(%q) = %v, want ok=%v", tt.host, err, tt.ok)
+		}
+	}
+}
+
+func TestPreferencesValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		prefs Preferences
+		ok    bool
+	}{
+		{"inbox", DefaultPreferences, true},
+		{"email", Preferences{Enabled: true, Channels: []string{ChannelEmail}, Email: "nick@example.com"}, true},
+		{"email without address", Preferences{Enabled: true, Channels: []string{ChannelEmail}}, false},
+		{"public webhook", Preferences{Channels: []string{ChannelWebhook}, WebhookURL: "https://8.8.8.8/hook"}, true},
+		{"webhook without URL", Preferences{Channels: []string{ChannelWebhook}}, false},
+		{"webhook with another scheme", Preferences{Channels: []string{ChannelWebhook}, WebhookURL: "ftp://8.8.8.8/hook"}, false},
+		{"webhook without host", Preferences{Channels: []string{ChannelWebhook}, WebhookURL: "http:///hook"}, false},
+		{"loopback webhook", Preferences{Channels: []string{ChannelWebhook}, WebhookURL: "http://127.0.0.1:5000/students"}, false},
+		{"IPv6 loopback webhook", Preferences{Channels: []string{ChannelWebhook}, WebhookURL: "http://[::1]:3000/services"}, false},
+		{"metadata webhook", Preferences{Channels: []string{ChannelWebhook}, WebhookURL: "http://169.254.169.254/latest"}, false},
+		{"localhost webhook", Preferences{Channels: []string{ChannelWebhook}, WebhookURL: "http://localhost:4000/log"}, false},
+		//未启用webhook渠道时不检查地址
+		{"unused webhook", Preferences{Channels: []string{ChannelInbox}, WebhookURL: "http://127.0.0.1/"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.prefs.Validate(); (err == nil) != tt.ok {
+				t.Fatalf("Validate = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+
+	ps := NewPreferenceStore()
+	if err := ps.Set(1, Preferences{Channels: []string{ChannelWebhook}, WebhookURL: "http://10.0.0.1/"}); err == nil {
+		t.Fatal("PreferenceStore saved a private webhook URL")
+	}
+	if got := ps.Get(1); got.WebhookURL != "" {
+		t.Fatalf("preferences after a rejected Set = %+v, want the defaults", got)
+	}
+}
+
+// 即使地址通过了Validate（如DNS解析结果随后改变），默认的客户端在连接时也拒绝非公网地址
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+	err := WebhookChannel{}.Send(context.Background(), Notification{ID: "n1"}, Preferences{WebhookURL: srv.URL})
+	if err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Fatalf("Send to %s = %v, want the dial to be refused", srv.URL, err)
+	}
+	if atomic.LoadInt32(&hits) != 0 {
+		t.Fatal("webhook reached a loopback server")
+	}
+}
+
+func TestWebhookChannelSend(t *testing.T) {
+	var received Notification
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		_ = json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	wc := WebhookChannel{HTTP: srv.Client()}
+	n := Notification{ID: "n1", StudentID: 1, Subject: "New grade"}
+	if err := wc.Send(context.Background(), n, Preferences{WebhookURL: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if received.ID != "n1" || received.Subject != "New grade" {
+		t.Fatalf("webhook received %+v", received)
+	}
+	status = http.StatusInternalServerError
+	if err := wc.Send(context.Background(), n, Preferences{WebhookURL: srv.URL}); err == nil {
+		t.Fatal("Send succeeded although the webhook responded with 500")
+	}
+	if err := wc.Send(context.Background(), n, Preferences{}); err == nil {
+		t.Fatal("Send succeeded without a webhook URL")
+	}
+}
@@ -0,0 +1,164 @@
+package notification
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTPChannel 通过SMTP服务器发送邮件，本地开发时可以指向FakeSMTPServer
+type SMTPChannel struct {
+	Addr string
+	From string
+	//为nil时不进行认证
+	Auth smtp.Auth
+}
+
+func (SMTPChannel) Name() string { return ChannelEmail }
+
+func (sc SMTPChannel) Send(ctx context.Context, n Notification, prefs Preferences) error {
+	if prefs.Email == "" {
+		return errors.New("no email address configured")
+	}
+	from := sc.From
+	if from == "" {
+		from = "notifications@localhost"
+	}
+	msg := strings.Join([]string{
+		"From: " + from,
+		"To: " + prefs.Email,
+		"Subject: " + n.Subject,
+		"Date: " + n.Time.Format(time.RFC1123Z),
+		"Message-ID: <" + n.ID + "@" + from[strings.LastIndex(from, "@")+1:] + ">",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		n.Body,
+	}, "\r\n")
+	//smtp.SendMail不接受context，放在goroutine中以便在ctx取消时返回
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(sc.Addr, sc.Auth, from, []string{prefs.Email}, []byte(msg))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Mail FakeSMTPServer收到的邮件
+type Mail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// FakeSMTPServer 本地开发与测试使用的SMTP服务器，只记录收到的邮件，不进行投递
+type FakeSMTPServer struct {
+	ln    net.Listener
+	mutex sync.Mutex
+	mails []Mail
+}
+
+// ListenFakeSMTP 在addr上启动FakeSMTPServer，如127.0.0.1:1025，端口为0时由系统分配
+func ListenFakeSMTP(addr string) (*FakeSMTPServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &FakeSMTPServer{ln: ln}
+	go s.serve()
+	return s, nil
+}
+
+// Addr 实际监听的地址
+func (s *FakeSMTPServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Mails 返回收到的所有邮件
+func (s *FakeSMTPServer) Mails() []Mail {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Mail{}, s.mails...)
+}
+
+// Close 停止接收邮件
+func (s *FakeSMTPServer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *FakeSMTPServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// 只实现net/smtp发送邮件需要的命令
+func (s *FakeSMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		_, _ = fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	reply("220 localhost fake SMTP ready")
+	var mail Mail
+	for {
+		_ = conn.SetDeadline(time.Now().Add(time.Minute))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "HELO"), strings.HasPrefix(cmd, "EHLO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			mail = Mail{From: strings.Trim(line[len("MAIL FROM:"):], " <>")}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			mail.To = append(mail.To, strings.Trim(line[len("RCPT TO:"):], " <>"))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.TrimRight(l, "\r\n") == "." {
+					break
+				}
+				//去掉发送方为以.开头的行添加的.
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			mail.Data = data.String()
+			s.mutex.Lock()
+			s.mails = append(s.mails, mail)
+			s.mutex.Unlock()
+			log.Printf("Method handle of FakeSMTPServer:mail from %s to %v\n", mail.From, mail.To)
+			reply("250 OK")
+		case cmd == "RSET", cmd == "NOOP":
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
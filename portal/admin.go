@@ -0,0 +1,115 @@
+package portal
+
+import (
+	"distributedDemo/auth"
+	"distributedDemo/registry"
+	"distributedDemo/trace"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// 只有管理员可以访问管理页面
+func requireAdmin(next http.Handler) http.Handler {
+	return requireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r).Role != auth.RoleAdmin {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// 依赖关系图中的一个服务
+type dependencyNode struct {
+	Name      registry.ServiceName
+	Instances int
+	Requires  []registry.ServiceName
+	//依赖于该服务的其他服务
+	RequiredBy []registry.ServiceName
+}
+
+type adminPage struct {
+	layout
+	Instances    []registry.InstanceStatus
+	Dependencies []dependencyNode
+}
+
+func (s *Server) adminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := currentUser(r).Token(string(registry.PortalService), time.Minute)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	instances, err := s.client.Instances(r.Context(), token)
+	if err != nil {
+		trace.Println(r.Context(), "Method adminHandler of Server:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	page := adminPage{
+		layout:       newLayout(w, r),
+		Instances:    instances,
+		Dependencies: dependencyGraph(instances),
+	}
+	render(w, r, http.StatusOK, "admin.html", page)
+}
+
+// 由各实例声明的RequiredServices得出服务之间的依赖关系
+func dependencyGraph(instances []registry.InstanceStatus) []dependencyNode {
+	nodes := make(map[registry.ServiceName]*dependencyNode)
+	node := func(name registry.ServiceName) *dependencyNode {
+		n, ok := nodes[name]
+		if !ok {
+			n = &dependencyNode{Name: name}
+			nodes[name] = n
+		}
+		return n
+	}
+	edges := make(map[[2]registry.ServiceName]bool)
+	for _, inst := range instances {
+		n := node(inst.ServiceName)
+		if inst.Registered {
+			n.Instances++
+		}
+		for _, req := range inst.RequiredServices {
+			edge := [2]registry.ServiceName{inst.ServiceName, req}
+			if edges[edge] {
+				continue
+			}
+			edges[edge] = true
+			n.Requires = append(n.Requires, req)
+			node(req).RequiredBy = append(node(req).RequiredBy, inst.ServiceName)
+		}
+	}
+	graph := make([]dependencyNode, 0, len(nodes))
+	for _, n := range nodes {
+		graph = append(graph, *n)
+	}
+	sort.Slice(graph, func(i, j int) bool { return graph[i].Name < graph[j].Name })
+	return graph
+}
+
+// 执行管理操作后回到管理页面，并显示操作结果
+func (s *Server) adminActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	action, instanceURL := r.PostFormValue("Action"), r.PostFormValue("URL")
+	token, err := currentUser(r).Token(string(registry.PortalService), time.Minute)
+	if err == nil {
+		err = s.client.AdminAction(r.Context(), token, action, instanceURL)
+	}
+	if err != nil {
+		trace.Println(r.Context(), "Method adminActionHandler of Server:", err)
+		setFlash(w, "error", action+" "+instanceURL+": "+err.Error())
+	} else {
+		setFlash(w, "success", action+" "+instanceURL+": done")
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
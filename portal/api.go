@@ -0,0 +1,535 @@
+package portal
+
+import (
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/grades"
+	gradesclient "distributedDemo/grades/client"
+	"distributedDemo/idempotency"
+	"distributedDemo/notification"
+	"distributedDemo/registry"
+	"distributedDemo/rpc"
+	"distributedDemo/trace"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIPrefix 供单页应用与移动端使用的JSON API的路径前缀，不兼容的修改使用新的版本号
+const APIPrefix = "/api/v1/"
+
+// APITokenTTL 通过POST /api/v1/login获取的token的有效期
+const APITokenTTL = time.Hour
+
+// APITokenAudience API token的Audience，其他服务不接受该token，portal以每个请求单独签发的短期token调用它们
+const APITokenAudience = string(registry.PortalService)
+
+// 描述API的OpenAPI 3文档，修改API时需同步修改
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// API的错误响应，格式与rpc包的错误相同，校验失败时fields为各字段的错误信息
+type apiError struct {
+	Code    rpc.Code          `json:"code"`
+	Message string            `json:"message,omitempty"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// 由状态码得出错误码
+func apiCode(status int) rpc.Code {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return rpc.CodeInvalidArgument
+	case http.StatusUnauthorized:
+		return rpc.CodeUnauthenticated
+	case http.StatusForbidden:
+		return rpc.CodePermissionDenied
+	case http.StatusNotFound:
+		return rpc.CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return rpc.CodeUnimplemented
+	case http.StatusConflict:
+		return rpc.CodeAborted
+	case http.StatusPreconditionFailed:
+		return rpc.CodeFailedPrecondition
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return rpc.CodeUnavailable
+	}
+	return rpc.CodeInternal
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string, fields map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(apiError{Code: apiCode(status), Message: message, Fields: fields})
+}
+
+// grade服务的错误，版本不匹配时与HTTP的If-Match一致以412响应
+func writeGradesError(w http.ResponseWriter, err error) {
+	status := gradesStatus(err)
+	if errors.Is(err, gradesclient.ErrVersionMismatch) {
+		status = http.StatusPreconditionFailed
+	}
+	writeAPIError(w, status, errorMessage(err), nil)
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// 注册在APIPrefix下的接口，路径与参数见openapi.json
+func (s *Server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(APIPrefix+"openapi.json", serveOpenAPI)
+	mux.HandleFunc(APIPrefix+"login", apiLoginHandler)
+	mux.Handle(APIPrefix+"me", requireAPIUser(http.HandlerFunc(s.apiMeHandler)))
+	students := requireAPIUser(http.HandlerFunc(s.apiStudentsHandler))
+	mux.Handle(APIPrefix+"students", students)
+	mux.Handle(APIPrefix+"students/", students)
+	inbox := requireAPIUser(http.HandlerFunc(s.apiInboxHandler))
+	mux.Handle(APIPrefix+"inbox", inbox)
+	mux.Handle(APIPrefix+"inbox/", inbox)
+	mux.HandleFunc(APIPrefix, func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "no such API", nil)
+	})
+	return mux
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPIDocument)
+}
+
+// API接受Authorization中的token，或登录portal后的会话
+// 调用grade等服务时不转发该token，而是与会话一样由userToken签发
+// 使用会话时修改的请求需要在X-CSRF-Token中携带GET /api/v1/me返回的CSRFToken，token不会被其他站点自动携带，不需要检查
+func requireAPIUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u *auth.User
+		claims, err := auth.FromRequestFor(r, APITokenAudience)
+		switch {
+		case err == nil:
+			//服务的token没有对应的用户，用户被删除后token也不再有效
+			user, ok := auth.GetUser(claims.Subject)
+			if !ok || claims.Role == auth.RoleService {
+				writeAPIError(w, http.StatusUnauthorized, "the token does not belong to a user", nil)
+				return
+			}
+			u = user
+		case errors.Is(err, auth.ErrNoToken):
+			user, ok := auth.SessionUser(r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAPIError(w, http.StatusUnauthorized, "log in with POST "+APIPrefix+"login and send the token as a Bearer token", nil)
+				return
+			}
+			if r.Method != http.MethodGet && r.Method != http.MethodHead && !validCSRF(r, "") {
+				writeAPIError(w, http.StatusForbidden, "requests using the portal session must send the CSRFToken from GET "+APIPrefix+"me in "+csrfHeader, nil)
+				return
+			}
+			u = user
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, err.Error(), nil)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userKey{}, u)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type apiUser struct {
+	Username  string
+	Role      auth.Role
+	StudentID int      `json:",omitempty"`
+	Classes   []string `json:",omitempty"`
+}
+
+func newAPIUser(u *auth.User) apiUser {
+	return apiUser{Username: u.Username, Role: u.Role, StudentID: u.StudentID, Classes: u.Classes}
+}
+
+type apiLoginRequest struct {
+	Username string
+	Password string
+}
+
+type apiLoginResponse struct {
+	Token     string
+	ExpiresAt time.Time
+	User      apiUser
+}
+
+// POST /api/v1/login 以用户名与密码换取token
+func apiLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST", nil)
+		return
+	}
+	var req apiLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "the request body must be a JSON object: "+err.Error(), nil)
+		return
+	}
+	u, err := auth.Authenticate(req.Username, req.Password)
+	if err != nil {
+		trace.Println(r.Context(), "func apiLoginHandler:", req.Username, err)
+		writeAPIError(w, http.StatusUnauthorized, "invalid username or password", nil)
+		return
+	}
+	expiresAt := time.Now().Add(APITokenTTL)
+	claims := u.Claims(string(registry.PortalService))
+	claims.Audience = APITokenAudience
+	token, err := auth.IssueToken(claims, APITokenTTL)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, apiLoginResponse{Token: token, ExpiresAt: expiresAt, User: newAPIUser(u)})
+}
+
+// 学生列表中的一项
+type apiStudentSummary struct {
+	ID        int
+	FirstName string
+	LastName  string
+	Class     string
+	//没有成绩时为null
+	Average    *float32
+	GradeCount int
+	Version    int
+	URL        string
+}
+
+type apiGrade struct {
+	//在学生的成绩中的位置，修改与删除时使用
+	Index int
+	grades.Grade
+	URL string
+}
+
+type apiStudent struct {
+	apiStudentSummary
+	Grades []apiGrade
+	//当前用户可以修改该学生的成绩
+	CanEdit bool
+}
+
+func newAPIStudentSummary(s grades.Student) apiStudentSummary {
+	summary := apiStudentSummary{
+		ID:         s.ID,
+		FirstName:  s.FirstName,
+		LastName:   s.LastName,
+		Class:      s.Class,
+		GradeCount: len(s.Grades),
+		Version:    s.Version,
+		URL:        fmt.Sprintf("%sstudents/%d", APIPrefix, s.ID),
+	}
+	if len(s.Grades) > 0 {
+		average := s.Average()
+		summary.Average = &average
+	}
+	return summary
+}
+
+func newAPIStudent(u *auth.User, s *grades.Student, order sortOrder) apiStudent {
+	student := apiStudent{
+		apiStudentSummary: newAPIStudentSummary(*s),
+		Grades:            []apiGrade{},
+		CanEdit:           canWriteGrades(u, s.Class),
+	}
+	for _, row := range sortGrades(s.Grades, order) {
+		student.Grades = append(student.Grades, apiGrade{
+			Index: row.Index,
+			Grade: row.Grade,
+			URL:   fmt.Sprintf("%s/grades/%d", student.URL, row.Index),
+		})
+	}
+	return student
+}
+
+// GET /api/v1/me 的响应，汇总当前用户在各个服务中的信息
+type apiMe struct {
+	User apiUser
+	//使用portal的会话调用API时，修改的请求需要在X-CSRF-Token中携带
+	CSRFToken string `json:",omitempty"`
+	//学生自己的成绩摘要
+	Student *apiStudentSummary `json:",omitempty"`
+	//学生未读的通知数
+	Unread *int `json:",omitempty"`
+	//暂时无法访问的服务，对应的字段被省略，其余字段仍然有效
+	Unavailable []registry.ServiceName `json:",omitempty"`
+}
+
+func (s *Server) apiMeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use GET", nil)
+		return
+	}
+	u := currentUser(r)
+	me := apiMe{User: newAPIUser(u)}
+	if r.Header.Get("Authorization") == "" {
+		me.CSRFToken = csrfToken(w, r)
+	}
+	if u.Role == auth.RoleStudent {
+		//两个服务相互独立，同时查询
+		var wg sync.WaitGroup
+		var student *grades.Student
+		var inbox []notification.Notification
+		var gradesErr, inboxErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			student, gradesErr = s.grades.GetStudent(r.Context(), u.StudentID)
+		}()
+		go func() {
+			defer wg.Done()
+			inbox, inboxErr = s.notifications.Inbox(r.Context(), u.StudentID)
+		}()
+		wg.Wait()
+		if gradesErr != nil {
+			trace.Println(r.Context(), "Method apiMeHandler of Server:", gradesErr)
+			me.Unavailable = append(me.Unavailable, registry.GradeService)
+		} else {
+			summary := newAPIStudentSummary(*student)
+			me.Student = &summary
+		}
+		if inboxErr != nil {
+			trace.Println(r.Context(), "Method apiMeHandler of Server:", inboxErr)
+			me.Unavailable = append(me.Unavailable, registry.NotificationService)
+		} else {
+			unread := unreadCount(inbox)
+			me.Unread = &unread
+		}
+	}
+	writeAPIJSON(w, http.StatusOK, me)
+}
+
+func unreadCount(list []notification.Notification) int {
+	n := 0
+	for _, item := range list {
+		if !item.Read {
+			n++
+		}
+	}
+	return n
+}
+
+type apiStudentList struct {
+	Students []apiStudentSummary
+}
+
+// 添加学生的请求
+type apiStudentInput struct {
+	FirstName string
+	LastName  string
+	Class     string
+}
+
+// GET  /api/v1/students?q=&sort=&order=
+// POST /api/v1/students
+// GET  /api/v1/students/{id}?sort=&order=
+// POST /api/v1/students/{id}/grades
+// PUT|DELETE /api/v1/students/{id}/grades/{index}
+func (s *Server) apiStudentsHandler(w http.ResponseWriter, r *http.Request) {
+	pathSegments := strings.Split(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(APIPrefix, "/")), "/")
+	id, index, ok := parsePath(pathSegments)
+	if !ok || len(pathSegments) > 5 {
+		writeAPIError(w, http.StatusNotFound, "no such resource", nil)
+		return
+	}
+	switch {
+	case len(pathSegments) == 2 && r.Method == http.MethodGet:
+		s.apiListStudents(w, r)
+	case len(pathSegments) == 2 && r.Method == http.MethodPost:
+		s.apiCreateStudent(w, r)
+	case len(pathSegments) == 3 && r.Method == http.MethodGet:
+		s.apiGetStudent(w, r, id)
+	case len(pathSegments) == 4 && r.Method == http.MethodPost:
+		s.apiWriteGrade(w, r, id, func(ctx context.Context, g grades.Grade) error {
+			_, err := s.grades.AddGrade(ctx, id, g)
+			return err
+		})
+	case len(pathSegments) == 5 && r.Method == http.MethodPut:
+		s.apiWriteGrade(w, r, id, func(ctx context.Context, g grades.Grade) error {
+			_, err := s.grades.UpdateGrade(ctx, id, index, g)
+			return err
+		})
+	case len(pathSegments) == 5 && r.Method == http.MethodDelete:
+		if err := s.grades.DeleteGrade(apiContext(r), id, index); err != nil {
+			trace.Println(r.Context(), "Method apiStudentsHandler of Server:", err)
+			writeGradesError(w, err)
+			return
+		}
+		s.apiRespondStudent(w, r, id, http.StatusOK)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, r.Method+" is not supported on "+r.URL.Path, nil)
+	}
+}
+
+// 请求头中的If-Match与Idempotency-Key，分别对应页面表单中的Version与IdempotencyKey
+func apiContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if h := strings.TrimSpace(r.Header.Get("If-Match")); h != "" && h != "*" {
+		version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(h, "W/"), `"`))
+		if err != nil {
+			//无法解析的ETag与任何版本都不匹配
+			version = -1
+		}
+		ctx = gradesclient.IfVersion(ctx, version)
+	}
+	if key := r.Header.Get(idempotency.Header); key != "" {
+		ctx = gradesclient.WithIdempotencyKey(ctx, key)
+	}
+	return ctx
+}
+
+func (s *Server) apiListStudents(w http.ResponseWriter, r *http.Request) {
+	list, err := s.grades.ListStudents(r.Context())
+	if err != nil {
+		trace.Println(r.Context(), "Method apiListStudents of Server:", err)
+		writeGradesError(w, err)
+		return
+	}
+	found := searchStudents(list, strings.TrimSpace(r.URL.Query().Get("q")), parseStudentsOrder(r))
+	res := apiStudentList{Students: make([]apiStudentSummary, 0, len(found))}
+	for _, student := range found {
+		res.Students = append(res.Students, newAPIStudentSummary(student))
+	}
+	writeAPIJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) apiCreateStudent(w http.ResponseWriter, r *http.Request) {
+	var in apiStudentInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "the request body must be a JSON object: "+err.Error(), nil)
+		return
+	}
+	student := grades.Student{
+		FirstName: strings.TrimSpace(in.FirstName),
+		LastName:  strings.TrimSpace(in.LastName),
+		Class:     strings.TrimSpace(in.Class),
+	}
+	if problems := student.Problems(); problems != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "the student is invalid", problems)
+		return
+	}
+	created, err := s.grades.CreateStudent(apiContext(r), student)
+	if err != nil {
+		trace.Println(r.Context(), "Method apiCreateStudent of Server:", err)
+		writeGradesError(w, err)
+		return
+	}
+	res := newAPIStudent(currentUser(r), created, sortOrder{})
+	w.Header().Set("Location", res.URL)
+	w.Header().Set("ETag", created.ETag())
+	writeAPIJSON(w, http.StatusCreated, res)
+}
+
+// 学生的版本作为ETag，可以在修改时通过If-Match使用
+func (s *Server) apiGetStudent(w http.ResponseWriter, r *http.Request, id int) {
+	student, err := s.grades.GetStudent(r.Context(), id)
+	if err != nil {
+		trace.Println(r.Context(), "Method apiGetStudent of Server:", err)
+		writeGradesError(w, err)
+		return
+	}
+	w.Header().Set("ETag", student.ETag())
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if strings.TrimPrefix(r.Header.Get("If-None-Match"), "W/") == student.ETag() {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, newAPIStudent(currentUser(r), student, parseGradesOrder(r)))
+}
+
+// 校验请求体中的成绩并调用write，成功后返回修改后的学生
+func (s *Server) apiWriteGrade(w http.ResponseWriter, r *http.Request, id int, write func(ctx context.Context, g grades.Grade) error) {
+	var g grades.Grade
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "the request body must be a JSON object: "+err.Error(), nil)
+		return
+	}
+	g.Title = strings.TrimSpace(g.Title)
+	if problems := g.Problems(); problems != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, "the grade is invalid", problems)
+		return
+	}
+	if err := write(apiContext(r), g); err != nil {
+		trace.Println(r.Context(), "Method apiWriteGrade of Server:", err)
+		writeGradesError(w, err)
+		return
+	}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		status = http.StatusCreated
+	}
+	s.apiRespondStudent(w, r, id, status)
+}
+
+// 修改成功后以学生最新的内容响应，客户端不需要再次查询
+func (s *Server) apiRespondStudent(w http.ResponseWriter, r *http.Request, id, status int) {
+	student, err := s.grades.GetStudent(r.Context(), id)
+	if err != nil {
+		//修改已经生效，只是无法返回最新的内容
+		trace.Println(r.Context(), "Method apiRespondStudent of Server:", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("ETag", student.ETag())
+	writeAPIJSON(w, status, newAPIStudent(currentUser(r), student, sortOrder{}))
+}
+
+type apiInbox struct {
+	Notifications []notification.Notification
+	Unread        int
+}
+
+// GET  /api/v1/inbox
+// POST /api/v1/inbox/{id}/read
+func (s *Server) apiInboxHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if u.Role != auth.RoleStudent {
+		writeAPIError(w, http.StatusForbidden, "only students have an inbox", nil)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix+"inbox"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		list, err := s.notifications.Inbox(r.Context(), u.StudentID)
+		if err != nil {
+			trace.Println(r.Context(), "Method apiInboxHandler of Server:", err)
+			writeAPIError(w, notificationStatus(err), err.Error(), nil)
+			return
+		}
+		if list == nil {
+			list = []notification.Notification{}
+		}
+		writeAPIJSON(w, http.StatusOK, apiInbox{Notifications: list, Unread: unreadCount(list)})
+	case strings.HasSuffix(path, "/read") && r.Method == http.MethodPost:
+		if err := s.notifications.MarkRead(r.Context(), u.StudentID, strings.TrimSuffix(path, "/read")); err != nil {
+			trace.Println(r.Context(), "Method apiInboxHandler of Server:", err)
+			writeAPIError(w, notificationStatus(err), err.Error(), nil)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case path == "" || strings.HasSuffix(path, "/read"):
+		writeAPIError(w, http.StatusMethodNotAllowed, r.Method+" is not supported on "+r.URL.Path, nil)
+	default:
+		writeAPIError(w, http.StatusNotFound, "no such resource", nil)
+	}
+}
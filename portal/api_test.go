@@ -0,0 +1,288 @@
+package portal
+
+import (
+	"bytes"
+	"distributedDemo/auth"
+	"distributedDemo/registry"
+	"distributedDemo/rpc"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 调用API，token为空时使用hc中的会话，响应体解码到out
+func (tp *testPortal) api(t *testing.T, hc *http.Client, method, path, token string, body interface{}, header map[string]string, out interface{}) *http.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, tp.url+path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		auth.SetToken(req, token)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if out != nil && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotModified {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return res
+}
+
+// 通过POST /api/v1/login获取token
+func (tp *testPortal) apiToken(t *testing.T, username string) string {
+	t.Helper()
+	var login apiLoginResponse
+	res := tp.api(t, http.DefaultClient, http.MethodPost, APIPrefix+"login", "", apiLoginRequest{Username: username, Password: username}, nil, &login)
+	if res.StatusCode != http.StatusOK || login.Token == "" {
+		t.Fatalf("login as %s: status %d", username, res.StatusCode)
+	}
+	if login.User.Username != username {
+		t.Fatalf("login returned user %+v", login.User)
+	}
+	return login.Token
+}
+
+func TestAPILogin(t *testing.T) {
+	tp := startPortal(t)
+	tp.apiToken(t, "teacherA")
+	var e apiError
+	res := tp.api(t, http.DefaultClient, http.MethodPost, APIPrefix+"login", "", apiLoginRequest{Username: "teacherA", Password: "wrong"}, nil, &e)
+	if res.StatusCode != http.StatusUnauthorized || e.Code != rpc.CodeUnauthenticated {
+		t.Fatalf("wrong password: status %d, %+v", res.StatusCode, e)
+	}
+	res = tp.api(t, http.DefaultClient, http.MethodGet, APIPrefix+"login", "", nil, nil, &e)
+	if res.StatusCode != http.StatusMethodNotAllowed || e.Code != rpc.CodeUnimplemented {
+		t.Fatalf("GET login: status %d, %+v", res.StatusCode, e)
+	}
+}
+
+// 没有token、token无效或不属于用户时以401响应，缺少或无效的token同时要求客户端以Bearer认证
+func TestAPIRequiresUser(t *testing.T) {
+	tp := startPortal(t)
+	tests := []struct {
+		name      string
+		token     string
+		challenge bool
+	}{
+		{"no token", "", true},
+		{"invalid token", "not-a-token", true},
+		{"service token", auth.ServiceToken(string(registry.GradeService)), false},
+	}
+	for _, tt := range tests {
+		var e apiError
+		res := tp.api(t, http.DefaultClient, http.MethodGet, APIPrefix+"students", tt.token, nil, nil, &e)
+		if res.StatusCode != http.StatusUnauthorized || e.Code != rpc.CodeUnauthenticated {
+			t.Errorf("%s: status %d, %+v", tt.name, res.StatusCode, e)
+		}
+		if got := res.Header.Get("WWW-Authenticate") != ""; got != tt.challenge {
+			t.Errorf("%s: WWW-Authenticate %q", tt.name, res.Header.Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestAPIStudents(t *testing.T) {
+	tp := startPortal(t)
+	token := tp.apiToken(t, "teacherA")
+
+	var list apiStudentList
+	tp.api(t, http.DefaultClient, http.MethodGet, APIPrefix+"students?q=a&sort=average&order=desc", token, nil, nil, &list)
+	var got []string
+	for _, s := range list.Students {
+		got = append(got, s.FirstName)
+	}
+	//老师只能看到所教班级的学生
+	if want := []string{"Kelly", "Roberto", "Nick"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("students = %v, want %v", got, want)
+	}
+	if s := list.Students[2]; s.URL != APIPrefix+"students/1" || s.GradeCount != 3 || s.Average == nil || s.Version != 1 {
+		t.Fatalf("summary = %+v", s)
+	}
+
+	var student apiStudent
+	res := tp.api(t, http.DefaultClient, http.MethodGet, APIPrefix+"students/1?sort=score", token, nil, nil, &student)
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") != `"1"` || !student.CanEdit {
+		t.Fatalf("GET student: status %d, ETag %q, %+v", res.StatusCode, res.Header.Get("ETag"), student)
+	}
+	if student.Grades[0].Title != "Quiz 2" || student.Grades[0].URL != APIPrefix+"students/1/grades/2" {
+		t.Fatalf("grades by score = %+v", student.Grades)
+	}
+	res = tp.api(t, http.DefaultClient, http.MethodGet, APIPrefix+"students/1", token, nil, map[string]string{"If-None-Match": `"1"`}, nil)
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("conditional GET: status %d, want 304", res.StatusCode)
+	}
+
+	//修改后返回学生最新的内容与ETag
+	quiz := map[string]interface{}{"Title": " Quiz 3 ", "Type": "Quiz", "Score": 90}
+	res = tp.api(t, http.DefaultClient, http.MethodPost, APIPrefix+"students/1/grades", token, quiz, map[string]string{"If-Match": `"1"`}, &student)
+	if res.StatusCode != http.StatusCreated || res.Header.Get("ETag") != `"2"` || len(student.Grades) != 4 || student.Grades[3].Title != "Quiz 3" {
+		t.Fatalf("POST grade: status %d, ETag %q, %+v", res.StatusCode, res.Header.Get("ETag"), student)
+	}
+	var e apiError
+	res = tp.api(t, http.DefaultClient, http.MethodPut, APIPrefix+"students/1/grades/0", token, quiz, map[string]string{"If-Match": `"1"`}, &e)
+	if res.StatusCode != http.StatusPreconditionFailed || e.Code != rpc.CodeFailedPrecondition {
+		t.Fatalf("PUT with a stale version: status %d, %+v", res.StatusCode, e)
+	}
+	//无法解析的ETag与任何版本都不匹配
+	e = apiError{}
+	res = tp.api(t, http.DefaultClient, http.MethodDelete, APIPrefix+"students/1/grades/0", token, nil, map[string]string{"If-Match": "latest"}, &e)
+	if res.StatusCode != http.StatusPreconditionFailed || e.Code != rpc.CodeFailedPrecondition {
+		t.Fatalf("DELETE with a malformed If-Match: status %d, %+v", res.StatusCode, e)
+	}
+	res = tp.api(t, http.DefaultClient, http.MethodPut, APIPrefix+"students/1/grades/0", token, quiz, map[string]string{"If-Match": `W/"2"`}, &student)
+	if res.StatusCode != http.StatusOK || student.Grades[0].Title != "Quiz 3" {
+		t.Fatalf("PUT: status %d, %+v", res.StatusCode, student)
+	}
+	res = tp.api(t, http.DefaultClient, http.MethodDelete, APIPrefix+"students/1/grades/0", token, nil, nil, &student)
+	if res.StatusCode != http.StatusOK || len(student.Grades) != 3 || res.Header.Get("ETag") != `"4"` {
+		t.Fatalf("DELETE: status %d, ETag %q, %+v", res.StatusCode, res.Header.Get("ETag"), student)
+	}
+
+	//校验失败时在fields中返回每个字段的错误
+	e = apiError{}
+	res = tp.api(t, http.DefaultClient, http.MethodPost, APIPrefix+"students/1/grades", token, map[string]interface{}{"Type": "Homework", "Score": 101}, nil, &e)
+	if res.StatusCode != http.StatusUnprocessableEntity || e.Code != rpc.CodeInvalidArgument || len(e.Fields) != 3 {
+		t.Fatalf("invalid grade: status %d, %+v", res.StatusCode, e)
+	}
+	if got := tp.titles(t, 1); len(got) != 3 {
+		t.Fatalf("grades after an invalid request = %v", got)
+	}
+}
+
+func TestAPICreateStudent(t *testing.T) {
+	tp := startPortal(t)
+	token := tp.apiToken(t, "teacherA")
+	var student apiStudent
+	res := tp.api(t, http.DefaultClient, http.MethodPost, APIPrefix+"students", token, apiStudentInput{FirstName: "Ada", LastName: "Lovelace", Class: "A"}, nil, &student)
+	if res.StatusCode != http.StatusCreated || res.Header.Get("Location") != student.URL || student.FirstName != "Ada" || student.Grades == nil {
+		t.Fatalf("create: status %d, Location %q, %+v", res.StatusCode, res.Header.Get("Location"), student)
+	}
+	for _, tt := range []struct {
+		in     apiStudentInput
+		status int
+		code   rpc.Code
+	}{
+		{apiStudentInput{FirstName: "Ada"}, http.StatusUnprocessableEntity, rpc.CodeInvalidArgument},
+		{apiStudentInput{FirstName: "Ada", LastName: "Lovelace", Class: "B"}, http.StatusForbidden, rpc.CodePermissionDenied},
+	} {
+		var e apiError
+		res := tp.api(t, http.DefaultClient, http.MethodPost, APIPrefix+"students", token, tt.in, nil, &e)
+		if res.StatusCode != tt.status || e.Code != tt.code {
+			t.Errorf("create %+v: status %d, %+v", tt.in, res.StatusCode, e)
+		}
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	tp := startPortal(t)
+	token := tp.apiToken(t, "nick")
+	tests := []struct {
+		method string
+		path   string
+		status int
+		code   rpc.Code
+	}{
+		//学生只能查看自己的成绩
+		{http.MethodGet, "students/2", http.StatusForbidden, rpc.CodePermissionDenied},
+		{http.MethodGet, "students/99", http.StatusNotFound, rpc.CodeNotFound},
+		{http.MethodGet, "students/x", http.StatusNotFound, rpc.CodeNotFound},
+		{http.MethodGet, "students/1/grades/0/delete", http.StatusNotFound, rpc.CodeNotFound},
+		{http.MethodPatch, "students/1", http.StatusMethodNotAllowed, rpc.CodeUnimplemented},
+		{http.MethodGet, "teachers", http.StatusNotFound, rpc.CodeNotFound},
+		{http.MethodPost, "me", http.StatusMethodNotAllowed, rpc.CodeUnimplemented},
+	}
+	for _, tt := range tests {
+		var e apiError
+		res := tp.api(t, http.DefaultClient, tt.method, APIPrefix+tt.path, token, nil, nil, &e)
+		if res.StatusCode != tt.status || e.Code != tt.code {
+			t.Errorf("%s %s: status %d, %+v, want %d %s", tt.method, tt.path, res.StatusCode, e, tt.status, tt.code)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: Content-Type %q", tt.method, tt.path, ct)
+		}
+	}
+}
+
+// 汇总各服务的信息，无法访问的服务列在Unavailable中，其余字段仍然返回
+func TestAPIMe(t *testing.T) {
+	tp := startPortal(t)
+	var me apiMe
+	tp.api(t, http.DefaultClient, http.MethodGet, APIPrefix+"me", tp.apiToken(t, "nick"), nil, nil, &me)
+	if me.User.Username != "nick" || me.Student == nil || me.Student.ID != 1 || me.Student.GradeCount != 3 {
+		t.Fatalf("me = %+v", me)
+	}
+	//测试中没有启动notification服务
+	if me.Unread != nil || !reflect.DeepEqual(me.Unavailable, []registry.ServiceName{registry.NotificationService}) {
+		t.Fatalf("Unread %v, Unavailable %v", me.Unread, me.Unavailable)
+	}
+	//使用token时不需要CSRF token
+	if me.CSRFToken != "" {
+		t.Fatal("CSRFToken returned to a token client")
+	}
+
+	me = apiMe{}
+	tp.api(t, http.DefaultClient, http.MethodGet, APIPrefix+"me", tp.apiToken(t, "teacherA"), nil, nil, &me)
+	if me.Student != nil || me.Unavailable != nil || !reflect.DeepEqual(me.User.Classes, []string{"A"}) {
+		t.Fatalf("teacher me = %+v", me)
+	}
+	var e apiError
+	res := tp.api(t, http.DefaultClient, http.MethodGet, APIPrefix+"inbox", tp.apiToken(t, "teacherA"), nil, nil, &e)
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("teacher inbox: status %d, %+v", res.StatusCode, e)
+	}
+}
+
+// 使用portal的会话时，修改的请求需要携带/me返回的CSRFToken
+func TestAPISessionRequiresCSRFHeader(t *testing.T) {
+	tp := startPortal(t)
+	hc := tp.login(t, "teacherA")
+	var me apiMe
+	tp.api(t, hc, http.MethodGet, APIPrefix+"me", "", nil, nil, &me)
+	if me.User.Username != "teacherA" || me.CSRFToken == "" {
+		t.Fatalf("me = %+v", me)
+	}
+	quiz := map[string]interface{}{"Title": "Quiz 3", "Type": "Quiz", "Score": 90}
+	var e apiError
+	res := tp.api(t, hc, http.MethodPost, APIPrefix+"students/1/grades", "", quiz, nil, &e)
+	if res.StatusCode != http.StatusForbidden || !strings.Contains(e.Message, csrfHeader) {
+		t.Fatalf("POST without the header: status %d, %+v", res.StatusCode, e)
+	}
+	res = tp.api(t, hc, http.MethodPost, APIPrefix+"students/1/grades", "", quiz, map[string]string{csrfHeader: me.CSRFToken}, nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST with the header: status %d", res.StatusCode)
+	}
+}
+
+// OpenAPI文档描述了所有注册的路径
+func TestOpenAPIDocument(t *testing.T) {
+	tp := startPortal(t)
+	var doc struct {
+		OpenAPI string
+		Paths   map[string]json.RawMessage
+	}
+	res := tp.api(t, http.DefaultClient, http.MethodGet, APIPrefix+"openapi.json", "", nil, nil, &doc)
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Fatalf("status %d, openapi %q", res.StatusCode, doc.OpenAPI)
+	}
+	for _, path := range []string{"openapi.json", "login", "me", "students", "students/{id}", "students/{id}/grades",
+		"students/{id}/grades/{index}", "inbox", "inbox/{notificationID}/read"} {
+		if _, ok := doc.Paths[APIPrefix+path]; !ok {
+			t.Errorf("%s%s is not documented", APIPrefix, path)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package portal
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/events"
+	"distributedDemo/grades"
+	"distributedDemo/metrics"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL grade服务的响应在portal中直接使用的时间，过期后以If-None-Match向grade服务确认是否变化
+const DefaultCacheTTL = 30 * time.Second
+
+// 超出时先清理过期的条目，再淘汰最早保存的条目
+const maxCacheEntries = 1024
+
+// SubscribedEvents portal在Registration.Subscribes中声明的事件类型，收到后使缓存的学生失效
+var SubscribedEvents = []string{string(grades.GradeAdded), string(grades.GradeUpdated), string(grades.GradeDeleted), string(grades.StudentCreated)}
+
+var (
+	cacheRequests = metrics.NewCounterVec("portal_cache_requests_total",
+		"Cacheable requests from the portal to backend services, by resource and result (hit, miss or revalidated).",
+		"resource", "result")
+	cacheInvalidations = metrics.NewCounterVec("portal_cache_invalidations_total",
+		"Cache entries dropped because the resource was written, by reason.",
+		"reason")
+)
+
+// 同一资源对不同用户的内容不同，因此按用户分别缓存
+type cacheKey struct {
+	provider string
+	resource string
+	subject  string
+}
+
+type cacheEntry struct {
+	etag    string
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache 缓存GET请求的成功响应的http.RoundTripper，以provider、资源路径与用户为键
+// 其他方法的请求发出后，使该路径及其上级路径的缓存失效，如添加成绩后学生与学生列表都会重新查询
+type responseCache struct {
+	//实际发出请求的客户端，使用其当前的Transport，启用TLS后会被替换
+	client *http.Client
+	ttl    time.Duration
+
+	mutex   sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+func newResponseCache(client *http.Client, ttl time.Duration) *responseCache {
+	return &responseCache{client: client, ttl: ttl, entries: make(map[cacheKey]*cacheEntry)}
+}
+
+func (c *responseCache) transport() http.RoundTripper {
+	if c.client.Transport != nil {
+		return c.client.Transport
+	}
+	return http.DefaultTransport
+}
+
+func (c *responseCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		res, err := c.transport().RoundTrip(req)
+		//请求失败时写入也可能已经生效，同样使缓存失效
+		c.invalidate(req.Context(), req.URL.Path, "write")
+		return res, err
+	}
+	claims, err := auth.FromRequest(req)
+	if err != nil || req.Header.Get("If-None-Match") != "" {
+		//没有token的请求不缓存，调用方自己发起的条件请求原样转发
+		return c.transport().RoundTrip(req)
+	}
+	key := cacheKey{
+		provider: req.URL.Scheme + "://" + req.URL.Host,
+		resource: req.URL.Path,
+		subject:  claims.Subject,
+	}
+	resource := resourceLabel(req.URL.Path)
+
+	c.mutex.Lock()
+	entry := c.entries[key]
+	c.mutex.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		cacheRequests.For(req.Context()).Inc(resource, "hit")
+		return entry.response(req), nil
+	}
+
+	if entry != nil && entry.etag != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("If-None-Match", entry.etag)
+	}
+	res, err := c.transport().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified && entry != nil {
+		_, _ = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		cacheRequests.For(req.Context()).Inc(resource, "revalidated")
+		c.mutex.Lock()
+		entry.expires = time.Now().Add(c.ttl)
+		c.mutex.Unlock()
+		return entry.response(req), nil
+	}
+	cacheRequests.For(req.Context()).Inc(resource, "miss")
+	if res.StatusCode != http.StatusOK {
+		return res, nil
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	c.store(key, &cacheEntry{
+		etag:    res.Header.Get("ETag"),
+		header:  res.Header.Clone(),
+		body:    body,
+		stored:  now,
+		expires: now.Add(c.ttl),
+	})
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+// 以缓存的内容构造响应，调用方可以像读取真实响应一样读取并关闭Body
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+func (c *responseCache) store(key cacheKey, entry *cacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[key] = entry
+	if len(c.entries) <= maxCacheEntries {
+		return
+	}
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for len(c.entries) > maxCacheEntries {
+		var oldest cacheKey
+		var oldestTime time.Time
+		for k, e := range c.entries {
+			if oldestTime.IsZero() || e.stored.Before(oldestTime) {
+				oldest, oldestTime = k, e.stored
+			}
+		}
+		delete(c.entries, oldest)
+	}
+}
+
+// 使path及其上级路径在所有provider上、对所有用户的缓存失效
+func (c *responseCache) invalidate(ctx context.Context, path, reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for k := range c.entries {
+		if k.resource == path || strings.HasPrefix(path, strings.TrimSuffix(k.resource, "/")+"/") {
+			delete(c.entries, k)
+			cacheInvalidations.For(ctx).Inc(reason)
+		}
+	}
+}
+
+// 指标中的资源以{id}代替路径中的数字，避免每个学生产生一组指标
+func resourceLabel(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if _, err := strconv.Atoi(s); err == nil {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// 其他客户端修改成绩或添加学生后，grade服务投递的事件使对应的缓存失效
+func (s *Server) handleEvent(ctx context.Context, e events.Event) error {
+	var id int
+	switch e.Type {
+	case grades.GradeAdded, grades.GradeUpdated, grades.GradeDeleted:
+		var ge grades.GradeEvent
+		if err := e.Decode(&ge); err != nil {
+			return nil
+		}
+		id = ge.StudentID
+	case grades.StudentCreated:
+		var se grades.StudentEvent
+		if err := e.Decode(&se); err != nil {
+			return nil
+		}
+		id = se.Student.ID
+	default:
+		return nil
+	}
+	s.cache.invalidate(ctx, fmt.Sprintf("/students/%d", id), "event")
+	return nil
+}
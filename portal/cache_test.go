@@ -0,0 +1,297 @@
+package portal
+
+import (
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/events"
+	"distributedDemo/grades"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// grade服务的替身，每个路径的内容带有版本号，版本作为ETag，支持If-None-Match
+type fakeBackend struct {
+	mutex    sync.Mutex
+	versions map[string]int
+	//每个路径收到的GET请求及其中的If-None-Match
+	requests map[string][]string
+}
+
+func newFakeBackend(t *testing.T) (*fakeBackend, *httptest.Server) {
+	t.Helper()
+	fb := &fakeBackend{versions: make(map[string]int), requests: make(map[string][]string)}
+	srv := httptest.NewServer(fb)
+	t.Cleanup(srv.Close)
+	return fb, srv
+}
+
+func (fb *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	if r.Method != http.MethodGet {
+		fb.versions[r.URL.Path]++
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	fb.requests[r.URL.Path] = append(fb.requests[r.URL.Path], r.Header.Get("If-None-Match"))
+	if r.URL.Path == "/students/404" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	etag := fmt.Sprintf(`"%d"`, fb.versions[r.URL.Path])
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "%s version %d", r.URL.Path, fb.versions[r.URL.Path])
+}
+
+func (fb *fakeBackend) change(path string) {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	fb.versions[path]++
+}
+
+func (fb *fakeBackend) received(path string) []string {
+	fb.mutex.Lock()
+	defer fb.mutex.Unlock()
+	return append([]string(nil), fb.requests[path]...)
+}
+
+func issueToken(t *testing.T, subject string) string {
+	t.Helper()
+	token, err := auth.IssueToken(auth.Claims{Subject: subject, Role: auth.RoleTeacher, Classes: []string{"A"}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// 以token发送请求，返回状态码与响应体
+func fetch(t *testing.T, hc *http.Client, method, url, token string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		auth.SetToken(req, token)
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+// 使缓存的所有条目过期，下一次请求需要向后端确认
+func (c *responseCache) expireAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, e := range c.entries {
+		e.expires = time.Now().Add(-time.Second)
+	}
+}
+
+func newTestCache(t *testing.T) (*fakeBackend, string, *responseCache, *http.Client) {
+	t.Helper()
+	fb, srv := newFakeBackend(t)
+	cache := newResponseCache(srv.Client(), time.Hour)
+	return fb, srv.URL, cache, &http.Client{Transport: cache}
+}
+
+func TestCacheServesFreshEntries(t *testing.T) {
+	fb, url, _, hc := newTestCache(t)
+	nick := issueToken(t, "nick")
+	for i := 0; i < 3; i++ {
+		code, body := fetch(t, hc, http.MethodGet, url+"/students/1", nick)
+		if code != http.StatusOK || body != "/students/1 version 0" {
+			t.Fatalf("GET %d = %d %q", i+1, code, body)
+		}
+	}
+	if n := len(fb.received("/students/1")); n != 1 {
+		t.Fatalf("backend received %d requests, want 1", n)
+	}
+
+	//不同用户看到的内容可能不同，分别缓存
+	fetch(t, hc, http.MethodGet, url+"/students/1", issueToken(t, "kevin"))
+	if n := len(fb.received("/students/1")); n != 2 {
+		t.Fatalf("backend received %d requests after another user's GET, want 2", n)
+	}
+}
+
+func TestCacheRevalidatesExpiredEntries(t *testing.T) {
+	fb, url, cache, hc := newTestCache(t)
+	nick := issueToken(t, "nick")
+	fetch(t, hc, http.MethodGet, url+"/students", nick)
+
+	//未变化时后端以304响应，调用方仍然得到完整的响应
+	cache.expireAll()
+	code, body := fetch(t, hc, http.MethodGet, url+"/students", nick)
+	if code != http.StatusOK || body != "/students version 0" {
+		t.Fatalf("revalidated GET = %d %q", code, body)
+	}
+	if got := fb.received("/students"); len(got) != 2 || got[1] != `"0"` {
+		t.Fatalf("If-None-Match sent = %q, want the cached ETag on the second request", got)
+	}
+	//确认后重新计算过期时间
+	fetch(t, hc, http.MethodGet, url+"/students", nick)
+	if n := len(fb.received("/students")); n != 2 {
+		t.Fatalf("backend received %d requests, want the revalidated entry to be fresh again", n)
+	}
+
+	//其他实例或客户端修改后，新的内容替换缓存
+	fb.change("/students")
+	cache.expireAll()
+	if _, body := fetch(t, hc, http.MethodGet, url+"/students", nick); body != "/students version 1" {
+		t.Fatalf("GET after a change = %q, want version 1", body)
+	}
+	if _, body := fetch(t, hc, http.MethodGet, url+"/students", nick); body != "/students version 1" {
+		t.Fatalf("cached GET after a change = %q, want version 1", body)
+	}
+	if n := len(fb.received("/students")); n != 3 {
+		t.Fatalf("backend received %d requests, want 3", n)
+	}
+}
+
+// 修改使该路径及其上级路径的缓存失效，其他学生的缓存保留
+func TestCacheInvalidatesOnWrite(t *testing.T) {
+	fb, url, _, hc := newTestCache(t)
+	nick := issueToken(t, "nick")
+	for _, path := range []string{"/students", "/students/1", "/students/2"} {
+		fetch(t, hc, http.MethodGet, url+path, nick)
+	}
+	if code, _ := fetch(t, hc, http.MethodPost, url+"/students/1/grades", nick); code != http.StatusCreated {
+		t.Fatalf("POST = %d", code)
+	}
+	for path, want := range map[string]int{"/students": 2, "/students/1": 2, "/students/2": 1} {
+		fetch(t, hc, http.MethodGet, url+path, nick)
+		if n := len(fb.received(path)); n != want {
+			t.Errorf("%s: backend received %d requests after the write, want %d", path, n, want)
+		}
+	}
+}
+
+func TestCacheSkipsUncacheableRequests(t *testing.T) {
+	fb, url, _, hc := newTestCache(t)
+	//没有token的请求
+	fetch(t, hc, http.MethodGet, url+"/students/1", "")
+	fetch(t, hc, http.MethodGet, url+"/students/1", "")
+	if n := len(fb.received("/students/1")); n != 2 {
+		t.Fatalf("backend received %d requests without a token, want 2", n)
+	}
+	//失败的响应
+	nick := issueToken(t, "nick")
+	fetch(t, hc, http.MethodGet, url+"/students/404", nick)
+	if code, _ := fetch(t, hc, http.MethodGet, url+"/students/404", nick); code != http.StatusNotFound {
+		t.Fatalf("second GET of a missing student = %d, want 404", code)
+	}
+	if n := len(fb.received("/students/404")); n != 2 {
+		t.Fatalf("backend received %d requests for a 404, want 2", n)
+	}
+	//调用方自己的条件请求原样转发，304交给调用方
+	fetch(t, hc, http.MethodGet, url+"/students/2", nick)
+	req, _ := http.NewRequest(http.MethodGet, url+"/students/2", nil)
+	auth.SetToken(req, nick)
+	req.Header.Set("If-None-Match", `"0"`)
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("caller's conditional GET = %d, want 304", res.StatusCode)
+	}
+}
+
+// grade服务投递的事件使对应学生及学生列表的缓存失效
+func TestEventsInvalidateCache(t *testing.T) {
+	fb, url, cache, hc := newTestCache(t)
+	s := &Server{cache: cache}
+	nick := issueToken(t, "nick")
+	fetchAll := func() {
+		for _, path := range []string{"/students", "/students/1", "/students/2"} {
+			fetch(t, hc, http.MethodGet, url+path, nick)
+		}
+	}
+	fetchAll()
+	event := func(typ events.Type, data interface{}) events.Event {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events.Event{ID: "e", Type: typ, Data: raw}
+	}
+	if err := s.handleEvent(context.Background(), event(grades.GradeUpdated, grades.GradeEvent{StudentID: 1})); err != nil {
+		t.Fatal(err)
+	}
+	fetchAll()
+	for path, want := range map[string]int{"/students": 2, "/students/1": 2, "/students/2": 1} {
+		if n := len(fb.received(path)); n != want {
+			t.Errorf("%s: backend received %d requests after GradeUpdated, want %d", path, n, want)
+		}
+	}
+
+	if err := s.handleEvent(context.Background(), event(grades.StudentCreated, grades.StudentEvent{Student: grades.Student{ID: 2}})); err != nil {
+		t.Fatal(err)
+	}
+	fetchAll()
+	if n := len(fb.received("/students/2")); n != 2 {
+		t.Fatalf("/students/2: backend received %d requests after StudentCreated, want 2", n)
+	}
+
+	//无法解析或未订阅的事件不影响缓存，也不要求重新投递
+	for _, e := range []events.Event{
+		{ID: "bad", Type: grades.GradeAdded, Data: json.RawMessage(`"x"`)},
+		{ID: "other", Type: "Other", Data: json.RawMessage(`{}`)},
+	} {
+		if err := s.handleEvent(context.Background(), e); err != nil {
+			t.Fatalf("handleEvent(%s) = %v", e.ID, err)
+		}
+	}
+	fetchAll()
+	if n := len(fb.received("/students")); n != 3 {
+		t.Fatalf("/students: backend received %d requests, want the ignored events to keep the cache", n)
+	}
+}
+
+func TestCacheEvictsOldestEntries(t *testing.T) {
+	c := newResponseCache(http.DefaultClient, time.Hour)
+	now := time.Now()
+	for i := 0; i <= maxCacheEntries; i++ {
+		c.store(cacheKey{resource: fmt.Sprint("/students/", i)}, &cacheEntry{
+			stored:  now.Add(time.Duration(i) * time.Millisecond),
+			expires: now.Add(time.Hour),
+		})
+	}
+	if n := len(c.entries); n != maxCacheEntries {
+		t.Fatalf("%d entries, want %d", n, maxCacheEntries)
+	}
+	if _, ok := c.entries[cacheKey{resource: "/students/0"}]; ok {
+		t.Fatal("oldest entry was kept")
+	}
+}
+
+func TestResourceLabel(t *testing.T) {
+	for path, want := range map[string]string{
+		"/students":             "/students",
+		"/students/12":          "/students/{id}",
+		"/students/12/grades/3": "/students/{id}/grades/{id}",
+	} {
+		if got := resourceLabel(path); got != want {
+			t.Errorf("resourceLabel(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
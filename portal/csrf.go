@@ -0,0 +1,62 @@
+package portal
+
+import (
+	"crypto/subtle"
+	"distributedDemo/idempotency"
+	"log"
+	"net/http"
+)
+
+// 采用double submit cookie：token同时保存在cookie与表单中，其他站点的页面无法读取cookie，也就无法构造合法的表单
+const (
+	csrfCookie = "csrf_token"
+	//表单中的字段，页面中通过layout.html的csrf模板生成
+	csrfField = "csrf_token"
+	//不使用表单的客户端通过请求头携带token
+	csrfHeader = "X-CSRF-Token"
+)
+
+// 返回浏览器已有的token，没有时生成一个并写入cookie
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	token := idempotency.NewKey()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	//同一个请求中再次调用时使用同一个token
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: token})
+	return token
+}
+
+// 拒绝token与cookie不一致的修改请求，GET等安全的请求直接交给next
+func verifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validCSRF(r, r.PostFormValue(csrfField)) {
+			log.Println("func verifyCSRF: rejected", r.Method, r.URL.Path, "from", r.RemoteAddr)
+			http.Error(w, "invalid or missing CSRF token, reload the page and try again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 请求头中的token，没有时为formToken，与cookie中的token一致
+func validCSRF(r *http.Request, formToken string) bool {
+	cookie, err := r.Cookie(csrfCookie)
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = formToken
+	}
+	return err == nil && token != "" && subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1
+}
@@ -0,0 +1,105 @@
+package portal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// 缺少token、token与cookie不一致或没有cookie的表单以403拒绝，不执行修改
+func TestCSRFRejectsForgedForms(t *testing.T) {
+	tp := startPortal(t)
+	hc := tp.login(t, "teacherA")
+	for name, token := range map[string]string{
+		"missing token": "",
+		"wrong token":   "forged",
+	} {
+		form := gradeValues("", "Forged")
+		req, err := http.NewRequest(http.MethodPost, tp.url+"/students/1/grades", strings.NewReader(form.Encode()+"&"+csrfField+"="+url.QueryEscape(token)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want 403", name, res.StatusCode)
+		}
+	}
+	if got := tp.titles(t, 1); len(got) != 3 {
+		t.Fatalf("grades after forged forms = %v", got)
+	}
+
+	//其他站点的页面可以猜出表单中的字段，但浏览器不会带上对应的cookie
+	res := tp.post(t, newBrowser(t), "/login", url.Values{"Username": {"teacherA"}, "Password": {"teacherA"}, csrfField: {"guessed"}})
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("login without the cookie: status %d, want 403", res.StatusCode)
+	}
+	//注销同样需要token，以免其他站点的链接使用户退出登录
+	res = tp.post(t, hc, "/logout", url.Values{csrfField: {"forged"}})
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("logout with a wrong token: status %d, want 403", res.StatusCode)
+	}
+	if res, _ := tp.get(t, hc, "/students"); res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /students after a forged logout: status %d, want the session to be kept", res.StatusCode)
+	}
+}
+
+// 不使用表单的客户端通过请求头携带token
+func TestCSRFTokenInHeader(t *testing.T) {
+	tp := startPortal(t)
+	hc := tp.login(t, "teacherA")
+	form := gradeValues("", "Quiz 3")
+	req, err := http.NewRequest(http.MethodPost, tp.url+"/students/1/grades", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(csrfHeader, tp.cookie(t, hc, csrfCookie))
+	res, err := hc.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("status %d, want 303", res.StatusCode)
+	}
+	if got := tp.titles(t, 1); len(got) != 4 {
+		t.Fatalf("grades = %v", got)
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	//第一次访问时生成token并写入cookie，同一个请求中再次调用得到同一个token
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/login", nil)
+	token := csrfToken(w, r)
+	if token == "" || csrfToken(w, r) != token {
+		t.Fatalf("csrfToken returned %q, then a different token", token)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || cookies[0].Value != token || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %v", cookies)
+	}
+
+	//已有cookie时沿用
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/login", nil)
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: "existing"})
+	if got := csrfToken(w, r); got != "existing" || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("csrfToken = %q with cookies %v, want the existing token", got, w.Result().Cookies())
+	}
+
+	//安全的请求不检查token
+	called := false
+	h := verifyCSRF(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/students", nil))
+	if !called {
+		t.Fatal("GET without a token was rejected")
+	}
+}
@@ -0,0 +1,56 @@
+package portal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+)
+
+// 保存一次性提示的cookie，下一个页面显示后即清除
+const flashCookie = "flash"
+
+// cookie的大小有限，过长的提示（如包含响应体的错误）被截断
+const maxFlashLength = 500
+
+// 重定向之后显示的操作结果
+type flash struct {
+	//success或error
+	Kind    string
+	Message string
+}
+
+func setFlash(w http.ResponseWriter, kind, message string) {
+	if len(message) > maxFlashLength {
+		message = message[:maxFlashLength] + "..."
+	}
+	data, err := json.Marshal(flash{Kind: kind, Message: message})
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(data),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// 读取并清除请求中的提示，没有时返回nil
+// 提示只会显示给设置它的浏览器，并经过模板转义，因此不需要签名
+func popFlash(w http.ResponseWriter, r *http.Request) *flash {
+	cookie, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{Name: flashCookie, Value: "", Path: "/", MaxAge: -1})
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	var f flash
+	if err := json.Unmarshal(data, &f); err != nil || f.Message == "" {
+		return nil
+	}
+	return &f
+}
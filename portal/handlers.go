@@ -1,162 +1,158 @@
 package portal
 
 import (
-	"bytes"
-	"distributedDemo/grades"
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/events"
+	gradesclient "distributedDemo/grades/client"
+	"distributedDemo/notification"
 	"distributedDemo/registry"
-
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 )
 
-func RegisterHandlers() {
-	http.Handle("/", http.RedirectHandler("/students", http.StatusPermanentRedirect))
+// Server portal服务，通过client发现grade服务并调用registry的管理接口
+type Server struct {
+	client        *registry.Client
+	grades        *gradesclient.Client
+	notifications *notification.Client
+	//grades使用的缓存
+	cache *responseCache
+}
 
-	h := new(studentsHandler)
-	http.Handle("/students", h)
-	http.Handle("/students/", h)
+// NewServer 创建使用client的portal服务，client应与启动服务时使用的Client相同
+func NewServer(client *registry.Client) *Server {
+	cache := newResponseCache(client.HTTP, DefaultCacheTTL)
+	return &Server{
+		client: client,
+		grades: gradesclient.New(client,
+			gradesclient.WithToken(userToken),
+			gradesclient.WithHTTPClient(&http.Client{Transport: cache})),
+		//学生以自己的身份查看站内信与修改通知设置
+		notifications: notification.NewClient(client, userToken),
+		cache:         cache,
+	}
 }
 
-type studentsHandler struct{}
+// RegisterHandlers 在mux上注册使用registry.DefaultClient的portal服务的接口
+func RegisterHandlers(mux *http.ServeMux) {
+	NewServer(registry.DefaultClient).RegisterHandlers(mux)
+}
 
-func (sh studentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	pathSegments := strings.Split(r.URL.Path, "/")
-	switch len(pathSegments) {
-	case 2: // /students
-		sh.renderStudents(w, r)
-	case 3: // /students/{:id}
-		id, err := strconv.Atoi(pathSegments[2])
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		sh.renderStudent(w, r, id)
-	case 4: // /students/{:id}/grades
-		id, err := strconv.Atoi(pathSegments[2])
-		if err != nil {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		if strings.ToLower(pathSegments[3]) != "grades" {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		sh.renderGrades(w, r, id)
+// RegisterHandlers 注册路由
+func (s *Server) RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/", http.RedirectHandler("/students", http.StatusPermanentRedirect))
 
-	default:
-		w.WriteHeader(http.StatusNotFound)
-	}
-}
+	//grade服务投递的事件，使缓存失效
+	mux.Handle("/events", events.Handler(s.handleEvent))
 
-func (studentsHandler) renderStudents(w http.ResponseWriter, r *http.Request) {
-	var err error
-	defer func() {
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Println("Method renderStudents of studentsHandler:\nError retrieving students: ", err)
-		}
-	}()
+	//浏览器提交的表单都需要携带CSRF token
+	mux.Handle("/login", verifyCSRF(http.HandlerFunc(loginHandler)))
+	mux.Handle("/logout", verifyCSRF(http.HandlerFunc(logoutHandler)))
 
-	serviceURL, err := registry.GetProvider(registry.GradeService)
-	if err != nil {
-		return
-	}
+	mux.Handle("/admin", requireAdmin(http.HandlerFunc(s.adminHandler)))
+	mux.Handle("/admin/actions", verifyCSRF(requireAdmin(http.HandlerFunc(s.adminActionHandler))))
 
-	res, err := http.Get(serviceURL + "/students")
-	if err != nil {
-		return
-	}
+	mux.Handle("/inbox", verifyCSRF(requireStudent(http.HandlerFunc(s.inboxHandler))))
+	mux.Handle("/preferences", verifyCSRF(requireStudent(http.HandlerFunc(s.preferencesHandler))))
 
-	var s grades.Students
-	err = json.NewDecoder(res.Body).Decode(&s)
-	if err != nil {
-		return
-	}
+	h := verifyCSRF(requireLogin(&studentsHandler{s: s}))
+	mux.Handle("/students", h)
+	mux.Handle("/students/", h)
 
-	err = rootTemplate.Lookup("students.html").Execute(w, s)
-	if err != nil {
-		log.Println("Method renderStudents of studentsHandler:", err)
-		return
-	}
+	//JSON API自行认证，只有使用session的请求需要CSRF token
+	mux.Handle(APIPrefix, s.apiHandler())
 }
 
-func (studentsHandler) renderStudent(w http.ResponseWriter, r *http.Request, id int) {
+type userKey struct{}
 
-	var err error
-	defer func() {
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Println("Error retrieving students: ", err)
+// 未登录时跳转到登录页面，已登录则将用户放入context
+func requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := auth.SessionUser(r)
+		if !ok {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
 			return
 		}
-	}()
-
-	serviceURL, err := registry.GetProvider(registry.GradeService)
-	if err != nil {
-		return
-	}
-
-	res, err := http.Get(fmt.Sprintf("%v/students/%v", serviceURL, id))
-	if err != nil {
-		return
-	}
+		ctx := context.WithValue(r.Context(), userKey{}, u)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-	var s grades.Student
-	err = json.NewDecoder(res.Body).Decode(&s)
-	if err != nil {
-		return
-	}
+func currentUser(r *http.Request) *auth.User {
+	u, _ := r.Context().Value(userKey{}).(*auth.User)
+	return u
+}
 
-	err = rootTemplate.Lookup("student.html").Execute(w, s)
-	if err != nil {
-		log.Println("Method renderStudent of studentsHandler:", err)
-		return
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		render(w, r, http.StatusOK, "login.html", newLayout(w, r))
+	case http.MethodPost:
+		u, err := auth.Authenticate(r.PostFormValue("Username"), r.PostFormValue("Password"))
+		if err != nil {
+			log.Println("func loginHandler:", r.PostFormValue("Username"), err)
+			page := newLayout(w, r)
+			page.Flash = &flash{Kind: "error", Message: "Invalid username or password"}
+			render(w, r, http.StatusUnauthorized, "login.html", page)
+			return
+		}
+		err = auth.NewSession(w, u)
+		if err != nil {
+			log.Println("func loginHandler:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		//学生登录后直接查看自己的成绩
+		if u.Role == auth.RoleStudent {
+			http.Redirect(w, r, fmt.Sprintf("/students/%v", u.StudentID), http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, "/students", http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func (studentsHandler) renderGrades(w http.ResponseWriter, r *http.Request, id int) {
-
+// 注销需要通过页面中的表单提交，以免其他站点的链接使用户退出登录
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	defer func() {
-		w.Header().Add("location", fmt.Sprintf("/students/%v", id))
-		w.WriteHeader(http.StatusTemporaryRedirect)
-	}()
-	title := r.FormValue("Title")
-	gradeType := r.FormValue("Type")
-	score, err := strconv.ParseFloat(r.FormValue("Score"), 32)
-	if err != nil {
-		log.Println("Failed to parse score: ", err)
-		return
-	}
-	g := grades.Grade{
-		Title: title,
-		Type:  grades.GradeType(gradeType),
-		Score: float32(score),
-	}
-	data, err := json.Marshal(g)
-	if err != nil {
-		log.Println("Failed to convert grade to JSON: ", g, err)
-	}
+	auth.EndSession(w, r)
+	setFlash(w, "success", "Logged out")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
 
-	serviceURL, err := registry.GetProvider(registry.GradeService)
-	if err != nil {
-		log.Println("Failed to retrieve instance of Grading Service", err)
-		return
-	}
-	res, err := http.Post(fmt.Sprintf("%v/students/%v/grades", serviceURL, id), "application/json", bytes.NewBuffer(data))
-	if err != nil {
-		log.Println("Failed to save grade to Grading Service", err)
-		return
-	}
-	if res.StatusCode != http.StatusCreated {
-		log.Println("Failed to save grade to Grading Service. Status: ", res.StatusCode)
-		return
+// 以当前登录用户的身份调用grade服务
+func userToken(ctx context.Context) (string, error) {
+	u, ok := ctx.Value(userKey{}).(*auth.User)
+	if !ok {
+		return "", errors.New("no user logged in")
 	}
+	return u.Token(string(registry.PortalService), time.Minute)
+}
+
+// grade服务的错误对应的状态码，无权限查看或学生不存在时直接返回给浏览器
+func gradesStatus(err error) int {
+	switch {
+	case errors.Is(err, gradesclient.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, gradesclient.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, gradesclient.ErrVersionMismatch):
+		return http.StatusConflict
+	case errors.Is(err, gradesclient.ErrBadRequest):
+		return http.StatusBadRequest
+	//同一个Idempotency-Key的请求仍在进行中
+	case errors.Is(err, gradesclient.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, gradesclient.ErrUnavailable):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
 }
@@ -0,0 +1,141 @@
+package portal
+
+import (
+	"distributedDemo/auth"
+	"distributedDemo/events"
+	"distributedDemo/grades"
+	"distributedDemo/notification"
+	"distributedDemo/trace"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// 只有学生有站内信与通知设置
+func requireStudent(next http.Handler) http.Handler {
+	return requireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r).Role != auth.RoleStudent {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// 通知服务的错误对应的状态码
+func notificationStatus(err error) int {
+	var se *notification.StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode
+	}
+	return http.StatusBadGateway
+}
+
+type inboxPage struct {
+	layout
+	StudentID     int
+	Notifications []notification.Notification
+}
+
+// GET /inbox 查看通知，POST /inbox 将表单中ID对应的通知标记为已读
+func (s *Server) inboxHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	switch r.Method {
+	case http.MethodGet:
+		list, err := s.notifications.Inbox(r.Context(), u.StudentID)
+		if err != nil {
+			trace.Println(r.Context(), "Method inboxHandler of Server:", err)
+			w.WriteHeader(notificationStatus(err))
+			return
+		}
+		render(w, r, http.StatusOK, "inbox.html", inboxPage{layout: newLayout(w, r), StudentID: u.StudentID, Notifications: list})
+	case http.MethodPost:
+		if err := s.notifications.MarkRead(r.Context(), u.StudentID, r.PostFormValue("ID")); err != nil {
+			trace.Println(r.Context(), "Method inboxHandler of Server:", err)
+			setFlash(w, "error", "The notification was not marked as read: "+err.Error())
+		}
+		http.Redirect(w, r, "/inbox", http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type preferencesPage struct {
+	layout
+	StudentID   int
+	Preferences notification.Preferences
+	//通知服务提供的渠道
+	Available []string
+	//可以订阅的事件
+	Events []events.Type
+}
+
+// 页面模板中判断复选框是否选中
+func (p preferencesPage) HasChannel(name string) bool {
+	for _, c := range p.Preferences.Channels {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p preferencesPage) HasEvent(t events.Type) bool {
+	if len(p.Preferences.Events) == 0 {
+		return true
+	}
+	for _, e := range p.Preferences.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// GET /preferences 显示通知设置，POST /preferences 保存表单中的设置
+func (s *Server) preferencesHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	page := preferencesPage{
+		StudentID: u.StudentID,
+		Events:    []events.Type{grades.GradeAdded, grades.GradeUpdated},
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var err error
+		page.Preferences, page.Available, err = s.notifications.Preferences(r.Context(), u.StudentID)
+		if err != nil {
+			trace.Println(r.Context(), "Method preferencesHandler of Server:", err)
+			w.WriteHeader(notificationStatus(err))
+			return
+		}
+		page.layout = newLayout(w, r)
+		render(w, r, http.StatusOK, "preferences.html", page)
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		p := notification.Preferences{
+			Enabled:    r.PostForm.Get("Enabled") != "",
+			Channels:   r.PostForm["Channels"],
+			Email:      strings.TrimSpace(r.PostForm.Get("Email")),
+			WebhookURL: strings.TrimSpace(r.PostForm.Get("WebhookURL")),
+		}
+		for _, t := range r.PostForm["Events"] {
+			p.Events = append(p.Events, events.Type(t))
+		}
+		//全部事件都选中时保存为空，以后新增的事件也会通知
+		if len(p.Events) == len(page.Events) {
+			p.Events = nil
+		}
+		if err := s.notifications.SetPreferences(r.Context(), u.StudentID, p); err != nil {
+			trace.Println(r.Context(), "Method preferencesHandler of Server:", err)
+			setFlash(w, "error", "Preferences were not saved: "+err.Error())
+		} else {
+			setFlash(w, "success", "Preferences saved")
+		}
+		http.Redirect(w, r, "/preferences", http.StatusSeeOther)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,512 @@
+package portal
+
+import (
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/grades"
+	gradesclient "distributedDemo/grades/client"
+	"distributedDemo/registry"
+	"distributedDemo/trace"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type studentsHandler struct {
+	s *Server
+}
+
+// GET  /students                              学生列表，q按姓名搜索，sort与order排序
+// POST /students                              添加学生
+// GET  /students/{id}                         学生及其成绩
+// POST /students/{id}/grades                  添加成绩
+// GET  /students/{id}/grades/{index}          编辑成绩
+// POST /students/{id}/grades/{index}          保存编辑的成绩
+// POST /students/{id}/grades/{index}/delete   删除成绩
+func (sh studentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pathSegments := strings.Split(r.URL.Path, "/")
+	id, index, ok := parsePath(pathSegments)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(pathSegments) == 2 && r.Method == http.MethodGet:
+		sh.renderStudents(w, r)
+	case len(pathSegments) == 2 && r.Method == http.MethodPost:
+		sh.createStudent(w, r)
+	case len(pathSegments) == 3 && r.Method == http.MethodGet:
+		sh.renderStudent(w, r, id)
+	case len(pathSegments) == 4 && r.Method == http.MethodPost:
+		sh.addGrade(w, r, id)
+	case len(pathSegments) == 5 && r.Method == http.MethodGet:
+		sh.renderGrade(w, r, id, index)
+	case len(pathSegments) == 5 && r.Method == http.MethodPost:
+		sh.updateGrade(w, r, id, index)
+	case len(pathSegments) == 6 && r.Method == http.MethodPost:
+		sh.deleteGrade(w, r, id, index)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// 从路径中取出学生的ID与成绩的位置，路径不是上述的形式时ok为false
+func parsePath(pathSegments []string) (id, index int, ok bool) {
+	var err error
+	switch n := len(pathSegments); {
+	case n == 2:
+		return 0, 0, true
+	case n > 6:
+		return 0, 0, false
+	case n >= 6 && pathSegments[5] != "delete":
+		return 0, 0, false
+	case n >= 4 && strings.ToLower(pathSegments[3]) != "grades":
+		return 0, 0, false
+	}
+	if id, err = strconv.Atoi(pathSegments[2]); err != nil {
+		return 0, 0, false
+	}
+	if len(pathSegments) >= 5 {
+		if index, err = strconv.Atoi(pathSegments[4]); err != nil {
+			return 0, 0, false
+		}
+	}
+	return id, index, true
+}
+
+// 表格的排序方式，由查询参数sort与order=desc指定
+type sortOrder struct {
+	path string
+	//除sort与order以外的查询参数，如搜索的关键字，切换排序时保留
+	query url.Values
+	Sort  string
+	Desc  bool
+}
+
+// 只接受columns中的列，sort不合法时使用defaultColumn，为空表示保持原来的顺序
+func parseSortOrder(r *http.Request, defaultColumn string, columns ...string) sortOrder {
+	query := r.URL.Query()
+	o := sortOrder{path: r.URL.Path, query: url.Values{}, Sort: defaultColumn, Desc: query.Get("order") == "desc"}
+	for _, c := range columns {
+		if query.Get("sort") == c {
+			o.Sort = c
+		}
+	}
+	for k, v := range query {
+		if k != "sort" && k != "order" {
+			o.query[k] = v
+		}
+	}
+	return o
+}
+
+// URL 表头中按column排序的链接，再次点击当前排序的列时反向排序
+func (o sortOrder) URL(column string) string {
+	query := url.Values{}
+	for k, v := range o.query {
+		query[k] = v
+	}
+	query.Set("sort", column)
+	if column == o.Sort && !o.Desc {
+		query.Set("order", "desc")
+	}
+	return o.path + "?" + query.Encode()
+}
+
+// Mark 当前排序的列显示排序的方向
+func (o sortOrder) Mark(column string) string {
+	switch {
+	case column != o.Sort:
+		return ""
+	case o.Desc:
+		return " ▼"
+	}
+	return " ▲"
+}
+
+// 按less对slice排序，Desc时反向，相等的元素保持原来的顺序
+func (o sortOrder) apply(slice interface{}, less func(i, j int) bool) {
+	if o.Sort == "" {
+		return
+	}
+	sort.SliceStable(slice, func(i, j int) bool {
+		if o.Desc {
+			return less(j, i)
+		}
+		return less(i, j)
+	})
+}
+
+// students.html使用的数据
+type studentsPage struct {
+	layout
+	Students grades.Students
+	//按姓名搜索的关键字
+	Query string
+	Order sortOrder
+	//管理员与老师可以添加学生，老师只能添加到所教的班级
+	CanCreate bool
+	Form      studentForm
+}
+
+// 添加学生的表单，校验失败时保留填写的内容
+type studentForm struct {
+	grades.Student
+	//字段名到错误信息
+	Errors map[string]string
+}
+
+func (sh studentsHandler) renderStudents(w http.ResponseWriter, r *http.Request) {
+	sh.renderStudentsPage(w, r, http.StatusOK, studentsPage{})
+}
+
+// 以status渲染学生列表，page中的Form与Flash由调用方指定，其余字段在这里填充
+func (sh studentsHandler) renderStudentsPage(w http.ResponseWriter, r *http.Request, status int, page studentsPage) {
+	list, err := sh.s.grades.ListStudents(r.Context())
+	if err != nil {
+		trace.Println(r.Context(), "Method renderStudentsPage of studentsHandler:\nError retrieving students: ", err)
+		renderError(w, r, err)
+		return
+	}
+	page.layout = page.withLayout(w, r)
+	page.Query = strings.TrimSpace(r.URL.Query().Get("q"))
+	page.Order = parseStudentsOrder(r)
+	page.Students = searchStudents(list, page.Query, page.Order)
+	page.CanCreate = canCreateStudents(page.User)
+	if page.Form.Class == "" && len(page.User.Classes) == 1 {
+		page.Form.Class = page.User.Classes[0]
+	}
+	render(w, r, status, "students.html", page)
+}
+
+// 学生列表可以按姓名（默认）、班级或平均分排序
+func parseStudentsOrder(r *http.Request) sortOrder {
+	return parseSortOrder(r, "name", "name", "class", "average")
+}
+
+// 返回姓名与query匹配的学生，按order排序，页面与API共用
+func searchStudents(list grades.Students, query string, order sortOrder) grades.Students {
+	found := make(grades.Students, 0, len(list))
+	for _, s := range list {
+		if matchesName(s, query) {
+			found = append(found, s)
+		}
+	}
+	order.apply(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		switch order.Sort {
+		case "class":
+			if a.Class != b.Class {
+				return a.Class < b.Class
+			}
+		case "average":
+			if average(a) != average(b) {
+				return average(a) < average(b)
+			}
+		}
+		return strings.ToLower(a.LastName+"\x00"+a.FirstName) < strings.ToLower(b.LastName+"\x00"+b.FirstName)
+	})
+	return found
+}
+
+// 老师只能添加到所教的班级，由grade服务检查
+func canCreateStudents(u *auth.User) bool {
+	return u.Role == auth.RoleAdmin || u.Role == auth.RoleTeacher
+}
+
+// 不区分大小写地匹配名、姓、"名 姓"或"姓, 名"
+func matchesName(s grades.Student, query string) bool {
+	if query == "" {
+		return true
+	}
+	query = strings.ToLower(query)
+	for _, name := range []string{s.FirstName + " " + s.LastName, s.LastName + ", " + s.FirstName} {
+		if strings.Contains(strings.ToLower(name), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// 没有成绩的学生排在最前，而不是以NaN参与比较
+func average(s grades.Student) float32 {
+	if len(s.Grades) == 0 {
+		return -1
+	}
+	return s.Average()
+}
+
+func (sh studentsHandler) createStudent(w http.ResponseWriter, r *http.Request) {
+	form := studentForm{Student: grades.Student{
+		FirstName: strings.TrimSpace(r.PostFormValue("FirstName")),
+		LastName:  strings.TrimSpace(r.PostFormValue("LastName")),
+		Class:     strings.TrimSpace(r.PostFormValue("Class")),
+	}}
+	if form.Errors = form.Problems(); form.Errors != nil {
+		sh.renderStudentsPage(w, r, http.StatusUnprocessableEntity, studentsPage{Form: form})
+		return
+	}
+	created, err := sh.s.grades.CreateStudent(formContext(r), form.Student)
+	if errors.Is(err, gradesclient.ErrForbidden) {
+		form.Errors = map[string]string{"Class": "You are not allowed to add students to this class"}
+		sh.renderStudentsPage(w, r, http.StatusForbidden, studentsPage{Form: form})
+		return
+	}
+	if err != nil {
+		trace.Println(r.Context(), "Method createStudent of studentsHandler:", err)
+		page := studentsPage{Form: form}
+		page.Flash = &flash{Kind: "error", Message: "The student was not added: " + errorMessage(err)}
+		sh.renderStudentsPage(w, r, gradesStatus(err), page)
+		return
+	}
+	setFlash(w, "success", fmt.Sprintf("Added %s %s to class %s", created.FirstName, created.LastName, created.Class))
+	http.Redirect(w, r, fmt.Sprintf("/students/%d", created.ID), http.StatusSeeOther)
+}
+
+// 成绩在Student.Grades中的位置，排序后仍用于编辑与删除
+type gradeRow struct {
+	Index int
+	grades.Grade
+}
+
+// student.html使用的数据
+type studentPage struct {
+	layout
+	*grades.Student
+	Rows  []gradeRow
+	Order sortOrder
+	Types []grades.GradeType
+	//当前用户可以修改该学生的成绩
+	CanEdit bool
+	//提交的成绩因学生已被他人修改而没有保存，页面显示最新的成绩并保留填写的内容
+	Conflict bool
+	Form     gradeForm
+}
+
+// 成绩表单提交的内容，分数保留原始的输入，无法解析时也能原样显示
+type gradeForm struct {
+	Title  string
+	Type   grades.GradeType
+	Score  string
+	Errors map[string]string
+}
+
+func gradeFormOf(g grades.Grade) gradeForm {
+	return gradeForm{Title: g.Title, Type: g.Type, Score: strconv.FormatFloat(float64(g.Score), 'f', -1, 32)}
+}
+
+// 解析并校验表单中的成绩，Errors为nil时返回的成绩可以提交给grade服务
+func parseGradeForm(r *http.Request) (grades.Grade, gradeForm) {
+	form := gradeForm{
+		Title: strings.TrimSpace(r.PostFormValue("Title")),
+		Type:  grades.GradeType(r.PostFormValue("Type")),
+		Score: strings.TrimSpace(r.PostFormValue("Score")),
+	}
+	g := grades.Grade{Title: form.Title, Type: form.Type}
+	score, err := strconv.ParseFloat(form.Score, 32)
+	if err == nil {
+		g.Score = float32(score)
+	}
+	form.Errors = g.Problems()
+	if err != nil {
+		if form.Errors == nil {
+			form.Errors = make(map[string]string)
+		}
+		form.Errors["Score"] = "Score must be a number"
+	}
+	return g, form
+}
+
+// 表单中打开页面时学生的版本与Idempotency-Key，修改所基于的版本过期或重复提交时grade服务不会执行
+func formContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if version, err := strconv.Atoi(r.PostFormValue("Version")); err == nil {
+		ctx = gradesclient.IfVersion(ctx, version)
+	}
+	if key := r.PostFormValue("IdempotencyKey"); key != "" {
+		ctx = gradesclient.WithIdempotencyKey(ctx, key)
+	}
+	return ctx
+}
+
+func (sh studentsHandler) renderStudent(w http.ResponseWriter, r *http.Request, id int) {
+	sh.renderStudentPage(w, r, id, http.StatusOK, studentPage{})
+}
+
+// 以status渲染学生的页面，page中的Form、Conflict与Flash由调用方指定
+func (sh studentsHandler) renderStudentPage(w http.ResponseWriter, r *http.Request, id, status int, page studentPage) {
+	s, err := sh.s.grades.GetStudent(r.Context(), id)
+	if err != nil {
+		trace.Println(r.Context(), "Error retrieving students: ", err)
+		renderError(w, r, err)
+		return
+	}
+	page.layout = page.withLayout(w, r)
+	page.Student = s
+	page.Types = grades.GradeTypes
+	page.CanEdit = canWriteGrades(page.User, s.Class)
+	page.Order = parseGradesOrder(r)
+	page.Rows = sortGrades(s.Grades, page.Order)
+	render(w, r, status, "student.html", page)
+}
+
+// 成绩默认按添加的顺序显示，可以按标题、类型或分数排序
+func parseGradesOrder(r *http.Request) sortOrder {
+	return parseSortOrder(r, "", "title", "type", "score")
+}
+
+func sortGrades(gs []grades.Grade, order sortOrder) []gradeRow {
+	rows := make([]gradeRow, 0, len(gs))
+	for i, g := range gs {
+		rows = append(rows, gradeRow{Index: i, Grade: g})
+	}
+	order.apply(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch order.Sort {
+		case "type":
+			return a.Type < b.Type
+		case "score":
+			return a.Score < b.Score
+		}
+		return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+	})
+	return rows
+}
+
+func canWriteGrades(u *auth.User, class string) bool {
+	claims := u.Claims(string(registry.PortalService))
+	return claims.CanWriteGrades(class)
+}
+
+func (sh studentsHandler) addGrade(w http.ResponseWriter, r *http.Request, id int) {
+	g, form := parseGradeForm(r)
+	if form.Errors != nil {
+		sh.renderStudentPage(w, r, id, http.StatusUnprocessableEntity, studentPage{Form: form})
+		return
+	}
+	_, err := sh.s.grades.AddGrade(formContext(r), id, g)
+	//页面打开后学生被他人修改过时不保存，以免基于过期的成绩做出判断
+	if errors.Is(err, gradesclient.ErrVersionMismatch) {
+		trace.Println(r.Context(), "Method addGrade of studentsHandler:", err)
+		sh.renderStudentPage(w, r, id, http.StatusConflict, studentPage{Conflict: true, Form: form})
+		return
+	}
+	if err != nil {
+		trace.Println(r.Context(), "Failed to save grade to Grading Service", err)
+		page := studentPage{Form: form}
+		page.Flash = &flash{Kind: "error", Message: "The grade was not saved: " + errorMessage(err)}
+		sh.renderStudentPage(w, r, id, gradesStatus(err), page)
+		return
+	}
+	setFlash(w, "success", fmt.Sprintf("Added %q", g.Title))
+	http.Redirect(w, r, fmt.Sprintf("/students/%d", id), http.StatusSeeOther)
+}
+
+// grade.html使用的数据
+type gradePage struct {
+	layout
+	Student *grades.Student
+	Index   int
+	Types   []grades.GradeType
+	//成绩在grade服务中当前的值，与他人的修改冲突时与填写的内容一起显示
+	Current  grades.Grade
+	Conflict bool
+	Form     gradeForm
+}
+
+func (sh studentsHandler) renderGrade(w http.ResponseWriter, r *http.Request, id, index int) {
+	sh.renderGradePage(w, r, id, index, http.StatusOK, gradePage{})
+}
+
+// 以status渲染编辑成绩的页面，page.Form为空时填入成绩当前的值
+func (sh studentsHandler) renderGradePage(w http.ResponseWriter, r *http.Request, id, index, status int, page gradePage) {
+	s, err := sh.s.grades.GetStudent(r.Context(), id)
+	if err != nil {
+		trace.Println(r.Context(), "Method renderGradePage of studentsHandler:", err)
+		renderError(w, r, err)
+		return
+	}
+	//成绩可能已被他人删除，此时位置不再有效
+	if index < 0 || index >= len(s.Grades) {
+		setFlash(w, "error", "That grade no longer exists")
+		http.Redirect(w, r, fmt.Sprintf("/students/%d", id), http.StatusSeeOther)
+		return
+	}
+	page.layout = page.withLayout(w, r)
+	if !canWriteGrades(page.User, s.Class) {
+		renderError(w, r, gradesclient.ErrForbidden)
+		return
+	}
+	page.Student, page.Index, page.Types = s, index, grades.GradeTypes
+	page.Current = s.Grades[index]
+	if page.Form.Title == "" && page.Form.Errors == nil {
+		page.Form = gradeFormOf(page.Current)
+	}
+	render(w, r, status, "grade.html", page)
+}
+
+func (sh studentsHandler) updateGrade(w http.ResponseWriter, r *http.Request, id, index int) {
+	g, form := parseGradeForm(r)
+	if form.Errors != nil {
+		sh.renderGradePage(w, r, id, index, http.StatusUnprocessableEntity, gradePage{Form: form})
+		return
+	}
+	_, err := sh.s.grades.UpdateGrade(formContext(r), id, index, g)
+	switch {
+	case errors.Is(err, gradesclient.ErrVersionMismatch):
+		trace.Println(r.Context(), "Method updateGrade of studentsHandler:", err)
+		sh.renderGradePage(w, r, id, index, http.StatusConflict, gradePage{Conflict: true, Form: form})
+		return
+	case err != nil:
+		trace.Println(r.Context(), "Method updateGrade of studentsHandler:", err)
+		page := gradePage{Form: form}
+		page.Flash = &flash{Kind: "error", Message: "The grade was not saved: " + errorMessage(err)}
+		sh.renderGradePage(w, r, id, index, gradesStatus(err), page)
+		return
+	}
+	setFlash(w, "success", fmt.Sprintf("Updated %q", g.Title))
+	http.Redirect(w, r, fmt.Sprintf("/students/%d", id), http.StatusSeeOther)
+}
+
+func (sh studentsHandler) deleteGrade(w http.ResponseWriter, r *http.Request, id, index int) {
+	err := sh.s.grades.DeleteGrade(formContext(r), id, index)
+	switch {
+	case errors.Is(err, gradesclient.ErrVersionMismatch):
+		//删除的位置可能已经指向别的成绩，让用户在最新的成绩中重新选择
+		setFlash(w, "error", "This student's grades were changed by someone else and nothing was deleted. Review the grades below and try again.")
+	case err != nil:
+		trace.Println(r.Context(), "Method deleteGrade of studentsHandler:", err)
+		setFlash(w, "error", "The grade was not deleted: "+errorMessage(err))
+	default:
+		setFlash(w, "success", "Grade deleted")
+	}
+	http.Redirect(w, r, fmt.Sprintf("/students/%d", id), http.StatusSeeOther)
+}
+
+// 页面中显示的grade服务的错误，完整的错误只记录在日志中
+func errorMessage(err error) string {
+	switch {
+	case errors.Is(err, gradesclient.ErrNotFound):
+		return "the student or grade does not exist"
+	case errors.Is(err, gradesclient.ErrForbidden):
+		return "you are not allowed to do this"
+	case errors.Is(err, gradesclient.ErrBadRequest):
+		return "the grade service rejected the request"
+	case errors.Is(err, gradesclient.ErrVersionMismatch):
+		return "the student was changed by someone else"
+	case errors.Is(err, gradesclient.ErrUnavailable):
+		return "the grade service is unavailable, try again later"
+	}
+	return "something went wrong, try again later"
+}
+
+// 以grade服务的错误对应的状态码渲染出错的页面
+func renderError(w http.ResponseWriter, r *http.Request, err error) {
+	l := newLayout(w, r)
+	l.Flash = &flash{Kind: "error", Message: "Sorry, " + errorMessage(err)}
+	render(w, r, gradesStatus(err), "error.html", l)
+}
@@ -0,0 +1,390 @@
+package portal
+
+import (
+	"distributedDemo/auth"
+	"distributedDemo/grades"
+	"distributedDemo/health"
+	"distributedDemo/registry"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 测试中的portal及其通过registry发现的grade服务，grade服务以MockStudents为初始数据
+type testPortal struct {
+	url       string
+	gradesURL string
+}
+
+func startPortal(t *testing.T) *testPortal {
+	t.Helper()
+	for _, u := range []struct {
+		name    string
+		role    auth.Role
+		student int
+		classes []string
+	}{
+		{"admin", auth.RoleAdmin, 0, nil},
+		{"teacherA", auth.RoleTeacher, 0, []string{"A"}},
+		{"nick", auth.RoleStudent, 1, nil},
+	} {
+		if err := auth.AddUser(u.name, u.name, u.role, u.student, u.classes...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg := registry.NewRegistry("test")
+	reg.HTTP = &http.Client{}
+	regMux := http.NewServeMux()
+	reg.RegisterHandlers(regMux)
+	regSrv := httptest.NewServer(regMux)
+	t.Cleanup(func() {
+		regSrv.Close()
+		reg.Close()
+	})
+
+	gs := grades.NewGradesServer(grades.MockStudents())
+	gradesMux := http.NewServeMux()
+	gs.RegisterHandlers(gradesMux)
+	gradesSrv := httptest.NewServer(gradesMux)
+	t.Cleanup(gradesSrv.Close)
+	gradesClient := registry.NewClient(regSrv.URL)
+	gradesClient.HTTP = &http.Client{}
+	err := gradesClient.RegisterService(registry.Registration{ServiceName: registry.GradeService, ServiceURL: gradesSrv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//portal注册时在响应中得到grade服务的实例
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	rc := registry.NewClient(regSrv.URL)
+	rc.HTTP = &http.Client{}
+	portalReg := registry.Registration{
+		ServiceName:      registry.PortalService,
+		ServiceURL:       srv.URL,
+		RequiredServices: []registry.ServiceName{registry.GradeService},
+		ServiceUpdateURL: srv.URL + "/services",
+		HeartbeatURL:     srv.URL + "/heartbeat",
+	}
+	if err := rc.RegisterHandlers(mux, portalReg, health.NewChecks()); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.RegisterService(portalReg); err != nil {
+		t.Fatal(err)
+	}
+	NewServer(rc).RegisterHandlers(mux)
+	return &testPortal{url: srv.URL, gradesURL: gradesSrv.URL}
+}
+
+// 返回保存cookie且不跟随重定向的浏览器
+func newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// 通过登录页面以username登录，密码与用户名相同
+func (tp *testPortal) login(t *testing.T, username string) *http.Client {
+	t.Helper()
+	hc := newBrowser(t)
+	tp.get(t, hc, "/login")
+	res := tp.post(t, hc, "/login", url.Values{"Username": {username}, "Password": {username}})
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("login as %s: status %d", username, res.StatusCode)
+	}
+	return hc
+}
+
+func (tp *testPortal) get(t *testing.T, hc *http.Client, path string) (*http.Response, string) {
+	t.Helper()
+	res, err := hc.Get(tp.url + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+// 提交表单，表单中带上浏览器cookie中的CSRF token
+func (tp *testPortal) post(t *testing.T, hc *http.Client, path string, form url.Values) *http.Response {
+	t.Helper()
+	if form.Get(csrfField) == "" {
+		form.Set(csrfField, tp.cookie(t, hc, csrfCookie))
+	}
+	res, err := hc.PostForm(tp.url+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func (tp *testPortal) cookie(t *testing.T, hc *http.Client, name string) string {
+	t.Helper()
+	u, err := url.Parse(tp.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range hc.Jar.Cookies(u) {
+		if c.Name == name {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// 直接从grade服务查询学生成绩的标题，不经过portal的缓存
+func (tp *testPortal) titles(t *testing.T, id int) []string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/students/%d", tp.gradesURL, id), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.IssueToken(auth.Claims{Subject: "admin", Role: auth.RoleAdmin}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.SetToken(req, token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var s grades.Student
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, g := range s.Grades {
+		titles = append(titles, g.Title)
+	}
+	return titles
+}
+
+func gradeValues(version, title string) url.Values {
+	return url.Values{"Version": {version}, "Title": {title}, "Type": {string(grades.GradeQuiz)}, "Score": {"90"}}
+}
+
+// 打开页面后学生被他人修改过时，添加或修改成绩以409重新显示表单，不保存
+func TestStaleFormShowsConflict(t *testing.T) {
+	tp := startPortal(t)
+	hc := tp.login(t, "teacherA")
+	if res := tp.post(t, hc, "/students/1/grades", gradeValues("1", "Quiz 3")); res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("add with the current version: status %d", res.StatusCode)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/students/1/grades", "your grade has not been saved"},
+		{"/students/1/grades/0", "your changes have not been saved"},
+	} {
+		form := gradeValues("1", "Stale")
+		form.Set(csrfField, tp.cookie(t, hc, csrfCookie))
+		res, err := hc.PostForm(tp.url+tt.path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusConflict || !strings.Contains(string(body), tt.want) {
+			t.Errorf("POST %s with a stale version: status %d, want 409 with %q", tt.path, res.StatusCode, tt.want)
+		}
+		//填写的内容保留在表单中
+		if !strings.Contains(string(body), `value="Stale"`) {
+			t.Errorf("POST %s: the submitted title is not shown again", tt.path)
+		}
+	}
+	if got := tp.titles(t, 1); len(got) != 4 || got[0] != "Quiz 1" || got[3] != "Quiz 3" {
+		t.Fatalf("grades after stale submissions = %v", got)
+	}
+}
+
+// 删除的位置可能已经指向别的成绩，版本过期时不删除并提示用户
+func TestStaleDeleteIsNotApplied(t *testing.T) {
+	tp := startPortal(t)
+	hc := tp.login(t, "teacherA")
+	tp.post(t, hc, "/students/1/grades", gradeValues("1", "Quiz 3"))
+	res := tp.post(t, hc, "/students/1/grades/0/delete", url.Values{"Version": {"1"}})
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/students/1" {
+		t.Fatalf("stale delete: status %d, Location %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	if _, body := tp.get(t, hc, "/students/1"); !strings.Contains(body, "nothing was deleted") {
+		t.Fatal("the student page does not explain why nothing was deleted")
+	}
+	if got := tp.titles(t, 1); len(got) != 4 {
+		t.Fatalf("grades after a stale delete = %v", got)
+	}
+
+	tp.post(t, hc, "/students/1/grades/0/delete", url.Values{"Version": {"2"}})
+	if got := tp.titles(t, 1); len(got) != 3 || got[0] != "Final Exam" {
+		t.Fatalf("grades after a delete = %v", got)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path      string
+		id, index int
+		ok        bool
+	}{
+		{"/students", 0, 0, true},
+		{"/students/3", 3, 0, true},
+		{"/students/3/grades", 3, 0, true},
+		{"/students/3/Grades", 3, 0, true},
+		{"/students/3/grades/2", 3, 2, true},
+		{"/students/3/grades/2/delete", 3, 2, true},
+		{"/students/x", 0, 0, false},
+		{"/students/3/notes", 0, 0, false},
+		{"/students/3/grades/x", 0, 0, false},
+		{"/students/3/grades/2/edit", 0, 0, false},
+		{"/students/3/grades/2/delete/now", 0, 0, false},
+	}
+	for _, tt := range tests {
+		id, index, ok := parsePath(strings.Split(tt.path, "/"))
+		if id != tt.id || index != tt.index || ok != tt.ok {
+			t.Errorf("parsePath(%q) = %d, %d, %v, want %d, %d, %v", tt.path, id, index, ok, tt.id, tt.index, tt.ok)
+		}
+	}
+}
+
+func TestSearchStudents(t *testing.T) {
+	names := func(list grades.Students) string {
+		var s []string
+		for _, st := range list {
+			s = append(s, st.FirstName)
+		}
+		return strings.Join(s, " ")
+	}
+	order := func(rawQuery string) sortOrder {
+		return parseStudentsOrder(httptest.NewRequest(http.MethodGet, "/students?"+rawQuery, nil))
+	}
+	tests := []struct {
+		query    string
+		rawQuery string
+		want     string
+	}{
+		{"", "", "Roberto Nick Kelly Rachel Emma"},
+		{"", "sort=name&order=desc", "Emma Rachel Kelly Nick Roberto"},
+		{"", "sort=class", "Roberto Nick Kelly Rachel Emma"},
+		{"", "sort=class&order=desc", "Emma Rachel Kelly Nick Roberto"},
+		//不支持的列按默认的姓名排序
+		{"", "sort=secret", "Roberto Nick Kelly Rachel Emma"},
+		{"NICK", "", "Nick"},
+		{"nick carter", "", "Nick"},
+		{"carter, n", "", "Nick"},
+		{"st", "", "Emma"},
+		{"nobody", "", ""},
+	}
+	for _, tt := range tests {
+		if got := names(searchStudents(grades.MockStudents(), tt.query, order(tt.rawQuery))); got != tt.want {
+			t.Errorf("search %q with %q = %q, want %q", tt.query, tt.rawQuery, got, tt.want)
+		}
+	}
+}
+
+func TestSortOrderLinks(t *testing.T) {
+	o := parseStudentsOrder(httptest.NewRequest(http.MethodGet, "/students?q=ni&sort=class", nil))
+	//再次点击当前排序的列时反向排序，搜索的关键字保留
+	if got := o.URL("class"); got != "/students?order=desc&q=ni&sort=class" {
+		t.Errorf("URL(class) = %q", got)
+	}
+	if got := o.URL("name"); got != "/students?q=ni&sort=name" {
+		t.Errorf("URL(name) = %q", got)
+	}
+	if o.Mark("class") != " ▲" || o.Mark("name") != "" {
+		t.Errorf("Mark(class) = %q, Mark(name) = %q", o.Mark("class"), o.Mark("name"))
+	}
+	o = parseGradesOrder(httptest.NewRequest(http.MethodGet, "/students/1", nil))
+	rows := sortGrades(grades.MockStudents()[0].Grades, o)
+	if rows[0].Title != "Quiz 1" || rows[2].Index != 2 {
+		t.Errorf("grades without a sort column were reordered: %+v", rows)
+	}
+	o = parseGradesOrder(httptest.NewRequest(http.MethodGet, "/students/1?sort=score&order=desc", nil))
+	rows = sortGrades(grades.MockStudents()[0].Grades, o)
+	if rows[0].Title != "Final Exam" || rows[0].Index != 1 {
+		t.Errorf("grades by score: %+v", rows)
+	}
+}
+
+// 校验失败时以422重新显示表单及每个字段的错误，不调用grade服务
+func TestInvalidGradeFormIsRenderedWithErrors(t *testing.T) {
+	tp := startPortal(t)
+	hc := tp.login(t, "teacherA")
+	form := url.Values{"Title": {"Homework 1"}, "Type": {"Homework"}, "Score": {"ninety"}, csrfField: {tp.cookie(t, hc, csrfCookie)}}
+	res, err := hc.PostForm(tp.url+"/students/1/grades", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want 422", res.StatusCode)
+	}
+	for _, want := range []string{"Type must be one of", "Score must be a number", `value="Homework 1"`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("the form does not show %q", want)
+		}
+	}
+	if got := tp.titles(t, 1); len(got) != 3 {
+		t.Fatalf("grades after an invalid form = %v", got)
+	}
+}
+
+func TestCreateStudent(t *testing.T) {
+	tp := startPortal(t)
+	hc := tp.login(t, "teacherA")
+	res := tp.post(t, hc, "/students", url.Values{"FirstName": {"Ada"}, "LastName": {"Lovelace"}, "Class": {"A"}})
+	if res.StatusCode != http.StatusSeeOther || !strings.HasPrefix(res.Header.Get("Location"), "/students/") {
+		t.Fatalf("create: status %d, Location %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	//提示只显示一次
+	if _, body := tp.get(t, hc, res.Header.Get("Location")); !strings.Contains(body, "Added Ada Lovelace to class A") {
+		t.Fatal("the student page does not show the success message")
+	}
+	if _, body := tp.get(t, hc, res.Header.Get("Location")); strings.Contains(body, "Added Ada Lovelace") {
+		t.Fatal("the success message is shown again")
+	}
+
+	for _, tt := range []struct {
+		form   url.Values
+		status int
+		want   string
+	}{
+		{url.Values{"FirstName": {" "}, "LastName": {"Lovelace"}, "Class": {"A"}}, http.StatusUnprocessableEntity, "First name is required"},
+		{url.Values{"FirstName": {"Ada"}, "LastName": {"Lovelace"}, "Class": {"B"}}, http.StatusForbidden, "You are not allowed to add students to this class"},
+	} {
+		tt.form.Set(csrfField, tp.cookie(t, hc, csrfCookie))
+		res, err := hc.PostForm(tp.url+"/students", tt.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.status || !strings.Contains(string(body), tt.want) {
+			t.Errorf("create %v: status %d, want %d with %q", tt.form, res.StatusCode, tt.status, tt.want)
+		}
+	}
+}
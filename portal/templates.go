@@ -1,20 +1,60 @@
 package portal
 
 import (
+	"bytes"
+	"distributedDemo/auth"
+	"distributedDemo/idempotency"
+	"distributedDemo/trace"
+	"embed"
 	"html/template"
+	"net/http"
 )
 
-var rootTemplate *template.Template
+//go:embed *.html
+var templateFS embed.FS
 
-func ImportTemplates() error {
-	var err error
-	rootTemplate, err = template.ParseFiles(
-		"./portal/students.html",
-		"./portal/student.html")
+// 页面模板编译进可执行文件，不依赖运行时的工作目录
+var rootTemplate = template.Must(template.ParseFS(templateFS, "*.html"))
 
-	if err != nil {
-		return err
+// 所有页面共用的数据，每个页面的数据类型都嵌入layout，由layout.html中的nav、flash与csrf模板使用
+type layout struct {
+	//未登录时为nil
+	User      *auth.User
+	Flash     *flash
+	CSRFToken string
+}
+
+func newLayout(w http.ResponseWriter, r *http.Request) layout {
+	return layout{
+		User:      currentUser(r),
+		Flash:     popFlash(w, r),
+		CSRFToken: csrfToken(w, r),
 	}
+}
 
-	return nil
+// 填充l，保留调用方已经设置的Flash，如提交失败后直接显示的错误
+func (l layout) withLayout(w http.ResponseWriter, r *http.Request) layout {
+	filled := newLayout(w, r)
+	if l.Flash != nil {
+		filled.Flash = l.Flash
+	}
+	return filled
+}
+
+// IdempotencyKey 页面中每个修改的表单各自携带一个新的key，重复提交同一个表单只会执行一次
+func (layout) IdempotencyKey() string {
+	return idempotency.NewKey()
+}
+
+// 以status渲染页面，先渲染到缓冲区，模板出错时以500响应而不是输出半个页面
+func render(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := rootTemplate.ExecuteTemplate(&buf, name, data); err != nil {
+		trace.Println(r.Context(), "func render:", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = buf.WriteTo(w)
 }
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 管理接口请求体，Key为空时调整默认限额，否则调整该客户端的配额
+type update struct {
+	Key string
+	Limit
+}
+
+// Handler 查看与调整ls中的限额的管理接口，应只允许管理员访问
+//
+//	GET    /ratelimits                 所有限流器的限额
+//	PUT    /ratelimits/{name}          请求体为{"Rate":10,"Burst":20}，Key不为空时设置该客户端的配额
+//	DELETE /ratelimits/{name}?key=...  取消客户端的配额
+func (ls *Limiters) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ratelimits"), "/")
+		if name == "" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			writeJSON(w, ls.Snapshot())
+			return
+		}
+		l, ok := ls.Get(name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			var u update
+			if err := json.NewDecoder(r.Body).Decode(&u); err != nil || u.Burst < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			log.Printf("Method Handler of Limiters:%s key %q set to %+v\n", name, u.Key, u.Limit)
+			if u.Key == "" {
+				l.SetLimit(u.Limit)
+			} else {
+				l.SetQuota(u.Key, u.Limit)
+			}
+		case http.MethodDelete:
+			l.RemoveQuota(r.URL.Query().Get("key"))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, l.status())
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("func writeJSON of ratelimit:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
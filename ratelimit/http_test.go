@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	ls := NewLimiters()
+	ls.Add(New("grades", Limit{Rate: 5, Burst: 10}, nil))
+	ls.Add(New("api", Limit{Rate: 1, Burst: 1}, nil))
+	h := ls.Handler()
+	send := func(method, target, body string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec.Code, rec.Body.String()
+	}
+
+	status, body := send(http.MethodGet, "/ratelimits", "")
+	var all []Status
+	if err := json.Unmarshal([]byte(body), &all); status != http.StatusOK || err != nil {
+		t.Fatalf("GET /ratelimits: status %d, %v: %s", status, err, body)
+	}
+	if len(all) != 2 || all[0].Name != "api" || all[1].Name != "grades" || all[1].Limit != (Limit{Rate: 5, Burst: 10}) {
+		t.Fatalf("GET /ratelimits = %+v, want api and grades sorted by name", all)
+	}
+
+	//调整默认限额与单个客户端的配额
+	for _, tt := range []struct {
+		method, target, body string
+		want                 Status
+	}{
+		{http.MethodPut, "/ratelimits/grades", `{"Rate":10,"Burst":20}`,
+			Status{Name: "grades", Limit: Limit{Rate: 10, Burst: 20}, Quotas: map[string]Limit{}}},
+		{http.MethodPut, "/ratelimits/grades/", `{"Key":"principal:nick","Rate":1,"Burst":5}`,
+			Status{Name: "grades", Limit: Limit{Rate: 10, Burst: 20}, Quotas: map[string]Limit{"principal:nick": {Rate: 1, Burst: 5}}}},
+		{http.MethodGet, "/ratelimits/grades", "",
+			Status{Name: "grades", Limit: Limit{Rate: 10, Burst: 20}, Quotas: map[string]Limit{"principal:nick": {Rate: 1, Burst: 5}}}},
+		{http.MethodDelete, "/ratelimits/grades?key=principal:nick", "",
+			Status{Name: "grades", Limit: Limit{Rate: 10, Burst: 20}, Quotas: map[string]Limit{}}},
+	} {
+		status, body := send(tt.method, tt.target, tt.body)
+		var got Status
+		if err := json.Unmarshal([]byte(body), &got); status != http.StatusOK || err != nil {
+			t.Fatalf("%s %s: status %d, %v: %s", tt.method, tt.target, status, err, body)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s %s = %+v, want %+v", tt.method, tt.target, got, tt.want)
+		}
+	}
+	l, _ := ls.Get("grades")
+	if got := l.status().Limit; got != (Limit{Rate: 10, Burst: 20}) {
+		t.Fatalf("limiter limit = %+v after PUT", got)
+	}
+
+	for _, tt := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodGet, "/ratelimits/unknown", "", http.StatusNotFound},
+		{http.MethodPut, "/ratelimits/grades", `{"Rate":`, http.StatusBadRequest},
+		{http.MethodPut, "/ratelimits/grades", `{"Rate":1,"Burst":-1}`, http.StatusBadRequest},
+		{http.MethodPost, "/ratelimits/grades", `{}`, http.StatusMethodNotAllowed},
+		{http.MethodPut, "/ratelimits", `{}`, http.StatusMethodNotAllowed},
+	} {
+		if status, _ := send(tt.method, tt.target, tt.body); status != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, status, tt.want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package ratelimit
+
+import (
+	"distributedDemo/auth"
+	"distributedDemo/metrics"
+	"distributedDemo/tlsutil"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limit 令牌桶的参数，Rate为每秒补充的令牌数，Burst为桶的容量，Rate不大于0时不限流
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// KeyFunc 决定请求计入哪个令牌桶
+type KeyFunc func(r *http.Request) string
+
+// ByIP 按客户端IP限流
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// ByPrincipal 按token中的用户或服务限流，未携带有效token时按客户端IP限流
+func ByPrincipal(r *http.Request) string {
+	if c, ok := auth.FromContext(r.Context()); ok {
+		return "principal:" + c.Subject
+	}
+	if c, err := auth.FromRequest(r); err == nil {
+		return "principal:" + c.Subject
+	}
+	return ByIP(r)
+}
+
+// ByService 按调用方的服务名称限流，优先使用TLS证书中的名称，其次是token签发给的服务
+func ByService(r *http.Request) string {
+	if name, ok := tlsutil.PeerName(r); ok {
+		return "service:" + name
+	}
+	if c, err := auth.FromRequest(r); err == nil && c.Service != "" {
+		return "service:" + c.Service
+	}
+	return ByIP(r)
+}
+
+// 超过该数量时清理已经装满的令牌桶
+const maxBuckets = 10000
+
+var rejected = metrics.NewCounterVec("ratelimit_rejected_total",
+	"Requests rejected with 429 by a rate limiter.",
+	"limiter")
+
+// Limiter 按KeyFunc分桶的令牌桶限流器，限额可在运行时调整
+type Limiter struct {
+	name string
+	key  KeyFunc
+	//当前时间，测试中替换为可控制的时钟
+	now func() time.Time
+
+	mutex sync.Mutex
+	limit Limit
+	//个别客户端的配额，优先于limit
+	quotas  map[string]Limit
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// New 创建名为name的限流器，加入服务的Limiters后可以通过其Handler按名称调整限额
+func New(name string, limit Limit, key KeyFunc) *Limiter {
+	if key == nil {
+		key = ByIP
+	}
+	return &Limiter{
+		name:    name,
+		key:     key,
+		now:     time.Now,
+		limit:   limit,
+		quotas:  make(map[string]Limit),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Name 限流器的名称
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// Limiters 一个服务使用的限流器，以名称为键
+// 同一进程内运行多个服务时，每个服务使用各自的Limiters，同名的限流器互不影响
+type Limiters struct {
+	limiters map[string]*Limiter
+	mutex    sync.RWMutex
+}
+
+// NewLimiters 创建空的Limiters
+func NewLimiters() *Limiters {
+	return &Limiters{limiters: make(map[string]*Limiter)}
+}
+
+// Add 加入限流器，同名的限流器会被替换
+func (ls *Limiters) Add(l *Limiter) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	ls.limiters[l.name] = l
+}
+
+// Get 按名称查找限流器
+func (ls *Limiters) Get(name string) (*Limiter, bool) {
+	ls.mutex.RLock()
+	defer ls.mutex.RUnlock()
+	l, ok := ls.limiters[name]
+	return l, ok
+}
+
+// SetLimit 调整默认限额，已有的令牌桶按新的限额继续计算
+func (l *Limiter) SetLimit(limit Limit) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit = limit
+}
+
+// SetQuota 为key对应的客户端单独设置配额
+func (l *Limiter) SetQuota(key string, limit Limit) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.quotas[key] = limit
+}
+
+// RemoveQuota 取消key的配额，之后使用默认限额
+func (l *Limiter) RemoveQuota(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.quotas, key)
+}
+
+// Allow 从key的令牌桶中取出一个令牌，令牌不足时返回需要等待的时间
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	limit, ok := l.quotas[key]
+	if !ok {
+		limit = l.limit
+	}
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// 调用方需持有l.mutex
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		limit, ok := l.quotas[key]
+		if !ok {
+			limit = l.limit
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Middleware 超出限额的请求返回429，并通过Retry-After告知客户端多久后重试
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := l.Allow(l.key(r)); !ok {
+			rejected.For(r.Context()).Inc(l.name)
+			w.Header().Set("Retry-After", retryAfter(wait))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Retry-After以秒为单位，向上取整
+func retryAfter(d time.Duration) string {
+	secs := int(d / time.Second)
+	if d%time.Second != 0 {
+		secs++
+	}
+	if secs < 1 {
+		secs = 1
+	}
+	return fmt.Sprint(secs)
+}
+
+// Status 限流器当前的限额，供管理接口展示
+type Status struct {
+	Name   string
+	Limit  Limit
+	Quotas map[string]Limit
+}
+
+func (l *Limiter) status() Status {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	quotas := make(map[string]Limit, len(l.quotas))
+	for k, v := range l.quotas {
+		quotas[k] = v
+	}
+	return Status{Name: l.name, Limit: l.limit, Quotas: quotas}
+}
+
+// Snapshot 按名称排序的所有限流器的限额
+func (ls *Limiters) Snapshot() []Status {
+	ls.mutex.RLock()
+	list := make([]Status, 0, len(ls.limiters))
+	for _, l := range ls.limiters {
+		list = append(list, l.status())
+	}
+	ls.mutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
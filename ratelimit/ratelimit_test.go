@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"distributedDemo/auth"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 只在advance时前进的时钟
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestLimiter(limit Limit, key KeyFunc) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	l := New("test", limit, key)
+	l.now = clock.Now
+	return l, clock
+}
+
+func TestAllowBurstThenRefill(t *testing.T) {
+	l, clock := newTestLimiter(Limit{Rate: 2, Burst: 3}, nil)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d within the burst was rejected", i+1)
+		}
+	}
+	if ok, wait := l.Allow("a"); ok || wait != 500*time.Millisecond {
+		t.Fatalf("Allow after the burst = %v, %v, want false, 500ms", ok, wait)
+	}
+	//其他客户端使用各自的令牌桶
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("another key was rejected")
+	}
+
+	clock.advance(250 * time.Millisecond)
+	if ok, wait := l.Allow("a"); ok || wait != 250*time.Millisecond {
+		t.Fatalf("Allow after half a token = %v, %v, want false, 250ms", ok, wait)
+	}
+	clock.advance(250 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("request rejected after a token was refilled")
+	}
+
+	//空闲再久也最多积累Burst个令牌
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d after refilling was rejected", i+1)
+		}
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("bucket refilled beyond its burst")
+	}
+}
+
+func TestAllowWithoutRateDoesNotLimit(t *testing.T) {
+	l, _ := newTestLimiter(Limit{}, nil)
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatal("limiter without a rate rejected a request")
+		}
+	}
+}
+
+func TestQuotaOverridesDefaultLimit(t *testing.T) {
+	l, clock := newTestLimiter(Limit{Rate: 1, Burst: 1}, nil)
+	l.SetQuota("vip", Limit{Rate: 1, Burst: 5})
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow("vip"); !ok {
+			t.Fatalf("request %d within the quota was rejected", i+1)
+		}
+	}
+	l.Allow("other")
+	if ok, _ := l.Allow("other"); ok {
+		t.Fatal("default limit not applied to a key without a quota")
+	}
+
+	l.RemoveQuota("vip")
+	clock.advance(time.Hour)
+	l.Allow("vip")
+	if ok, _ := l.Allow("vip"); ok {
+		t.Fatal("removed quota still applied")
+	}
+
+	//调整默认限额后，已有的令牌桶按新的限额补充
+	l.SetLimit(Limit{Rate: 10, Burst: 1})
+	clock.advance(100 * time.Millisecond)
+	if ok, _ := l.Allow("other"); !ok {
+		t.Fatal("new rate not applied to an existing bucket")
+	}
+}
+
+func TestMiddlewareRejectsWithRetryAfter(t *testing.T) {
+	l, clock := newTestLimiter(Limit{Rate: 0.4, Burst: 1}, nil)
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/students", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Fatalf("first request: status %d, want 200", rec.Code)
+	}
+	//需要等待2.5秒，Retry-After向上取整
+	rec := send()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "3" {
+		t.Fatalf("second request: status %d, Retry-After %q, want 429 and 3", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	clock.advance(2500 * time.Millisecond)
+	if rec := send(); rec.Code != http.StatusOK {
+		t.Fatalf("request after Retry-After: status %d, want 200", rec.Code)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		0:                       "1",
+		time.Millisecond:        "1",
+		time.Second:             "1",
+		time.Second + 1:         "2",
+		2500 * time.Millisecond: "3",
+	} {
+		if got := retryAfter(d); got != want {
+			t.Errorf("retryAfter(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
+
+func TestPruneDropsFullBuckets(t *testing.T) {
+	l, clock := newTestLimiter(Limit{Rate: 1, Burst: 2}, nil)
+	l.Allow("busy")
+	l.Allow("busy")
+	for i := 0; len(l.buckets) < maxBuckets; i++ {
+		l.Allow(fmt.Sprint("client-", i))
+	}
+	//所有令牌桶都已经补满，只有busy的令牌桶还在补充
+	clock.advance(1500 * time.Millisecond)
+	l.Allow("busy")
+	l.Allow("new")
+	if _, ok := l.buckets["busy"]; !ok {
+		t.Fatal("bucket that is still refilling was pruned")
+	}
+	if n := len(l.buckets); n != 2 {
+		t.Fatalf("%d buckets after pruning, want busy and new", n)
+	}
+}
+
+func TestKeyFuncs(t *testing.T) {
+	token := func(c auth.Claims) string {
+		s, err := auth.IssueToken(c, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	user := token(auth.Claims{Subject: "nick", Role: auth.RoleStudent})
+	service := token(auth.Claims{Subject: "PortalService", Role: auth.RoleService, Service: "PortalService"})
+	peer := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{
+		{Subject: pkix.Name{CommonName: "GatewayService"}},
+	}}}
+
+	tests := []struct {
+		name   string
+		key    KeyFunc
+		remote string
+		token  string
+		tls    *tls.ConnectionState
+		want   string
+	}{
+		{"ByIP", ByIP, "10.0.0.1:1234", user, nil, "ip:10.0.0.1"},
+		{"ByIP IPv6", ByIP, "[::1]:1234", "", nil, "ip:::1"},
+		{"ByIP without port", ByIP, "10.0.0.1", "", nil, "ip:10.0.0.1"},
+		{"ByPrincipal user", ByPrincipal, "10.0.0.1:1234", user, nil, "principal:nick"},
+		{"ByPrincipal without token", ByPrincipal, "10.0.0.1:1234", "", nil, "ip:10.0.0.1"},
+		{"ByPrincipal invalid token", ByPrincipal, "10.0.0.1:1234", "invalid", nil, "ip:10.0.0.1"},
+		{"ByService token", ByService, "10.0.0.1:1234", service, nil, "service:PortalService"},
+		{"ByService certificate", ByService, "10.0.0.1:1234", service, peer, "service:GatewayService"},
+		{"ByService user token", ByService, "10.0.0.1:1234", user, nil, "ip:10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			req.TLS = tt.tls
+			if tt.token != "" {
+				auth.SetToken(req, tt.token)
+			}
+			if got := tt.key(req); got != tt.want {
+				t.Fatalf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/auth"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// 管理接口支持的操作
+const (
+	ActionDeregister = "deregister"
+	ActionDrain      = "drain"
+	ActionUndrain    = "undrain"
+	ActionCheck      = "check"
+)
+
+// 查询URL对应的注册信息
+func (r *Registry) lookup(url string) (Registration, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.lookupLocked(url)
+}
+
+// 调用方需持有r.mutex
+func (r *Registry) lookupLocked(url string) (Registration, bool) {
+	for _, reg := range r.registrations {
+		if reg.ServiceURL == url {
+			return reg, true
+		}
+	}
+	return Registration{}, false
+}
+
+// 摘除或恢复实例的流量：实例保持注册，但依赖它的服务会收到移除或添加的通知
+func (r *Registry) drain(ctx context.Context, url string, drained bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	reg, ok := r.lookupLocked(url)
+	if !ok || !r.status.setDrained(url, drained) {
+		return fmt.Errorf("method drain of registry:service at URL %s not found", url)
+	}
+	entry := []patchEntry{entryOf(reg)}
+	if drained {
+		r.notifyLocked(ctx, patch{Removed: entry})
+	} else if r.status.routable(url) {
+		r.notifyLocked(ctx, patch{Added: entry})
+	}
+	return nil
+}
+
+// 强制取消注册，心跳检测失败后残留的状态也一并清除
+func (r *Registry) deregister(ctx context.Context, url string) error {
+	if r.scheduler != nil {
+		r.scheduler.unschedule(url)
+	}
+	_, registered := r.lookup(url)
+	if registered {
+		if err := r.remove(ctx, url); err != nil {
+			return err
+		}
+	}
+	r.status.forget(url)
+	return nil
+}
+
+// AdminService registry的管理接口，只允许管理员访问
+//
+//	GET  /admin/instances           所有实例的状态
+//	POST /admin/instances/{action}  对请求体中URL对应的实例执行操作
+type AdminService struct {
+	Registry *Registry
+}
+
+func (s AdminService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg := s.Registry
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/instances"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		data, err := json.Marshal(reg.status.snapshot())
+		if err != nil {
+			log.Println("Method ServeHTTP of AdminService:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	case path != "" && r.Method == http.MethodPost:
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		url := string(payload)
+		claims, _ := auth.FromContext(r.Context())
+		log.Printf("Method ServeHTTP of AdminService:%s requested %s for %s\n", claims.Subject, path[1:], url)
+		switch path[1:] {
+		case ActionDeregister:
+			err = reg.deregister(r.Context(), url)
+		case ActionDrain:
+			err = reg.drain(r.Context(), url, true)
+		case ActionUndrain:
+			err = reg.drain(r.Context(), url, false)
+		case ActionCheck:
+			//由调度器检测时结果计入阈值，被移除但仍在检测中的实例也可以立即检测
+			if reg.scheduler != nil {
+				if _, ok := reg.scheduler.checkNow(url); ok {
+					break
+				}
+			}
+			instance, ok := reg.lookup(url)
+			if !ok {
+				err = fmt.Errorf("service at URL %s not found", url)
+				break
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), DefaultProbeConfig.Timeout)
+			reg.probe(ctx, instance)
+			cancel()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("Method ServeHTTP of AdminService:", err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Instances 查询所有实例的状态，token需为管理员身份
+func (c *Client) Instances(ctx context.Context, token string) ([]InstanceStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/admin/instances", nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.SetToken(req, token)
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list instances. Registry service responded with code %d", res.StatusCode)
+	}
+	var list []InstanceStatus
+	err = json.NewDecoder(res.Body).Decode(&list)
+	return list, err
+}
+
+// AdminAction 对url对应的实例执行管理操作，token需为管理员身份
+func (c *Client) AdminAction(ctx context.Context, token, action, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.URL+"/admin/instances/"+action, bytes.NewBufferString(url))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "text/plain")
+	auth.SetToken(req, token)
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to %s %s. Registry service responded with code %d", action, url, res.StatusCode)
+	}
+	return nil
+}
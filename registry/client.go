@@ -2,133 +2,373 @@ package registry
 
 import (
 	"bytes"
+	"context"
+	crand "crypto/rand"
+	"distributedDemo/auth"
+	"distributedDemo/health"
+	"distributedDemo/tlsutil"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
 )
 
-// RegisterService 给registryService服务发送一个POST请求
-func RegisterService(r Registration) error {
+// Client 服务与registry交互的客户端，并记录registry推送的所依赖的服务的实例
+// registry按实例推送更新，同一进程内运行多个服务时每个服务应使用各自的Client
+type Client struct {
+	//registry的地址，如http://localhost:3000
+	URL       string
+	Providers *Providers
+	//调用registry与所依赖的服务使用的http客户端，启用TLS时通过tlsutil.Configure配置证书
+	HTTP *http.Client
+	//注册时交给registry的UpdateKey，只接受以它签名的服务更新
+	updateKey []byte
+}
+
+// NewClient 创建连接registryURL的客户端
+func NewClient(registryURL string) *Client {
+	key := make([]byte, UpdateKeySize)
+	if _, err := crand.Read(key); err != nil {
+		panic(fmt.Sprintf("func NewClient: %v", err))
+	}
+	return &Client{
+		URL:       strings.TrimSuffix(registryURL, "/"),
+		Providers: NewProviders(),
+		HTTP:      tlsutil.NewClient(),
+		updateKey: key,
+	}
+}
+
+// DefaultClient 连接RegistryURL，每个进程只运行一个服务时使用，使用tlsutil.Client调用其他服务
+var DefaultClient = defaultClient()
+
+func defaultClient() *Client {
+	c := NewClient(RegistryURL)
+	c.HTTP = tlsutil.Client
+	return c
+}
+
+// RegisterHandlers 在mux上注册registry调用的心跳检测与服务更新接口，checks为实例的健康检查
+// r声明支持ProtocolConnect时，心跳检测也可以通过InstanceService的Heartbeat过程进行
+func (c *Client) RegisterHandlers(mux *http.ServeMux, r Registration, checks *health.Checks) error {
 	heartbeatURL, err := url.Parse(r.HeartbeatURL)
 	if err != nil {
 		return err
 	}
-	http.HandleFunc(heartbeatURL.Path, func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	//启用TLS时只接受registry的心跳检测与服务更新
+	mux.Handle(heartbeatURL.Path, tlsutil.RequirePeer(checks.Handler(), string(RegistryService)))
+	if r.Supports(ProtocolConnect) {
+		registerHeartbeatRPC(mux, checks)
+	}
 
 	serviceUpdateURL, err := url.Parse(r.ServiceUpdateURL)
 	if err != nil {
 		return err
 	}
-	http.Handle(serviceUpdateURL.Path, &serviceUpdateHandler{})
+	mux.Handle(serviceUpdateURL.Path, tlsutil.RequirePeer(&serviceUpdateHandler{providers: c.Providers, key: c.updateKey}, string(RegistryService)))
+	return nil
+}
+
+// RegisterService 给registryService服务发送一个POST请求，调用前需通过RegisterHandlers注册相应的接口
+func (c *Client) RegisterService(r Registration) error {
+	if r.Zone == "" {
+		r.Zone = LocalZone()
+	}
+	c.Providers.SetZone(r.Zone)
+	if r.ServiceUpdateURL != "" {
+		r.UpdateKey = c.updateKey
+	}
 
 	buf := new(bytes.Buffer)
 	enc := json.NewEncoder(buf)
-	err = enc.Encode(r)
+	err := enc.Encode(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL+"/services", bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	auth.SetToken(req, auth.ServiceToken(string(r.ServiceName)))
+	err = auth.SignRequest(req, buf.Bytes())
 	if err != nil {
 		return err
 	}
-	res, err := http.Post(ServicesURL, "application/json", buf)
+	res, err := c.HTTP.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("failed to register service."+
 			"Registry service responded with code %d", res.StatusCode)
 	}
+	//响应中是所依赖的服务的完整列表，registry随后还会推送同一份列表，重复收到时会被忽略
+	var initial patch
+	if err := json.NewDecoder(res.Body).Decode(&initial); err == nil {
+		if err := c.Providers.Update(initial); err != nil {
+			log.Println("Method RegisterService of Client:", err)
+		}
+	}
 	return nil
 }
 
-type serviceUpdateHandler struct{}
+// ShutdownService 取消注册服务
+func (c *Client) ShutdownService(serviceName ServiceName, url string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.URL+"/services", bytes.NewBuffer([]byte(url)))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "text/plain")
+	auth.SetToken(req, auth.ServiceToken(string(serviceName)))
+	err = auth.SignRequest(req, []byte(url))
+	if err != nil {
+		return err
+	}
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to deregister service. Registry"+
+			"service responded with code %v", res.StatusCode)
+	}
+	return nil
+}
+
+// Peers 查询registry中name的所有已注册实例，包括尚未就绪的实例，只能查询自己所属的服务
+// 与Providers不同，结果不受实例的健康检查影响，供同一服务的实例之间相互发现，如选举leader
+func (c *Client) Peers(ctx context.Context, name ServiceName) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/services", nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.SetToken(req, auth.ServiceToken(string(name)))
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list instances of %v. Registry service responded with code %d", name, res.StatusCode)
+	}
+	var urls []string
+	if err := json.NewDecoder(res.Body).Decode(&urls); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// GetProvider 随机返回所依赖的服务的一个实例的URL
+func (c *Client) GetProvider(name ServiceName) (string, error) {
+	return c.Providers.Get(name)
+}
+
+// RegisterHandlers 使用DefaultClient注册接口，心跳检测返回health包中注册的检查的结果
+func RegisterHandlers(mux *http.ServeMux, r Registration) error {
+	return DefaultClient.RegisterHandlers(mux, r, health.DefaultChecks)
+}
+
+// RegisterService 使用DefaultClient注册服务
+func RegisterService(r Registration) error {
+	return DefaultClient.RegisterService(r)
+}
+
+// ShutdownService 使用DefaultClient取消注册服务
+func ShutdownService(serviceName ServiceName, url string) error {
+	return DefaultClient.ShutdownService(serviceName, url)
+}
+
+type serviceUpdateHandler struct {
+	providers *Providers
+	key       []byte
+}
 
 func (suh serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	dec := json.NewDecoder(r.Body)
+	//只接受以注册时提供的UpdateKey签名的更新，其他服务即使持有共享密钥也无法伪造服务地址
+	body, err := auth.VerifyRequestWithKey(r, suh.key)
+	if err != nil {
+		log.Println("Method ServeHTTP of serviceUpdateHandler: rejected update from", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	var p patch
-	err := dec.Decode(&p)
+	err = json.Unmarshal(body, &p)
 	if err != nil {
 		log.Println("Method ServeHTTP of serviceUpdateHandler:", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	log.Println("Updated received", p)
-	prov.Update(p)
+	//缺失了更新时以409响应，registry会改为推送完整的服务列表
+	if err := suh.providers.Update(p); err != nil {
+		log.Println("Method ServeHTTP of serviceUpdateHandler:", err)
+		w.WriteHeader(http.StatusConflict)
+	}
 }
 
-// ShutdownService 取消注册服务
-func ShutdownService(url string) error {
-	req, err := http.NewRequest(http.MethodDelete, ServicesURL, bytes.NewBuffer([]byte(url)))
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", "text/plain")
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to deregister service. Registry"+
-			"service responded with code %v", res.StatusCode)
+// Providers 例如grade服务依赖于logger服务来记录日志，此时logger服务就可以看作是grade服务的提供者（provider）
+type Providers struct {
+	//服务的所有实例，可能不止一个，也可能位于其他可用区
+	services map[ServiceName][]patchEntry
+	//当前实例所在的可用区，优先使用同一可用区的实例
+	zone string
+	//最近应用的更新所在的流与序号
+	stream string
+	seq    uint64
+	mutex  *sync.RWMutex
+}
+
+// NewProviders 创建空的实例列表
+func NewProviders() *Providers {
+	return &Providers{
+		services: make(map[ServiceName][]patchEntry),
+		mutex:    new(sync.RWMutex),
 	}
-	return nil
 }
 
-//例如grade服务依赖于logger服务来记录日志，此时logger服务就可以看作是grade服务的提供者（provider）
-type providers struct {
-	//string slice是服务包含的URL，可能不止一个
-	services map[ServiceName][]string
-	mutex    *sync.RWMutex
+// SetZone 设置当前实例所在的可用区
+func (p *Providers) SetZone(zone string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.zone = zone
 }
 
-func (p *providers) Update(pat patch) {
+// Update 按顺序应用registry推送的更新，重复的更新会被忽略，发现缺失的更新时返回错误
+func (p *Providers) Update(pat patch) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
+	switch {
+	//旧版本的registry推送的更新不带序号，直接应用
+	case pat.Seq == 0:
+	//重试导致的重复推送，或晚于后续更新到达的注册响应
+	case pat.Stream == p.stream && pat.Seq <= p.seq:
+		return nil
+	case pat.Resync:
+		p.services = make(map[ServiceName][]patchEntry)
+	case pat.Stream != p.stream || pat.Seq != p.seq+1:
+		return fmt.Errorf("missing patches: have %s/%d, received %s/%d", p.stream, p.seq, pat.Stream, pat.Seq)
+	}
+	if pat.Seq != 0 {
+		p.stream, p.seq = pat.Stream, pat.Seq
+	}
+
 	for _, patchEntry := range pat.Added {
-		if _, ok := p.services[patchEntry.Name]; !ok {
-			p.services[patchEntry.Name] = make([]string, 0)
+		//重新注册的实例可能改变了订阅的事件，替换原有的信息
+		if i := indexOf(p.services[patchEntry.Name], patchEntry.URL); i >= 0 {
+			p.services[patchEntry.Name][i] = patchEntry
+			continue
 		}
-		p.services[patchEntry.Name] = append(p.services[patchEntry.Name],
-			patchEntry.URL)
+		p.services[patchEntry.Name] = append(p.services[patchEntry.Name], patchEntry)
 	}
 	for _, patchEntry := range pat.Removed {
-		if providerURLs, ok := p.services[patchEntry.Name]; ok {
-			for i := range providerURLs {
-				if providerURLs[i] == patchEntry.URL {
-					p.services[patchEntry.Name] = append(providerURLs[:i],
-						providerURLs[i+1:]...)
-				}
-			}
+		entries := p.services[patchEntry.Name]
+		if i := indexOf(entries, patchEntry.URL); i >= 0 {
+			entries = append(entries[:i:i], entries[i+1:]...)
+		}
+		if len(entries) == 0 {
+			delete(p.services, patchEntry.Name)
+			continue
+		}
+		p.services[patchEntry.Name] = entries
+	}
+	return nil
+}
+
+func indexOf(entries []patchEntry, url string) int {
+	for i, e := range entries {
+		if e.URL == url {
+			return i
 		}
 	}
+	return -1
 }
 
-//注意返回值的string，表示服务对应的URL，准确来说应改为slice。
-//todo receiver
-func (p providers) get(name ServiceName) (string, error) {
-	providers, ok := p.services[name]
-	if !ok {
+// Get 随机返回服务的一个URL，同一可用区内没有可用的实例时才使用其他可用区的实例
+func (p *Providers) Get(name ServiceName) (string, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	entries := p.services[name]
+	if len(entries) == 0 {
 		return "", fmt.Errorf("no providers available for service %v", name)
 	}
-	idx := int(rand.Float32() * float32(len(providers)))
-	return providers[idx], nil
+	return p.pick(entries), nil
 }
 
-// GetProvider 由于provider的get方法是私有的，对外就要套一层函数
-func GetProvider(name ServiceName) (string, error) {
-	return prov.get(name)
+// All 返回服务所有实例的URL，按URL排序，如同一服务的实例需要相互发现时
+func (p *Providers) All(name ServiceName) []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	urls := make([]string, 0, len(p.services[name]))
+	for _, e := range p.services[name] {
+		urls = append(urls, e.URL)
+	}
+	sort.Strings(urls)
+	return urls
 }
 
-var prov = providers{
-	services: make(map[ServiceName][]string),
-	mutex:    new(sync.RWMutex),
+// 随机选择一个实例，同一可用区内没有实例时才使用其他可用区的实例，调用方需持有读锁
+func (p *Providers) pick(entries []patchEntry) string {
+	local := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Zone == "" || e.Zone == p.zone {
+			local = append(local, e.URL)
+		}
+	}
+	if len(local) > 0 {
+		return local[rand.Intn(len(local))]
+	}
+	return entries[rand.Intn(len(entries))].URL
+}
+
+// Subscribers 返回订阅了eventType的服务，同一服务的多个实例只需要其中一个收到事件
+func (p *Providers) Subscribers(eventType string) []ServiceName {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var names []ServiceName
+	for name, entries := range p.services {
+		for _, e := range entries {
+			if e.subscribes(eventType) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// EventURL 随机返回服务中订阅了eventType的一个实例的事件接收地址
+func (p *Providers) EventURL(name ServiceName, eventType string) (string, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var subscribed []patchEntry
+	for _, e := range p.services[name] {
+		if e.subscribes(eventType) {
+			//pick返回的是URL，这里需要事件接收地址
+			subscribed = append(subscribed, patchEntry{URL: e.EventURL, Zone: e.Zone})
+		}
+	}
+	if len(subscribed) == 0 {
+		return "", fmt.Errorf("no instance of %v subscribes to %s", name, eventType)
+	}
+	return p.pick(subscribed), nil
+}
+
+// GetProvider 从DefaultClient记录的实例中随机返回服务的一个URL
+func GetProvider(name ServiceName) (string, error) {
+	return DefaultClient.GetProvider(name)
 }
@@ -0,0 +1,224 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	//重试间隔从patchRetryMin开始倍增，最长为patchRetryMax
+	patchRetryMin = 200 * time.Millisecond
+	patchRetryMax = 30 * time.Second
+	//单次推送的超时时间
+	patchTimeout = 5 * time.Second
+	//积压的更新超过该数量时不再逐条推送，改为推送完整的服务列表
+	maxPatchBacklog = 64
+)
+
+// 服务发现更新的实例以409响应表示检测到了缺失的更新，请求完整的服务列表
+var errResyncRequested = errors.New("subscriber requested a resync")
+
+// 待推送的更新，Seq为0表示尚未编号
+type delivery struct {
+	ctx context.Context
+	p   patch
+}
+
+// 依赖其他服务的实例，按顺序逐条推送更新，收到确认后才推送下一条
+type subscriber struct {
+	r    *Registry
+	stop chan struct{}
+	wake chan struct{}
+
+	mutex sync.Mutex
+	reg   Registration
+	//实例注册时提供的UpdateKey，用于签名推送的更新
+	key    []byte
+	stream string
+	seq    uint64
+	queue  []delivery
+	//为true时先推送完整的服务列表，再推送之后的更新
+	resync bool
+}
+
+// 以ServiceURL为键记录所有订阅更新的实例
+type subscriptions struct {
+	subs  map[string]*subscriber
+	mutex sync.Mutex
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{subs: make(map[string]*subscriber)}
+}
+
+// 每次订阅使用新的流ID，实例据此区分registry或自身重启前后的序号
+func newStream() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 开始或重新开始向实例推送更新，initial为实例当前应知道的完整服务列表
+// 返回已编号的initial，它同时作为第一条更新排队推送
+func (ss *subscriptions) subscribe(r *Registry, reg Registration, key []byte, initial patch) patch {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	s, ok := ss.subs[reg.ServiceURL]
+	if !ok {
+		s = &subscriber{r: r, stop: make(chan struct{}), wake: make(chan struct{}, 1)}
+		ss.subs[reg.ServiceURL] = s
+		go s.loop()
+	}
+	s.mutex.Lock()
+	s.reg, s.key, s.stream, s.seq, s.resync = reg, key, newStream(), 0, false
+	initial = s.number(initial, true)
+	s.queue = []delivery{{ctx: context.Background(), p: initial}}
+	s.mutex.Unlock()
+	s.signal()
+	return initial
+}
+
+func (ss *subscriptions) unsubscribe(url string) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if s, ok := ss.subs[url]; ok {
+		close(s.stop)
+		delete(ss.subs, url)
+	}
+}
+
+// 停止向所有实例推送更新
+func (ss *subscriptions) stopAll() {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	for url, s := range ss.subs {
+		close(s.stop)
+		delete(ss.subs, url)
+	}
+}
+
+// 将更新加入实例的推送队列，不等待推送完成
+func (ss *subscriptions) publish(ctx context.Context, url string, p patch) {
+	ss.mutex.Lock()
+	s, ok := ss.subs[url]
+	ss.mutex.Unlock()
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	if len(s.queue) >= maxPatchBacklog {
+		log.Printf("Method publish of subscriptions:%s fell %d patches behind, resyncing\n", url, len(s.queue))
+		s.requestResync()
+	} else {
+		//即使正在等待推送完整的服务列表也保留该更新，列表可能在更新之前就已生成，重复应用不影响结果
+		s.queue = append(s.queue, delivery{ctx: ctx, p: p})
+	}
+	s.mutex.Unlock()
+	s.signal()
+}
+
+// 调用方需持有s.mutex
+func (s *subscriber) number(p patch, resync bool) patch {
+	s.seq++
+	p.Seq, p.Stream, p.Resync = s.seq, s.stream, resync
+	return p
+}
+
+// 丢弃积压的更新，下次推送完整的服务列表，调用方需持有s.mutex
+func (s *subscriber) requestResync() {
+	s.queue = nil
+	s.resync = true
+	patchResyncs.In(s.r.metrics).Inc(string(s.reg.ServiceName))
+	s.r.status.resync(s.reg)
+}
+
+func (s *subscriber) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 取出队首待推送的更新及签名用的密钥，需要时先生成完整的服务列表
+func (s *subscriber) next() (Registration, []byte, delivery, bool) {
+	s.mutex.Lock()
+	if s.resync {
+		reg := s.reg
+		s.mutex.Unlock()
+		//计算服务列表时不持有s.mutex，避免与notify互相等待
+		state := s.r.requiredState(reg)
+		s.mutex.Lock()
+		if s.resync {
+			s.resync = false
+			s.queue = append([]delivery{{ctx: context.Background(), p: s.number(state, true)}}, s.queue...)
+		}
+	}
+	defer s.mutex.Unlock()
+	if len(s.queue) == 0 {
+		return s.reg, s.key, delivery{}, false
+	}
+	if s.queue[0].p.Seq == 0 {
+		s.queue[0].p = s.number(s.queue[0].p, false)
+	}
+	return s.reg, s.key, s.queue[0], true
+}
+
+// 实例确认收到seq后将其移出队列
+func (s *subscriber) ack(seq uint64) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.queue) > 0 && s.queue[0].p.Seq == seq {
+		s.queue = s.queue[1:]
+	}
+	return len(s.queue)
+}
+
+func (s *subscriber) loop() {
+	backoff := patchRetryMin
+	for {
+		reg, key, d, ok := s.next()
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(d.ctx, patchTimeout)
+		err := s.r.sendPatch(ctx, d.p, reg.ServiceUpdateURL, key)
+		cancel()
+		switch {
+		case err == nil:
+			backoff = patchRetryMin
+			s.r.status.patch(reg, nil, s.ack(d.p.Seq))
+		case errors.Is(err, errResyncRequested):
+			log.Println("Method loop of subscriber:", reg.ServiceURL, err)
+			s.mutex.Lock()
+			s.requestResync()
+			s.mutex.Unlock()
+		default:
+			log.Printf("Method loop of subscriber:patch %d to %s failed, retrying in %v: %v\n",
+				d.p.Seq, reg.ServiceURL, backoff, err)
+			s.mutex.Lock()
+			backlog := len(s.queue)
+			s.mutex.Unlock()
+			s.r.status.patch(reg, err, backlog)
+			patchFailures.In(s.r.metrics).Inc(string(reg.ServiceName))
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				return
+			}
+			backoff *= 2
+			if backoff > patchRetryMax {
+				backoff = patchRetryMax
+			}
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 依赖GradeService的实例，由serviceUpdateHandler应用收到的更新
+// respond返回非0时不交给serviceUpdateHandler，直接以该状态码响应
+type fakeSubscriber struct {
+	url       string
+	providers *Providers
+	handler   http.Handler
+	respond   func(p patch, attempt int) int
+
+	mutex    sync.Mutex
+	received []patch
+	times    []time.Time
+}
+
+func (fs *fakeSubscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var p patch
+	_ = json.Unmarshal(body, &p)
+	fs.mutex.Lock()
+	fs.received = append(fs.received, p)
+	fs.times = append(fs.times, time.Now())
+	attempt := 0
+	for _, prev := range fs.received {
+		if prev.Seq == p.Seq && prev.Stream == p.Stream {
+			attempt++
+		}
+	}
+	fs.mutex.Unlock()
+	if fs.respond != nil {
+		if code := fs.respond(p, attempt); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+	}
+	fs.handler.ServeHTTP(w, r)
+}
+
+// 收到的所有推送，包括失败后重试的推送
+func (fs *fakeSubscriber) patches() ([]patch, []time.Time) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return append([]patch(nil), fs.received...), append([]time.Time(nil), fs.times...)
+}
+
+func newDeliveryRegistry(t *testing.T) *Registry {
+	t.Helper()
+	r := NewRegistry("test")
+	r.HTTP = &http.Client{}
+	t.Cleanup(r.Close)
+	return r
+}
+
+// 像Client.RegisterService一样注册一个依赖GradeService的实例，并应用注册响应中的服务列表
+func startSubscriber(t *testing.T, r *Registry, respond func(p patch, attempt int) int) *fakeSubscriber {
+	t.Helper()
+	key := []byte("delivery-test-key")
+	fs := &fakeSubscriber{providers: NewProviders(), respond: respond}
+	fs.handler = serviceUpdateHandler{providers: fs.providers, key: key}
+	srv := httptest.NewServer(fs)
+	t.Cleanup(srv.Close)
+	fs.url = srv.URL
+	initial := r.add(context.Background(), Registration{
+		ServiceName:      PortalService,
+		ServiceURL:       srv.URL,
+		RequiredServices: []ServiceName{GradeService},
+		ServiceUpdateURL: srv.URL + "/services",
+		UpdateKey:        key,
+	})
+	if err := fs.providers.Update(initial); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func instanceStatus(t *testing.T, r *Registry, url string) InstanceStatus {
+	t.Helper()
+	for _, st := range r.status.snapshot() {
+		if st.ServiceURL == url {
+			return st
+		}
+	}
+	t.Fatalf("no status for %s", url)
+	return InstanceStatus{}
+}
+
+// 推送队列中尚未确认的更新数量
+func backlog(r *Registry, url string) int {
+	r.subscriptions.mutex.Lock()
+	s, ok := r.subscriptions.subs[url]
+	r.subscriptions.mutex.Unlock()
+	if !ok {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.resync {
+		return len(s.queue) + 1
+	}
+	return len(s.queue)
+}
+
+// 等待所有更新推送完成，且订阅者的列表与urls一致
+func waitForProviders(t *testing.T, r *Registry, fs *fakeSubscriber, urls []string) {
+	t.Helper()
+	sort.Strings(urls)
+	if urls == nil {
+		urls = []string{}
+	}
+	waitUntil(t, 5*time.Second, func() bool {
+		return backlog(r, fs.url) == 0 && reflect.DeepEqual(fs.providers.All(GradeService), urls)
+	}, "subscriber has %v with %d patches queued, want %v", fs.providers.All(GradeService), backlog(r, fs.url), urls)
+}
+
+func gradeURL(i int) string {
+	return fmt.Sprintf("http://grades-%d", i)
+}
+
+func TestDeliveryKeepsOrderOfConcurrentChanges(t *testing.T) {
+	r := newDeliveryRegistry(t)
+	fs := startSubscriber(t, r, nil)
+
+	//每个实例由一个goroutine注册，另一个goroutine在它出现后立即取消注册，只有偶数编号的实例保留；
+	//通知与状态变化不在同一次加锁中进行时，Removed可能排在Added之前，使订阅者留下已移除的实例
+	//每轮的更新数量小于maxPatchBacklog，不会因积压而改为推送完整的列表
+	var want []string
+	for round := 0; round < 20; round++ {
+		var wg sync.WaitGroup
+		for i := round * 20; i < (round+1)*20; i++ {
+			url := gradeURL(i)
+			if i%2 == 0 {
+				want = append(want, url)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.add(context.Background(), instanceReg(url, 0))
+			}()
+			if i%2 == 1 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for r.remove(context.Background(), url) != nil {
+					}
+				}()
+			}
+		}
+		wg.Wait()
+		waitForProviders(t, r, fs, want)
+	}
+
+	received, _ := fs.patches()
+	for i := 1; i < len(received); i++ {
+		if received[i].Seq != received[i-1].Seq+1 {
+			t.Fatalf("patch %d has seq %d after %d, want consecutive seqs", i, received[i].Seq, received[i-1].Seq)
+		}
+	}
+	if st := instanceStatus(t, r, fs.url); st.Resyncs != 0 {
+		t.Fatalf("%d resyncs, want none", st.Resyncs)
+	}
+}
+
+func TestDeliveryResyncsAfterGap(t *testing.T) {
+	r := newDeliveryRegistry(t)
+	//seq 2被确认但没有应用，模拟丢失的更新；订阅者收到seq 3时发现缺失，以409请求完整的列表
+	fs := startSubscriber(t, r, func(p patch, attempt int) int {
+		if p.Seq == 2 {
+			return http.StatusOK
+		}
+		return 0
+	})
+	r.add(context.Background(), instanceReg(gradeURL(0), 0))
+	r.add(context.Background(), instanceReg(gradeURL(1), 0))
+	waitForProviders(t, r, fs, []string{gradeURL(0), gradeURL(1)})
+
+	received, _ := fs.patches()
+	last := received[len(received)-1]
+	if !last.Resync || len(last.Added) != 2 {
+		t.Fatalf("last patch = %+v, want the full list after the gap", last)
+	}
+	if st := instanceStatus(t, r, fs.url); st.Resyncs != 1 {
+		t.Fatalf("%d resyncs, want 1", st.Resyncs)
+	}
+}
+
+func TestDeliveryResyncsWhenBacklogOverflows(t *testing.T) {
+	r := newDeliveryRegistry(t)
+	entered, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	//第一条更新阻塞，之后的更新在队列中积压
+	fs := startSubscriber(t, r, func(p patch, attempt int) int {
+		if p.Seq == 1 {
+			close(entered)
+			<-release
+		}
+		return 0
+	})
+	t.Cleanup(func() { once.Do(func() { close(release) }) })
+	<-entered
+
+	var want []string
+	for i := 0; i < maxPatchBacklog+10; i++ {
+		r.add(context.Background(), instanceReg(gradeURL(i), 0))
+		want = append(want, gradeURL(i))
+	}
+	if n := backlog(r, fs.url); n > maxPatchBacklog {
+		t.Fatalf("%d patches queued, want at most %d", n, maxPatchBacklog)
+	}
+	if st := instanceStatus(t, r, fs.url); st.Resyncs != 1 {
+		t.Fatalf("%d resyncs after overflowing the backlog, want 1", st.Resyncs)
+	}
+
+	once.Do(func() { close(release) })
+	waitForProviders(t, r, fs, want)
+	received, _ := fs.patches()
+	resynced := false
+	for _, p := range received[1:] {
+		if p.Resync && len(p.Added) > 0 {
+			resynced = true
+		}
+	}
+	if !resynced {
+		t.Fatal("the full list was not delivered after the backlog overflowed")
+	}
+	if len(received) > maxPatchBacklog {
+		t.Fatalf("%d patches delivered, want the backlog replaced by the full list", len(received))
+	}
+}
+
+func TestDeliveryRetriesWithBackoffUntilAcked(t *testing.T) {
+	r := newDeliveryRegistry(t)
+	const failures = 2
+	fs := startSubscriber(t, r, func(p patch, attempt int) int {
+		if p.Seq == 2 && attempt <= failures {
+			return http.StatusInternalServerError
+		}
+		return 0
+	})
+	r.add(context.Background(), instanceReg(gradeURL(0), 0))
+	r.add(context.Background(), instanceReg(gradeURL(1), 0))
+	waitForProviders(t, r, fs, []string{gradeURL(0), gradeURL(1)})
+
+	received, times := fs.patches()
+	var seqs []uint64
+	for _, p := range received {
+		seqs = append(seqs, p.Seq)
+	}
+	//未确认的更新被重试，之后的更新等待它被确认后才推送
+	if want := []uint64{1, 2, 2, 2, 3}; !reflect.DeepEqual(seqs, want) {
+		t.Fatalf("delivered seqs %v, want %v", seqs, want)
+	}
+	//重试间隔从patchRetryMin开始倍增
+	for i, wait := range []time.Duration{patchRetryMin, 2 * patchRetryMin} {
+		if d := times[i+2].Sub(times[i+1]); d < wait {
+			t.Fatalf("retry %d after %v, want at least %v", i+1, d, wait)
+		}
+	}
+	st := instanceStatus(t, r, fs.url)
+	if st.PatchFailures != failures || st.LastPatchError != "" {
+		t.Fatalf("status = %d failures, last error %q, want %d failures and no error", st.PatchFailures, st.LastPatchError, failures)
+	}
+}
@@ -0,0 +1,360 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDNSDomain DNS接口默认的域名，如gradeservice.service.local
+const DefaultDNSDomain = "service.local"
+
+// DNS报文中用到的类型与返回码
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+
+	dnsRcodeOK       = 0
+	dnsRcodeFormat   = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeRefused  = 5
+
+	//未使用EDNS时UDP响应的最大长度，超过时设置TC标志，由客户端改用TCP查询
+	dnsUDPSize = 512
+	//同时处理的UDP查询数量，解析实例的主机名可能需要等待
+	dnsUDPConcurrency = 64
+)
+
+var errDNSFormat = errors.New("malformed dns message")
+
+// DNSServer 以DNS的形式提供健康的实例，供不使用registry包的程序通过标准的解析器发现服务
+//
+//	gradeservice.service.local               A/AAAA 所有健康实例的地址
+//	_gradeservice._tcp.service.local         SRV    所有健康实例的端口及其主机名
+//	<实例ID>.gradeservice.service.local      A/AAAA 单个实例的地址，即SRV记录中的主机名
+type DNSServer struct {
+	//提供实例的registry
+	Registry *Registry
+	Addr     string
+	Domain   string
+	TTL      time.Duration
+}
+
+// ListenAndServe 同时在UDP与TCP上监听，任一监听失败时返回
+func (d *DNSServer) ListenAndServe() error {
+	if d.Domain == "" {
+		d.Domain = DefaultDNSDomain
+	}
+	d.Domain = strings.ToLower(strings.Trim(d.Domain, "."))
+	pc, err := net.ListenPacket("udp", d.Addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	ln, err := net.Listen("tcp", d.Addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	errc := make(chan error, 2)
+	go func() { errc <- d.serveUDP(pc) }()
+	go func() { errc <- d.serveTCP(ln) }()
+	return <-errc
+}
+
+// 每个查询在单独的goroutine中回答，解析某个实例的主机名较慢时不影响其他查询
+func (d *DNSServer) serveUDP(pc net.PacketConn) error {
+	slots := make(chan struct{}, dnsUDPConcurrency)
+	for {
+		buf := make([]byte, 1500)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots }()
+			res := d.answer(buf[:n])
+			if res == nil {
+				return
+			}
+			if len(res) > dnsUDPSize {
+				res = truncate(res)
+			}
+			_, _ = pc.WriteTo(res, addr)
+		}()
+	}
+}
+
+func (d *DNSServer) serveTCP(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			for {
+				_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+				var size uint16
+				if binary.Read(conn, binary.BigEndian, &size) != nil {
+					return
+				}
+				msg := make([]byte, size)
+				if _, err := io.ReadFull(conn, msg); err != nil {
+					return
+				}
+				res := d.answer(msg)
+				if res == nil {
+					return
+				}
+				out := make([]byte, 2, 2+len(res))
+				binary.BigEndian.PutUint16(out, uint16(len(res)))
+				if _, err := conn.Write(append(out, res...)); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+// 一条待写入响应的资源记录
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	data  []byte
+}
+
+// 解析查询并生成响应，无法解析的报文返回nil
+func (d *DNSServer) answer(msg []byte) []byte {
+	if len(msg) < 12 {
+		return nil
+	}
+	id, flags := msg[0:2], binary.BigEndian.Uint16(msg[2:4])
+	//只回答标准查询
+	if flags&0x8000 != 0 {
+		return nil
+	}
+	qname, qtype, end, err := parseQuestion(msg)
+	if err != nil || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return dnsHeader(id, flags, dnsRcodeFormat, nil, 0, 0)
+	}
+	question := msg[12:end]
+	if qname != d.Domain && !strings.HasSuffix(qname, "."+d.Domain) {
+		return dnsHeader(id, flags, dnsRcodeRefused, question, 0, 0)
+	}
+	answers, extra, found := d.lookup(qname, qtype)
+	if !found {
+		return dnsHeader(id, flags, dnsRcodeNXDomain, question, 0, 0)
+	}
+	res := dnsHeader(id, flags, dnsRcodeOK, question, len(answers), len(extra))
+	ttl := uint32(d.TTL / time.Second)
+	for _, rr := range append(answers, extra...) {
+		res = appendRecord(res, rr, ttl)
+	}
+	return res
+}
+
+// 按查询的名称找到对应的实例，found为false表示名称不存在
+func (d *DNSServer) lookup(qname string, qtype uint16) (answers, extra []dnsRecord, found bool) {
+	//域名本身存在但没有记录
+	if qname == d.Domain {
+		return nil, nil, true
+	}
+	labels := strings.Split(strings.TrimSuffix(qname, "."+d.Domain), ".")
+	instances := d.Registry.healthyInstances()
+	switch {
+	//_gradeservice._tcp.service.local
+	case len(labels) == 2 && strings.HasPrefix(labels[0], "_") && labels[1] == "_tcp":
+		service := labels[0][1:]
+		for _, inst := range instances {
+			if dnsLabel(inst.ServiceName) != service {
+				continue
+			}
+			found = true
+			host, port := instanceAddr(inst)
+			if qtype != dnsTypeSRV || port == 0 {
+				continue
+			}
+			target := instanceID(inst) + "." + service + "." + d.Domain
+			answers = append(answers, dnsRecord{name: qname, rtype: dnsTypeSRV, data: srvData(port, target)})
+			extra = append(extra, addressRecords(target, host, 0)...)
+		}
+	//gradeservice.service.local
+	case len(labels) == 1:
+		for _, inst := range instances {
+			if dnsLabel(inst.ServiceName) != labels[0] {
+				continue
+			}
+			found = true
+			host, _ := instanceAddr(inst)
+			answers = append(answers, addressRecords(qname, host, qtype)...)
+		}
+	//<实例ID>.gradeservice.service.local
+	case len(labels) == 2:
+		for _, inst := range instances {
+			if dnsLabel(inst.ServiceName) != labels[1] || instanceID(inst) != labels[0] {
+				continue
+			}
+			found = true
+			host, _ := instanceAddr(inst)
+			answers = append(answers, addressRecords(qname, host, qtype)...)
+		}
+	}
+	return answers, extra, found
+}
+
+// 本可用区及其他可用区中健康的实例
+func (r *Registry) healthyInstances() []Registration {
+	list := r.localInstances()
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, instances := range r.remote {
+		list = append(list, instances...)
+	}
+	return list
+}
+
+func dnsLabel(name ServiceName) string {
+	return strings.ToLower(string(name))
+}
+
+// 实例ID由ServiceURL得出，实例重新注册后保持不变
+func instanceID(reg Registration) string {
+	sum := sha1.Sum([]byte(reg.ServiceURL))
+	return hex.EncodeToString(sum[:4])
+}
+
+func instanceAddr(reg Registration) (string, uint16) {
+	u, err := url.Parse(reg.ServiceURL)
+	if err != nil {
+		return "", 0
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return u.Hostname(), uint16(p)
+}
+
+// 生成主机的A/AAAA记录，qtype为0时两种都生成
+func addressRecords(name, host string, qtype uint16) []dnsRecord {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if host != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			log.Println("func addressRecords:", err)
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	var records []dnsRecord
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			if qtype == dnsTypeA || qtype == 0 {
+				records = append(records, dnsRecord{name: name, rtype: dnsTypeA, data: v4})
+			}
+		} else if qtype == dnsTypeAAAA || qtype == 0 {
+			records = append(records, dnsRecord{name: name, rtype: dnsTypeAAAA, data: ip.To16()})
+		}
+	}
+	return records
+}
+
+func srvData(port uint16, target string) []byte {
+	data := make([]byte, 6)
+	//priority与weight相同，由客户端随机选择
+	binary.BigEndian.PutUint16(data[0:], 0)
+	binary.BigEndian.PutUint16(data[2:], 10)
+	binary.BigEndian.PutUint16(data[4:], port)
+	return appendName(data, target)
+}
+
+// 解析唯一的问题，返回小写且不带末尾点的名称
+func parseQuestion(msg []byte) (name string, qtype uint16, end int, err error) {
+	var labels []string
+	i := 12
+	for {
+		if i >= len(msg) {
+			return "", 0, 0, errDNSFormat
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			break
+		}
+		//查询中的名称不会被压缩
+		if n&0xC0 != 0 || i+n > len(msg) {
+			return "", 0, 0, errDNSFormat
+		}
+		labels = append(labels, strings.ToLower(string(msg[i:i+n])))
+		i += n
+	}
+	if i+4 > len(msg) || binary.BigEndian.Uint16(msg[i+2:]) != dnsClassIN {
+		return "", 0, 0, errDNSFormat
+	}
+	return strings.Join(labels, "."), binary.BigEndian.Uint16(msg[i:]), i + 4, nil
+}
+
+func dnsHeader(id []byte, flags uint16, rcode int, question []byte, answers, extra int) []byte {
+	res := make([]byte, 12, 12+len(question)+256)
+	copy(res, id)
+	//QR与AA置位，保留查询的RD标志
+	binary.BigEndian.PutUint16(res[2:], 0x8000|0x0400|flags&0x0100|uint16(rcode))
+	if question != nil {
+		binary.BigEndian.PutUint16(res[4:], 1)
+	}
+	binary.BigEndian.PutUint16(res[6:], uint16(answers))
+	binary.BigEndian.PutUint16(res[10:], uint16(extra))
+	return append(res, question...)
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendRecord(b []byte, rr dnsRecord, ttl uint32) []byte {
+	b = appendName(b, rr.name)
+	var fixed [10]byte
+	binary.BigEndian.PutUint16(fixed[0:], rr.rtype)
+	binary.BigEndian.PutUint16(fixed[2:], dnsClassIN)
+	binary.BigEndian.PutUint32(fixed[4:], ttl)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(rr.data)))
+	b = append(b, fixed[:]...)
+	return append(b, rr.data...)
+}
+
+// 只保留报头与问题并设置TC标志
+func truncate(res []byte) []byte {
+	_, _, end, err := parseQuestion(res)
+	if err != nil {
+		end = 12
+	}
+	out := append([]byte(nil), res[:end]...)
+	out[2] |= 0x02
+	binary.BigEndian.PutUint16(out[6:], 0)
+	binary.BigEndian.PutUint16(out[8:], 0)
+	binary.BigEndian.PutUint16(out[10:], 0)
+	return out
+}
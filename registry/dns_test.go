@@ -0,0 +1,240 @@
+package registry
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// 构造只有一个问题的标准查询
+func dnsQuery(name string, qtype uint16) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = appendName(msg, name)
+	return append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+}
+
+// 解析后的响应，记录以"类型 名称 数据"表示，便于比较
+type dnsResponse struct {
+	rcode     int
+	truncated bool
+	answers   []string
+	extra     []string
+}
+
+func parseDNSResponse(t *testing.T, res []byte) dnsResponse {
+	t.Helper()
+	if len(res) < 12 {
+		t.Fatalf("response of %d bytes", len(res))
+	}
+	flags := binary.BigEndian.Uint16(res[2:])
+	if flags&0x8000 == 0 {
+		t.Fatal("QR flag not set in the response")
+	}
+	out := dnsResponse{rcode: int(flags & 0x000F), truncated: flags&0x0200 != 0}
+	i := 12
+	if binary.BigEndian.Uint16(res[4:]) == 1 {
+		_, i = readName(t, res, i)
+		i += 4
+	}
+	readRecords := func(n int) []string {
+		var records []string
+		for j := 0; j < n; j++ {
+			var name string
+			name, i = readName(t, res, i)
+			rtype := binary.BigEndian.Uint16(res[i:])
+			size := int(binary.BigEndian.Uint16(res[i+8:]))
+			data := res[i+10 : i+10+size]
+			i += 10 + size
+			switch rtype {
+			case dnsTypeA, dnsTypeAAAA:
+				records = append(records, fmt.Sprintf("%d %s %s", rtype, name, net.IP(data)))
+			case dnsTypeSRV:
+				target, _ := readName(t, data, 6)
+				records = append(records, fmt.Sprintf("%d %s %d %s", rtype, name, binary.BigEndian.Uint16(data[4:]), target))
+			}
+		}
+		sort.Strings(records)
+		return records
+	}
+	out.answers = readRecords(int(binary.BigEndian.Uint16(res[6:])))
+	out.extra = readRecords(int(binary.BigEndian.Uint16(res[10:])))
+	return out
+}
+
+func readName(t *testing.T, msg []byte, i int) (string, int) {
+	t.Helper()
+	name := ""
+	for msg[i] != 0 {
+		n := int(msg[i])
+		if name != "" {
+			name += "."
+		}
+		name += string(msg[i+1 : i+1+n])
+		i += 1 + n
+	}
+	return name, i + 1
+}
+
+func newDNSServer(t *testing.T, urls ...string) *DNSServer {
+	t.Helper()
+	r := newDeliveryRegistry(t)
+	for _, url := range urls {
+		r.add(context.Background(), instanceReg(url, 0))
+	}
+	return &DNSServer{Registry: r, Domain: DefaultDNSDomain, TTL: 5 * time.Second}
+}
+
+func TestDNSAnswers(t *testing.T) {
+	const v4, v6 = "http://127.0.0.1:4000", "http://[::1]:4001"
+	d := newDNSServer(t, v4, v6)
+	id4 := instanceID(Registration{ServiceURL: v4}) + ".gradeservice.service.local"
+	id6 := instanceID(Registration{ServiceURL: v6}) + ".gradeservice.service.local"
+
+	tests := []struct {
+		name    string
+		query   []byte
+		want    *dnsResponse
+		noReply bool
+	}{
+		{name: "A", query: dnsQuery("gradeservice.service.local", dnsTypeA),
+			want: &dnsResponse{answers: []string{"1 gradeservice.service.local 127.0.0.1"}}},
+		{name: "AAAA", query: dnsQuery("gradeservice.service.local", dnsTypeAAAA),
+			want: &dnsResponse{answers: []string{"28 gradeservice.service.local ::1"}}},
+		{name: "mixed case", query: dnsQuery("GradeService.Service.Local.", dnsTypeA),
+			want: &dnsResponse{answers: []string{"1 gradeservice.service.local 127.0.0.1"}}},
+		{name: "SRV", query: dnsQuery("_gradeservice._tcp.service.local", dnsTypeSRV),
+			want: &dnsResponse{
+				answers: []string{
+					"33 _gradeservice._tcp.service.local 4000 " + id4,
+					"33 _gradeservice._tcp.service.local 4001 " + id6,
+				},
+				extra: []string{"1 " + id4 + " 127.0.0.1", "28 " + id6 + " ::1"},
+			}},
+		{name: "A of a SRV name", query: dnsQuery("_gradeservice._tcp.service.local", dnsTypeA),
+			want: &dnsResponse{}},
+		{name: "single instance", query: dnsQuery(id4, dnsTypeA),
+			want: &dnsResponse{answers: []string{"1 " + id4 + " 127.0.0.1"}}},
+		{name: "apex", query: dnsQuery("service.local", dnsTypeA), want: &dnsResponse{}},
+		{name: "unknown service", query: dnsQuery("unknown.service.local", dnsTypeA),
+			want: &dnsResponse{rcode: dnsRcodeNXDomain}},
+		{name: "unknown instance", query: dnsQuery("00000000.gradeservice.service.local", dnsTypeA),
+			want: &dnsResponse{rcode: dnsRcodeNXDomain}},
+		{name: "unknown SRV", query: dnsQuery("_unknown._tcp.service.local", dnsTypeSRV),
+			want: &dnsResponse{rcode: dnsRcodeNXDomain}},
+		{name: "other domain", query: dnsQuery("example.com", dnsTypeA),
+			want: &dnsResponse{rcode: dnsRcodeRefused}},
+		{name: "compressed name",
+			query: append([]byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12}, 0, dnsTypeA, 0, dnsClassIN),
+			want:  &dnsResponse{rcode: dnsRcodeFormat}},
+		{name: "label past the end", query: []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 20, 'a'},
+			want: &dnsResponse{rcode: dnsRcodeFormat}},
+		{name: "missing type and class", query: dnsQuery("gradeservice.service.local", dnsTypeA)[:40],
+			want: &dnsResponse{rcode: dnsRcodeFormat}},
+		{name: "class CH", query: append(dnsQuery("gradeservice.service.local", dnsTypeA)[:42], 0, 3),
+			want: &dnsResponse{rcode: dnsRcodeFormat}},
+		{name: "two questions",
+			query: append([]byte{0x12, 0x34, 0x01, 0x00, 0, 2}, dnsQuery("gradeservice.service.local", dnsTypeA)[6:]...),
+			want:  &dnsResponse{rcode: dnsRcodeFormat}},
+		{name: "short header", query: []byte{0x12, 0x34, 0x01}, noReply: true},
+		{name: "response", query: append([]byte{0x12, 0x34, 0x81, 0x00}, dnsQuery("gradeservice.service.local", dnsTypeA)[4:]...),
+			noReply: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := d.answer(tt.query)
+			if tt.noReply {
+				if res != nil {
+					t.Fatalf("answered %x, want no reply", res)
+				}
+				return
+			}
+			if res == nil {
+				t.Fatal("no reply")
+			}
+			if res[0] != 0x12 || res[1] != 0x34 {
+				t.Fatalf("response id %x, want the query id", res[:2])
+			}
+			got := parseDNSResponse(t, res)
+			if got.rcode != tt.want.rcode || !reflect.DeepEqual(got.answers, tt.want.answers) ||
+				!reflect.DeepEqual(got.extra, tt.want.extra) {
+				t.Fatalf("got rcode %d answers %q extra %q, want rcode %d answers %q extra %q",
+					got.rcode, got.answers, got.extra, tt.want.rcode, tt.want.answers, tt.want.extra)
+			}
+		})
+	}
+}
+
+// 超过512字节的UDP响应只保留问题并设置TC标志，通过TCP可以得到完整的响应
+func TestDNSTruncatesLargeUDPResponses(t *testing.T) {
+	var urls []string
+	for i := 0; i < 40; i++ {
+		urls = append(urls, fmt.Sprintf("http://127.0.0.%d:4000", i+1))
+	}
+	d := newDNSServer(t, urls...)
+	query := dnsQuery("gradeservice.service.local", dnsTypeA)
+	if n := len(d.answer(query)); n <= dnsUDPSize {
+		t.Fatalf("response of %d bytes, the test needs more than %d", n, dnsUDPSize)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go d.serveUDP(pc)
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > dnsUDPSize {
+		t.Fatalf("UDP response of %d bytes", n)
+	}
+	if got := parseDNSResponse(t, buf[:n]); !got.truncated || len(got.answers) != 0 {
+		t.Fatalf("UDP response truncated=%v with %d answers, want TC and no answers", got.truncated, len(got.answers))
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go d.serveTCP(ln)
+	tcp, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	_ = tcp.SetDeadline(time.Now().Add(2 * time.Second))
+	msg := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	if _, err := tcp.Write(append(msg, query...)); err != nil {
+		t.Fatal(err)
+	}
+	var size uint16
+	if err := binary.Read(tcp, binary.BigEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, size)
+	if _, err := io.ReadFull(tcp, res); err != nil {
+		t.Fatal(err)
+	}
+	if got := parseDNSResponse(t, res); got.truncated || len(got.answers) != len(urls) {
+		t.Fatalf("TCP response truncated=%v with %d answers, want %d answers", got.truncated, len(got.answers), len(urls))
+	}
+}
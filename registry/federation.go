@@ -0,0 +1,163 @@
+package registry
+
+import (
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/tlsutil"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ZoneEnv 实例与registry所在的可用区，未设置时为DefaultZone
+const ZoneEnv = "DISTRIBUTED_ZONE"
+
+const DefaultZone = "default"
+
+// FederationPath 其他可用区的registry通过该接口获取本registry的实例
+const FederationPath = "/federation/instances"
+
+// 连续失败达到该次数后，认为对端registry所在的可用区不可用，移除从它获取的实例
+const peerFailureThreshold = 3
+
+// LocalZone 当前进程所在的可用区
+func LocalZone() string {
+	if z := os.Getenv(ZoneEnv); z != "" {
+		return z
+	}
+	return DefaultZone
+}
+
+// 本可用区内可以接收流量的实例，从其他registry获取的实例不再转发，避免互相传播
+func (r *Registry) localInstances() []Registration {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	list := make([]Registration, 0, len(r.registrations))
+	for _, reg := range r.registrations {
+		if r.status.routable(reg.ServiceURL) {
+			list = append(list, reg)
+		}
+	}
+	return list
+}
+
+// 用从对端registry获取的实例替换原有的记录，并通知依赖这些服务的本地实例
+func (r *Registry) updateRemote(ctx context.Context, peer string, instances []Registration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	previous := r.remote[peer]
+	if len(instances) == 0 {
+		delete(r.remote, peer)
+	} else {
+		r.remote[peer] = instances
+	}
+
+	var p patch
+	seen := make(map[string]bool)
+	for _, reg := range instances {
+		seen[reg.ServiceURL] = true
+	}
+	for _, reg := range previous {
+		if !seen[reg.ServiceURL] {
+			p.Removed = append(p.Removed, entryOf(reg))
+		}
+	}
+	seen = make(map[string]bool)
+	for _, reg := range previous {
+		seen[reg.ServiceURL] = true
+	}
+	for _, reg := range instances {
+		if !seen[reg.ServiceURL] {
+			p.Added = append(p.Added, entryOf(reg))
+		}
+	}
+	if len(p.Added) > 0 || len(p.Removed) > 0 {
+		log.Printf("Method updateRemote of registry:%s added %d, removed %d instances\n", peer, len(p.Added), len(p.Removed))
+		r.notifyLocked(ctx, p)
+	}
+}
+
+// 周期性地从对端registry获取其可用区内的实例
+func (r *Registry) federate(peer string, interval time.Duration) {
+	failures := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		instances, err := r.fetchPeer(ctx, peer)
+		cancel()
+		if err != nil {
+			failures++
+			log.Printf("Method federate of registry:peer %s failed %d times: %v\n", peer, failures, err)
+			if failures == peerFailureThreshold {
+				r.updateRemote(context.Background(), peer, nil)
+			}
+		} else {
+			failures = 0
+			r.updateRemote(context.Background(), peer, instances)
+		}
+		select {
+		case <-r.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (r *Registry) fetchPeer(ctx context.Context, peer string) ([]Registration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer+FederationPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	auth.SetToken(req, auth.ServiceToken(string(RegistryService)))
+	res, err := r.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer registry responded with code %d", res.StatusCode)
+	}
+	var instances []Registration
+	err = json.NewDecoder(res.Body).Decode(&instances)
+	return instances, err
+}
+
+// SetupFederation 周期性地从其他可用区的registry同步实例，直到Close
+func (r *Registry) SetupFederation(peers []string, interval time.Duration) {
+	for _, peer := range peers {
+		peer = strings.TrimSuffix(strings.TrimSpace(peer), "/")
+		if peer == "" {
+			continue
+		}
+		go r.federate(peer, interval)
+	}
+}
+
+// FederationService 向其他可用区的registry提供本可用区内健康的实例，只允许registry访问
+type FederationService struct {
+	Registry *Registry
+}
+
+func (s FederationService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := auth.FromRequest(r)
+	if err != nil || claims.Service != string(RegistryService) || !tlsutil.VerifyPeer(r, string(RegistryService)) {
+		log.Println("Method ServeHTTP of FederationService:rejected request from", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	data, err := json.Marshal(s.Registry.localInstances())
+	if err != nil {
+		log.Println("Method ServeHTTP of FederationService:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
@@ -0,0 +1,99 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var portalReg = Registration{ServiceName: PortalService, RequiredServices: []ServiceName{GradeService}}
+
+// 以registry推送给portal的完整列表创建Providers
+func providersFor(t *testing.T, r *Registry, zone string) *Providers {
+	t.Helper()
+	p := NewProviders()
+	p.SetZone(zone)
+	if err := p.Update(r.requiredState(portalReg)); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestProvidersPreferSameZone(t *testing.T) {
+	p := NewProviders()
+	p.SetZone("a")
+	err := p.Update(patch{Added: []patchEntry{
+		{Name: GradeService, URL: "http://b1", Zone: "b"},
+		{Name: GradeService, URL: "http://a1", Zone: "a"},
+		{Name: GradeService, URL: "http://b2", Zone: "b"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if url, err := p.Get(GradeService); err != nil || url != "http://a1" {
+			t.Fatalf("Get = %q, %v, want the instance in the same zone", url, err)
+		}
+	}
+}
+
+func TestProvidersFallBackToOtherZonesWhenLocalInstancesFail(t *testing.T) {
+	r := newTestRegistry(t, ProbeConfig{Interval: time.Hour, FailureThreshold: 2})
+	f := &fakeInstance{}
+	srv := startInstance(t, f)
+	local := instanceReg(srv.URL, 0)
+	local.Zone = "a"
+	registerInstance(r, local)
+	remote := instanceReg("http://grades.b", 0)
+	remote.Zone = "b"
+	r.updateRemote(context.Background(), "http://registry.b", []Registration{remote})
+
+	if url, _ := providersFor(t, r, "a").Get(GradeService); url != srv.URL {
+		t.Fatalf("Get = %q with a healthy local instance, want %q", url, srv.URL)
+	}
+
+	//本可用区的实例被移除后，改用其他可用区的实例
+	r.scheduler.checkNow(srv.URL)
+	r.scheduler.checkNow(srv.URL)
+	p := providersFor(t, r, "a")
+	for i := 0; i < 20; i++ {
+		if url, err := p.Get(GradeService); err != nil || url != remote.ServiceURL {
+			t.Fatalf("Get = %q, %v without a healthy local instance, want %q", url, err, remote.ServiceURL)
+		}
+	}
+}
+
+func TestRegistryDropsPeerInstancesAfterPeerFails(t *testing.T) {
+	peer := NewRegistry("b")
+	t.Cleanup(peer.Close)
+	peer.add(context.Background(), instanceReg("http://grades.b", 0))
+
+	var failing, failures int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) != 0 {
+			atomic.AddInt32(&failures, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		FederationService{Registry: peer}.ServeHTTP(w, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	r := newTestRegistry(t, ProbeConfig{})
+	r.SetupFederation([]string{srv.URL}, 10*time.Millisecond)
+	hasRemote := func() bool {
+		url, err := providersFor(t, r, "a").Get(GradeService)
+		return err == nil && url == "http://grades.b"
+	}
+	waitUntil(t, 2*time.Second, hasRemote, "instances of the peer registry were never synchronized")
+
+	atomic.StoreInt32(&failing, 1)
+	waitUntil(t, 2*time.Second, func() bool { return !hasRemote() },
+		"instances of a failed peer registry were not removed")
+	if n := atomic.LoadInt32(&failures); n < peerFailureThreshold {
+		t.Fatalf("peer instances removed after %d failures, want at least %d", n, peerFailureThreshold)
+	}
+}
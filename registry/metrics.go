@@ -0,0 +1,32 @@
+package registry
+
+import "distributedDemo/metrics"
+
+var (
+	heartbeatChecks = metrics.NewCounterVec("registry_heartbeat_checks_total",
+		"Heartbeat checks performed by the registry, by service and result.",
+		"service", "result")
+	registeredInstances = metrics.NewGaugeVec("registry_registered_instances",
+		"Number of registered instances per service.",
+		"service")
+	patchFailures = metrics.NewCounterVec("registry_patch_delivery_failures_total",
+		"Service update patches that could not be delivered, by receiving service.",
+		"service")
+	patchResyncs = metrics.NewCounterVec("registry_patch_resyncs_total",
+		"Full service list resyncs sent instead of incremental patches, by receiving service.",
+		"service")
+)
+
+// 按当前的注册信息重新计算各服务的实例数，调用方需持有读锁
+func (r *Registry) updateInstanceGauge() {
+	counts := make(map[ServiceName]int)
+	for _, reg := range r.registrations {
+		counts[reg.ServiceName]++
+	}
+	//只重置本Registry的指标，不影响同一进程内的其他Registry
+	gauge := registeredInstances.In(r.metrics)
+	gauge.Reset()
+	for name, n := range counts {
+		gauge.Set(float64(n), string(name))
+	}
+}
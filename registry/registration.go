@@ -1,5 +1,7 @@
 package registry
 
+import "time"
+
 type Registration struct {
 	ServiceName      ServiceName
 	ServiceURL       string
@@ -8,6 +10,69 @@ type Registration struct {
 	ServiceUpdateURL string
 	//“心跳”检测服务是否正常的URL
 	HeartbeatURL string
+	//心跳检测的间隔，为0时使用registry的默认值
+	HeartbeatInterval time.Duration `json:",omitempty"`
+	//实例所在的可用区，为空时使用LocalZone
+	Zone string `json:",omitempty"`
+	//实例支持的协议，为空时只支持ProtocolHTTP
+	Protocols []string `json:",omitempty"`
+	//实例发布的事件类型，registry会把订阅了这些事件的实例推送给它
+	Publishes []string `json:",omitempty"`
+	//实例订阅的事件类型，发布方将事件POST到EventURL
+	Subscribes []string `json:",omitempty"`
+	EventURL   string   `json:",omitempty"`
+	//实例随机生成的密钥，registry用它签名推送到ServiceUpdateURL的更新
+	//其他服务不知道该密钥，无法冒充registry；registry不会在管理、同步等接口中返回它
+	UpdateKey []byte `json:",omitempty"`
+}
+
+// UpdateKeySize 实例生成的UpdateKey的长度
+const UpdateKeySize = 32
+
+// 实例可以声明支持的协议
+const (
+	ProtocolHTTP = "http"
+	// ProtocolConnect 见rpc包，声明支持的实例由registry通过RPC进行心跳检测
+	ProtocolConnect = "connect"
+)
+
+// Supports 实例是否支持protocol
+func (r Registration) Supports(protocol string) bool {
+	if len(r.Protocols) == 0 {
+		return protocol == ProtocolHTTP
+	}
+	for _, p := range r.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// 推送给其他实例的reg的信息
+func entryOf(reg Registration) patchEntry {
+	return patchEntry{
+		Name:       reg.ServiceName,
+		URL:        reg.ServiceURL,
+		Zone:       reg.Zone,
+		EventURL:   reg.EventURL,
+		Subscribes: reg.Subscribes,
+	}
+}
+
+// reg是否需要知道e对应的实例：e属于reg所依赖的服务，或订阅了reg发布的事件
+func (reg Registration) interestedIn(e patchEntry) bool {
+	for _, name := range reg.RequiredServices {
+		if e.Name == name {
+			return true
+		}
+	}
+	for _, published := range reg.Publishes {
+		if e.subscribes(published) {
+			return true
+		}
+	}
+	return false
 }
 
 // ServiceName 注册的服务名称
@@ -15,16 +80,43 @@ type ServiceName string
 
 //注册的具体服务名称
 const (
-	LoggerService = ServiceName("LoggerService")
-	GradeService  = ServiceName("GradeService")
-	PortalService = ServiceName("Portal")
+	LoggerService  = ServiceName("LoggerService")
+	GradeService   = ServiceName("GradeService")
+	PortalService  = ServiceName("Portal")
+	GatewayService = ServiceName("Gateway")
+	//订阅成绩事件并通知学生
+	NotificationService = ServiceName("NotificationService")
+	//registry自身的名称，用于TLS证书中标识身份
+	RegistryService = ServiceName("Registry")
 )
 
 type patchEntry struct {
 	Name ServiceName
 	URL  string
+	Zone string `json:",omitempty"`
+	//实例订阅的事件及接收地址，只推送给发布这些事件的实例
+	EventURL   string   `json:",omitempty"`
+	Subscribes []string `json:",omitempty"`
 }
+
+func (e patchEntry) subscribes(eventType string) bool {
+	if e.EventURL == "" {
+		return false
+	}
+	for _, t := range e.Subscribes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
 type patch struct {
 	Added   []patchEntry
 	Removed []patchEntry
+	//同一Stream内的更新按Seq依次编号，实例据此发现缺失或重复的更新
+	Stream string `json:",omitempty"`
+	Seq    uint64 `json:",omitempty"`
+	//为true时Added是完整的服务列表，实例应替换而不是合并
+	Resync bool `json:",omitempty"`
 }
@@ -0,0 +1,223 @@
+package registry
+
+import (
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/health"
+	"distributedDemo/rpc"
+	"distributedDemo/tlsutil"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// ServicePath registry的RPC的路径前缀，与/services接口一起提供
+	ServicePath = "/distributed.registry.v1.RegistryService/"
+	// InstanceServicePath 实例为registry提供的RPC的路径前缀
+	InstanceServicePath = "/distributed.registry.v1.InstanceService/"
+)
+
+type DeregisterRequest struct {
+	ServiceURL string
+}
+
+type DeregisterResponse struct{}
+
+type WatchRequest struct {
+	Services []ServiceName
+}
+
+type HeartbeatRequest struct{}
+
+func (r *Registry) registerRPC(mux *http.ServeMux) {
+	//与/services相同，注册与取消注册的请求体必须带有签名
+	mux.Handle(ServicePath+"Register", r.idempotency.Middleware(requireService(rpc.Unary(r.registerRPCHandler), true)))
+	mux.Handle(ServicePath+"Deregister", r.idempotency.Middleware(requireService(rpc.Unary(r.deregisterRPCHandler), true)))
+	mux.Handle(ServicePath+"Watch", requireService(rpc.ServerStream(r.watchRPCHandler), false))
+}
+
+type requestKey struct{}
+
+// 只允许持有服务token的调用方，并将claims与原始请求放入context，供检查TLS证书使用
+func requireService(next http.Handler, signed bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := auth.FromRequest(r)
+		if err != nil {
+			log.Println("func requireService:", r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !claims.HasRole(auth.RoleService) {
+			log.Printf("func requireService:%s (%s) is not a service\n", claims.Subject, claims.Role)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if signed {
+			if _, err := auth.VerifyRequest(r); err != nil {
+				log.Println("func requireService: rejected request from", r.RemoteAddr, err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		ctx := context.WithValue(auth.WithClaims(r.Context(), claims), requestKey{}, r)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func requestFromContext(ctx context.Context) (*http.Request, *auth.Claims) {
+	req, _ := ctx.Value(requestKey{}).(*http.Request)
+	claims, _ := auth.FromContext(ctx)
+	return req, claims
+}
+
+func (r *Registry) registerRPCHandler(ctx context.Context, newReg *Registration) (*patch, error) {
+	req, claims := requestFromContext(ctx)
+	initial, err := r.register(req.WithContext(ctx), claims, *newReg)
+	if errors.Is(err, errNoUpdateKey) {
+		return nil, rpc.Errorf(rpc.CodeInvalidArgument, "%v", err)
+	}
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodePermissionDenied, "%v", err)
+	}
+	return &initial, nil
+}
+
+func (r *Registry) deregisterRPCHandler(ctx context.Context, dr *DeregisterRequest) (*DeregisterResponse, error) {
+	req, claims := requestFromContext(ctx)
+	err := r.unregister(req.WithContext(ctx), claims, dr.ServiceURL)
+	if err == errForbidden {
+		return nil, rpc.Errorf(rpc.CodePermissionDenied, "%v", err)
+	}
+	if err != nil {
+		return nil, rpc.Errorf(rpc.CodeNotFound, "%v", err)
+	}
+	return &DeregisterResponse{}, nil
+}
+
+// 先发送Services的完整列表，之后发送其中服务的变化，直到调用方断开连接
+func (r *Registry) watchRPCHandler(ctx context.Context, wr *WatchRequest, send func(*patch) error) error {
+	w := &watcher{
+		services: wr.Services,
+		ch:       make(chan patch, maxPatchBacklog),
+		overflow: make(chan struct{}),
+		stream:   newStream(),
+	}
+	//持有写锁时生成服务列表并开始订阅，之后的变化都会排在该列表之后
+	r.mutex.Lock()
+	initial := w.number(r.requiredStateLocked(Registration{RequiredServices: wr.Services}), true)
+	r.watchers[w] = true
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.watchers, w)
+		r.mutex.Unlock()
+	}()
+
+	if err := send(&initial); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.done:
+			return rpc.Errorf(rpc.CodeUnavailable, "registry is shutting down")
+		case <-w.overflow:
+			//调用方重新订阅时会收到新的完整列表
+			return rpc.Errorf(rpc.CodeAborted, "watcher fell more than %d patches behind", maxPatchBacklog)
+		case p := <-w.ch:
+			if err := send(&p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 通过RPC订阅更新的连接，更新在同一流内依次编号
+type watcher struct {
+	services []ServiceName
+	ch       chan patch
+	//积压过多时关闭
+	overflow chan struct{}
+
+	mutex  sync.Mutex
+	stream string
+	seq    uint64
+	closed bool
+}
+
+func (w *watcher) number(p patch, resync bool) patch {
+	w.seq++
+	p.Seq, p.Stream, p.Resync = w.seq, w.stream, resync
+	return p
+}
+
+// 编号与发送在同一把锁内进行，保证发送的顺序与编号一致
+func (w *watcher) publish(p patch) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.ch <- w.number(p, false):
+	default:
+		w.closed = true
+		close(w.overflow)
+	}
+}
+
+// 实例一侧的心跳检测RPC，返回与HeartbeatURL相同的检查结果
+func heartbeatRPC(checks *health.Checks) http.Handler {
+	return rpc.Unary(func(ctx context.Context, _ *HeartbeatRequest) (*health.Report, error) {
+		report := checks.Evaluate(ctx)
+		return &report, nil
+	})
+}
+
+// Watch 通过RPC持续接收r所依赖的服务的变化并更新Providers，直到ctx被取消
+// 用于不提供ServiceUpdateURL的实例，连接中断或发现缺失的更新时重新订阅，重新订阅后先收到完整的服务列表
+func (c *Client) Watch(ctx context.Context, r Registration) error {
+	if r.Zone == "" {
+		r.Zone = LocalZone()
+	}
+	c.Providers.SetZone(r.Zone)
+	rc := &rpc.Client{
+		BaseURL: c.URL,
+		HTTP:    c.HTTP,
+		Prepare: func(req *http.Request, _ []byte) error {
+			auth.SetToken(req, auth.ServiceToken(string(r.ServiceName)))
+			return nil
+		},
+	}
+	backoff := patchRetryMin
+	for {
+		err := rpc.CallServerStream(ctx, rc, ServicePath+"Watch", &WatchRequest{Services: r.RequiredServices},
+			func(p *patch) error {
+				backoff = patchRetryMin
+				return c.Providers.Update(*p)
+			})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("Method Watch of Client:resubscribing in %v: %v\n", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > patchRetryMax {
+			backoff = patchRetryMax
+		}
+	}
+}
+
+// 启用TLS时只接受registry的心跳检测
+func registerHeartbeatRPC(mux *http.ServeMux, checks *health.Checks) {
+	mux.Handle(InstanceServicePath+"Heartbeat", tlsutil.RequirePeer(heartbeatRPC(checks), string(RegistryService)))
+}
@@ -0,0 +1,248 @@
+package registry
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ProbeConfig 心跳检测的调度参数
+type ProbeConfig struct {
+	//两次检测之间的间隔，实例注册时可通过Registration.HeartbeatInterval单独指定
+	Interval time.Duration
+	//每次间隔再随机增加[0, Jitter)，避免所有实例在同一时刻被检测
+	Jitter time.Duration
+	//单次检测的超时时间
+	Timeout time.Duration
+	//同时进行的检测数的上限
+	Concurrency int
+	//连续失败达到该次数后，实例视为宕机并被移除
+	FailureThreshold int
+	//宕机的实例连续成功达到该次数后重新加入
+	SuccessThreshold int
+	//宕机超过该时长的实例不再检测，其状态也一并清除，为0时一直检测
+	ExpireAfter time.Duration
+}
+
+// DefaultProbeConfig 默认的调度参数
+var DefaultProbeConfig = ProbeConfig{
+	Interval:         10 * time.Second,
+	Jitter:           2 * time.Second,
+	Timeout:          3 * time.Second,
+	Concurrency:      16,
+	FailureThreshold: 3,
+	SuccessThreshold: 2,
+	ExpireAfter:      10 * time.Minute,
+}
+
+// 未设置或不合法的参数使用默认值
+func (c ProbeConfig) withDefaults() ProbeConfig {
+	d := DefaultProbeConfig
+	if c.Interval <= 0 {
+		c.Interval = d.Interval
+	}
+	if c.Jitter < 0 {
+		c.Jitter = 0
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = d.Timeout
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = d.Concurrency
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = d.FailureThreshold
+	}
+	if c.SuccessThreshold <= 0 {
+		c.SuccessThreshold = d.SuccessThreshold
+	}
+	return c
+}
+
+// 为每个实例运行独立的检测循环，所有循环共享并发数的上限
+type scheduler struct {
+	r      *Registry
+	config ProbeConfig
+	//令牌数即同时进行的检测数上限
+	slots   chan struct{}
+	probers map[string]*prober
+	mutex   sync.Mutex
+}
+
+func newScheduler(r *Registry, config ProbeConfig) *scheduler {
+	config = config.withDefaults()
+	return &scheduler{
+		r:       r,
+		config:  config,
+		slots:   make(chan struct{}, config.Concurrency),
+		probers: make(map[string]*prober),
+	}
+}
+
+// 单个实例的检测循环及其连续成功、失败的计数
+type prober struct {
+	s *scheduler
+	//取消后检测循环退出，进行中的检测也随之中止
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	//保证同一实例的检测串行进行，并保护以下字段
+	mutex     sync.Mutex
+	reg       Registration
+	failures  int
+	successes int
+	down      bool
+	downSince time.Time
+}
+
+// 开始检测实例，已在检测中的实例(如重启后重新注册)更新注册信息并重新计数
+func (s *scheduler) schedule(reg Registration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if p, ok := s.probers[reg.ServiceURL]; ok {
+		p.mutex.Lock()
+		p.reg = reg
+		p.failures, p.successes, p.down = 0, 0, false
+		p.mutex.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prober{s: s, ctx: ctx, cancel: cancel, reg: reg}
+	s.probers[reg.ServiceURL] = p
+	go p.loop()
+}
+
+// 停止检测实例，用于显式取消注册
+func (s *scheduler) unschedule(url string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if p, ok := s.probers[url]; ok {
+		p.halt()
+		delete(s.probers, url)
+	}
+}
+
+// 停止检测所有实例
+func (s *scheduler) stopAll() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for url, p := range s.probers {
+		p.halt()
+		delete(s.probers, url)
+	}
+}
+
+// 停止检测循环并等待进行中的检测结束，之后不会再因检测结果移除或重新加入实例
+func (p *prober) halt() {
+	p.cancel()
+	p.mutex.Lock()
+	p.mutex.Unlock()
+}
+
+// 立即检测一次实例，结果同样计入阈值，返回实例是否存活
+func (s *scheduler) checkNow(url string) (alive bool, ok bool) {
+	s.mutex.Lock()
+	p, ok := s.probers[url]
+	s.mutex.Unlock()
+	if !ok {
+		return false, false
+	}
+	return p.run(), true
+}
+
+func (p *prober) interval() time.Duration {
+	p.mutex.Lock()
+	d := p.reg.HeartbeatInterval
+	p.mutex.Unlock()
+	if d <= 0 {
+		d = p.s.config.Interval
+	}
+	if p.s.config.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.s.config.Jitter)))
+	}
+	return d
+}
+
+func (p *prober) loop() {
+	timer := time.NewTimer(p.interval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		//等待空闲的检测名额，期间实例可能已被取消注册
+		select {
+		case <-p.ctx.Done():
+			return
+		case p.s.slots <- struct{}{}:
+		}
+		p.run()
+		<-p.s.slots
+		if p.expired() {
+			return
+		}
+		timer.Reset(p.interval())
+	}
+}
+
+// 检测一次并根据阈值决定是否移除或重新加入实例
+// 已停止检测的实例(如已取消注册)不再检测，避免将其重新加入
+func (p *prober) run() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.ctx.Err() != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(p.ctx, p.s.config.Timeout)
+	defer cancel()
+	alive := p.s.r.probe(ctx, p.reg)
+	if p.ctx.Err() != nil {
+		return false
+	}
+	if alive {
+		p.failures = 0
+		p.successes++
+		if p.down && p.successes >= p.s.config.SuccessThreshold {
+			log.Printf("Method run of prober:%v at %s recovered after %d successful checks\n",
+				p.reg.ServiceName, p.reg.ServiceURL, p.successes)
+			p.down = false
+			p.s.r.add(context.Background(), p.reg)
+		}
+		return true
+	}
+	p.successes = 0
+	p.failures++
+	if !p.down && p.failures >= p.s.config.FailureThreshold {
+		log.Printf("Method run of prober:%v at %s removed after %d failed checks\n",
+			p.reg.ServiceName, p.reg.ServiceURL, p.failures)
+		p.down, p.downSince = true, time.Now()
+		if err := p.s.r.remove(context.Background(), p.reg.ServiceURL); err != nil {
+			log.Println("Method run of prober:", err)
+		}
+	}
+	return false
+}
+
+// 宕机过久的实例停止检测并清除状态
+func (p *prober) expired() bool {
+	p.mutex.Lock()
+	url := p.reg.ServiceURL
+	expired := p.down && p.s.config.ExpireAfter > 0 && time.Since(p.downSince) > p.s.config.ExpireAfter
+	p.mutex.Unlock()
+	if !expired {
+		return false
+	}
+	log.Println("Method expired of prober:giving up on", url)
+	p.s.mutex.Lock()
+	if p.s.probers[url] == p {
+		delete(p.s.probers, url)
+	}
+	p.s.mutex.Unlock()
+	p.cancel()
+	p.s.r.status.forget(url)
+	return true
+}
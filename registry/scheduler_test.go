@@ -0,0 +1,229 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 供registry检测的实例，healthy为0时心跳返回503，delay期间阻塞直到请求被取消
+type fakeInstance struct {
+	healthy  int32
+	hits     int32
+	inFlight int32
+	maxIn    int32
+	delay    time.Duration
+	entered  chan struct{}
+}
+
+func (f *fakeInstance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&f.hits, 1)
+	n := atomic.AddInt32(&f.inFlight, 1)
+	defer atomic.AddInt32(&f.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&f.maxIn)
+		if n <= max || atomic.CompareAndSwapInt32(&f.maxIn, max, n) {
+			break
+		}
+	}
+	if f.entered != nil {
+		select {
+		case f.entered <- struct{}{}:
+		default:
+		}
+	}
+	if f.delay > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(f.delay):
+		}
+	}
+	if atomic.LoadInt32(&f.healthy) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func newTestRegistry(t *testing.T, config ProbeConfig) *Registry {
+	t.Helper()
+	r := NewRegistry("test")
+	r.HTTP = &http.Client{}
+	r.SetupHeartbeat(config)
+	t.Cleanup(r.Close)
+	return r
+}
+
+func startInstance(t *testing.T, f *fakeInstance) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// 像register一样添加实例并开始检测
+func registerInstance(r *Registry, reg Registration) {
+	r.add(context.Background(), reg)
+	r.scheduler.schedule(reg)
+}
+
+func instanceReg(url string, interval time.Duration) Registration {
+	return Registration{
+		ServiceName:       GradeService,
+		ServiceURL:        url,
+		HeartbeatURL:      url + "/heartbeat",
+		HeartbeatInterval: interval,
+	}
+}
+
+func waitUntil(t *testing.T, timeout time.Duration, cond func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSchedulerFailureAndSuccessThresholds(t *testing.T) {
+	r := newTestRegistry(t, ProbeConfig{Interval: time.Hour, FailureThreshold: 3, SuccessThreshold: 2})
+	f := &fakeInstance{}
+	srv := startInstance(t, f)
+	registerInstance(r, instanceReg(srv.URL, 0))
+
+	for i := 1; i <= 3; i++ {
+		if alive, ok := r.scheduler.checkNow(srv.URL); !ok || alive {
+			t.Fatalf("check %d: alive=%v scheduled=%v, want a failed check", i, alive, ok)
+		}
+		_, registered := r.lookup(srv.URL)
+		if want := i < 3; registered != want {
+			t.Fatalf("after %d failed checks registered=%v, want %v", i, registered, want)
+		}
+	}
+
+	//被移除的实例仍在检测中，连续成功达到阈值后重新加入
+	atomic.StoreInt32(&f.healthy, 1)
+	for i := 1; i <= 2; i++ {
+		if alive, ok := r.scheduler.checkNow(srv.URL); !ok || !alive {
+			t.Fatalf("recovery check %d: alive=%v scheduled=%v, want a successful check", i, alive, ok)
+		}
+		_, registered := r.lookup(srv.URL)
+		if want := i == 2; registered != want {
+			t.Fatalf("after %d successful checks registered=%v, want %v", i, registered, want)
+		}
+	}
+
+	//成功一次即清零失败计数
+	atomic.StoreInt32(&f.healthy, 0)
+	r.scheduler.checkNow(srv.URL)
+	r.scheduler.checkNow(srv.URL)
+	atomic.StoreInt32(&f.healthy, 1)
+	r.scheduler.checkNow(srv.URL)
+	atomic.StoreInt32(&f.healthy, 0)
+	r.scheduler.checkNow(srv.URL)
+	r.scheduler.checkNow(srv.URL)
+	if _, registered := r.lookup(srv.URL); !registered {
+		t.Fatal("instance removed although its failures were not consecutive")
+	}
+}
+
+func TestSchedulerIntervalAndJitter(t *testing.T) {
+	r := newTestRegistry(t, ProbeConfig{Interval: time.Hour, Jitter: 10 * time.Millisecond})
+	p := &prober{s: r.scheduler, reg: instanceReg("http://default", 0)}
+	own := &prober{s: r.scheduler, reg: instanceReg("http://own", 50*time.Millisecond)}
+	for i := 0; i < 100; i++ {
+		if d := p.interval(); d < time.Hour || d >= time.Hour+10*time.Millisecond {
+			t.Fatalf("default interval %v outside [1h, 1h+10ms)", d)
+		}
+		if d := own.interval(); d < 50*time.Millisecond || d >= 60*time.Millisecond {
+			t.Fatalf("per-instance interval %v outside [50ms, 60ms)", d)
+		}
+	}
+
+	//按实例自己的间隔检测，而不是等待默认的1小时
+	f := &fakeInstance{healthy: 1}
+	srv := startInstance(t, f)
+	registerInstance(r, instanceReg(srv.URL, 20*time.Millisecond))
+	waitUntil(t, 2*time.Second, func() bool { return atomic.LoadInt32(&f.hits) >= 3 },
+		"instance with a 20ms interval was checked %d times", atomic.LoadInt32(&f.hits))
+}
+
+func TestSchedulerTimeout(t *testing.T) {
+	r := newTestRegistry(t, ProbeConfig{Interval: time.Hour, Timeout: 50 * time.Millisecond, FailureThreshold: 1})
+	f := &fakeInstance{healthy: 1, delay: 5 * time.Second}
+	srv := startInstance(t, f)
+	registerInstance(r, instanceReg(srv.URL, 0))
+
+	start := time.Now()
+	if alive, _ := r.scheduler.checkNow(srv.URL); alive {
+		t.Fatal("a check that timed out reported the instance alive")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("check took %v with a 50ms timeout", elapsed)
+	}
+	if _, registered := r.lookup(srv.URL); registered {
+		t.Fatal("instance whose check timed out was not removed")
+	}
+}
+
+func TestSchedulerConcurrencyLimit(t *testing.T) {
+	r := newTestRegistry(t, ProbeConfig{Interval: 5 * time.Millisecond, Concurrency: 2})
+	f := &fakeInstance{healthy: 1, delay: 20 * time.Millisecond}
+	srv := startInstance(t, f)
+	for i := 0; i < 6; i++ {
+		registerInstance(r, instanceReg(fmt.Sprintf("%s/%d", srv.URL, i), 0))
+	}
+	waitUntil(t, 5*time.Second, func() bool { return atomic.LoadInt32(&f.hits) >= 20 },
+		"instances were checked %d times", atomic.LoadInt32(&f.hits))
+	if max := atomic.LoadInt32(&f.maxIn); max > 2 {
+		t.Fatalf("%d checks ran at the same time, limit is 2", max)
+	}
+}
+
+func TestSchedulerUnschedule(t *testing.T) {
+	r := newTestRegistry(t, ProbeConfig{Interval: 5 * time.Millisecond})
+	f := &fakeInstance{healthy: 1}
+	srv := startInstance(t, f)
+	registerInstance(r, instanceReg(srv.URL, 0))
+	waitUntil(t, 2*time.Second, func() bool { return atomic.LoadInt32(&f.hits) > 0 },
+		"instance was never checked")
+
+	r.scheduler.unschedule(srv.URL)
+	//取消前已发出的请求可能稍后才到达实例
+	time.Sleep(20 * time.Millisecond)
+	hits := atomic.LoadInt32(&f.hits)
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&f.hits); after != hits {
+		t.Fatalf("instance checked %d more times after it was unscheduled", after-hits)
+	}
+	if _, ok := r.scheduler.checkNow(srv.URL); ok {
+		t.Fatal("unscheduled instance can still be checked")
+	}
+}
+
+func TestSchedulerUnscheduleDropsCheckInProgress(t *testing.T) {
+	r := newTestRegistry(t, ProbeConfig{Interval: time.Hour, FailureThreshold: 1})
+	f := &fakeInstance{delay: 5 * time.Second, entered: make(chan struct{}, 1)}
+	srv := startInstance(t, f)
+	registerInstance(r, instanceReg(srv.URL, 0))
+
+	done := make(chan bool)
+	go func() {
+		alive, _ := r.scheduler.checkNow(srv.URL)
+		done <- alive
+	}()
+	<-f.entered
+	//取消检测后，检测失败的结果不再移除实例
+	r.scheduler.unschedule(srv.URL)
+	<-done
+	if _, registered := r.lookup(srv.URL); !registered {
+		t.Fatal("a check cancelled by unschedule removed the instance")
+	}
+}
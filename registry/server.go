@@ -2,222 +2,409 @@ package registry
 
 import (
 	"bytes"
+	"context"
+	"distributedDemo/auth"
+	"distributedDemo/health"
+	"distributedDemo/idempotency"
+	"distributedDemo/metrics"
+	"distributedDemo/rpc"
+	"distributedDemo/tlsutil"
+	"distributedDemo/trace"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 const ServerPort = ":3000"
-const ServicesURL = "http://localhost" + ServerPort + "/services"
 
-type registry struct {
+// RegistryURLEnv 设置该环境变量后连接该地址的registry，如同一台机器上运行的其他可用区的registry
+const RegistryURLEnv = "DISTRIBUTED_REGISTRY_URL"
+
+// RegistryURL DefaultClient连接的registry的地址，启用TLS时使用https
+var RegistryURL = registryURL()
+
+func registryURL() string {
+	if u := os.Getenv(RegistryURLEnv); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return tlsutil.Scheme() + "://localhost" + ServerPort
+}
+
+// Registry 服务注册中心，记录所有实例并向依赖它们的服务推送更新
+// 同一进程内可以创建多个互不影响的Registry，如在测试中启动多个可用区
+type Registry struct {
 	registrations []Registration
 	//可能被多个线程并发地访问，因此为了保证线程安全，要加上互斥锁
 	mutex *sync.RWMutex
+	//各实例的健康状况与更新推送情况
+	status *statusBook
+	//由SetupRegistryService创建，为nil时不进行心跳检测
+	scheduler *scheduler
+	//依赖其他服务的实例的更新推送队列
+	subscriptions *subscriptions
+	//registry所在的可用区，未声明可用区的实例也属于该可用区
+	zone string
+	//从其他可用区的registry获取的实例，以对端registry的URL为键
+	remote map[string][]Registration
+	//通过RPC订阅更新的连接，与subscriptions一样由notify推送
+	watchers map[*watcher]bool
+	//Close时关闭，停止同步其他可用区的实例
+	done chan struct{}
+	once sync.Once
+	//注册、取消注册与管理操作的Idempotency-Key及其响应
+	idempotency *idempotency.Store
+	//registry自身的指标，同一进程内的多个Registry互不覆盖
+	metrics *metrics.Registry
+	//心跳检测、推送更新与同步其他可用区时使用的http客户端，启用TLS时通过tlsutil.Configure配置证书
+	HTTP *http.Client
+}
+
+// NewRegistry 创建位于zone的registry，未声明可用区的实例也属于该可用区
+func NewRegistry(zone string) *Registry {
+	return &Registry{
+		registrations: make([]Registration, 0),
+		mutex:         new(sync.RWMutex),
+		status:        newStatusBook(),
+		subscriptions: newSubscriptions(),
+		zone:          zone,
+		remote:        make(map[string][]Registration),
+		watchers:      make(map[*watcher]bool),
+		done:          make(chan struct{}),
+		idempotency:   idempotency.NewStore(idempotency.DefaultWindow),
+		metrics:       metrics.NewRegistry(),
+		HTTP:          tlsutil.NewClient(),
+	}
 }
 
-// 添加服务注册
-func (r *registry) add(reg Registration) error {
+// Metrics registry的指标，由 /metrics 接口输出
+func (r *Registry) Metrics() *metrics.Registry {
+	return r.metrics
+}
+
+// 添加服务注册，返回reg所依赖的服务的完整列表，该列表同时会推送给reg
+func (r *Registry) add(ctx context.Context, reg Registration) patch {
+	//密钥只交给推送队列，不随注册信息保存，避免从管理或同步接口泄露
+	key := reg.UpdateKey
+	reg.UpdateKey = nil
 	r.mutex.Lock()
-	r.registrations = append(r.registrations, reg)
-	r.mutex.Unlock()
-	err := r.sendRequiredServices(reg)
-	r.notify(patch{
-		Added: []patchEntry{
+	if reg.Zone == "" {
+		reg.Zone = r.zone
+	}
+	//同一URL重复注册(如实例重启)时替换原有的注册信息，避免依赖它的服务收到重复的地址
+	replaced := false
+	for i := range r.registrations {
+		if r.registrations[i].ServiceURL == reg.ServiceURL {
+			r.registrations[i] = reg
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		r.registrations = append(r.registrations, reg)
+	}
+	r.updateInstanceGauge()
+	r.status.registered(reg, true)
+	//持有写锁时生成服务列表并开始订阅，之后的变化都会排在该列表之后推送
+	//不提供ServiceUpdateURL的实例通过RPC的Watch接收更新
+	var initial patch
+	if (len(reg.RequiredServices) > 0 || len(reg.Publishes) > 0) && reg.ServiceUpdateURL != "" {
+		initial = r.subscriptions.subscribe(r, reg, key, r.requiredStateLocked(reg))
+	}
+	//被摘除流量或未就绪的实例重新注册时，不通知依赖它的服务
+	if r.status.routable(reg.ServiceURL) {
+		r.notifyLocked(ctx, patch{
 			//待注册的服务的名称与URL
-			{
-				Name: reg.ServiceName,
-				URL:  reg.ServiceURL,
-			},
-		},
-	})
-	return err
+			Added: []patchEntry{entryOf(reg)},
+		})
+	}
+	r.mutex.Unlock()
+	return initial
 }
 
 // 当服务注册或被移除时进行通知
-func (r *registry) notify(fullPatch patch) {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
+// 通知按实例排队，由各实例的推送队列依次发送，不随请求结束而取消，但仍关联到请求的调用链
+// 调用方需持有r.mutex的写锁，并在修改状态的同一次加锁中调用，使各实例队列中更新的顺序与状态变化的顺序一致
+func (r *Registry) notifyLocked(ctx context.Context, fullPatch patch) {
+	ctx = trace.Detach(ctx)
 	//遍历已经注册的服务
 	for _, reg := range r.registrations {
-		//使用goroutine并发地发送通知
-		go func(reg Registration) {
-			//针对每个注册的服务，对其所依赖的服务进行循环
-			for _, reqService := range reg.RequiredServices {
-				p := patch{
-					Added:   []patchEntry{},
-					Removed: []patchEntry{},
-				}
-				//发送更新的标志位
-				sendUpdate := false
-				//看看添加了哪些服务
-				for _, added := range fullPatch.Added {
-					if added.Name == reqService {
-						p.Added = append(p.Added, added)
-						sendUpdate = true
-					}
-				}
-				for _, removed := range fullPatch.Removed {
-					if removed.Name == reqService {
-						p.Removed = append(p.Removed, removed)
-						sendUpdate = true
-					}
-				}
-				if sendUpdate {
-					err := r.sendPatch(p, reg.ServiceUpdateURL)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-				}
-			}
-		}(reg)
+		//只保留该服务所依赖的服务及其事件的订阅者的变化
+		p := filterPatch(fullPatch, reg)
+		if len(p.Added) > 0 || len(p.Removed) > 0 {
+			r.subscriptions.publish(ctx, reg.ServiceURL, p)
+		}
+	}
+	for w := range r.watchers {
+		p := filterPatch(fullPatch, Registration{RequiredServices: w.services})
+		if len(p.Added) > 0 || len(p.Removed) > 0 {
+			w.publish(p)
+		}
+	}
+}
+
+// 只保留reg需要知道的变化
+func filterPatch(fullPatch patch, reg Registration) patch {
+	var p patch
+	for _, added := range fullPatch.Added {
+		if reg.interestedIn(added) {
+			p.Added = append(p.Added, added)
+		}
+	}
+	for _, removed := range fullPatch.Removed {
+		if reg.interestedIn(removed) {
+			p.Removed = append(p.Removed, removed)
+		}
 	}
+	return p
 }
 
-// 请求所依赖的服务
-func (r *registry) sendRequiredServices(reg Registration) error {
+// 生成reg所依赖的服务的完整列表
+func (r *Registry) requiredState(reg Registration) patch {
 	//仅需要一个读的锁
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
+	return r.requiredStateLocked(reg)
+}
 
-	var p patch
-	//查看要添加的服务是否存在
+// 调用方需持有r.mutex
+func (r *Registry) requiredStateLocked(reg Registration) patch {
+	p := patch{Added: []patchEntry{}}
+	//查看所依赖的服务或订阅者是否存在
 	for _, serviceReg := range r.registrations {
-		for _, reqService := range reg.RequiredServices {
-			if serviceReg.ServiceName == reqService {
-				//存在则添加到待注册服务列表中
-				p.Added = append(p.Added, patchEntry{
-					Name: serviceReg.ServiceName,
-					URL:  serviceReg.ServiceURL,
-				})
-			}
-
+		if e := entryOf(serviceReg); reg.interestedIn(e) && r.status.routable(serviceReg.ServiceURL) {
+			//存在则添加到服务列表中
+			p.Added = append(p.Added, e)
 		}
 	}
-	err := r.sendPatch(p, reg.ServiceUpdateURL)
-	if err != nil {
-		return err
+	//其他可用区的实例由对端registry检测，获取到的都是健康的实例
+	for _, instances := range r.remote {
+		for _, serviceReg := range instances {
+			if e := entryOf(serviceReg); reg.interestedIn(e) {
+				p.Added = append(p.Added, e)
+			}
+		}
 	}
-	return nil
+	return p
 }
 
-// 当一个服务出现时，想要通知依赖该服务的其他服务
-func (r *registry) sendPatch(p patch, url string) error {
+// 当一个服务出现时，想要通知依赖该服务的其他服务，key为实例注册时提供的UpdateKey
+func (r *Registry) sendPatch(ctx context.Context, p patch, url string, key []byte) error {
 	d, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
 	//使用NewBuffer将变量d变为ioReader类型
-	_, err = http.Post(url, "application/json", bytes.NewBuffer(d))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(d))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	//服务只接受以自己的UpdateKey签名的更新，持有共享密钥的其他服务无法伪造
+	err = auth.SignRequestWithKey(req, d, key)
+	if err != nil {
+		return err
+	}
+	res, err := r.HTTP.Do(req)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errResyncRequested
+	default:
+		return fmt.Errorf("patch %d rejected by %s with code %d", p.Seq, url, res.StatusCode)
+	}
 }
 
 // 取消服务注册
-func (r *registry) remove(url string) error {
-	//check whether the url exist
-	for i := range reg.registrations {
-		if reg.registrations[i].ServiceURL == url {
-			r.notify(patch{
-				Removed: []patchEntry{
-					{
-						Name: r.registrations[i].ServiceName,
-						URL:  r.registrations[i].ServiceURL,
-					},
-				},
-			})
-			r.mutex.Lock()
-			reg.registrations = append(reg.registrations[:i], reg.registrations[i+1:]...)
+func (r *Registry) remove(ctx context.Context, url string) error {
+	r.mutex.Lock()
+	for i := range r.registrations {
+		if r.registrations[i].ServiceURL == url {
+			removed := r.registrations[i]
+			r.registrations = append(r.registrations[:i], r.registrations[i+1:]...)
+			r.updateInstanceGauge()
+			r.subscriptions.unsubscribe(url)
+			r.status.registered(removed, false)
+			r.notifyLocked(ctx, patch{Removed: []patchEntry{entryOf(removed)}})
 			r.mutex.Unlock()
 			return nil
 		}
 	}
+	r.mutex.Unlock()
 	return fmt.Errorf("method remove of registry:service at URL %s not found", url)
 }
 
-func (r *registry) heartbeat(freq time.Duration) {
-	for {
-		var wg sync.WaitGroup
-		for _, reg := range r.registrations {
-			wg.Add(1)
-			go func(reg Registration) {
-				defer wg.Done()
-				successFlag := true
-				for attempts := 0; attempts < 3; attempts++ {
-					res, err := http.Get(reg.HeartbeatURL)
-					if err != nil {
-						log.Println("In ./registry/server.go:Method heartbeat of registry:", err)
-					} else if res.StatusCode == http.StatusOK {
-						log.Println("Heartbeat check passed for", reg.ServiceName)
-						if !successFlag {
-							err := r.add(reg)
-							if err != nil {
-								return
-							}
-						}
-						break
-					}
-					log.Println("Heartbeat check failed for", reg.ServiceName)
-					if successFlag {
-						successFlag = false
-						err := r.remove(reg.ServiceURL)
-						if err != nil {
-							return
-						}
-					}
-					time.Sleep(1 * time.Second)
-				}
-			}(reg)
-			wg.Wait()
-			time.Sleep(freq)
-		}
-	}
-}
-
-var once sync.Once
-
-func SetupRegistryService() {
-	once.Do(func() {
-		go reg.heartbeat(10 * time.Second)
-	})
+// 对实例进行一次心跳检测并记录结果，返回实例是否存活
+// 存活但未就绪的实例会从依赖它的服务的列表中移除，恢复就绪后再重新加入
+func (r *Registry) probe(ctx context.Context, reg Registration) bool {
+	start := time.Now()
+	report, err := r.heartbeat(ctx, reg)
+	check := HealthCheck{Time: start, Latency: time.Since(start), Status: health.StatusDown}
+	if err == nil {
+		check.OK, check.Ready, check.Status = report.Live, report.Ready, report.Status
+		if !report.Live {
+			err = fmt.Errorf("heartbeat reported %s", report.Status)
+		}
+	}
+	if err != nil {
+		log.Println("In ./registry/server.go:Method probe of registry:", err)
+		check.Error = err.Error()
+		heartbeatChecks.In(r.metrics).Inc(string(reg.ServiceName), "failure")
+	} else {
+		heartbeatChecks.In(r.metrics).Inc(string(reg.ServiceName), string(report.Status))
+	}
+	//与注册、取消注册使用同一把锁，就绪状态的变化与通知不会和它们交错
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.status.heartbeat(reg, check, report.Checks) {
+		entry := []patchEntry{entryOf(reg)}
+		if check.Ready {
+			log.Println("Instance ready again, routing traffic to", reg.ServiceURL)
+			r.notifyLocked(context.Background(), patch{Added: entry})
+		} else {
+			log.Println("Instance alive but not ready, routing traffic away from", reg.ServiceURL)
+			r.notifyLocked(context.Background(), patch{Removed: entry})
+		}
+	}
+	return check.OK
+}
+
+// 声明支持ProtocolConnect的实例通过RPC检测，否则请求其HeartbeatURL
+func (r *Registry) heartbeat(ctx context.Context, reg Registration) (health.Report, error) {
+	if reg.Supports(ProtocolConnect) {
+		report, err := rpc.Call[HeartbeatRequest, health.Report](ctx,
+			&rpc.Client{BaseURL: reg.ServiceURL, HTTP: r.HTTP}, InstanceServicePath+"Heartbeat", &HeartbeatRequest{})
+		if err != nil {
+			return health.Report{}, err
+		}
+		return *report, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reg.HeartbeatURL, nil)
+	if err != nil {
+		return health.Report{}, err
+	}
+	res, err := r.HTTP.Do(req)
+	if err != nil {
+		return health.Report{}, err
+	}
+	defer res.Body.Close()
+	return health.ReadReport(res), nil
 }
 
-// 包级变量
-var reg = registry{
-	registrations: make([]Registration, 0),
-	mutex:         new(sync.RWMutex),
+// SetupHeartbeat 按config周期性地检测已注册的实例，未设置的参数使用DefaultProbeConfig
+// 应在开始处理请求前调用，只有第一次调用生效，不调用时不进行心跳检测
+func (r *Registry) SetupHeartbeat(config ProbeConfig) {
+	if r.scheduler == nil {
+		r.scheduler = newScheduler(r, config)
+	}
+}
+
+// RegisterHandlers 在mux上注册服务注册、管理与可用区同步的接口
+func (r *Registry) RegisterHandlers(mux *http.ServeMux) {
+	//修改类的请求可以携带Idempotency-Key，重复的请求重放第一次的响应
+	mux.Handle("/services", r.idempotency.Middleware(&RegService{Registry: r}))
+	mux.Handle("/admin/", r.idempotency.Middleware(auth.Require(&AdminService{Registry: r}, auth.RoleAdmin)))
+	mux.Handle(FederationPath, &FederationService{Registry: r})
+	r.registerRPC(mux)
+}
+
+// Close 停止心跳检测、更新推送与可用区同步，已注册的实例不会收到通知
+func (r *Registry) Close() {
+	r.once.Do(func() {
+		close(r.done)
+		if r.scheduler != nil {
+			r.scheduler.stopAll()
+		}
+		r.subscriptions.stopAll()
+	})
 }
 
-// RegService 让如下结构体成为httpserver类型
-type RegService struct{}
+// RegService 服务注册与取消注册的接口
+type RegService struct {
+	Registry *Registry
+}
 
 func (s RegService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg := s.Registry
 	log.Println("Method ServeHTTP of RegService:Request received")
+	//只有持有服务token的可信服务才能注册或取消注册
+	claims, err := auth.FromRequest(r)
+	if err != nil {
+		log.Println("Method ServeHTTP of RegService:", err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !claims.HasRole(auth.RoleService) {
+		log.Printf("Method ServeHTTP of RegService:%s (%s) is not a service\n", claims.Subject, claims.Role)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	//注册与取消注册的请求体必须带有签名，且不能被重放
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		_, err = auth.VerifyRequest(r)
+		if err != nil {
+			log.Println("Method ServeHTTP of RegService: rejected request from", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
 	switch r.Method {
+	//列出调用方所属服务的所有已注册实例，包括未就绪与被摘除流量的实例
+	case http.MethodGet:
+		if !tlsutil.VerifyPeer(r, claims.Service) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, err := json.Marshal(reg.registeredInstances(ServiceName(claims.Service)))
+		if err != nil {
+			log.Println("Method ServeHTTP of RegService:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
 	//注册服务
 	case http.MethodPost:
 		dec := json.NewDecoder(r.Body)
-		var r Registration
-		err := dec.Decode(&r)
+		var newReg Registration
+		err := dec.Decode(&newReg)
 		if err != nil {
 			log.Println("Method ServeHTTP of RegService:Error decoding registration", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		log.Printf("Method ServeHTTP of RegService:Adding service:%v with URL:%s\n", r.ServiceName, r.ServiceURL)
-		err = reg.add(r)
+		initial, err := reg.register(r, claims, newReg)
+		if errors.Is(err, errNoUpdateKey) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			log.Println("Method ServeHTTP of RegService:add service failed", err)
-			w.WriteHeader(http.StatusBadRequest)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		//响应中带上所依赖的服务的完整列表，服务注册完成后即可使用
+		data, err := json.Marshal(initial)
+		if err != nil {
+			log.Println("Method ServeHTTP of RegService:", err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
 	//取消服务
 	case http.MethodDelete:
 		payload, err := io.ReadAll(r.Body)
@@ -226,11 +413,12 @@ func (s RegService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		url := string(payload)
-		log.Printf("Method ServeHTTP of RegService:Removing service at URL:%s", url)
-		err = reg.remove(url)
+		err = reg.unregister(r, claims, string(payload))
+		if errors.Is(err, errForbidden) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
 		if err != nil {
-			log.Println("Method ServeHTTP of RegService:add service failed", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -240,3 +428,56 @@ func (s RegService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	}
 }
+
+// 本可用区中已注册的name的所有实例的URL，不论是否就绪，按URL排序
+func (r *Registry) registeredInstances(name ServiceName) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	urls := make([]string, 0)
+	for _, reg := range r.registrations {
+		if reg.ServiceName == name {
+			urls = append(urls, reg.ServiceURL)
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// 调用方不能以其他服务的名义注册或取消注册
+var errForbidden = errors.New("not allowed to act for this service")
+
+// 接收更新推送的实例必须提供UpdateKey
+var errNoUpdateKey = fmt.Errorf("registrations with a ServiceUpdateURL need an UpdateKey of at least %d bytes", UpdateKeySize)
+
+// 注册实例，服务只能以自己的名义注册，启用TLS时还要与证书中的服务名称一致
+func (r *Registry) register(req *http.Request, claims *auth.Claims, newReg Registration) (patch, error) {
+	if claims.Service != string(newReg.ServiceName) || !tlsutil.VerifyPeer(req, string(newReg.ServiceName)) {
+		log.Printf("Method register of Registry:%s cannot register as %v\n", claims.Service, newReg.ServiceName)
+		return patch{}, errForbidden
+	}
+	if newReg.ServiceUpdateURL != "" && len(newReg.UpdateKey) < UpdateKeySize {
+		log.Printf("Method register of Registry:%v at %s did not send an UpdateKey\n", newReg.ServiceName, newReg.ServiceURL)
+		return patch{}, errNoUpdateKey
+	}
+	log.Printf("Method register of Registry:Adding service:%v with URL:%s\n", newReg.ServiceName, newReg.ServiceURL)
+	initial := r.add(req.Context(), newReg)
+	if r.scheduler != nil {
+		r.scheduler.schedule(newReg)
+	}
+	return initial, nil
+}
+
+// 取消注册url对应的实例，只有实例所属的服务可以取消注册
+func (r *Registry) unregister(req *http.Request, claims *auth.Claims, url string) error {
+	if existing, ok := r.lookup(url); ok &&
+		(claims.Service != string(existing.ServiceName) || !tlsutil.VerifyPeer(req, string(existing.ServiceName))) {
+		log.Printf("Method unregister of Registry:%s cannot remove %v\n", claims.Service, existing.ServiceName)
+		return errForbidden
+	}
+	log.Printf("Method unregister of Registry:Removing service at URL:%s", url)
+	err := r.deregister(req.Context(), url)
+	if err != nil {
+		log.Println("Method unregister of Registry:remove service failed", err)
+	}
+	return err
+}
@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"distributedDemo/health"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 每个实例保留的心跳检测记录数
+const healthHistorySize = 20
+
+// HealthCheck 一次心跳检测的结果
+type HealthCheck struct {
+	Time time.Time
+	//OK表示实例存活
+	OK      bool
+	Ready   bool
+	Status  health.Status
+	Latency time.Duration
+	Error   string
+}
+
+// InstanceStatus registry记录的实例运行状况，供管理页面展示
+type InstanceStatus struct {
+	Registration
+	//心跳检测失败被移除后仍保留状态，直到被显式取消注册
+	Registered bool
+	Healthy    bool
+	//存活但未就绪的实例不会出现在依赖它的服务的列表中
+	Ready        bool
+	HealthStatus health.Status
+	Checks       []health.CheckResult
+	//被摘除流量的实例仍保持注册，但不会出现在依赖它的服务的列表中
+	Drained       bool
+	LastHeartbeat time.Time
+	LastLatency   time.Duration
+	History       []HealthCheck
+
+	LastPatch        time.Time
+	LastPatchError   string
+	PatchesDelivered int
+	PatchFailures    int
+	//等待推送的更新数
+	PatchBacklog int
+	//推送完整服务列表的次数，实例落后过多或检测到缺失的更新时触发
+	Resyncs int
+}
+
+// 以ServiceURL为键记录实例状态
+type statusBook struct {
+	instances map[string]*InstanceStatus
+	mutex     sync.Mutex
+}
+
+func newStatusBook() *statusBook {
+	return &statusBook{instances: make(map[string]*InstanceStatus)}
+}
+
+// 调用方需持有sb.mutex
+func (sb *statusBook) get(reg Registration) *InstanceStatus {
+	st, ok := sb.instances[reg.ServiceURL]
+	if !ok {
+		//状态会在管理接口中返回，不保存实例的UpdateKey
+		reg.UpdateKey = nil
+		st = &InstanceStatus{Registration: reg, Healthy: true, Ready: true, HealthStatus: health.StatusUp}
+		sb.instances[reg.ServiceURL] = st
+	}
+	return st
+}
+
+func (sb *statusBook) registered(reg Registration, registered bool) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	st := sb.get(reg)
+	st.Registration = reg
+	st.Registered = registered
+}
+
+func (sb *statusBook) forget(url string) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	delete(sb.instances, url)
+}
+
+// 记录心跳检测结果，返回已注册且未被摘除流量的实例是否从就绪变为未就绪，或者反过来
+func (sb *statusBook) heartbeat(reg Registration, check HealthCheck, checks []health.CheckResult) (changed bool) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	st := sb.get(reg)
+	//宕机的实例由心跳检测的重试逻辑移除，这里只关心存活实例的就绪状态
+	changed = check.OK && st.Ready != check.Ready && st.Registered && !st.Drained
+	if check.OK {
+		st.Ready = check.Ready
+	}
+	st.Healthy = check.OK
+	st.HealthStatus = check.Status
+	st.Checks = checks
+	st.LastHeartbeat = check.Time
+	st.LastLatency = check.Latency
+	st.History = append(st.History, check)
+	if len(st.History) > healthHistorySize {
+		st.History = st.History[len(st.History)-healthHistorySize:]
+	}
+	return changed
+}
+
+func (sb *statusBook) patch(reg Registration, err error, backlog int) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	st := sb.get(reg)
+	st.LastPatch = time.Now()
+	st.PatchBacklog = backlog
+	if err != nil {
+		st.LastPatchError = err.Error()
+		st.PatchFailures++
+		return
+	}
+	st.LastPatchError = ""
+	st.PatchesDelivered++
+}
+
+func (sb *statusBook) resync(reg Registration) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	sb.get(reg).Resyncs++
+}
+
+func (sb *statusBook) setDrained(url string, drained bool) bool {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	st, ok := sb.instances[url]
+	if !ok {
+		return false
+	}
+	st.Drained = drained
+	return true
+}
+
+// 实例是否应该出现在依赖它的服务的列表中：未被摘除流量且已就绪
+func (sb *statusBook) routable(url string) bool {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	st, ok := sb.instances[url]
+	return !ok || (!st.Drained && st.Ready)
+}
+
+// 返回按服务名称与URL排序的状态快照
+func (sb *statusBook) snapshot() []InstanceStatus {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	list := make([]InstanceStatus, 0, len(sb.instances))
+	for _, st := range sb.instances {
+		cp := *st
+		cp.History = append([]HealthCheck(nil), st.History...)
+		cp.Checks = append([]health.CheckResult(nil), st.Checks...)
+		list = append(list, cp)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ServiceName != list[j].ServiceName {
+			return list[i].ServiceName < list[j].ServiceName
+		}
+		return list[i].ServiceURL < list[j].ServiceURL
+	})
+	return list
+}
@@ -0,0 +1,210 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"distributedDemo/tlsutil"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client 调用某个实例上的过程
+type Client struct {
+	//实例的地址，如http://localhost:5000
+	BaseURL string
+	//为nil时使用tlsutil.Client
+	HTTP *http.Client
+	//发送前修改请求，如设置token或签名，body为完整的请求体，客户端流式调用时为nil
+	Prepare func(req *http.Request, body []byte) error
+}
+
+func (c *Client) newRequest(ctx context.Context, procedure, contentType string, body io.Reader, raw []byte) (*http.Request, error) {
+	u := strings.TrimSuffix(c.BaseURL, "/") + "/" + strings.TrimPrefix(procedure, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(ProtocolVersionHeader, "1")
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := time.Until(deadline).Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		req.Header.Set(TimeoutHeader, strconv.FormatInt(ms, 10))
+	}
+	if c.Prepare != nil {
+		if err := c.Prepare(req, raw); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	hc := c.HTTP
+	if hc == nil {
+		hc = tlsutil.Client
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return nil, &Error{Code: CodeUnavailable, Message: err.Error()}
+	}
+	return res, nil
+}
+
+// 一元调用或流式调用在建立前失败时，由状态码与响应体得出错误
+func responseError(res *http.Response) *Error {
+	var e Error
+	data, _ := io.ReadAll(io.LimitReader(res.Body, maxMessageSize))
+	if err := json.Unmarshal(data, &e); err != nil || e.Code == "" {
+		return &Error{Code: statusCode(res.StatusCode), Message: fmt.Sprintf("server responded with code %d", res.StatusCode)}
+	}
+	return &e
+}
+
+// Call 一元调用
+func Call[Req, Res any](ctx context.Context, c *Client, procedure string, req *Req) (*Res, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := c.newRequest(ctx, procedure, ContentTypeUnary, bytes.NewReader(body), body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	out := new(Res)
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return nil, Errorf(CodeInternal, "decoding response: %v", err)
+	}
+	return out, nil
+}
+
+// CallServerStream 服务端流式调用，依次以收到的消息调用recv，recv返回错误时结束调用
+func CallServerStream[Req, Res any](ctx context.Context, c *Client, procedure string, req *Req, recv func(*Res) error) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	_ = writeEnvelope(&body, 0, data)
+	raw := body.Bytes()
+	httpReq, err := c.newRequest(ctx, procedure, ContentTypeStream, bytes.NewReader(raw), raw)
+	if err != nil {
+		return err
+	}
+	res, err := c.do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError(res)
+	}
+	for {
+		flags, data, err := readEnvelope(res.Body)
+		if err != nil {
+			if err == io.EOF {
+				return Errorf(CodeUnavailable, "stream ended unexpectedly")
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if flags&flagEndStream != 0 {
+			return endError(data)
+		}
+		msg := new(Res)
+		if err := json.Unmarshal(data, msg); err != nil {
+			return Errorf(CodeInternal, "decoding response: %v", err)
+		}
+		if err := recv(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// CallClientStream 客户端流式调用，依次发送next返回的消息，直到next返回io.EOF
+func CallClientStream[Req, Res any](ctx context.Context, c *Client, procedure string, next func() (*Req, error)) (*Res, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			msg, err := next()
+			if err == io.EOF {
+				_ = writeEnvelope(pw, flagEndStream, []byte("{}"))
+				pw.Close()
+				return
+			}
+			var data []byte
+			if err == nil {
+				data, err = json.Marshal(msg)
+			}
+			if err == nil {
+				err = writeEnvelope(pw, 0, data)
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	httpReq, err := c.newRequest(ctx, procedure, ContentTypeStream, pr, nil)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	res, err := c.do(httpReq)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError(res)
+	}
+	var out *Res
+	for {
+		flags, data, err := readEnvelope(res.Body)
+		if err != nil {
+			return nil, Errorf(CodeUnavailable, "stream ended unexpectedly: %v", err)
+		}
+		if flags&flagEndStream != 0 {
+			if err := endError(data); err != nil {
+				return nil, err
+			}
+			if out == nil {
+				return nil, Errorf(CodeInternal, "no response message")
+			}
+			return out, nil
+		}
+		out = new(Res)
+		if err := json.Unmarshal(data, out); err != nil {
+			return nil, Errorf(CodeInternal, "decoding response: %v", err)
+		}
+	}
+}
+
+func endError(data []byte) error {
+	var end endStreamMessage
+	if err := json.Unmarshal(data, &end); err != nil {
+		return Errorf(CodeInternal, "decoding end of stream: %v", err)
+	}
+	if end.Error != nil {
+		return end.Error
+	}
+	return nil
+}
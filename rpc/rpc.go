@@ -0,0 +1,321 @@
+// Package rpc 与Connect协议兼容的JSON RPC，与原有的HTTP接口一起提供服务
+//
+// 每个过程对应一个路径，如/distributed.grades.v1.GradesService/GetStudent，请求均使用POST：
+//
+//	一元调用       Content-Type: application/json，请求体与响应体为JSON，出错时以对应的状态码返回{"code":"not_found","message":"..."}
+//	流式调用       Content-Type: application/connect+json，每条消息前有1字节标志与4字节长度，最后一条带结束标志的消息中包含错误
+//
+// 因此curl或任何Connect客户端都可以直接调用，如
+//
+//	curl -H 'Content-Type: application/json' -H "Authorization: Bearer $TOKEN" \
+//		-d '{"ID":1}' http://localhost:5000/distributed.grades.v1.GradesService/GetStudent
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ContentTypeUnary 一元调用的Content-Type
+	ContentTypeUnary = "application/json"
+	// ContentTypeStream 流式调用的Content-Type
+	ContentTypeStream = "application/connect+json"
+	// ProtocolVersionHeader Connect客户端在一元调用中携带的协议版本
+	ProtocolVersionHeader = "Connect-Protocol-Version"
+	// TimeoutHeader 客户端设置的超时时间，单位为毫秒
+	TimeoutHeader = "Connect-Timeout-Ms"
+
+	//流式消息的结束标志
+	flagEndStream = 0x02
+	//单条消息的大小上限
+	maxMessageSize = 4 << 20
+)
+
+// Code 错误码，与Connect及gRPC的错误码对应
+type Code string
+
+const (
+	CodeCanceled           = Code("canceled")
+	CodeUnknown            = Code("unknown")
+	CodeInvalidArgument    = Code("invalid_argument")
+	CodeDeadlineExceeded   = Code("deadline_exceeded")
+	CodeNotFound           = Code("not_found")
+	CodeAlreadyExists      = Code("already_exists")
+	CodePermissionDenied   = Code("permission_denied")
+	CodeResourceExhausted  = Code("resource_exhausted")
+	CodeFailedPrecondition = Code("failed_precondition")
+	CodeAborted            = Code("aborted")
+	CodeUnimplemented      = Code("unimplemented")
+	CodeInternal           = Code("internal")
+	CodeUnavailable        = Code("unavailable")
+	CodeUnauthenticated    = Code("unauthenticated")
+)
+
+// 一元调用出错时使用的状态码
+var codeStatus = map[Code]int{
+	CodeCanceled:           499,
+	CodeUnknown:            http.StatusInternalServerError,
+	CodeInvalidArgument:    http.StatusBadRequest,
+	CodeDeadlineExceeded:   http.StatusGatewayTimeout,
+	CodeNotFound:           http.StatusNotFound,
+	CodeAlreadyExists:      http.StatusConflict,
+	CodePermissionDenied:   http.StatusForbidden,
+	CodeResourceExhausted:  http.StatusTooManyRequests,
+	CodeFailedPrecondition: http.StatusBadRequest,
+	CodeAborted:            http.StatusConflict,
+	CodeUnimplemented:      http.StatusNotImplemented,
+	CodeInternal:           http.StatusInternalServerError,
+	CodeUnavailable:        http.StatusServiceUnavailable,
+	CodeUnauthenticated:    http.StatusUnauthorized,
+}
+
+// 没有可解析的错误信息时（如被auth.Require拒绝），由状态码推断错误码
+func statusCode(status int) Code {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeInvalidArgument
+	case http.StatusUnauthorized:
+		return CodeUnauthenticated
+	case http.StatusForbidden:
+		return CodePermissionDenied
+	case http.StatusNotFound:
+		return CodeUnimplemented
+	case http.StatusConflict:
+		return CodeAborted
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return CodeUnavailable
+	}
+	return CodeUnknown
+}
+
+// Error 带错误码的错误，处理函数返回其他错误时视为CodeUnknown
+type Error struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return string(e.Code)
+	}
+	return string(e.Code) + ": " + e.Message
+}
+
+// Errorf 创建带错误码的错误
+func Errorf(code Code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// CodeOf 返回err的错误码，err为nil时返回空字符串
+func CodeOf(err error) Code {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	}
+	return CodeUnknown
+}
+
+func toError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{Code: CodeOf(err), Message: err.Error()}
+}
+
+// Unary 一元调用的处理函数
+func Unary[Req, Res any](fn func(ctx context.Context, req *Req) (*Res, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel, ok := start(w, r, ContentTypeUnary)
+		if !ok {
+			return
+		}
+		defer cancel()
+		req := new(Req)
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxMessageSize)).Decode(req); err != nil && err != io.EOF {
+			writeUnaryError(w, Errorf(CodeInvalidArgument, "decoding request: %v", err))
+			return
+		}
+		res, err := fn(ctx, req)
+		if err != nil {
+			writeUnaryError(w, toError(err))
+			return
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			writeUnaryError(w, Errorf(CodeInternal, "encoding response: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", ContentTypeUnary)
+		_, _ = w.Write(data)
+	})
+}
+
+// ServerStream 服务端流式调用的处理函数，通过send依次发送消息
+func ServerStream[Req, Res any](fn func(ctx context.Context, req *Req, send func(*Res) error) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel, ok := start(w, r, ContentTypeStream)
+		if !ok {
+			return
+		}
+		defer cancel()
+		req := new(Req)
+		flags, data, err := readEnvelope(r.Body)
+		if err == nil && flags&flagEndStream == 0 {
+			err = json.Unmarshal(data, req)
+		}
+		w.Header().Set("Content-Type", ContentTypeStream)
+		if err != nil {
+			endStream(w, Errorf(CodeInvalidArgument, "decoding request: %v", err))
+			return
+		}
+		flusher, _ := w.(http.Flusher)
+		send := func(res *Res) error {
+			data, err := json.Marshal(res)
+			if err != nil {
+				return err
+			}
+			if err := writeEnvelope(w, 0, data); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		}
+		var e *Error
+		if err := fn(ctx, req, send); err != nil {
+			e = toError(err)
+		}
+		endStream(w, e)
+	})
+}
+
+// ClientStream 客户端流式调用的处理函数，通过recv依次读取消息，读完时recv返回io.EOF
+func ClientStream[Req, Res any](fn func(ctx context.Context, recv func() (*Req, error)) (*Res, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel, ok := start(w, r, ContentTypeStream)
+		if !ok {
+			return
+		}
+		defer cancel()
+		w.Header().Set("Content-Type", ContentTypeStream)
+		recv := func() (*Req, error) {
+			flags, data, err := readEnvelope(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			if flags&flagEndStream != 0 {
+				return nil, io.EOF
+			}
+			req := new(Req)
+			if err := json.Unmarshal(data, req); err != nil {
+				return nil, Errorf(CodeInvalidArgument, "decoding request: %v", err)
+			}
+			return req, nil
+		}
+		res, err := fn(ctx, recv)
+		if err != nil {
+			endStream(w, toError(err))
+			return
+		}
+		data, err := json.Marshal(res)
+		if err == nil {
+			err = writeEnvelope(w, 0, data)
+		}
+		if err != nil {
+			log.Println("func ClientStream:", r.URL.Path, err)
+			return
+		}
+		endStream(w, nil)
+	})
+}
+
+// 检查方法与Content-Type，并按Connect-Timeout-Ms设置超时
+func start(w http.ResponseWriter, r *http.Request, contentType string) (context.Context, context.CancelFunc, bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, nil, false
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, contentType) {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return nil, nil, false
+	}
+	if ms, err := strconv.ParseInt(r.Header.Get(TimeoutHeader), 10, 64); err == nil && ms > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+		return ctx, cancel, true
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	return ctx, cancel, true
+}
+
+func writeUnaryError(w http.ResponseWriter, e *Error) {
+	status, ok := codeStatus[e.Code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	data, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", ContentTypeUnary)
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// 流式调用的最后一条消息
+type endStreamMessage struct {
+	Error *Error `json:"error,omitempty"`
+}
+
+func endStream(w io.Writer, e *Error) {
+	data, _ := json.Marshal(endStreamMessage{Error: e})
+	_ = writeEnvelope(w, flagEndStream, data)
+}
+
+func writeEnvelope(w io.Writer, flags byte, data []byte) error {
+	var prefix [5]byte
+	prefix[0] = flags
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readEnvelope(r io.Reader) (byte, []byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = Errorf(CodeInvalidArgument, "truncated message")
+		}
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return 0, nil, Errorf(CodeResourceExhausted, "message of %d bytes exceeds limit", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, Errorf(CodeInvalidArgument, "truncated message: %v", err)
+	}
+	return prefix[0], data, nil
+}
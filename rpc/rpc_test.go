@@ -0,0 +1,288 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type echoRequest struct {
+	Text  string
+	Count int
+}
+
+type echoResponse struct {
+	Text string
+}
+
+// 测试用的服务：Echo原样返回，Fail返回请求中指定的错误码，Repeat与Join分别为服务端与客户端流式调用
+func newTestServer(t *testing.T) *Client {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/test.Service/Echo", Unary(func(ctx context.Context, req *echoRequest) (*echoResponse, error) {
+		return &echoResponse{Text: req.Text}, nil
+	}))
+	mux.Handle("/test.Service/Fail", Unary(func(ctx context.Context, req *echoRequest) (*echoResponse, error) {
+		if req.Text == "" {
+			return nil, errors.New("plain error")
+		}
+		return nil, Errorf(Code(req.Text), "failed with %s", req.Text)
+	}))
+	mux.Handle("/test.Service/Deadline", Unary(func(ctx context.Context, req *echoRequest) (*echoResponse, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return &echoResponse{Text: "none"}, nil
+		}
+		return &echoResponse{Text: fmt.Sprint(time.Until(deadline) <= time.Minute)}, nil
+	}))
+	mux.Handle("/test.Service/Repeat", ServerStream(func(ctx context.Context, req *echoRequest, send func(*echoResponse) error) error {
+		for i := 0; i < req.Count; i++ {
+			if err := send(&echoResponse{Text: fmt.Sprint(req.Text, i)}); err != nil {
+				return err
+			}
+		}
+		if req.Text == "fail" {
+			return Errorf(CodeAborted, "stopped after %d", req.Count)
+		}
+		return nil
+	}))
+	mux.Handle("/test.Service/Join", ClientStream(func(ctx context.Context, recv func() (*echoRequest, error)) (*echoResponse, error) {
+		var parts []string
+		for {
+			req, err := recv()
+			if err == io.EOF {
+				return &echoResponse{Text: strings.Join(parts, ",")}, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if req.Text == "fail" {
+				return nil, Errorf(CodeInvalidArgument, "bad part")
+			}
+			parts = append(parts, req.Text)
+		}
+	}))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return &Client{BaseURL: srv.URL, HTTP: srv.Client()}
+}
+
+func TestUnaryCall(t *testing.T) {
+	c := newTestServer(t)
+	res, err := Call[echoRequest, echoResponse](context.Background(), c, "/test.Service/Echo", &echoRequest{Text: "hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "hi" {
+		t.Fatalf("response = %+v", res)
+	}
+}
+
+func TestUnaryErrors(t *testing.T) {
+	c := newTestServer(t)
+	for code, status := range codeStatus {
+		_, err := Call[echoRequest, echoResponse](context.Background(), c, "/test.Service/Fail", &echoRequest{Text: string(code)})
+		if CodeOf(err) != code {
+			t.Errorf("code %s: err = %v", code, err)
+		}
+		//错误码与状态码的对应同样适用于不使用本包的客户端
+		res, err := http.Post(c.BaseURL+"/test.Service/Fail", ContentTypeUnary, strings.NewReader(fmt.Sprintf(`{"Text":%q}`, code)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Errorf("code %s: status %d, want %d", code, res.StatusCode, status)
+		}
+	}
+	//不带错误码的错误视为unknown
+	_, err := Call[echoRequest, echoResponse](context.Background(), c, "/test.Service/Fail", &echoRequest{})
+	if CodeOf(err) != CodeUnknown || !strings.Contains(err.Error(), "plain error") {
+		t.Fatalf("plain error: err = %v, want unknown with the message", err)
+	}
+	//不存在的过程由状态码推断错误码
+	_, err = Call[echoRequest, echoResponse](context.Background(), c, "/test.Service/Missing", &echoRequest{})
+	if CodeOf(err) != CodeUnimplemented {
+		t.Fatalf("missing procedure: err = %v, want unimplemented", err)
+	}
+	_, err = Call[echoRequest, echoResponse](context.Background(), &Client{BaseURL: "http://127.0.0.1:1"}, "/test.Service/Echo", &echoRequest{})
+	if CodeOf(err) != CodeUnavailable {
+		t.Fatalf("unreachable server: err = %v, want unavailable", err)
+	}
+}
+
+func TestUnaryRejectsWrongMethodAndContentType(t *testing.T) {
+	c := newTestServer(t)
+	res, err := http.Get(c.BaseURL + "/test.Service/Echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed || res.Header.Get("Allow") != http.MethodPost {
+		t.Fatalf("GET: status %d, Allow %q", res.StatusCode, res.Header.Get("Allow"))
+	}
+	res, err = http.Post(c.BaseURL+"/test.Service/Echo", "text/plain", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("text/plain: status %d, want 415", res.StatusCode)
+	}
+	res, err = http.Post(c.BaseURL+"/test.Service/Echo", ContentTypeUnary, strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("malformed request: status %d, want 400", res.StatusCode)
+	}
+}
+
+// ctx的截止时间通过Connect-Timeout-Ms传给服务端
+func TestTimeoutPropagates(t *testing.T) {
+	c := newTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	res, err := Call[echoRequest, echoResponse](ctx, c, "/test.Service/Deadline", &echoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "true" {
+		t.Fatalf("server deadline = %s, want within a minute", res.Text)
+	}
+	res, err = Call[echoRequest, echoResponse](context.Background(), c, "/test.Service/Deadline", &echoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "none" {
+		t.Fatalf("server deadline = %s, want none", res.Text)
+	}
+}
+
+func TestPrepareSeesRequestBody(t *testing.T) {
+	c := newTestServer(t)
+	var body string
+	c.Prepare = func(req *http.Request, raw []byte) error {
+		body = string(raw)
+		req.Header.Set("Authorization", "Bearer token")
+		return nil
+	}
+	if _, err := Call[echoRequest, echoResponse](context.Background(), c, "/test.Service/Echo", &echoRequest{Text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"Text":"hi","Count":0}` {
+		t.Fatalf("Prepare saw body %q", body)
+	}
+	c.Prepare = func(req *http.Request, raw []byte) error { return errors.New("no token") }
+	if _, err := Call[echoRequest, echoResponse](context.Background(), c, "/test.Service/Echo", &echoRequest{}); err == nil {
+		t.Fatal("request sent although Prepare failed")
+	}
+}
+
+func TestServerStream(t *testing.T) {
+	c := newTestServer(t)
+	var got []string
+	recv := func(res *echoResponse) error {
+		got = append(got, res.Text)
+		return nil
+	}
+	if err := CallServerStream(context.Background(), c, "/test.Service/Repeat", &echoRequest{Text: "m", Count: 3}, recv); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "m0 m1 m2" {
+		t.Fatalf("received %q", got)
+	}
+
+	//处理函数的错误在最后一条消息中返回，之前的消息已经收到
+	got = nil
+	err := CallServerStream(context.Background(), c, "/test.Service/Repeat", &echoRequest{Text: "fail", Count: 2}, recv)
+	if CodeOf(err) != CodeAborted || len(got) != 2 {
+		t.Fatalf("err = %v after %d messages, want aborted after 2", err, len(got))
+	}
+
+	//recv返回错误时结束调用
+	stop := errors.New("stop")
+	err = CallServerStream(context.Background(), c, "/test.Service/Repeat", &echoRequest{Text: "m", Count: 10},
+		func(*echoResponse) error { return stop })
+	if err != stop {
+		t.Fatalf("err = %v, want the error returned by recv", err)
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	c := newTestServer(t)
+	send := func(parts ...string) func() (*echoRequest, error) {
+		return func() (*echoRequest, error) {
+			if len(parts) == 0 {
+				return nil, io.EOF
+			}
+			req := &echoRequest{Text: parts[0]}
+			parts = parts[1:]
+			return req, nil
+		}
+	}
+	res, err := CallClientStream[echoRequest, echoResponse](context.Background(), c, "/test.Service/Join", send("a", "b", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "a,b,c" {
+		t.Fatalf("response = %q", res.Text)
+	}
+	_, err = CallClientStream[echoRequest, echoResponse](context.Background(), c, "/test.Service/Join", send("a", "fail"))
+	if CodeOf(err) != CodeInvalidArgument {
+		t.Fatalf("err = %v, want invalid_argument", err)
+	}
+}
+
+func TestReadEnvelope(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeEnvelope(&buf, flagEndStream, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	flags, data, err := readEnvelope(&buf)
+	if err != nil || flags != flagEndStream || string(data) != "{}" {
+		t.Fatalf("readEnvelope = %d, %q, %v", flags, data, err)
+	}
+	if _, _, err := readEnvelope(&buf); err != io.EOF {
+		t.Fatalf("empty stream: err = %v, want io.EOF", err)
+	}
+	if _, _, err := readEnvelope(bytes.NewReader([]byte{0, 0})); CodeOf(err) != CodeInvalidArgument {
+		t.Fatalf("truncated prefix: err = %v, want invalid_argument", err)
+	}
+	if _, _, err := readEnvelope(bytes.NewReader([]byte{0, 0, 0, 0, 5, '{'})); CodeOf(err) != CodeInvalidArgument {
+		t.Fatalf("truncated message: err = %v, want invalid_argument", err)
+	}
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], maxMessageSize+1)
+	if _, _, err := readEnvelope(bytes.NewReader(prefix)); CodeOf(err) != CodeResourceExhausted {
+		t.Fatalf("oversized message: err = %v, want resource_exhausted", err)
+	}
+}
+
+func TestCodeOf(t *testing.T) {
+	tests := []struct {
+		err  error
+		want Code
+	}{
+		{nil, ""},
+		{Errorf(CodeNotFound, "x"), CodeNotFound},
+		{fmt.Errorf("wrapped: %w", Errorf(CodeAborted, "x")), CodeAborted},
+		{context.Canceled, CodeCanceled},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), CodeDeadlineExceeded},
+		{errors.New("other"), CodeUnknown},
+	}
+	for _, tt := range tests {
+		if got := CodeOf(tt.err); got != tt.want {
+			t.Errorf("CodeOf(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"distributedDemo/health"
+	"distributedDemo/metrics"
+	"distributedDemo/middleware"
+	"distributedDemo/ratelimit"
+	"distributedDemo/registry"
+	"net"
+)
+
+// Option 启动服务时的可选配置
+type Option func(*options)
+
+type options struct {
+	checks      []health.Check
+	middlewares []middleware.Middleware
+	client      *registry.Client
+	listener    net.Listener
+	console     bool
+	metrics     *metrics.Registry
+	limiters    []*ratelimit.Limiter
+}
+
+// WithHealthCheck 注册一项自定义的健康检查，结果通过心跳检测接口返回给registry
+func WithHealthCheck(c health.Check) Option {
+	return func(o *options) {
+		o.checks = append(o.checks, c)
+	}
+}
+
+// WithMiddleware 为服务的所有业务接口加上middleware，按指定的顺序处理请求
+// 可以多次指定，如WithMiddleware(middleware.Logging, middleware.Timeout(5*time.Second))
+func WithMiddleware(mws ...middleware.Middleware) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, mws...)
+	}
+}
+
+// WithRateLimit 对服务的所有业务接口限流，registry的心跳检测与更新推送以及指标采集不受限制
+// 可以指定多个限流器，如同时按客户端IP与用户限流，限流器与其他middleware按指定的顺序处理请求
+// 限流器只能通过该服务的/ratelimits接口调整
+func WithRateLimit(l *ratelimit.Limiter) Option {
+	return func(o *options) {
+		o.limiters = append(o.limiters, l)
+		o.middlewares = append(o.middlewares, l.Middleware)
+	}
+}
+
+// WithRegistry 通过c注册服务并接收所依赖的服务的更新，未指定时使用registry.DefaultClient
+// 同一进程内启动多个服务时，每个服务应使用各自的Client
+func WithRegistry(c *registry.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// WithMetrics 将服务的指标记录在m中并通过/metrics输出，未指定时使用metrics.Default
+// 同一进程内启动多个服务时，每个服务应使用各自的Registry
+func WithMetrics(m *metrics.Registry) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// WithListener 在ln上提供服务，忽略Start的port参数，如测试中使用系统分配的端口
+func WithListener(ln net.Listener) Option {
+	return func(o *options) {
+		o.listener = ln
+	}
+}
+
+// WithoutConsole 不等待标准输入上的按键来停止服务，服务只随ctx取消而停止
+func WithoutConsole() Option {
+	return func(o *options) {
+		o.console = false
+	}
+}
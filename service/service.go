@@ -2,18 +2,67 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
+	"distributedDemo/auth"
+	"distributedDemo/health"
+	"distributedDemo/metrics"
+	"distributedDemo/middleware"
+	"distributedDemo/ratelimit"
 	"distributedDemo/registry"
+	"distributedDemo/tlsutil"
+	"distributedDemo/trace"
 	"fmt"
 	"log"
 	"net/http"
 )
 
 // Start 启动多个webserver服务
+// 每个服务使用自己的mux，registerHandlersFunc在其上注册业务接口，
+// 业务接口依次经过默认的middleware（panic恢复、请求ID）及通过WithMiddleware、WithRateLimit指定的middleware
+// 返回的ctx在服务停止并取消注册后结束，取消传入的ctx也会停止服务
 func Start(ctx context.Context, host, port string,
-	reg registry.Registration, registerHandlersFunc func()) (context.Context, error) {
-	registerHandlersFunc()
-	ctx = startService(ctx, reg.ServiceName, host, port)
-	err := registry.RegisterService(reg)
+	reg registry.Registration, registerHandlersFunc func(mux *http.ServeMux), opts ...Option) (context.Context, error) {
+	o := options{client: registry.DefaultClient, console: true, metrics: metrics.Default}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	//每个服务只返回自己的健康检查结果
+	checks := health.NewChecks()
+	for _, c := range o.checks {
+		checks.Register(c)
+	}
+	//启用TLS时为服务签发证书，服务通过o.client调用其他服务时携带该证书
+	tlsConfig, err := tlsutil.Configure(o.client.HTTP, string(reg.ServiceName))
+	if err != nil {
+		return ctx, err
+	}
+	//服务之间的调用都携带traceparent
+	trace.Setup(string(reg.ServiceName), o.client.HTTP)
+	limiters := ratelimit.NewLimiters()
+	for _, l := range o.limiters {
+		limiters.Add(l)
+	}
+
+	app := http.NewServeMux()
+	registerHandlersFunc(app)
+	chain := append([]middleware.Middleware{middleware.Recover, middleware.RequestID}, o.middlewares...)
+
+	//registry、监控与管理使用的接口不经过业务的middleware，避免被限流或要求认证
+	mux := http.NewServeMux()
+	//业务接口的请求按app中的路由统计
+	mux.Handle("/", metrics.Mount(app, middleware.Chain(app, chain...)))
+	mux.Handle("/metrics", o.metrics.Handler())
+	//调用链中包含请求路径、参数与错误信息，只允许管理员查看
+	mux.Handle("/traces", auth.Require(trace.ViewerHandler(), auth.RoleAdmin))
+	//运行时调整限额
+	mux.Handle("/ratelimits", auth.Require(limiters.Handler(), auth.RoleAdmin))
+	mux.Handle("/ratelimits/", auth.Require(limiters.Handler(), auth.RoleAdmin))
+	err = o.client.RegisterHandlers(mux, reg, checks)
+	if err != nil {
+		return ctx, err
+	}
+	ctx = startService(ctx, o, reg, port, tlsConfig, o.metrics.InstrumentHandler(mux))
+	err = o.client.RegisterService(reg)
 	if err != nil {
 		return ctx, err
 	}
@@ -23,20 +72,26 @@ func Start(ctx context.Context, host, port string,
 // 操作服务状态（启动或关闭）(包级函数）
 // 这段代码实现了启动一个 HTTP 服务器的功能。它使用了 context.Context 来处理关闭服务器的操作。代码的执行流程如下：
 // 首先，通过 context.WithCancel 创建一个新的 context.Context，并启动一个新的 goroutine。
-// 在新的 goroutine 中，调用 srv.ListenAndServe 方法来启动 HTTP 服务器。如果服务器无法启动，则调用 registry.ShutdownService 方法来关闭服务器，并取消上下文。
-// 然后，另外启动一个 goroutine，等待用户输入。如果用户按下任意键，则调用 registry.ShutdownService 方法关闭服务器，并调用 srv.Shutdown 方法取消上下文。
+// 在新的 goroutine 中，启动 HTTP 服务器。服务器停止后（无法启动或被关闭），向registry取消注册，并取消上下文。
+// 然后，另外启动一个 goroutine，等待用户输入。如果用户按下任意键，则调用 srv.Shutdown 方法关闭服务器。
+// 传入的ctx被取消时同样关闭服务器，因此同一进程内启动的多个服务可以分别停止。
 // 需要注意的是，在这段代码中，srv.Addr 变量并未使用到 host 变量，也就是说，只有 port 参数被用来作为服务器的端口。
-func startService(ctx context.Context, serviceName registry.ServiceName,
-	host, port string) context.Context {
-
-	ctx, cancel := context.WithCancel(ctx)
+func startService(parent context.Context, o options, reg registry.Registration, port string, tlsConfig *tls.Config, handler http.Handler) context.Context {
+	//取消注册完成前不结束返回的ctx，避免调用方提前退出
+	ctx, cancel := context.WithCancel(trace.Detach(parent))
 	var srv http.Server
 	//host+port
 	srv.Addr = port
+	srv.Handler = trace.Middleware(string(reg.ServiceName), handler)
+	srv.TLSConfig = tlsConfig
 
 	go func() {
-		log.Println(srv.ListenAndServe())
-		err := registry.ShutdownService(fmt.Sprintf("http://%s%s", host, port))
+		if o.listener != nil {
+			log.Println(tlsutil.Serve(&srv, o.listener))
+		} else {
+			log.Println(tlsutil.ListenAndServe(&srv))
+		}
+		err := o.client.ShutdownService(reg.ServiceName, reg.ServiceURL)
 		if err != nil {
 			log.Println("func startService:", err)
 		}
@@ -44,15 +99,22 @@ func startService(ctx context.Context, serviceName registry.ServiceName,
 	}()
 
 	go func() {
-		fmt.Printf("%v started.Press any key to stop...\n", serviceName)
+		select {
+		case <-parent.Done():
+		case <-ctx.Done():
+			return
+		}
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	if !o.console {
+		return ctx
+	}
+	go func() {
+		fmt.Printf("%v started.Press any key to stop...\n", reg.ServiceName)
 		var s string
 		fmt.Scanln(&s)
-		err := registry.ShutdownService(fmt.Sprintf("http://%s%s", host, port))
-		if err != nil {
-			log.Println("func startService:", err)
-		}
-		_ = srv.Shutdown(ctx)
-		cancel()
+		_ = srv.Shutdown(context.Background())
 	}()
 
 	return ctx
@@ -0,0 +1,407 @@
+// Package testcluster 在当前进程内启动registry、logger、grade、通知与portal服务，供端到端测试使用
+//
+//	c, err := testcluster.Start(testcluster.Config{})
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer c.Close()
+//	res, err := http.Get(c.PortalURL + "/login")
+//
+// 各服务监听系统分配的端口，使用各自的registry.Client、TLS证书、指标与限流器，
+// 互不影响，也不影响同一进程内的其他集群；设置了tlsutil.DirEnv时服务之间使用mTLS，证书需先由cmd/certs签发
+package testcluster
+
+import (
+	"context"
+	"crypto/tls"
+	"distributedDemo/events"
+	"distributedDemo/grades"
+	"distributedDemo/health"
+	"distributedDemo/logger"
+	"distributedDemo/metrics"
+	"distributedDemo/middleware"
+	"distributedDemo/notification"
+	"distributedDemo/portal"
+	"distributedDemo/registry"
+	"distributedDemo/service"
+	"distributedDemo/tlsutil"
+	"distributedDemo/trace"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Config 集群的可选配置
+type Config struct {
+	//日志服务写入的文件，为空时写入临时目录，Close时删除
+	LogFile string
+	//成绩服务的初始数据，为nil时使用grades.MockStudents
+	Students grades.Students
+	//心跳检测参数，为零值时使用DefaultProbeConfig
+	Probe registry.ProbeConfig
+	//停止各服务并等待其取消注册的最长时间，为0时使用5秒
+	ShutdownTimeout time.Duration
+	//通知服务使用的SMTP服务器，如notification.ListenFakeSMTP启动的服务器，为空时不提供邮件渠道
+	SMTPAddr string
+}
+
+// DefaultProbeConfig 测试中使用较短的检测间隔，使实例宕机后尽快被移除
+var DefaultProbeConfig = registry.ProbeConfig{
+	Interval:         200 * time.Millisecond,
+	Timeout:          time.Second,
+	FailureThreshold: 2,
+	SuccessThreshold: 1,
+}
+
+// Cluster 运行中的服务及其地址
+type Cluster struct {
+	Registry *registry.Registry
+	Logger   *logger.Server
+	Grades   *grades.GradesServer
+	//grade服务发布事件使用的Publisher，可查看待投递的事件与死信
+	Events        *events.Publisher
+	Notifications *notification.Server
+
+	RegistryURL string
+	LoggerURL   string
+	GradesURL   string
+	PortalURL   string
+	//通知服务的地址
+	NotificationsURL string
+
+	//portal使用的Client，可用于调用registry的管理接口或查找logger与grade服务的实例
+	Client *registry.Client
+	//所有grade服务实例，第一个即Grades，其余由AddGradesInstance启动
+	GradesInstances []*GradesInstance
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	services []context.Context
+	server   *http.Server
+	tempDir  string
+	timeout  time.Duration
+}
+
+// Start 依次启动registry、logger、grade、通知与portal服务，返回时portal已经获得grade服务的地址
+func Start(config Config) (c *Cluster, err error) {
+	if config.Students == nil {
+		config.Students = grades.MockStudents()
+	}
+	if config.Probe == (registry.ProbeConfig{}) {
+		config.Probe = DefaultProbeConfig
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c = &Cluster{cancel: cancel, timeout: config.ShutdownTimeout}
+	//启动失败时停止已经启动的服务
+	defer func() {
+		if err != nil {
+			c.Close()
+			c = nil
+		}
+	}()
+	if config.LogFile == "" {
+		c.tempDir, err = os.MkdirTemp("", "testcluster")
+		if err != nil {
+			return c, err
+		}
+		config.LogFile = filepath.Join(c.tempDir, "distributed.log")
+	}
+	if err = c.startRegistry(config.Probe); err != nil {
+		return c, err
+	}
+
+	c.Logger = logger.NewServer(config.LogFile)
+	c.LoggerURL, err = c.startService(ctx, registry.LoggerService, nil,
+		c.Logger.RegisterHandlers,
+		service.WithHealthCheck(health.Check{
+			Name: "log file writable",
+			Kind: health.Readiness,
+			Func: c.Logger.FileWritable,
+		}))
+	if err != nil {
+		return c, err
+	}
+
+	c.ctx = ctx
+	first, err := c.startGrades(config.Students)
+	if err != nil {
+		return c, err
+	}
+	c.Grades, c.GradesURL, c.Events = first.Server, first.URL, first.Events
+	//等待第一个实例选出自己作为leader，之后启动的实例都跟随它
+	if err = waitFor(func() bool { return first.Replicator.InSync(ctx) == nil }, 5*time.Second); err != nil {
+		return c, fmt.Errorf("grades leader election: %w", err)
+	}
+
+	notificationsClient := registry.NewClient(c.RegistryURL)
+	c.Notifications, err = notification.NewServer(notificationsClient, notification.Config{SMTPAddr: config.SMTPAddr})
+	if err != nil {
+		return c, err
+	}
+	c.NotificationsURL, err = c.startService(ctx, registry.NotificationService,
+		[]registry.ServiceName{registry.LoggerService, registry.GradeService},
+		c.Notifications.RegisterHandlers,
+		service.WithRegistry(notificationsClient))
+	if err != nil {
+		return c, err
+	}
+
+	//portal注册后通过自己的Client查找grade服务，因此Client需要先于RegisterHandlers创建
+	portalClient := registry.NewClient(c.RegistryURL)
+	c.PortalURL, err = c.startService(ctx, registry.PortalService,
+		[]registry.ServiceName{registry.LoggerService, registry.GradeService, registry.NotificationService},
+		portal.NewServer(portalClient).RegisterHandlers,
+		service.WithRegistry(portalClient),
+		service.WithMiddleware(middleware.Logging, middleware.Gzip),
+		service.WithHealthCheck(health.Check{
+			Name: "grades reachable",
+			Kind: health.Readiness,
+			Func: health.Reachable(func() (string, error) {
+				return portalClient.GetProvider(registry.GradeService)
+			}),
+		}))
+	if err != nil {
+		return c, err
+	}
+	c.Client = portalClient
+	//grade服务在registry下一次心跳检测确认就绪后才会推送给portal
+	err = waitFor(func() bool {
+		_, err := portalClient.GetProvider(registry.GradeService)
+		return err == nil
+	}, 5*time.Second)
+	if err != nil {
+		return c, fmt.Errorf("portal discovering grades: %w", err)
+	}
+	return c, nil
+}
+
+// GradesInstance 集群中的一个grade服务实例
+type GradesInstance struct {
+	Server     *grades.GradesServer
+	URL        string
+	Replicator *grades.Replicator
+	//实例发布事件使用的Publisher，只有leader会发布事件
+	Events *events.Publisher
+
+	cancel context.CancelFunc
+	done   context.Context
+	//等待取消注册的最长时间
+	timeout time.Duration
+}
+
+// Stop 停止实例并等待其取消注册，用于模拟实例下线
+func (gi *GradesInstance) Stop() {
+	gi.cancel()
+	select {
+	case <-gi.done.Done():
+	case <-time.After(gi.timeout):
+		log.Println("Method Stop of GradesInstance:timed out waiting for", gi.URL, "to stop")
+	}
+	gi.Replicator.Close()
+	gi.Events.Close()
+}
+
+// AddGradesInstance 启动另一个grade服务实例，实例从leader获取数据，就绪后才会被其他服务使用
+func (c *Cluster) AddGradesInstance() (*GradesInstance, error) {
+	return c.startGrades(grades.Students{})
+}
+
+// 启动使用students作为初始数据的grade服务实例，实例之间通过registry相互发现并复制数据
+func (c *Cluster) startGrades(students grades.Students) (*GradesInstance, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	gi := &GradesInstance{URL: tlsutil.Scheme() + "://" + ln.Addr().String(), timeout: c.timeout}
+	//事件的订阅方与其他实例由grade服务自己的Client获得，与portal一样需要先创建Client
+	gradesClient := registry.NewClient(c.RegistryURL)
+	gradesMetrics := metrics.NewRegistry()
+	eventsConfig := events.Config{
+		RetryMin: 100 * time.Millisecond,
+		RetryMax: time.Second,
+		HTTP:     gradesClient.HTTP,
+		Metrics:  gradesMetrics,
+	}
+	if c.tempDir != "" {
+		eventsConfig.Dir = filepath.Join(c.tempDir, "events", strconv.Itoa(len(c.GradesInstances)))
+	}
+	gi.Events, err = events.NewPublisher(string(registry.GradeService), gradesClient.Providers, eventsConfig)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	gi.Server = grades.NewGradesServer(students)
+	gi.Server.SetPublisher(gi.Events)
+	gi.Server.SetMetrics(gradesMetrics)
+
+	var ctx context.Context
+	ctx, gi.cancel = context.WithCancel(c.ctx)
+	_, gi.done, err = c.startServiceOn(ctx, ln, registry.GradeService,
+		[]registry.ServiceName{registry.LoggerService, registry.GradeService},
+		//service.Start为gradesClient配置证书后再开始复制，复制的接口随后注册
+		func(mux *http.ServeMux) {
+			gi.Replicator = gi.Server.Replicate(gradesClient, gi.URL)
+			c.GradesInstances = append(c.GradesInstances, gi)
+			gi.Server.RegisterHandlers(mux)
+		},
+		service.WithRegistry(gradesClient),
+		service.WithMetrics(gradesMetrics),
+		service.WithMiddleware(middleware.Logging, middleware.Timeout(5*time.Second), middleware.Gzip),
+		service.WithHealthCheck(health.Check{
+			Name: "store writable",
+			Kind: health.Readiness,
+			Func: gi.Server.StoreWritable,
+		}),
+		service.WithHealthCheck(health.Check{
+			Name: "replica in sync",
+			Kind: health.Readiness,
+			Func: func(ctx context.Context) error { return gi.Replicator.InSync(ctx) },
+		}))
+	if err != nil {
+		//未开始复制的实例不在GradesInstances中，Close不会关闭它的Publisher
+		if gi.Replicator == nil {
+			gi.Events.Close()
+		}
+		return nil, err
+	}
+	return gi, nil
+}
+
+func waitFor(cond func() bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil
+}
+
+// 在系统分配的端口上启动registry，与cmd/registryService相同，启用TLS时要求调用方提供证书
+func (c *Cluster) startRegistry(probe registry.ProbeConfig) error {
+	c.Registry = registry.NewRegistry(registry.LocalZone())
+	tlsConfig, err := tlsutil.Configure(c.Registry.HTTP, string(registry.RegistryService))
+	if err != nil {
+		return err
+	}
+	trace.Setup(string(registry.RegistryService), c.Registry.HTTP)
+	if tlsConfig != nil {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	c.RegistryURL = tlsutil.Scheme() + "://" + ln.Addr().String()
+	c.Registry.SetupHeartbeat(probe)
+	mux := http.NewServeMux()
+	c.Registry.RegisterHandlers(mux)
+	mux.Handle("/metrics", c.Registry.Metrics().Handler())
+	c.server = &http.Server{
+		Handler:   trace.Middleware(string(registry.RegistryService), c.Registry.Metrics().InstrumentHandler(mux)),
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		if err := tlsutil.Serve(c.server, ln); !errors.Is(err, http.ErrServerClosed) {
+			log.Println("Method startRegistry of Cluster:", err)
+		}
+	}()
+	return nil
+}
+
+// 在系统分配的端口上启动服务，未通过opts指定Client时使用新的Client，返回服务的地址
+func (c *Cluster) startService(ctx context.Context, name registry.ServiceName, required []registry.ServiceName,
+	registerHandlersFunc func(mux *http.ServeMux), opts ...service.Option) (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	serviceURL, _, err := c.startServiceOn(ctx, ln, name, required, registerHandlersFunc, opts...)
+	return serviceURL, err
+}
+
+// 在ln上启动服务，用于需要在注册路由前知道自身地址的服务，返回服务的地址及服务停止后结束的ctx
+// 未通过opts指定时，服务使用新的Client与指标
+func (c *Cluster) startServiceOn(ctx context.Context, ln net.Listener, name registry.ServiceName, required []registry.ServiceName,
+	registerHandlersFunc func(mux *http.ServeMux), opts ...service.Option) (string, context.Context, error) {
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return "", nil, err
+	}
+	serviceURL := tlsutil.Scheme() + "://" + ln.Addr().String()
+	r := registry.Registration{
+		ServiceName:      name,
+		ServiceURL:       serviceURL,
+		RequiredServices: required,
+		ServiceUpdateURL: serviceURL + "/services",
+		HeartbeatURL:     serviceURL + "/heartbeat",
+	}
+	//与cmd下的main相同，logger与grade服务同时提供RPC接口
+	if name == registry.LoggerService || name == registry.GradeService {
+		r.Protocols = []string{registry.ProtocolHTTP, registry.ProtocolConnect}
+	}
+	switch name {
+	case registry.GradeService:
+		r.Publishes = grades.PublishedEvents
+	case registry.NotificationService:
+		r.Subscribes = notification.SubscribedEvents
+		r.EventURL = serviceURL + "/events"
+	case registry.PortalService:
+		r.Subscribes = portal.SubscribedEvents
+		r.EventURL = serviceURL + "/events"
+	}
+	opts = append([]service.Option{
+		service.WithRegistry(registry.NewClient(c.RegistryURL)),
+		service.WithMetrics(metrics.NewRegistry()),
+		service.WithListener(ln),
+		service.WithoutConsole(),
+	}, opts...)
+	done, err := service.Start(ctx, host, ":"+port, r, registerHandlersFunc, opts...)
+	c.services = append(c.services, done)
+	if err != nil {
+		return "", nil, fmt.Errorf("starting %v: %w", name, err)
+	}
+	return serviceURL, done, nil
+}
+
+// Close 停止所有服务并等待它们取消注册，然后停止registry并删除临时文件
+func (c *Cluster) Close() {
+	c.cancel()
+	timeout := time.NewTimer(c.timeout)
+	defer timeout.Stop()
+wait:
+	for _, done := range c.services {
+		select {
+		case <-done.Done():
+		case <-timeout.C:
+			log.Println("Method Close of Cluster:timed out waiting for services to stop")
+			break wait
+		}
+	}
+	for _, gi := range c.GradesInstances {
+		gi.Replicator.Close()
+		gi.Events.Close()
+	}
+	if c.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		_ = c.server.Shutdown(ctx)
+		cancel()
+	}
+	if c.Registry != nil {
+		c.Registry.Close()
+	}
+	if c.tempDir != "" {
+		_ = os.RemoveAll(c.tempDir)
+	}
+}
@@ -0,0 +1,249 @@
+package testcluster_test
+
+import (
+	"bytes"
+	"distributedDemo/auth"
+	"distributedDemo/grades"
+	"distributedDemo/registry"
+	"distributedDemo/testcluster"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startCluster(t *testing.T) *testcluster.Cluster {
+	t.Helper()
+	if err := auth.AddUser("teacherA", "teacherA", auth.RoleTeacher, 0, "A"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := testcluster.Start(testcluster.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// 以c.Client.HTTP发出请求，启用TLS时携带portal的证书
+func do(t *testing.T, c *testcluster.Cluster, method, url, token string, body interface{}) (int, []byte) {
+	t.Helper()
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := c.Client.HTTP.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, data
+}
+
+// 页面的表单与修改请求都需要携带与cookie一致的CSRF token
+const csrfToken = "testcluster"
+
+// 以username登录portal，返回携带会话与CSRF cookie、不跟随跳转的客户端
+func login(t *testing.T, c *testcluster.Cluster, username string) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portalURL, err := url.Parse(c.PortalURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jar.SetCookies(portalURL, []*http.Cookie{{Name: "csrf_token", Value: csrfToken, Path: "/"}})
+	client := &http.Client{
+		Transport: c.Client.HTTP.Transport,
+		Jar:       jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.PostForm(c.PortalURL+"/login",
+		url.Values{"Username": {username}, "Password": {username}, "csrf_token": {csrfToken}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("login as %s: status %d, want 303", username, res.StatusCode)
+	}
+	return client
+}
+
+// 以username登录portal的API，返回API的token
+func apiToken(t *testing.T, c *testcluster.Cluster, username string) string {
+	t.Helper()
+	status, data := do(t, c, http.MethodPost, c.PortalURL+"/api/v1/login", "",
+		map[string]string{"Username": username, "Password": username})
+	if status != http.StatusOK {
+		t.Fatalf("API login as %s: status %d: %s", username, status, data)
+	}
+	var res struct{ Token string }
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Token
+}
+
+// 使用已登录的客户端发出请求，返回状态码与响应体
+func send(t *testing.T, client *http.Client, req *http.Request) (int, []byte) {
+	t.Helper()
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, data
+}
+
+func TestPortalReadsAndWritesGradesDiscoveredThroughRegistry(t *testing.T) {
+	c := startCluster(t)
+
+	//portal通过registry推送的实例找到grade服务
+	provider, err := c.Client.GetProvider(registry.GradeService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider != c.GradesURL {
+		t.Fatalf("portal discovered %s, want %s", provider, c.GradesURL)
+	}
+
+	client := login(t, c, "teacherA")
+	form := url.Values{"Title": {"Final"}, "Type": {string(grades.GradeExam)}, "Score": {"91"}}
+	req, err := http.NewRequest(http.MethodPost, c.PortalURL+"/students/1/grades", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-CSRF-Token", csrfToken)
+	if status, data := send(t, client, req); status != http.StatusSeeOther {
+		t.Fatalf("adding a grade: status %d: %s", status, data)
+	}
+
+	//API的token只能用于portal，grade服务不接受
+	token := apiToken(t, c, "teacherA")
+	if status, data := do(t, c, http.MethodGet, c.GradesURL+"/students/1", token, nil); status != http.StatusUnauthorized {
+		t.Fatalf("grades service accepted a portal API token: status %d: %s", status, data)
+	}
+
+	//grade服务中保存了portal转交的修改
+	teacher, _ := auth.GetUser("teacherA")
+	gradesToken, err := teacher.Token(string(registry.PortalService), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, data := do(t, c, http.MethodGet, c.GradesURL+"/students/1", gradesToken, nil)
+	if status != http.StatusOK {
+		t.Fatalf("reading the student from the grades service: status %d: %s", status, data)
+	}
+	var student grades.Student
+	if err := json.Unmarshal(data, &student); err != nil {
+		t.Fatal(err)
+	}
+	last := student.Grades[len(student.Grades)-1]
+	if last.Title != "Final" || last.Score != 91 {
+		t.Fatalf("grades service stored %+v, want the grade added through the portal", last)
+	}
+
+	req, err = http.NewRequest(http.MethodGet, c.PortalURL+"/students/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, data := send(t, client, req); status != http.StatusOK || !strings.Contains(string(data), "Final") {
+		t.Fatalf("reading the student: status %d: %s", status, data)
+	}
+
+	//teacherA只能修改A班学生的成绩
+	status, data = do(t, c, http.MethodPost, c.GradesURL+"/students/3/grades", gradesToken,
+		grades.Grade{Title: "Final", Type: grades.GradeExam, Score: 91})
+	if status != http.StatusForbidden {
+		t.Fatalf("grading another class: status %d, want 403: %s", status, data)
+	}
+}
+
+func TestClustersInOneProcessKeepSeparateMetrics(t *testing.T) {
+	a := startCluster(t)
+	b := startCluster(t)
+
+	//每个registry只统计自己的实例，另一个集群注册时不会清空该指标
+	for name, c := range map[string]*testcluster.Cluster{"a": a, "b": b} {
+		status, data := do(t, c, http.MethodGet, c.RegistryURL+"/metrics", "", nil)
+		if status != http.StatusOK {
+			t.Fatalf("cluster %s: registry metrics: status %d", name, status)
+		}
+		for _, service := range []registry.ServiceName{registry.LoggerService, registry.GradeService, registry.PortalService} {
+			want := fmt.Sprintf("registry_registered_instances{service=%q} 1\n", service)
+			if !strings.Contains(string(data), want) {
+				t.Errorf("cluster %s: registry metrics missing %q:\n%s", name, want, data)
+			}
+		}
+	}
+
+	//只有收到请求的portal统计该请求
+	do(t, a, http.MethodGet, a.PortalURL+"/login", "", nil)
+	route := `route="/login"`
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, data := do(t, a, http.MethodGet, a.PortalURL+"/metrics", "", nil)
+		if strings.Contains(string(data), route) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("portal a did not count its own request:\n%s", data)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, data := do(t, b, http.MethodGet, b.PortalURL+"/metrics", "", nil); strings.Contains(string(data), route) {
+		t.Fatalf("portal b counted a request sent to portal a:\n%s", data)
+	}
+}
+
+func TestTracesRequireAdmin(t *testing.T) {
+	c := startCluster(t)
+	teacher, err := auth.IssueToken(auth.Claims{Subject: "teacherA", Role: auth.RoleTeacher, Classes: []string{"A"}}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := auth.IssueToken(auth.Claims{Subject: "admin", Role: auth.RoleAdmin}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, base := range []string{c.GradesURL, c.PortalURL} {
+		for token, want := range map[string]int{"": http.StatusUnauthorized, teacher: http.StatusForbidden, admin: http.StatusOK} {
+			if status, _ := do(t, c, http.MethodGet, base+"/traces", token, nil); status != want {
+				t.Errorf("GET %s/traces: status %d, want %d", base, status, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CA 开发环境使用的简易证书颁发机构，证书与私钥以PEM格式保存在同一目录下
+// 只有签发证书的cmd/certs持有CA的私钥，服务只读取自己的证书、私钥与CA证书，见Configure
+type CA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+	//签发证书的有效期
+	certValidity = 365 * 24 * time.Hour
+)
+
+// CreateCA 在dir下新建CA，CA的文件已经存在时返回的错误满足errors.Is(err, os.ErrExist)
+// 文件以O_EXCL创建，多个进程同时调用时只有一个能创建成功，不会相互覆盖
+func CreateCA(dir string) (*CA, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("func CreateCA: %v", err)
+	}
+	ca := &CA{dir: dir}
+	if err := ca.create(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile)); err != nil {
+		return nil, fmt.Errorf("func CreateCA: %w", err)
+	}
+	return ca, nil
+}
+
+// LoadCA 读取dir下已有的CA证书与私钥
+func LoadCA(dir string) (*CA, error) {
+	ca := &CA{dir: dir}
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("func LoadCA: %v", err)
+	}
+	ca.cert, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("func LoadCA: %v", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("func LoadCA: unsupported CA key type %T", pair.PrivateKey)
+	}
+	ca.key = key
+	return ca, nil
+}
+
+func (ca *CA) create(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "distributedDemo dev CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	ca.cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	ca.key = key
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	//先独占地创建私钥，已有CA时在此失败，证书最后写入
+	if err := createPEM(keyPath, "EC PRIVATE KEY", keyDER); err != nil {
+		return err
+	}
+	return createPEM(certPath, "CERTIFICATE", der)
+}
+
+// LoadPool 读取dir下的CA证书，返回只信任该CA的证书池，不需要CA的私钥
+func LoadPool(dir string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, caCertFile))
+	if err != nil {
+		return nil, fmt.Errorf("func LoadPool: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("func LoadPool: no certificate in %s", caCertFile)
+	}
+	return pool, nil
+}
+
+// 服务name的证书与私钥在dir中的路径
+func certPaths(dir, name string) (certPath, keyPath string) {
+	return filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+}
+
+// Issue 为服务签发证书，CommonName即服务名称，用于校验对端身份
+// 已签发且未过期的证书会被直接复用
+func (ca *CA) Issue(name string) (tls.Certificate, error) {
+	certPath, keyPath := certPaths(ca.dir, name)
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err == nil && time.Now().Before(leaf.NotAfter) {
+			pair.Leaf = leaf
+			return pair, nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		//同一张证书既用于提供服务，也用于调用其他服务
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := writePair(certPath, keyPath, der, key); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// 先写入临时文件再重命名，避免服务启动时读到不完整的文件
+func writePair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", keyDER); err != nil {
+		return err
+	}
+	return writePEM(certPath, "CERTIFICATE", der)
+}
+
+func writePEM(path, blockType string, der []byte) error {
+	tmp := path + ".tmp"
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 以O_EXCL创建path，文件已经存在时失败
+func createPEM(path, blockType string, der []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
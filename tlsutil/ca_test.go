@@ -0,0 +1,91 @@
+package tlsutil
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateCADoesNotOverwriteExistingCA(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := CreateCA(dir); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCA(dir); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("second CreateCA = %v, want os.ErrExist", err)
+	}
+	after, err := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Fatal("second CreateCA replaced the CA key")
+	}
+	if _, err := LoadCA(dir); err != nil {
+		t.Fatalf("LoadCA after CreateCA: %v", err)
+	}
+}
+
+func TestLoadCADoesNotCreateCA(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := LoadCA(dir); err == nil {
+		t.Fatal("LoadCA succeeded in an empty directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, caCertFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("LoadCA created %s: %v", caCertFile, err)
+	}
+}
+
+func TestIssueReusesValidCertificate(t *testing.T) {
+	ca, err := CreateCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := ca.Issue("GradeService")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ca.Issue("GradeService")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(first.Certificate[0]) != string(second.Certificate[0]) {
+		t.Fatal("Issue replaced a valid certificate")
+	}
+}
+
+func TestConfigureWithoutCAKey(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := CreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ca.Issue("GradeService"); err != nil {
+		t.Fatal(err)
+	}
+	//服务只需要自己的证书与CA证书
+	if err := os.Remove(filepath.Join(dir, caKeyFile)); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(DirEnv, dir)
+
+	cfg, err := Configure(&http.Client{}, "GradeService")
+	if err != nil {
+		t.Fatalf("Configure without the CA key: %v", err)
+	}
+	if cfg == nil || len(cfg.Certificates) != 1 {
+		t.Fatalf("Configure returned %+v, want the service certificate", cfg)
+	}
+	if _, err := Configure(&http.Client{}, "LoggerService"); err == nil {
+		t.Fatal("Configure succeeded for a service without a certificate")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "LoggerService.pem")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Configure issued a certificate: %v", err)
+	}
+}
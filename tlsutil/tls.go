@@ -0,0 +1,128 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// DirEnv 设置该环境变量后启用双向TLS，其值为cmd/certs生成的CA证书及各服务证书所在的目录
+const DirEnv = "DISTRIBUTED_TLS_DIR"
+
+var (
+	// Client 只运行一个服务的进程调用其他服务时使用的http客户端，即registry.DefaultClient的HTTP
+	// 同一进程内运行多个服务时，每个服务使用各自的客户端，分别通过Configure配置证书
+	Client = NewClient()
+)
+
+// Enabled 是否启用了TLS
+func Enabled() bool {
+	return os.Getenv(DirEnv) != ""
+}
+
+// Scheme 服务URL使用的协议
+func Scheme() string {
+	if Enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// NewClient 创建服务之间调用使用的http客户端
+func NewClient() *http.Client {
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// Configure 读取cmd/certs为服务name签发的证书，使client调用其他服务时携带该证书，并返回服务端使用的TLS配置
+// 服务只读取自己的证书、私钥与CA证书，不接触CA的私钥；证书不存在时返回错误
+// 未启用TLS时什么都不做，返回nil；每个服务配置各自的client，同一进程内的多个服务互不影响
+func Configure(client *http.Client, name string) (*tls.Config, error) {
+	if !Enabled() {
+		return nil, nil
+	}
+	dir := os.Getenv(DirEnv)
+	cert, err := tls.LoadX509KeyPair(certPaths(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("func Configure: no certificate for %s, issue it with go run ./cmd/certs: %v", name, err)
+	}
+	pool, err := LoadPool(dir)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	log.Printf("func Configure: TLS enabled for %s\n", name)
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		//浏览器访问portal时没有客户端证书，需要校验身份的接口使用RequirePeer
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// ListenAndServe 根据是否启用TLS选择对应的启动方式，srv.TLSConfig为Configure返回的配置，为nil时不使用TLS
+func ListenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
+// Serve 与ListenAndServe相同，但使用已经创建的监听，如端口为0时由系统分配的端口
+func Serve(srv *http.Server, ln net.Listener) error {
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(ln, "", "")
+	}
+	return srv.Serve(ln)
+}
+
+// PeerName 返回对端证书中的服务名称，未启用TLS或对端未提供证书时ok为false
+func PeerName(r *http.Request) (name string, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// VerifyPeer 启用TLS时，校验对端证书是否属于names中的某个服务
+func VerifyPeer(r *http.Request, names ...string) bool {
+	if !Enabled() {
+		return true
+	}
+	peer, ok := PeerName(r)
+	if !ok {
+		return false
+	}
+	if len(names) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if peer == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePeer 只允许持有names中某个服务证书的对端访问，names为空时允许任意由CA签发的证书
+func RequirePeer(next http.Handler, names ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !VerifyPeer(r, names...) {
+			peer, _ := PeerName(r)
+			log.Printf("func RequirePeer: peer %q rejected for %s %s\n", peer, r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,319 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 导出相关的环境变量
+const (
+	// FileEnv 将span以JSON Lines格式追加写入该文件
+	FileEnv = "DISTRIBUTED_TRACE_FILE"
+	// OTLPEnv 以OTLP/HTTP JSON格式发送span的地址，如logger服务的 http://localhost:4000/v1/traces
+	OTLPEnv = "DISTRIBUTED_TRACE_OTLP"
+)
+
+// Exporter 将结束的span发送到外部存储
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// 内存中保留最近的span，供 /traces 查看
+const storeCapacity = 4096
+
+type spanStore struct {
+	spans []*Span
+	next  int
+	//已保存的span的SpanID，collector收到本进程自己导出的span时不再重复保存
+	ids   map[string]bool
+	mutex sync.RWMutex
+}
+
+var store = spanStore{spans: make([]*Span, 0, storeCapacity), ids: make(map[string]bool)}
+
+func (ss *spanStore) add(spans ...*Span) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	for _, s := range spans {
+		if ss.ids[s.SpanID] {
+			continue
+		}
+		ss.ids[s.SpanID] = true
+		if len(ss.spans) < storeCapacity {
+			ss.spans = append(ss.spans, s)
+			continue
+		}
+		delete(ss.ids, ss.spans[ss.next].SpanID)
+		ss.spans[ss.next] = s
+		ss.next = (ss.next + 1) % storeCapacity
+	}
+}
+
+func (ss *spanStore) all() []*Span {
+	ss.mutex.RLock()
+	defer ss.mutex.RUnlock()
+	return append([]*Span(nil), ss.spans...)
+}
+
+var (
+	exporters []Exporter
+	queue     = make(chan *Span, 1024)
+	setupOnce sync.Once
+)
+
+// Setup 为服务service的client的请求注入traceparent，并根据环境变量启动exporter
+// 同一进程内的多个服务各自调用，exporter只启动一次
+func Setup(service string, client *http.Client) {
+	base := InstrumentClient(client, service)
+	setupOnce.Do(func() {
+		if path := os.Getenv(FileEnv); path != "" {
+			exporters = append(exporters, FileExporter{Path: path})
+		}
+		if url := os.Getenv(OTLPEnv); url != "" {
+			//exporter自身的请求不需要被追踪
+			exporters = append(exporters, &OTLPExporter{
+				URL:    url,
+				Client: &http.Client{Transport: base, Timeout: 5 * time.Second},
+			})
+		}
+		go exportLoop()
+	})
+}
+
+// span结束后先放入内存，再异步批量导出，队列已满时丢弃
+func export(s *Span) {
+	store.add(s)
+	select {
+	case queue <- s:
+	default:
+	}
+}
+
+func exportLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, 64)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		for _, e := range exporters {
+			if err := e.Export(batch); err != nil {
+				log.Println("func exportLoop of trace:", err)
+			}
+		}
+		batch = make([]*Span, 0, 64)
+	}
+	for {
+		select {
+		case s := <-queue:
+			batch = append(batch, s)
+			if len(batch) == cap(batch) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// FileExporter 将span以JSON Lines格式追加写入文件
+type FileExporter struct {
+	Path string
+}
+
+func (fe FileExporter) Export(spans []*Span) error {
+	f, err := os.OpenFile(fe.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, s := range spans {
+		if err := enc.Encode(toOTLPSpan(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLPExporter 以OTLP/HTTP JSON格式发送span
+type OTLPExporter struct {
+	URL    string
+	Client *http.Client
+}
+
+func (oe *OTLPExporter) Export(spans []*Span) error {
+	data, err := json.Marshal(toOTLP(spans))
+	if err != nil {
+		return err
+	}
+	res, err := oe.Client.Post(oe.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("OTLP collector responded with %d", res.StatusCode)
+	}
+	return nil
+}
+
+// 以下为OTLP/HTTP JSON格式中用到的部分字段
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	//1为OK，2为ERROR
+	Code int `json:"code"`
+}
+
+const serviceNameAttribute = "service.name"
+
+func toOTLPSpan(s *Span) otlpSpan {
+	out := otlpSpan{
+		TraceID:           s.TraceID,
+		SpanID:            s.SpanID,
+		ParentSpanID:      s.ParentID,
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		Status:            otlpStatus{Code: 1},
+		Attributes: []otlpAttribute{
+			{Key: serviceNameAttribute, Value: otlpValue{StringValue: s.Service}},
+		},
+	}
+	for k, v := range s.Attributes {
+		out.Attributes = append(out.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	if s.Error {
+		out.Status.Code = 2
+	}
+	return out
+}
+
+// 按服务分组，每个服务对应一个resource
+func toOTLP(spans []*Span) otlpRequest {
+	byService := make(map[string][]otlpSpan)
+	for _, s := range spans {
+		byService[s.Service] = append(byService[s.Service], toOTLPSpan(s))
+	}
+	var req otlpRequest
+	for service, ss := range byService {
+		req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+			Resource: otlpResource{Attributes: []otlpAttribute{
+				{Key: serviceNameAttribute, Value: otlpValue{StringValue: service}},
+			}},
+			ScopeSpans: []otlpScopeSpans{{Spans: ss}},
+		})
+	}
+	return req
+}
+
+func fromOTLP(req otlpRequest) []*Span {
+	var spans []*Span
+	for _, rs := range req.ResourceSpans {
+		service := ""
+		for _, a := range rs.Resource.Attributes {
+			if a.Key == serviceNameAttribute {
+				service = a.Value.StringValue
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, sp := range ss.Spans {
+				start, _ := strconv.ParseInt(sp.StartTimeUnixNano, 10, 64)
+				end, _ := strconv.ParseInt(sp.EndTimeUnixNano, 10, 64)
+				s := &Span{
+					TraceID:    sp.TraceID,
+					SpanID:     sp.SpanID,
+					ParentID:   sp.ParentSpanID,
+					Name:       sp.Name,
+					Service:    service,
+					Kind:       sp.Kind,
+					Start:      time.Unix(0, start),
+					End:        time.Unix(0, end),
+					Attributes: make(map[string]string),
+					Error:      sp.Status.Code == 2,
+					ended:      true,
+				}
+				for _, a := range sp.Attributes {
+					if a.Key != serviceNameAttribute {
+						s.Attributes[a.Key] = a.Value.StringValue
+					}
+				}
+				spans = append(spans, s)
+			}
+		}
+	}
+	return spans
+}
+
+// CollectorHandler 接收OTLP/HTTP JSON格式的span并保存在内存中，
+// 作为本地开发时的collector，配合 /traces 查看所有服务的调用链
+func CollectorHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var req otlpRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			log.Println("func CollectorHandler:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		//本进程自己的span已经在store中，add时按SpanID跳过
+		store.add(fromOTLP(req)...)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte("{}"))
+	})
+}
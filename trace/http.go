@@ -0,0 +1,127 @@
+package trace
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TraceparentHeader W3C Trace Context使用的请求头
+const TraceparentHeader = "traceparent"
+
+// 心跳检测、指标采集、日志与span的上报等请求不记录span，避免淹没真正的业务调用链
+var ignoredPaths = []string{"/heartbeat", "/metrics", "/traces", "/v1/traces", "/log"}
+
+func ignored(path string) bool {
+	for _, p := range ignoredPaths {
+		if path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware 为service的每个请求记录一个server span，上游通过traceparent传入的调用链会被延续
+// 处理请求时开始的span也属于service，同一进程内的多个服务各自使用自己的Middleware
+func Middleware(service string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ignored(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := WithService(r.Context(), service)
+		if sc, ok := ParseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+			ctx = withRemote(ctx, sc)
+		}
+		ctx, span := Start(ctx, r.Method+" "+r.URL.Path, KindServer)
+		defer span.Finish()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttribute("http.status_code", strconv.Itoa(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetError(nil)
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if !sr.wroteHeader {
+		sr.status = code
+		sr.wroteHeader = true
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	sr.wroteHeader = true
+	return sr.ResponseWriter.Write(b)
+}
+
+// Flush 转发给底层的ResponseWriter，使流式响应不被缓冲
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Transport 为每个对外请求记录一个client span，并通过traceparent将调用链传给下游服务
+type Transport struct {
+	Base http.RoundTripper
+	//发出请求的服务，不为空时client span属于该服务，否则与请求ctx中的span属于同一个服务
+	Service string
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if ignored(req.URL.Path) {
+		return base.RoundTrip(req)
+	}
+	ctx, span := Start(req.Context(), req.Method+" "+req.URL.Host+req.URL.Path, KindClient)
+	if t.Service != "" {
+		span.Service = t.Service
+	}
+	defer span.Finish()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.String())
+
+	//RoundTripper不能修改原请求
+	out := req.Clone(ctx)
+	out.Header.Set(TraceparentHeader, span.Context().Traceparent())
+	res, err := base.RoundTrip(out)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", strconv.Itoa(res.StatusCode))
+	if res.StatusCode >= http.StatusInternalServerError {
+		span.SetError(fmt.Errorf("server responded with %s", strings.TrimSpace(res.Status)))
+	}
+	return res, nil
+}
+
+// InstrumentClient 让service的client发出的请求都经过Transport，返回包装前的RoundTripper，
+// 供exporter等不需要被追踪的请求使用
+func InstrumentClient(c *http.Client, service string) http.RoundTripper {
+	base := c.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t, ok := base.(*Transport); ok {
+		base = t.Base
+	}
+	c.Transport = &Transport{Base: base, Service: service}
+	return base
+}
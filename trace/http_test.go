@@ -0,0 +1,162 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestTransportPropagatesTraceparent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(TraceparentHeader)
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &Transport{Service: "PortalService"}}
+
+	ctx, parent := Start(WithService(context.Background(), "PortalService"), "parent", KindInternal)
+	for _, path := range []string{"/students", "/fail"} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+path, nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if req.Header.Get(TraceparentHeader) != "" {
+			t.Fatal("Transport modified the original request")
+		}
+
+		sc, ok := ParseTraceparent(got)
+		if !ok || sc.TraceID != parent.TraceID {
+			t.Fatalf("%s: traceparent = %q, want trace %s", path, got, parent.TraceID)
+		}
+		span := findSpan(t, sc.SpanID)
+		if span.Kind != KindClient || span.ParentID != parent.SpanID || span.Service != "PortalService" {
+			t.Fatalf("%s: client span = %+v, want a client span of PortalService under %s", path, span, parent.SpanID)
+		}
+		if wantErr := path == "/fail"; span.Error != wantErr {
+			t.Fatalf("%s: span.Error = %v, want %v", path, span.Error, wantErr)
+		}
+	}
+}
+
+func TestTransportSkipsIgnoredPaths(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(TraceparentHeader)
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &Transport{}}
+	res, err := client.Get(srv.URL + "/heartbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got != "" {
+		t.Fatalf("heartbeat carried traceparent %q", got)
+	}
+}
+
+func TestMiddlewareContinuesUpstreamTrace(t *testing.T) {
+	var inner *Span
+	h := Middleware("GradeService", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner, _ = FromContext(r.Context())
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	for _, path := range []string{"/students", "/fail"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(TraceparentHeader, "00-"+testTraceID+"-"+testSpanID+"-01")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if inner == nil || inner.TraceID != testTraceID || inner.ParentID != testSpanID {
+			t.Fatalf("%s: server span = %+v, want trace %s with parent %s", path, inner, testTraceID, testSpanID)
+		}
+		span := findSpan(t, inner.SpanID)
+		if span.Kind != KindServer || span.Service != "GradeService" || span.Name != "GET "+path {
+			t.Fatalf("%s: server span = %+v", path, span)
+		}
+		if got := span.Attributes["http.status_code"]; got != strconv.Itoa(rec.Code) {
+			t.Fatalf("%s: http.status_code = %q, want %d", path, got, rec.Code)
+		}
+		if wantErr := path == "/fail"; span.Error != wantErr {
+			t.Fatalf("%s: span.Error = %v, want %v", path, span.Error, wantErr)
+		}
+	}
+}
+
+func TestMiddlewareStartsTraceWithoutTraceparent(t *testing.T) {
+	var inner *Span
+	h := Middleware("GradeService", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner, _ = FromContext(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/students", nil)
+	req.Header.Set(TraceparentHeader, "garbage")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if inner == nil || inner.ParentID != "" || !isHex(inner.TraceID, 32) {
+		t.Fatalf("server span = %+v, want a new trace", inner)
+	}
+
+	//心跳等请求不记录span
+	inner = nil
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/heartbeat", nil))
+	if inner != nil {
+		t.Fatal("heartbeat request recorded a span")
+	}
+}
+
+// 经过Transport与Middleware的一次调用，服务端的span是客户端span的子span
+func TestTransportAndMiddlewareShareTrace(t *testing.T) {
+	var server *Span
+	srv := httptest.NewServer(Middleware("GradeService", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server, _ = FromContext(r.Context())
+	})))
+	defer srv.Close()
+	client := &http.Client{Transport: &Transport{Service: "PortalService"}}
+
+	ctx, root := Start(WithService(context.Background(), "PortalService"), "GET /grades", KindServer)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/students", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	root.Finish()
+
+	spans := spansOf(root.TraceID)
+	if len(spans) != 3 {
+		t.Fatalf("trace %s has %d spans, want root, client and server", root.TraceID, len(spans))
+	}
+	var clientSpan *Span
+	for _, s := range spans {
+		if s.Kind == KindClient {
+			clientSpan = s
+		}
+	}
+	if clientSpan == nil || clientSpan.ParentID != root.SpanID {
+		t.Fatalf("client span = %+v, want a child of the root span", clientSpan)
+	}
+	if server == nil || server.ParentID != clientSpan.SpanID || server.Service != "GradeService" {
+		t.Fatalf("server span = %+v, want a child of the client span in GradeService", server)
+	}
+}
+
+// 内存中SpanID为id的已结束的span
+func findSpan(t *testing.T, id string) *Span {
+	t.Helper()
+	for _, s := range store.all() {
+		if s.SpanID == id {
+			return s
+		}
+	}
+	t.Fatalf("span %s was not finished", id)
+	return nil
+}
@@ -0,0 +1,215 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind 与OTLP中的SpanKind取值一致
+type Kind int
+
+const (
+	KindInternal = Kind(1)
+	KindServer   = Kind(2)
+	KindClient   = Kind(3)
+)
+
+// Span 一次调用（处理请求或对外请求）的记录
+type Span struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Service    string
+	Kind       Kind
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      bool
+
+	mutex sync.Mutex
+	ended bool
+}
+
+// SpanContext 跨服务传递的调用链信息
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Sampled bool
+}
+
+// 不属于任何服务的span使用的服务名称
+const unknownService = "unknown"
+
+type spanKey struct{}
+type remoteKey struct{}
+type serviceKey struct{}
+
+// WithService 返回带有服务名称的ctx，之后在其中开始的span都属于service，
+// 用于不经过Middleware的后台任务；同一进程内的多个服务各自设置，互不影响
+func WithService(ctx context.Context, service string) context.Context {
+	return context.WithValue(ctx, serviceKey{}, service)
+}
+
+// ctx中的span所属的服务，即父span或WithService设置的服务
+func serviceOf(ctx context.Context) string {
+	if parent, ok := FromContext(ctx); ok {
+		return parent.Service
+	}
+	if service, ok := ctx.Value(serviceKey{}).(string); ok {
+		return service
+	}
+	return unknownService
+}
+
+// Start 开始一个新的span，父span取自ctx，ctx中没有时新建一条调用链
+// span与父span属于同一个服务，没有父span时属于WithService设置的服务
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	s := &Span{
+		SpanID:     newID(8),
+		Name:       name,
+		Service:    serviceOf(ctx),
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+	}
+	if parent, ok := FromContext(ctx); ok {
+		s.TraceID, s.ParentID = parent.TraceID, parent.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		s.TraceID, s.ParentID = remote.TraceID, remote.SpanID
+	} else {
+		s.TraceID = newID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// FromContext 返回ctx中当前的span
+func FromContext(ctx context.Context) (*Span, bool) {
+	s, ok := ctx.Value(spanKey{}).(*Span)
+	return s, ok
+}
+
+// withRemote 记录由上游服务传入的调用链信息，作为下一个span的父span
+func withRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SetAttribute 为span添加属性
+func (s *Span) SetAttribute(key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError 将span标记为失败
+func (s *Span) SetError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Error = true
+	if err != nil {
+		s.Attributes["error"] = err.Error()
+	}
+}
+
+// Finish 结束span并交给exporter导出，重复调用只生效一次
+func (s *Span) Finish() {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mutex.Unlock()
+	export(s)
+}
+
+// Context 返回需要传递给下游服务的调用链信息
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID, Sampled: true}
+}
+
+// Traceparent 按W3C Trace Context格式输出
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent 解析W3C Trace Context中的traceparent请求头
+func ParseTraceparent(h string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	traceID, spanID, flags := parts[1], parts[2], parts[3]
+	if !isHex(traceID, 32) || !isHex(spanID, 16) || !isHex(flags, 2) ||
+		traceID == strings.Repeat("0", 32) || spanID == strings.Repeat("0", 16) {
+		return SpanContext{}, false
+	}
+	//版本00只有4段，更高版本可能追加字段
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	b, _ := hex.DecodeString(flags)
+	return SpanContext{TraceID: traceID, SpanID: spanID, Sampled: b[0]&1 == 1}, true
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Println 与log.Println相同，但会在日志前加上当前的trace id与span id，
+// 日志经clientLogger发送到logger服务后可以据此关联到调用链
+func Println(ctx context.Context, v ...interface{}) {
+	log.Print(logPrefix(ctx) + fmt.Sprintln(v...))
+}
+
+// Printf 与log.Printf相同，但会在日志前加上当前的trace id与span id
+func Printf(ctx context.Context, format string, v ...interface{}) {
+	log.Print(logPrefix(ctx) + fmt.Sprintf(format, v...))
+}
+
+func logPrefix(ctx context.Context) string {
+	s, ok := FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("trace_id=%s span_id=%s ", s.TraceID, s.SpanID)
+}
+
+// Detach 返回一个不会随ctx取消的context，但保留其中的span，
+// 用于请求结束后仍在后台执行、又需要关联到该调用链的操作
+func Detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if s, ok := FromContext(ctx); ok {
+		detached = context.WithValue(detached, spanKey{}, s)
+	} else if service, ok := ctx.Value(serviceKey{}).(string); ok {
+		detached = WithService(detached, service)
+	}
+	return detached
+}
@@ -0,0 +1,95 @@
+package trace
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   SpanContext
+		ok     bool
+	}{
+		{"sampled", "00-" + testTraceID + "-" + testSpanID + "-01", SpanContext{testTraceID, testSpanID, true}, true},
+		{"not sampled", "00-" + testTraceID + "-" + testSpanID + "-00", SpanContext{testTraceID, testSpanID, false}, true},
+		{"surrounding spaces", " 00-" + testTraceID + "-" + testSpanID + "-01 ", SpanContext{testTraceID, testSpanID, true}, true},
+		{"future version with extra fields", "01-" + testTraceID + "-" + testSpanID + "-01-extra", SpanContext{testTraceID, testSpanID, true}, true},
+		{"version 00 with extra fields", "00-" + testTraceID + "-" + testSpanID + "-01-extra", SpanContext{}, false},
+		{"invalid version ff", "ff-" + testTraceID + "-" + testSpanID + "-01", SpanContext{}, false},
+		{"upper case", "00-" + strings.ToUpper(testTraceID) + "-" + testSpanID + "-01", SpanContext{}, false},
+		{"zero trace id", "00-" + strings.Repeat("0", 32) + "-" + testSpanID + "-01", SpanContext{}, false},
+		{"zero span id", "00-" + testTraceID + "-" + strings.Repeat("0", 16) + "-01", SpanContext{}, false},
+		{"short trace id", "00-" + testTraceID[1:] + "-" + testSpanID + "-01", SpanContext{}, false},
+		{"short span id", "00-" + testTraceID + "-" + testSpanID[1:] + "-01", SpanContext{}, false},
+		{"missing flags", "00-" + testTraceID + "-" + testSpanID, SpanContext{}, false},
+		{"empty", "", SpanContext{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseTraceparent(tt.header)
+			if ok != tt.ok || got != tt.want {
+				t.Fatalf("ParseTraceparent(%q) = %+v, %v, want %+v, %v", tt.header, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	_, span := Start(context.Background(), "op", KindInternal)
+	sc := span.Context()
+	got, ok := ParseTraceparent(sc.Traceparent())
+	if !ok || got != sc {
+		t.Fatalf("ParseTraceparent(%q) = %+v, %v, want %+v", sc.Traceparent(), got, ok, sc)
+	}
+}
+
+func TestStartContinuesTrace(t *testing.T) {
+	ctx := WithService(context.Background(), "GradeService")
+	ctx, root := Start(ctx, "root", KindServer)
+	if root.ParentID != "" || root.Service != "GradeService" {
+		t.Fatalf("root span = %+v, want no parent in GradeService", root)
+	}
+	_, child := Start(ctx, "child", KindInternal)
+	if child.TraceID != root.TraceID || child.ParentID != root.SpanID || child.Service != root.Service {
+		t.Fatalf("child span = %+v, want a child of %+v", child, root)
+	}
+
+	//上游通过traceparent传入的调用链
+	remote := withRemote(context.Background(), SpanContext{TraceID: testTraceID, SpanID: testSpanID, Sampled: true})
+	_, s := Start(remote, "server", KindServer)
+	if s.TraceID != testTraceID || s.ParentID != testSpanID {
+		t.Fatalf("span = %+v, want trace %s with parent %s", s, testTraceID, testSpanID)
+	}
+}
+
+func TestDetachKeepsSpan(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, span := Start(ctx, "request", KindServer)
+	detached := Detach(ctx)
+	cancel()
+	if detached.Err() != nil {
+		t.Fatal("detached context was cancelled with its parent")
+	}
+	if s, ok := FromContext(detached); !ok || s != span {
+		t.Fatal("detached context lost the span")
+	}
+}
+
+// 内存中属于traceID的span
+func spansOf(traceID string) []*Span {
+	var spans []*Span
+	for _, s := range store.all() {
+		if s.TraceID == traceID {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
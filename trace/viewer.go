@@ -0,0 +1,162 @@
+package trace
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// 调用链概览
+type traceSummary struct {
+	TraceID  string
+	Root     string
+	Service  string
+	Start    time.Time
+	Duration time.Duration
+	Spans    int
+	Error    bool
+}
+
+// 调用链中的一个span，按父子关系缩进显示
+type spanRow struct {
+	*Span
+	Depth    int
+	Offset   time.Duration
+	Duration time.Duration
+}
+
+// ViewerHandler 简单的调用链查看页面，即 /traces 接口
+// 不带参数时列出最近的调用链，带 ?id= 时显示该调用链的所有span
+func ViewerHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		byTrace := make(map[string][]*Span)
+		for _, s := range store.all() {
+			byTrace[s.TraceID] = append(byTrace[s.TraceID], s)
+		}
+		var err error
+		if id := r.URL.Query().Get("id"); id != "" {
+			spans, ok := byTrace[id]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			err = viewerTemplate.ExecuteTemplate(w, "trace", struct {
+				TraceID string
+				Rows    []spanRow
+			}{id, spanTree(spans)})
+		} else {
+			err = viewerTemplate.ExecuteTemplate(w, "list", summarize(byTrace))
+		}
+		if err != nil {
+			log.Println("func ViewerHandler:", err)
+		}
+	})
+}
+
+func summarize(byTrace map[string][]*Span) []traceSummary {
+	summaries := make([]traceSummary, 0, len(byTrace))
+	for id, spans := range byTrace {
+		sum := traceSummary{TraceID: id, Spans: len(spans)}
+		var end time.Time
+		for _, s := range spans {
+			if sum.Start.IsZero() || s.Start.Before(sum.Start) {
+				sum.Start, sum.Root, sum.Service = s.Start, s.Name, s.Service
+			}
+			if s.End.After(end) {
+				end = s.End
+			}
+			sum.Error = sum.Error || s.Error
+		}
+		sum.Duration = end.Sub(sum.Start)
+		summaries = append(summaries, sum)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Start.After(summaries[j].Start)
+	})
+	return summaries
+}
+
+// 按父子关系深度优先排列，父span不在内存中的作为根节点
+func spanTree(spans []*Span) []spanRow {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start.Before(spans[j].Start) })
+	ids := make(map[string]bool, len(spans))
+	children := make(map[string][]*Span)
+	for _, s := range spans {
+		ids[s.SpanID] = true
+	}
+	var roots []*Span
+	for _, s := range spans {
+		if s.ParentID == "" || !ids[s.ParentID] {
+			roots = append(roots, s)
+			continue
+		}
+		children[s.ParentID] = append(children[s.ParentID], s)
+	}
+	start := spans[0].Start
+	var rows []spanRow
+	var walk func(s *Span, depth int)
+	walk = func(s *Span, depth int) {
+		rows = append(rows, spanRow{Span: s, Depth: depth, Offset: s.Start.Sub(start), Duration: s.End.Sub(s.Start)})
+		for _, c := range children[s.SpanID] {
+			walk(c, depth+1)
+		}
+	}
+	for _, root := range roots {
+		walk(root, 0)
+	}
+	return rows
+}
+
+var viewerTemplate = template.Must(template.New("viewer").Funcs(template.FuncMap{
+	"indent": func(depth int) int { return depth * 24 },
+}).Parse(`
+{{define "list"}}<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Traces</title></head>
+<body>
+    <h1>Traces</h1>
+    {{if len .}}
+    <table>
+        <tr><th>Start</th><th>Service</th><th>Root span</th><th>Spans</th><th>Duration</th><th>Trace ID</th></tr>
+        {{range .}}
+        <tr>
+            <td>{{.Start.Format "15:04:05.000"}}</td>
+            <td>{{.Service}}</td>
+            <td>{{if .Error}}<strong>{{.Root}}</strong>{{else}}{{.Root}}{{end}}</td>
+            <td>{{.Spans}}</td>
+            <td>{{.Duration}}</td>
+            <td><a href="?id={{.TraceID}}">{{.TraceID}}</a></td>
+        </tr>
+        {{end}}
+    </table>
+    {{else}}
+    <em>No traces recorded</em>
+    {{end}}
+</body>
+</html>{{end}}
+{{define "trace"}}<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="UTF-8"><title>Trace {{.TraceID}}</title></head>
+<body>
+    <h1><a href="?">Traces</a> - {{.TraceID}}</h1>
+    <table>
+        <tr><th>Span</th><th>Service</th><th>Offset</th><th>Duration</th><th>Attributes</th></tr>
+        {{range .Rows}}
+        <tr>
+            <td style="padding-left: {{indent .Depth}}px">{{if .Error}}<strong>{{.Name}}</strong>{{else}}{{.Name}}{{end}}</td>
+            <td>{{.Service}}</td>
+            <td>{{.Offset}}</td>
+            <td>{{.Duration}}</td>
+            <td>{{range $k, $v := .Attributes}}{{$k}}={{$v}} {{end}}</td>
+        </tr>
+        {{end}}
+    </table>
+</body>
+</html>{{end}}
+`))